@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	pauseMu sync.Mutex
+	// pausedNamespaces holds when each namespace was paused, "all" pauses every namespace
+	pausedNamespaces = map[string]time.Time{}
+	// parked holds the queued workloads waiting for their namespace to be resumed
+	parked = map[Workload]bool{}
+)
+
+func paused(ns string) bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	_, all := pausedNamespaces["all"]
+	_, one := pausedNamespaces[ns]
+	return all || one
+}
+
+// park keeps a workload of a paused namespace aside, its pending batches stay queued
+func park(w Workload) {
+	pauseMu.Lock()
+	parked[w] = true
+	pauseMu.Unlock()
+	reportPendingRollouts()
+}
+
+func pause(ns string) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if _, ok := pausedNamespaces[ns]; !ok {
+		pausedNamespaces[ns] = time.Now()
+	}
+	logrus.Warnf("rollouts paused for %s", ns)
+}
+
+// resume lifts the pause of ns and requeues its parked workloads, so changes seen meanwhile are applied.
+// Resuming all namespaces also resets the circuit breaker.
+func resume(ns string) {
+	if ns == "all" {
+		closeBreaker("through the admin endpoint")
+	}
+	pauseMu.Lock()
+	delete(pausedNamespaces, ns)
+	pauseMu.Unlock()
+	if breakerHolds() {
+		logrus.Warnf("rollouts resumed for %s, queued rollouts stay held by the circuit breaker until all namespaces are resumed", ns)
+		return
+	}
+	if rolloutsDisabled() {
+		logrus.Warnf("rollouts resumed for %s, queued rollouts stay held until the control ConfigMap enables them", ns)
+		return
+	}
+	logrus.Warnf("rollouts resumed for %s, applying %d queued rollouts", ns, releaseParked(ns))
+}
+
+// releaseParked requeues the parked workloads of ns, all for every namespace, no longer paused
+// nor held by the breaker or the control ConfigMap
+func releaseParked(ns string) int {
+	if breakerHolds() || rolloutsDisabled() {
+		return 0
+	}
+	pauseMu.Lock()
+	_, all := pausedNamespaces["all"]
+	var requeue []Workload
+	for w := range parked {
+		if _, stillPaused := pausedNamespaces[w.Namespace]; !all && !stillPaused && (ns == "all" || ns == w.Namespace) {
+			requeue = append(requeue, w)
+			delete(parked, w)
+		}
+	}
+	pauseMu.Unlock()
+	for _, w := range requeue {
+		requeueParked(w)
+	}
+	return len(requeue)
+}
+
+// registerAdminRoutes serves the admin endpoints to the admin token, or the listed users of --http-auth=tokenreview,
+// they're disabled without either
+func registerAdminRoutes(mux *http.ServeMux, auth *httpAuth) {
+	if auth.adminToken == "" && (auth.mode != httpAuthTokenReview || len(auth.users) == 0) {
+		logrus.Info("no admin token set, admin endpoints are disabled")
+		return
+	}
+	mux.HandleFunc("/pause", auth.authorizeAdmin(pauseHandler(pause)))
+	mux.HandleFunc("/resume", auth.authorizeAdmin(pauseHandler(resume)))
+	mux.HandleFunc("/status", auth.authorizeAdmin(statusHandler))
+	mux.HandleFunc("/explain", auth.authorizeAdmin(explainHandler))
+	mux.HandleFunc("/approve", auth.authorizeAdmin(approvalHandler(approvalApproved)))
+	mux.HandleFunc("/reject", auth.authorizeAdmin(approvalHandler(approvalRejected)))
+}
+
+// pauseHandler applies action to the namespace query or form parameter, all for every namespace
+func pauseHandler(action func(ns string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ns := r.FormValue("namespace")
+		if ns == "" {
+			http.Error(w, "namespace is required, or all", http.StatusBadRequest)
+			return
+		}
+		action(ns)
+		statusHandler(w, r)
+	}
+}
+
+type adminStatus struct {
+	Paused         map[string]time.Time `json:"paused"`
+	Parked         []string             `json:"parked"`
+	QueuedRollouts int                  `json:"queuedRollouts"`
+	Deferred       []string             `json:"deferred"`
+	Breaker        breakerStatus        `json:"breaker"`
+	Approvals      []pendingApproval    `json:"approvals"`
+	Cluster        string               `json:"cluster,omitempty"`
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := adminStatus{Paused: map[string]time.Time{}, Parked: []string{}, Deferred: []string{}, Breaker: currentBreakerStatus(), Approvals: currentApprovals(), Cluster: viper.GetString("cluster-name")}
+	pauseMu.Lock()
+	for ns, at := range pausedNamespaces {
+		status.Paused[ns] = at
+	}
+	for workload := range parked {
+		status.Parked = append(status.Parked, workload.String())
+	}
+	pauseMu.Unlock()
+	rolloutsMu.Lock()
+	status.QueuedRollouts = len(pendingBatches)
+	rolloutsMu.Unlock()
+	deferredMu.Lock()
+	for key := range deferredRollouts {
+		status.Deferred = append(status.Deferred, key)
+	}
+	deferredMu.Unlock()
+	sort.Strings(status.Parked)
+	sort.Strings(status.Deferred)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logrus.Errorf("%s failed to write status", err)
+	}
+}
+
+// resumeCmd resumes the rollouts of the running controller, all namespaces by default,
+// which also resets a tripped circuit breaker
+var resumeCmd = &cobra.Command{
+	Use:   "resume [namespace]",
+	Short: "resume the paused or circuit breaker held rollouts of the running controller",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ns := "all"
+		if len(args) == 1 {
+			ns = args[0]
+		}
+		if err := resumeController(os.Stdout, viper.GetString("controller-url"), ns); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func resumeController(out io.Writer, url, ns string) error {
+	if url == "" {
+		return fmt.Errorf("--controller-url is required")
+	}
+	token, err := readSecret("admin-token", "admin-token-file")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/resume", strings.NewReader(neturl.Values{"namespace": {ns}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("controller responded with %s, check --controller-url and the admin token", resp.Status)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// adminServer serves the admin endpoints to the token secret for the test, forgetting the paused namespaces after it
+func adminServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux, &httpAuth{mode: httpAuthNone, adminToken: "secret", users: map[string]bool{}})
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		pauseMu.Lock()
+		pausedNamespaces = map[string]time.Time{}
+		parked = map[Workload]bool{}
+		pauseMu.Unlock()
+	})
+	return server
+}
+
+func adminCall(t *testing.T, server *httptest.Server, method, path, token string) (int, adminStatus) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status adminStatus
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, status
+}
+
+func TestPauseAndResumeNamespace(t *testing.T) {
+	server := adminServer(t)
+	code, status := adminCall(t, server, http.MethodPost, "/pause?namespace=apps", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("expected the pause to succeed, got %d", code)
+	}
+	if _, ok := status.Paused["apps"]; !ok || !paused("apps") {
+		t.Fatalf("expected apps paused, got %v", status.Paused)
+	}
+	if paused("other") {
+		t.Fatal("pausing apps paused another namespace")
+	}
+	if _, status = adminCall(t, server, http.MethodGet, "/status", "secret"); len(status.Paused) != 1 {
+		t.Fatalf("expected the status to report the pause, got %v", status.Paused)
+	}
+	if code, status = adminCall(t, server, http.MethodPost, "/resume?namespace=apps", "secret"); code != http.StatusOK || len(status.Paused) != 0 || paused("apps") {
+		t.Fatalf("expected apps resumed, got %d %v", code, status.Paused)
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	server := adminServer(t)
+	adminCall(t, server, http.MethodPost, "/pause?namespace=all", "secret")
+	if !paused("apps") || !paused("other") {
+		t.Fatal("expected every namespace paused")
+	}
+	adminCall(t, server, http.MethodPost, "/resume?namespace=all", "secret")
+	if paused("apps") {
+		t.Fatal("expected every namespace resumed")
+	}
+}
+
+func TestPauseIsProtected(t *testing.T) {
+	server := adminServer(t)
+	for _, c := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{http.MethodPost, "/pause?namespace=apps", "", http.StatusUnauthorized},
+		{http.MethodPost, "/pause?namespace=apps", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/pause?namespace=apps", "secret", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/pause", "secret", http.StatusBadRequest},
+	} {
+		if code, _ := adminCall(t, server, c.method, c.path, c.token); code != c.code {
+			t.Fatalf("%s %s with token %q: expected %d, got %d", c.method, c.path, c.token, c.code, code)
+		}
+	}
+	if paused("apps") {
+		t.Fatal("a rejected call paused apps")
+	}
+}
+
+func TestPausedRolloutsApplyOnResume(t *testing.T) {
+	server := adminServer(t)
+	client := fakeClientset(t, labeledDeployment("paused", "web", "app"))
+	patches := patchCounter(client, false)
+	setFlags(t, map[string]interface{}{"pair-window": time.Duration(0), "preflight-dry-run": false})
+	adminCall(t, server, http.MethodPost, "/pause?namespace=paused", "secret")
+	enqueueRollouts(Source{Kind: "ConfigMap", Namespace: "paused", Name: "app-config"}, []Workload{{Kind: "Deployment", Namespace: "paused", Name: "web"}})
+	processQueuedRollouts(t)
+	if *patches != 0 {
+		t.Fatalf("expected the rollout parked while paused, got %d patches", *patches)
+	}
+	if _, status := adminCall(t, server, http.MethodGet, "/status", "secret"); len(status.Parked) != 1 || status.QueuedRollouts != 1 {
+		t.Fatalf("expected the parked rollout in the status, got %+v", status)
+	}
+	adminCall(t, server, http.MethodPost, "/resume?namespace=paused", "secret")
+	processQueuedRollouts(t)
+	if *patches != 1 {
+		t.Fatalf("expected the parked rollout applied on resume, got %d patches", *patches)
+	}
+}
@@ -0,0 +1,245 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package crev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ReloadsClient is the client API for Reloads service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReloadsClient interface {
+	// Trigger handles a ConfigMap or Secret as changed, or rolls out a match label value, like POST /api/v1/trigger
+	Trigger(ctx context.Context, in *TriggerRequest, opts ...grpc.CallOption) (*TriggerResponse, error)
+	// GetStatus returns the outcome so far of a change, like GET /api/v1/trigger/<correlation id>
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*ChangeStatus, error)
+	// ListPending lists the workloads waiting in the rollout queue
+	ListPending(ctx context.Context, in *ListPendingRequest, opts ...grpc.CallOption) (*ListPendingResponse, error)
+	// StreamEvents streams the lifecycle events of rollouts as they happen
+	StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Reloads_StreamEventsClient, error)
+}
+
+type reloadsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReloadsClient(cc grpc.ClientConnInterface) ReloadsClient {
+	return &reloadsClient{cc}
+}
+
+func (c *reloadsClient) Trigger(ctx context.Context, in *TriggerRequest, opts ...grpc.CallOption) (*TriggerResponse, error) {
+	out := new(TriggerResponse)
+	err := c.cc.Invoke(ctx, "/cre.v1.Reloads/Trigger", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *reloadsClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*ChangeStatus, error) {
+	out := new(ChangeStatus)
+	err := c.cc.Invoke(ctx, "/cre.v1.Reloads/GetStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *reloadsClient) ListPending(ctx context.Context, in *ListPendingRequest, opts ...grpc.CallOption) (*ListPendingResponse, error) {
+	out := new(ListPendingResponse)
+	err := c.cc.Invoke(ctx, "/cre.v1.Reloads/ListPending", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *reloadsClient) StreamEvents(ctx context.Context, in *StreamEventsRequest, opts ...grpc.CallOption) (Reloads_StreamEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Reloads_ServiceDesc.Streams[0], "/cre.v1.Reloads/StreamEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &reloadsStreamEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Reloads_StreamEventsClient interface {
+	Recv() (*RolloutEvent, error)
+	grpc.ClientStream
+}
+
+type reloadsStreamEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *reloadsStreamEventsClient) Recv() (*RolloutEvent, error) {
+	m := new(RolloutEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReloadsServer is the server API for Reloads service.
+// All implementations must embed UnimplementedReloadsServer
+// for forward compatibility
+type ReloadsServer interface {
+	// Trigger handles a ConfigMap or Secret as changed, or rolls out a match label value, like POST /api/v1/trigger
+	Trigger(context.Context, *TriggerRequest) (*TriggerResponse, error)
+	// GetStatus returns the outcome so far of a change, like GET /api/v1/trigger/<correlation id>
+	GetStatus(context.Context, *GetStatusRequest) (*ChangeStatus, error)
+	// ListPending lists the workloads waiting in the rollout queue
+	ListPending(context.Context, *ListPendingRequest) (*ListPendingResponse, error)
+	// StreamEvents streams the lifecycle events of rollouts as they happen
+	StreamEvents(*StreamEventsRequest, Reloads_StreamEventsServer) error
+	mustEmbedUnimplementedReloadsServer()
+}
+
+// UnimplementedReloadsServer must be embedded to have forward compatible implementations.
+type UnimplementedReloadsServer struct {
+}
+
+func (UnimplementedReloadsServer) Trigger(context.Context, *TriggerRequest) (*TriggerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Trigger not implemented")
+}
+func (UnimplementedReloadsServer) GetStatus(context.Context, *GetStatusRequest) (*ChangeStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedReloadsServer) ListPending(context.Context, *ListPendingRequest) (*ListPendingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPending not implemented")
+}
+func (UnimplementedReloadsServer) StreamEvents(*StreamEventsRequest, Reloads_StreamEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamEvents not implemented")
+}
+func (UnimplementedReloadsServer) mustEmbedUnimplementedReloadsServer() {}
+
+// UnsafeReloadsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReloadsServer will
+// result in compilation errors.
+type UnsafeReloadsServer interface {
+	mustEmbedUnimplementedReloadsServer()
+}
+
+func RegisterReloadsServer(s grpc.ServiceRegistrar, srv ReloadsServer) {
+	s.RegisterService(&Reloads_ServiceDesc, srv)
+}
+
+func _Reloads_Trigger_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReloadsServer).Trigger(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cre.v1.Reloads/Trigger",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReloadsServer).Trigger(ctx, req.(*TriggerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Reloads_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReloadsServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cre.v1.Reloads/GetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReloadsServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Reloads_ListPending_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPendingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReloadsServer).ListPending(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/cre.v1.Reloads/ListPending",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReloadsServer).ListPending(ctx, req.(*ListPendingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Reloads_StreamEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReloadsServer).StreamEvents(m, &reloadsStreamEventsServer{stream})
+}
+
+type Reloads_StreamEventsServer interface {
+	Send(*RolloutEvent) error
+	grpc.ServerStream
+}
+
+type reloadsStreamEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *reloadsStreamEventsServer) Send(m *RolloutEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Reloads_ServiceDesc is the grpc.ServiceDesc for Reloads service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Reloads_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cre.v1.Reloads",
+	HandlerType: (*ReloadsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Trigger",
+			Handler:    _Reloads_Trigger_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _Reloads_GetStatus_Handler,
+		},
+		{
+			MethodName: "ListPending",
+			Handler:    _Reloads_ListPending_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEvents",
+			Handler:       _Reloads_StreamEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/v1/cre.proto",
+}
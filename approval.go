@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// approvalRequiredAnnotation on a workload, "true" holds its rollouts until approved
+const approvalRequiredAnnotation = "cre.cnvrg.io/approval-required"
+
+const (
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+// pendingApproval is a queued workload whose rollout waits to be approved or rejected
+type pendingApproval struct {
+	ID        string    `json:"id"`
+	Workload  Workload  `json:"workload"`
+	Source    Source    `json:"source"`
+	Requested time.Time `json:"requested"`
+	approved  bool
+	timer     *time.Timer
+	// slackChannel and slackTS locate the interactive message to update with the disposition
+	slackChannel, slackTS string
+}
+
+var (
+	approvalsMu sync.Mutex
+	// approvals holds the workloads waiting for an approval, and the approved ones until their rollout starts
+	approvals = map[Workload]*pendingApproval{}
+)
+
+// awaitingApproval tells if the rollout of w waits for an approval, requesting it the first time.
+// An approved workload is let through once, its next changes need a new approval.
+func awaitingApproval(w Workload) bool {
+	approvalsMu.Lock()
+	if a := approvals[w]; a != nil {
+		if a.approved {
+			delete(approvals, w)
+		}
+		approvalsMu.Unlock()
+		return !a.approved
+	}
+	approvalsMu.Unlock()
+	if !requiresApproval(w) {
+		return false
+	}
+	rolloutsMu.Lock()
+	batches := pendingBatches[w]
+	rolloutsMu.Unlock()
+	if len(batches) == 0 {
+		return false
+	}
+	requestApproval(batches[0].src, w)
+	return true
+}
+
+func requiresApproval(w Workload) bool {
+	obj, _, err := getWorkload(w)
+	// Let the patch itself report the error
+	return err == nil && obj.GetAnnotations()[approvalRequiredAnnotation] == "true"
+}
+
+func requestApproval(src Source, w Workload) {
+	timeout := viper.GetDuration("approval-timeout")
+	a := &pendingApproval{ID: string(uuid.NewUUID()), Workload: w, Source: src, Requested: time.Now()}
+	a.timer = time.AfterFunc(timeout, func() { decideApproval(a.ID, approvalExpired, "") })
+	approvalsMu.Lock()
+	approvals[w] = a
+	approvalsMu.Unlock()
+	msg := fmt.Sprintf("rollout of %s for %s waits for an approval, for up to %s", w, src, timeout)
+	src.log().Info(msg)
+	traceWorkload(w, stageQueue, "pending-approval", "%s is annotated %s, waiting for an approval for up to %s", w, approvalRequiredAnnotation, timeout)
+	recordCorrelatedEvent(workloadRef(w), src, corev1.EventTypeNormal, "RolloutPendingApproval", msg)
+	notify(RolloutEvent{Type: EventRolloutPendingApproval, Source: src, Targets: []Workload{w}, Outcome: "pending-approval"})
+	if slackApprovalsEnabled() {
+		go func() {
+			channel, ts, err := postSlackApproval(a)
+			if err != nil {
+				src.log().Errorf("%s failed to post the slack approval of %s", err, w)
+				return
+			}
+			approvalsMu.Lock()
+			a.slackChannel, a.slackTS = channel, ts
+			approvalsMu.Unlock()
+		}()
+	}
+}
+
+// decideApproval applies the decision of by to the pending approval id. An approved workload is queued again
+// for all its pending changes, a rejected or expired one drops them.
+func decideApproval(id, decision, by string) error {
+	approvalsMu.Lock()
+	var a *pendingApproval
+	for _, p := range approvals {
+		if p.ID == id && !p.approved {
+			a = p
+		}
+	}
+	if a == nil {
+		approvalsMu.Unlock()
+		return fmt.Errorf("no rollout waits for approval %s, it was already decided or expired", id)
+	}
+	a.timer.Stop()
+	if decision == approvalApproved {
+		a.approved = true
+	} else {
+		delete(approvals, a.Workload)
+	}
+	approvalsMu.Unlock()
+	w, src := a.Workload, a.Source
+	msg := fmt.Sprintf("rollout of %s for %s %s by %s", w, src, decision, by)
+	if decision == approvalExpired {
+		msg = fmt.Sprintf("rollout of %s for %s wasn't approved within %s, dropping it", w, src, viper.GetDuration("approval-timeout"))
+	}
+	traceWorkload(w, stageQueue, decision, "%s", msg)
+	auditApproval(a, decision, by)
+	if a.slackTS != "" {
+		go func() {
+			if err := updateSlackApproval(a, decision, by); err != nil {
+				src.log().Errorf("%s failed to update the slack approval of %s", err, w)
+			}
+		}()
+	}
+	if decision == approvalApproved {
+		src.log().Info(msg)
+		recordCorrelatedEvent(workloadRef(w), src, corev1.EventTypeNormal, "RolloutApproved", msg)
+		requeueParked(w)
+		return nil
+	}
+	src.log().Warn(msg)
+	reason := "RolloutRejected"
+	if decision == approvalExpired {
+		reason = "RolloutApprovalExpired"
+	}
+	recordCorrelatedEvent(workloadRef(w), src, corev1.EventTypeWarning, reason, msg)
+	rolloutsMu.Lock()
+	batches := pendingBatches[w]
+	delete(pendingBatches, w)
+	rolloutsMu.Unlock()
+	notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: []Workload{w}, Outcome: "skipped", Error: msg})
+	for _, b := range batches {
+		b.done(w, false)
+	}
+	reportPendingRollouts()
+	return nil
+}
+
+// auditApproval records who decided the rollout of a held workload, with --audit-url and --audit-log-dir
+func auditApproval(a *pendingApproval, decision, by string) {
+	record := auditRecord{
+		ID:        a.Source.CorrelationID,
+		Time:      time.Now().UTC(),
+		Cluster:   viper.GetString("cluster-name"),
+		Source:    a.Source,
+		UID:       string(a.Source.UID),
+		Actions:   []auditAction{{Workload: a.Workload, Outcome: decision}},
+		DecidedBy: by,
+	}
+	if viper.GetString("audit-url") != "" {
+		if err := spoolAuditRecord(record); err != nil {
+			a.Source.log().Errorf("%s failed to spool the approval audit record of %s", err, a.Workload)
+		}
+	}
+	if viper.GetString("audit-log-dir") != "" {
+		if err := appendAuditLog(record); err != nil {
+			a.Source.log().Errorf("%s failed to write the approval audit record of %s to the audit log", err, a.Workload)
+		}
+	}
+}
+
+func workloadRef(w Workload) *corev1.ObjectReference {
+	return &corev1.ObjectReference{APIVersion: workloadGroup(workloadKindResources[w.Kind]) + "/v1", Kind: w.Kind, Namespace: w.Namespace, Name: w.Name}
+}
+
+// currentApprovals lists the rollouts waiting for an approval, oldest first
+func currentApprovals() []pendingApproval {
+	approvalsMu.Lock()
+	defer approvalsMu.Unlock()
+	pending := []pendingApproval{}
+	for _, a := range approvals {
+		if !a.approved {
+			pending = append(pending, *a)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Requested.Before(pending[j].Requested) })
+	return pending
+}
+
+// approvalHandler applies decision to the approval id query or form parameter
+func approvalHandler(decision string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+		if err := decideApproval(id, decision, "the admin endpoint"); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logrus.Infof("approval %s %s through the admin endpoint", id, decision)
+		statusHandler(w, r)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"strings"
+)
+
+var argoApplicationsGVR = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+
+// argoTrackingAnnotation is set by Argo CD with annotation based resource tracking, <app>:<group>/<kind>:<ns>/<name>
+const argoTrackingAnnotation = "argocd.argoproj.io/tracking-id"
+
+// argoApplication returns the namespace and name of the Argo CD Application tracking obj
+func argoApplication(obj metav1.Object) (string, string) {
+	ns := viper.GetString("argocd-namespace")
+	app := ""
+	if id := obj.GetAnnotations()[argoTrackingAnnotation]; id != "" {
+		app = strings.SplitN(id, ":", 2)[0]
+	} else if label := viper.GetString("argocd-tracking-label"); label != "" {
+		app = obj.GetLabels()[label]
+	}
+	// Applications outside the control plane namespace are tracked as <ns>_<app>
+	if parts := strings.SplitN(app, "_", 2); len(parts) == 2 {
+		ns, app = parts[0], parts[1]
+	}
+	return ns, app
+}
+
+// argoSyncRunning tells if a sync operation of the Application is running
+func argoSyncRunning(ns, name string) (bool, error) {
+	app, err := getCustomResource(argoApplicationsGVR, ns, name)
+	if err != nil || app == nil {
+		return false, err
+	}
+	phase, _, _ := unstructured.NestedString(app.Object, "status", "operationState", "phase")
+	return phase == "Running", nil
+}
+
+// argoGate holds back the rollout of a source while the Argo CD Application tracking it is syncing,
+// restarting right away duplicates the restart of the sync and makes the Application flap between Synced and OutOfSync
+func argoGate(obj metav1.Object, src Source, matchLabelValue string) bool {
+	if !viper.GetBool("argocd") {
+		return false
+	}
+	ns, app := argoApplication(obj)
+	if app == "" {
+		return false
+	}
+	running, err := argoSyncRunning(ns, app)
+	if err != nil {
+		logrus.Debugf("%s failed to get Argo CD Application %s/%s", err, ns, app)
+		return false
+	}
+	if !running {
+		return false
+	}
+	holdRollout(fmt.Sprintf("Argo CD sync of %s/%s", ns, app), src, matchLabelValue, viper.GetDuration("argocd-wait-timeout"),
+		func() (bool, error) { return argoSyncRunning(ns, app) },
+		func(o metav1.Object) bool {
+			n, a := argoApplication(o)
+			return n == ns && a == app
+		})
+	return true
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditSendInterval = 5 * time.Second
+	// auditSnapshotTTL bounds how long the data of a change waits for its rollout to finish
+	auditSnapshotTTL = 24 * time.Hour
+)
+
+var auditRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cre_audit_records_total",
+	Help: "Audit records by result (spooled, delivered, dropped when the spool is full, expired past the retention)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(auditRecords)
+}
+
+// auditSnapshot is the full data of a change, kept until its rollout finishes
+type auditSnapshot struct {
+	taken         time.Time
+	encoding      string
+	before, after map[string]string
+	actor         *auditActor
+	version       string
+}
+
+type auditActor struct {
+	Manager   string `json:"manager"`
+	Operation string `json:"operation"`
+	Time      string `json:"time,omitempty"`
+}
+
+type auditAction struct {
+	Workload Workload `json:"workload"`
+	Outcome  string   `json:"outcome"`
+}
+
+// auditRecord is the evidence of a change which restarted workloads, values included
+type auditRecord struct {
+	ID              string            `json:"id"`
+	Time            time.Time         `json:"time"`
+	Cluster         string            `json:"cluster,omitempty"`
+	Source          Source            `json:"source"`
+	UID             string            `json:"uid"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Actor           *auditActor       `json:"actor,omitempty"`
+	Encoding        string            `json:"encoding"`
+	Before          map[string]string `json:"before"`
+	After           map[string]string `json:"after"`
+	Actions         []auditAction     `json:"actions"`
+	// DecidedBy is who approved or rejected the rollout of an approval-required workload
+	DecidedBy string `json:"decidedBy,omitempty"`
+}
+
+var (
+	auditMu        sync.Mutex
+	auditSnapshots = map[string]*auditSnapshot{}
+)
+
+func auditEnabled() bool {
+	return viper.GetString("audit-url") != "" || viper.GetString("audit-log-dir") != ""
+}
+
+// auditChange keeps the data of a ConfigMap change until its rollout finishes
+func auditChange(src Source, obj metav1.Object, before, after map[string]string) {
+	if auditEnabled() {
+		keepAuditSnapshot(src, obj, "utf-8", before, after)
+	}
+}
+
+// auditSecretChange keeps the data of a Secret change, base64 encoded as it may be binary
+func auditSecretChange(src Source, obj metav1.Object, before, after map[string][]byte) {
+	if !auditEnabled() {
+		return
+	}
+	encode := func(data map[string][]byte) map[string]string {
+		m := make(map[string]string, len(data))
+		for k, v := range data {
+			m[k] = base64.StdEncoding.EncodeToString(v)
+		}
+		return m
+	}
+	keepAuditSnapshot(src, obj, "base64", encode(before), encode(after))
+}
+
+func keepAuditSnapshot(src Source, obj metav1.Object, encoding string, before, after map[string]string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	for id, s := range auditSnapshots {
+		if time.Since(s.taken) > auditSnapshotTTL {
+			delete(auditSnapshots, id)
+		}
+	}
+	auditSnapshots[src.CorrelationID] = &auditSnapshot{
+		taken:    time.Now(),
+		encoding: encoding,
+		before:   before,
+		after:    after,
+		actor:    lastWriter(obj),
+		version:  obj.GetResourceVersion(),
+	}
+}
+
+// lastWriter returns the manager of the most recent managedFields entry, the actor of the change
+func lastWriter(obj metav1.Object) *auditActor {
+	var last *metav1.ManagedFieldsEntry
+	for i, entry := range obj.GetManagedFields() {
+		if last == nil || (entry.Time != nil && (last.Time == nil || entry.Time.After(last.Time.Time))) {
+			last = &obj.GetManagedFields()[i]
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	actor := &auditActor{Manager: last.Manager, Operation: string(last.Operation)}
+	if last.Time != nil {
+		actor.Time = last.Time.UTC().Format(time.RFC3339)
+	}
+	return actor
+}
+
+// auditRollout spools the record of a change whose rollout finished, changes restarting nothing aren't audited
+func auditRollout(src Source, triggered, skipped []Workload) {
+	auditMu.Lock()
+	snapshot := auditSnapshots[src.CorrelationID]
+	delete(auditSnapshots, src.CorrelationID)
+	auditMu.Unlock()
+	if snapshot == nil || len(triggered) == 0 {
+		return
+	}
+	record := auditRecord{
+		ID:              src.CorrelationID,
+		Time:            time.Now().UTC(),
+		Cluster:         viper.GetString("cluster-name"),
+		Source:          src,
+		UID:             string(src.UID),
+		ResourceVersion: snapshot.version,
+		Actor:           snapshot.actor,
+		Encoding:        snapshot.encoding,
+		Before:          snapshot.before,
+		After:           snapshot.after,
+	}
+	for _, w := range triggered {
+		record.Actions = append(record.Actions, auditAction{Workload: w, Outcome: "triggered"})
+	}
+	for _, w := range skipped {
+		record.Actions = append(record.Actions, auditAction{Workload: w, Outcome: "skipped"})
+	}
+	if viper.GetString("audit-url") != "" {
+		if err := spoolAuditRecord(record); err != nil {
+			src.log().Errorf("%s failed to spool the audit record of %s", err, src)
+		}
+	}
+	if viper.GetString("audit-log-dir") != "" {
+		if err := appendAuditLog(record); err != nil {
+			src.log().Errorf("%s failed to write the audit record of %s to the audit log", err, src)
+		}
+	}
+}
+
+// spoolAuditRecord writes the record to audit-spool-dir, dropping the oldest records beyond audit-spool-max-bytes
+func spoolAuditRecord(record auditRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dir := viper.GetString("audit-spool-dir")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	enforceSpoolLimit(dir, viper.GetInt64("audit-spool-max-bytes")-int64(len(payload)))
+	name := fmt.Sprintf("%020d-%s.json", record.Time.UnixNano(), record.ID)
+	tmp := filepath.Join(dir, "."+name)
+	// 0600, the records hold Secret values
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	auditRecords.WithLabelValues("spooled").Inc()
+	return nil
+}
+
+type spooledRecord struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// spooledRecords lists the files of dir with the suffix, oldest first
+func spooledRecords(dir, suffix string) []spooledRecord {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("%s failed to read %s", err, dir)
+		return nil
+	}
+	var records []spooledRecord
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), suffix) {
+			continue
+		}
+		records = append(records, spooledRecord{path: filepath.Join(dir, f.Name()), size: f.Size(), modTime: f.ModTime()})
+	}
+	// names start with the zero padded creation time
+	sort.Slice(records, func(i, j int) bool { return records[i].path < records[j].path })
+	return records
+}
+
+// enforceSpoolLimit drops the oldest records until the spool holds at most maxBytes
+func enforceSpoolLimit(dir string, maxBytes int64) {
+	records := spooledRecords(dir, ".json")
+	var total int64
+	for _, r := range records {
+		total += r.size
+	}
+	for _, r := range records {
+		if total <= maxBytes {
+			return
+		}
+		if err := os.Remove(r.path); err != nil {
+			logrus.Errorf("%s failed to drop audit record %s", err, r.path)
+			continue
+		}
+		total -= r.size
+		auditRecords.WithLabelValues("dropped").Inc()
+		logrus.Warnf("audit spool is full, dropped the oldest record %s", filepath.Base(r.path))
+	}
+}
+
+// sendAuditRecords delivers the spooled records in order every auditSendInterval, stopping at the first failure
+// so records are retried in order, and expires the ones older than audit-spool-retention
+func sendAuditRecords() {
+	if viper.GetString("audit-url") == "" {
+		return
+	}
+	dir := viper.GetString("audit-spool-dir")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Fatalf("%s failed to create the audit spool %s", err, dir)
+	}
+	client, err := auditClient()
+	if err != nil {
+		logrus.Fatalf("%s, invalid audit sink configuration", err)
+	}
+	url := viper.GetString("audit-url")
+	retention := viper.GetDuration("audit-spool-retention")
+	logrus.Infof("shipping audit records to %s, spooled in %s", url, dir)
+	for range time.Tick(auditSendInterval) {
+		for _, r := range spooledRecords(dir, ".json") {
+			if retention > 0 && time.Since(r.modTime) > retention {
+				logrus.Warnf("audit record %s wasn't delivered within %s, expiring it", filepath.Base(r.path), retention)
+				os.Remove(r.path)
+				auditRecords.WithLabelValues("expired").Inc()
+				continue
+			}
+			if err := sendAuditRecord(client, url, r.path); err != nil {
+				logrus.Errorf("%s failed to deliver audit record %s, retrying in %s", err, filepath.Base(r.path), auditSendInterval)
+				break
+			}
+			os.Remove(r.path)
+			auditRecords.WithLabelValues("delivered").Inc()
+		}
+	}
+}
+
+func sendAuditRecord(client *http.Client, url, path string) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("audit endpoint responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// auditClient authenticates with the audit-client-cert key pair, reloaded when renewed, and verifies
+// the endpoint with audit-ca-file or the system roots
+func auditClient() (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile, keyFile := viper.GetString("audit-client-cert"), viper.GetString("audit-client-key"); certFile != "" || keyFile != "" {
+		certs := &certificateReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certs.GetCertificate(nil)
+		}
+	}
+	if caFile := viper.GetString("audit-ca-file"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return &http.Client{Timeout: notifyTimeout, Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
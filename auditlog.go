@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	currentAuditLog = "current.jsonl"
+	// rotated audit logs are named after their rotation time, so they sort oldest first
+	rotatedAuditLogFormat = "20060102T150405.000000000Z"
+	auditLogCheckInterval = time.Minute
+	auditUploadTimeout    = 5 * time.Minute
+)
+
+var auditLogFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cre_audit_log_files_total",
+	Help: "Rotated audit log files by result (uploaded, failed uploads, dropped over the disk budget)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(auditLogFiles)
+}
+
+// objectStore uploads a file and verifies the stored object matches its size and md5 before it's deleted locally
+type objectStore interface {
+	upload(ctx context.Context, key, path string, size int64, md5sum []byte) error
+}
+
+// objectStores by url scheme of --audit-upload-url, newObjectStore gets the bucket
+var objectStores = map[string]func(bucket string) (objectStore, error){}
+
+func registerObjectStore(scheme string, newObjectStore func(bucket string) (objectStore, error)) {
+	objectStores[scheme] = newObjectStore
+}
+
+// auditLog appends the audit records as JSON lines to current.jsonl in audit-log-dir,
+// rotated by size and age into files which are uploaded, then deleted
+type auditLog struct {
+	mu     sync.Mutex
+	dir    string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+var auditLogs = &auditLog{}
+
+func appendAuditLog(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return auditLogs.append(append(line, '\n'))
+}
+
+func (l *auditLog) append(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		l.dir = viper.GetString("audit-log-dir")
+		if err := os.MkdirAll(l.dir, 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(l.dir, currentAuditLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.file, l.size, l.opened = f, info.Size(), time.Now()
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	l.size += int64(len(line))
+	if l.size >= viper.GetInt64("audit-log-rotate-size") {
+		return l.rotateLocked()
+	}
+	return nil
+}
+
+// rotate renames a non empty current.jsonl, including one left by a previous run, and enforces the disk budget
+func (l *auditLog) rotate(olderThan time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil && time.Since(l.opened) < olderThan {
+		return nil
+	}
+	return l.rotateLocked()
+}
+
+func (l *auditLog) rotateLocked() error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			logrus.Errorf("%s failed to close the audit log", err)
+		}
+		l.file = nil
+	}
+	l.dir = viper.GetString("audit-log-dir")
+	current := filepath.Join(l.dir, currentAuditLog)
+	if info, err := os.Stat(current); err != nil || info.Size() == 0 {
+		return nil
+	}
+	rotated := filepath.Join(l.dir, "audit-"+time.Now().UTC().Format(rotatedAuditLogFormat)+".jsonl")
+	if err := os.Rename(current, rotated); err != nil {
+		return err
+	}
+	enforceAuditLogBudget(l.dir, viper.GetInt64("audit-log-max-bytes"))
+	return nil
+}
+
+// rotatedAuditLogs lists the rotated files, oldest first
+func rotatedAuditLogs(dir string) []spooledRecord {
+	var rotated []spooledRecord
+	for _, f := range spooledRecords(dir, ".jsonl") {
+		if name := filepath.Base(f.path); strings.HasPrefix(name, "audit-") {
+			rotated = append(rotated, f)
+		}
+	}
+	return rotated
+}
+
+// enforceAuditLogBudget drops the oldest rotated files, not uploaded yet, until they fit in maxBytes
+func enforceAuditLogBudget(dir string, maxBytes int64) {
+	rotated := rotatedAuditLogs(dir)
+	var total int64
+	for _, f := range rotated {
+		total += f.size
+	}
+	for _, f := range rotated {
+		if total <= maxBytes {
+			return
+		}
+		if err := os.Remove(f.path); err != nil {
+			logrus.Errorf("%s failed to drop audit log %s", err, f.path)
+			continue
+		}
+		total -= f.size
+		auditLogFiles.WithLabelValues("dropped").Inc()
+		logrus.Errorf("AUDIT RECORDS LOST: the audit logs exceed --audit-log-max-bytes, dropped %s without uploading it", filepath.Base(f.path))
+	}
+}
+
+// runAuditLog rotates the audit log every audit-log-rotate-interval and uploads the rotated files
+// every audit-upload-interval. Files left by a previous run are rotated and uploaded first,
+// a file is only deleted once its upload is verified, so interrupted uploads are retried after a restart.
+func runAuditLog() {
+	dir := viper.GetString("audit-log-dir")
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logrus.Fatalf("%s failed to create the audit log directory %s", err, dir)
+	}
+	var (
+		store  objectStore
+		prefix string
+	)
+	if target := viper.GetString("audit-upload-url"); target != "" {
+		var err error
+		if store, prefix, err = newAuditUploader(target); err != nil {
+			logrus.Fatalf("%s, invalid --audit-upload-url", err)
+		}
+		logrus.Infof("uploading rotated audit logs to %s", target)
+	}
+	if err := auditLogs.rotate(0); err != nil {
+		logrus.Errorf("%s failed to rotate the audit log", err)
+	}
+	rotateInterval := viper.GetDuration("audit-log-rotate-interval")
+	upload := time.NewTicker(viper.GetDuration("audit-upload-interval"))
+	check := time.NewTicker(auditLogCheckInterval)
+	uploadAuditLogs(store, prefix, dir)
+	for {
+		select {
+		case <-check.C:
+			if err := auditLogs.rotate(rotateInterval); err != nil {
+				logrus.Errorf("%s failed to rotate the audit log", err)
+			}
+		case <-upload.C:
+			uploadAuditLogs(store, prefix, dir)
+		}
+	}
+}
+
+// newAuditUploader parses s3://bucket/prefix or gs://bucket/prefix, the prefix defaults to {cluster}/{date}
+func newAuditUploader(target string) (objectStore, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	newObjectStore, ok := objectStores[u.Scheme]
+	if !ok || u.Host == "" {
+		return nil, "", fmt.Errorf("expected s3://bucket/prefix or gs://bucket/prefix, got %s", target)
+	}
+	store, err := newObjectStore(u.Host)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = "{cluster}/{date}"
+	}
+	return store, prefix, nil
+}
+
+// uploadAuditLogs uploads the rotated files oldest first, stopping at the first failure
+func uploadAuditLogs(store objectStore, prefix, dir string) {
+	if store == nil {
+		return
+	}
+	for _, f := range rotatedAuditLogs(dir) {
+		name := filepath.Base(f.path)
+		key := auditLogKey(prefix, name)
+		if err := uploadAuditLog(store, key, f); err != nil {
+			auditLogFiles.WithLabelValues("failed").Inc()
+			logrus.Errorf("%s failed to upload audit log %s, keeping it until the next upload", err, name)
+			return
+		}
+		if err := os.Remove(f.path); err != nil {
+			logrus.Errorf("%s failed to delete the uploaded audit log %s", err, name)
+		}
+		auditLogFiles.WithLabelValues("uploaded").Inc()
+		logrus.Infof("uploaded audit log %s as %s", name, key)
+	}
+}
+
+func uploadAuditLog(store objectStore, key string, f spooledRecord) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	_, err = io.Copy(h, file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditUploadTimeout)
+	defer cancel()
+	return store.upload(ctx, key, f.path, f.size, h.Sum(nil))
+}
+
+// auditLogKey expands {cluster} and {date}, the day the file was rotated, in the prefix
+func auditLogKey(prefix, name string) string {
+	date := "unknown"
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, "audit-"), ".jsonl")
+	if t, err := time.Parse(rotatedAuditLogFormat, stamp); err == nil {
+		date = t.Format("2006-01-02")
+	}
+	cluster := viper.GetString("cluster-name")
+	if cluster == "" {
+		cluster = "unnamed"
+	}
+	return strings.NewReplacer("{cluster}", cluster, "{date}", date).Replace(prefix) + "/" + name
+}
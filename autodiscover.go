@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// autoDiscovering tells if the workloads consuming a source are discovered from their pod template,
+// through volumes with auto-discover, env and envFrom with auto-discover-env
+func autoDiscovering() bool {
+	return viper.GetBool("auto-discover") || viper.GetBool("auto-discover-env")
+}
+
+// discoveredWorkloads returns the workloads in the namespace of src whose pod template consumes it by the discovered
+// references, labeled or not, so neither needs the match label. Each restart is logged with the reference to src.
+func discoveredWorkloads(src Source) []Workload {
+	if !autoDiscovering() || (src.Kind != "ConfigMap" && src.Kind != "Secret") {
+		return nil
+	}
+	ns := src.Namespace
+	if reason, excluded := excludedNamespace(ns); excluded {
+		logrus.Debugf("namespace %s is excluded by %s, not discovering the workloads mounting %s", ns, reason, src)
+		return nil
+	}
+	var targets []Workload
+	for _, cw := range mountingCandidates(ns) {
+		ref, ok := sourceReference(cw.spec, src)
+		if !ok || optedOut(src, cw.workload, cw.meta.Annotations) {
+			continue
+		}
+		w := cw.workload
+		src.log().Infof("discovered %s, its %s", w, ref)
+		traceDecision(src, stageTargets, "discovered", &w, "its %s", ref)
+		targets = append(targets, w)
+	}
+	return targets
+}
+
+// mountingCandidates lists the workloads of ns which may mount a source, kinds RBAC denies listing are left out,
+// logged once by checkCapabilities
+func mountingCandidates(ns string) []coveredWorkload {
+	clientset := clientset()
+	var workloads []coveredWorkload
+	if canList("Deployment") {
+		deployments, err := clientset.AppsV1().Deployments(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list Deployments in namespace %s to discover", err, ns)
+		} else {
+			for _, d := range deployments.Items {
+				workloads = append(workloads, coveredWorkload{Workload{Kind: "Deployment", Namespace: ns, Name: d.Name}, d.ObjectMeta, d.Spec.Template.Spec})
+			}
+		}
+	}
+	if canList("StatefulSet") {
+		statefulSets, err := clientset.AppsV1().StatefulSets(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list StatefulSets in namespace %s to discover", err, ns)
+		} else {
+			for _, s := range statefulSets.Items {
+				workloads = append(workloads, coveredWorkload{Workload{Kind: "StatefulSet", Namespace: ns, Name: s.Name}, s.ObjectMeta, s.Spec.Template.Spec})
+			}
+		}
+	}
+	if canList("DaemonSet") {
+		daemonSets, err := clientset.AppsV1().DaemonSets(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list DaemonSets in namespace %s to discover", err, ns)
+		} else {
+			for _, d := range daemonSets.Items {
+				workloads = append(workloads, coveredWorkload{Workload{Kind: "DaemonSet", Namespace: ns, Name: d.Name}, d.ObjectMeta, d.Spec.Template.Spec})
+			}
+		}
+	}
+	if canList("CronJob") {
+		cronJobs, err := clientset.BatchV1().CronJobs(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list CronJobs in namespace %s to discover", err, ns)
+		} else {
+			for _, c := range cronJobs.Items {
+				workloads = append(workloads, coveredWorkload{Workload{Kind: "CronJob", Namespace: ns, Name: c.Name}, c.ObjectMeta, c.Spec.JobTemplate.Spec.Template.Spec})
+			}
+		}
+	}
+	return workloads
+}
+
+// sourceReference describes the reference of the pod spec to src auto discovery follows, false when there's none
+func sourceReference(spec corev1.PodSpec, src Source) (string, bool) {
+	if viper.GetBool("auto-discover") {
+		if ref, ok := volumeReference(spec, src); ok {
+			return ref, true
+		}
+	}
+	if viper.GetBool("auto-discover-env") {
+		return envReference(spec, src)
+	}
+	return "", false
+}
+
+// volumeReference describes the volume of the pod spec mounting src, false when none does.
+// A volume mounting only some items of src refers to it when one of them changed, optional volumes do like the others.
+func volumeReference(spec corev1.PodSpec, src Source) (string, bool) {
+	for _, v := range spec.Volumes {
+		switch {
+		case src.Kind == "ConfigMap" && v.ConfigMap != nil && v.ConfigMap.Name == src.Name:
+			if ref, ok := itemsReference(fmt.Sprintf("volume %s mounts ConfigMap %s", v.Name, src.Name), v.ConfigMap.Items, v.ConfigMap.Optional, src); ok {
+				return ref, true
+			}
+		case src.Kind == "Secret" && v.Secret != nil && v.Secret.SecretName == src.Name:
+			if ref, ok := itemsReference(fmt.Sprintf("volume %s mounts Secret %s", v.Name, src.Name), v.Secret.Items, v.Secret.Optional, src); ok {
+				return ref, true
+			}
+		case v.Projected != nil:
+			for _, s := range v.Projected.Sources {
+				if src.Kind == "ConfigMap" && s.ConfigMap != nil && s.ConfigMap.Name == src.Name {
+					if ref, ok := itemsReference(fmt.Sprintf("projected volume %s mounts ConfigMap %s", v.Name, src.Name), s.ConfigMap.Items, s.ConfigMap.Optional, src); ok {
+						return ref, true
+					}
+				}
+				if src.Kind == "Secret" && s.Secret != nil && s.Secret.Name == src.Name {
+					if ref, ok := itemsReference(fmt.Sprintf("projected volume %s mounts Secret %s", v.Name, src.Name), s.Secret.Items, s.Secret.Optional, src); ok {
+						return ref, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// itemsReference completes the description of a volume reference with its items and optional flag,
+// false when it mounts only items none of the changed keys of src are
+func itemsReference(ref string, items []corev1.KeyToPath, optional *bool, src Source) (string, bool) {
+	if len(items) > 0 {
+		var keys []string
+		changed := false
+		for _, item := range items {
+			keys = append(keys, item.Key)
+			changed = changed || keyChanged(src, item.Key)
+		}
+		if !changed {
+			return "", false
+		}
+		ref += ", items " + strings.Join(keys, ", ")
+	}
+	if optional != nil && *optional {
+		ref += ", optional"
+	}
+	return ref, true
+}
+
+// envReference describes the env of a container or init container of the pod spec referencing src, false when none does.
+// envFrom refers to any change of src, a single key reference only to a change of that key.
+func envReference(spec corev1.PodSpec, src Source) (string, bool) {
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, from := range c.EnvFrom {
+			if src.Kind == "ConfigMap" && from.ConfigMapRef != nil && from.ConfigMapRef.Name == src.Name {
+				return fmt.Sprintf("container %s reads its env from ConfigMap %s", c.Name, src.Name), true
+			}
+			if src.Kind == "Secret" && from.SecretRef != nil && from.SecretRef.Name == src.Name {
+				return fmt.Sprintf("container %s reads its env from Secret %s", c.Name, src.Name), true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if ref := env.ValueFrom.ConfigMapKeyRef; src.Kind == "ConfigMap" && ref != nil && ref.Name == src.Name && keyChanged(src, ref.Key) {
+				return fmt.Sprintf("container %s reads env %s from key %s of ConfigMap %s", c.Name, env.Name, ref.Key, src.Name), true
+			}
+			if ref := env.ValueFrom.SecretKeyRef; src.Kind == "Secret" && ref != nil && ref.Name == src.Name && keyChanged(src, ref.Key) {
+				return fmt.Sprintf("container %s reads env %s from key %s of Secret %s", c.Name, env.Name, ref.Key, src.Name), true
+			}
+		}
+	}
+	return "", false
+}
+
+// keyChanged tells if the key is one of the changed keys of src, always true without changed keys, e.g. for a trigger
+func keyChanged(src Source, key string) bool {
+	if len(src.ChangedKeys) == 0 {
+		return true
+	}
+	for _, k := range src.ChangedKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"sync"
+	"time"
+)
+
+// States of the mass-change circuit breaker
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerDraining = "draining"
+)
+
+var (
+	breakerGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cre_breaker_open",
+		Help: "1 while the mass-change circuit breaker holds the rollouts, 0 otherwise",
+	})
+	breakerTrips = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cre_breaker_trips_total",
+		Help: "Number of times the mass-change circuit breaker tripped",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(breakerGauge, breakerTrips)
+}
+
+var (
+	breakerMu sync.Mutex
+	// breakerChanges holds when the matched changes of the last breaker-window were seen
+	breakerChanges []time.Time
+	breakerState   = breakerClosed
+	breakerTripped time.Time
+	// breakerTrip counts the trips, so the auto-resume of a previous trip doesn't close a newer one
+	breakerTrip int
+)
+
+// recordMatchedChange counts a matched change, tripping the breaker once more than breaker-max-changes
+// were seen within breaker-window. Changes of a mass edit, e.g. a bad kustomize base or a wrong helm value,
+// then stay queued until resumed instead of restarting the whole cluster.
+func recordMatchedChange(src Source) {
+	maxChanges := tunableInt("breaker-max-changes")
+	if maxChanges <= 0 {
+		return
+	}
+	now := time.Now()
+	window := tunableDuration("breaker-window")
+	breakerMu.Lock()
+	recent := breakerChanges[:0]
+	for _, at := range breakerChanges {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	breakerChanges = append(recent, now)
+	if len(breakerChanges) <= maxChanges || breakerState == breakerOpen {
+		breakerMu.Unlock()
+		return
+	}
+	breakerState = breakerOpen
+	breakerTripped = now
+	breakerTrip++
+	trip := breakerTrip
+	count := len(breakerChanges)
+	breakerMu.Unlock()
+	breakerGauge.Set(1)
+	breakerTrips.Inc()
+	msg := fmt.Sprintf("circuit breaker tripped: %d matched changes within %s, more than the %d of --breaker-max-changes, rollouts are queued until resumed", count, window, maxChanges)
+	if delay := viper.GetDuration("breaker-auto-resume"); delay > 0 {
+		msg += fmt.Sprintf(" or for %s", delay)
+		time.AfterFunc(delay, func() { autoResumeBreaker(trip) })
+	} else {
+		msg += " with cre resume"
+	}
+	src.log().Warn(msg)
+	recordSourceEvent(src, corev1.EventTypeWarning, "CircuitBreakerTripped", msg)
+	notify(RolloutEvent{Type: EventBreakerTripped, Source: src, Outcome: "tripped", Error: msg})
+}
+
+func autoResumeBreaker(trip int) {
+	breakerMu.Lock()
+	current := breakerTrip == trip && breakerState == breakerOpen
+	breakerMu.Unlock()
+	if !current {
+		return
+	}
+	closeBreaker(fmt.Sprintf("after the %s of --breaker-auto-resume", viper.GetDuration("breaker-auto-resume")))
+	releaseParked("all")
+}
+
+// breakerHolds tells if the breaker keeps rollouts queued
+func breakerHolds() bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	return breakerState == breakerOpen
+}
+
+// closeBreaker lets the queued rollouts drain, spaced by breaker-drain-interval, the caller requeues the parked ones
+func closeBreaker(reason string) {
+	breakerMu.Lock()
+	if breakerState != breakerOpen {
+		breakerMu.Unlock()
+		return
+	}
+	breakerState = breakerDraining
+	breakerChanges = nil
+	breakerMu.Unlock()
+	breakerGauge.Set(0)
+	logrus.Warnf("circuit breaker reset %s, draining the queued rollouts", reason)
+}
+
+// drainInterval returns the delay between two rollouts while the queue held by the breaker drains,
+// closing the breaker once nothing is left queued
+func drainInterval() time.Duration {
+	rolloutsMu.Lock()
+	queued := len(pendingBatches)
+	rolloutsMu.Unlock()
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if breakerState != breakerDraining {
+		return 0
+	}
+	if queued == 0 {
+		breakerState = breakerClosed
+		logrus.Info("circuit breaker drained the queued rollouts")
+		return 0
+	}
+	return tunableDuration("breaker-drain-interval")
+}
+
+type breakerStatus struct {
+	State         string     `json:"state"`
+	TrippedAt     *time.Time `json:"trippedAt,omitempty"`
+	AutoResumeAt  *time.Time `json:"autoResumeAt,omitempty"`
+	RecentChanges int        `json:"recentChanges"`
+	MaxChanges    int        `json:"maxChanges"`
+	Window        string     `json:"window"`
+}
+
+func currentBreakerStatus() breakerStatus {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	window := tunableDuration("breaker-window")
+	status := breakerStatus{State: breakerState, MaxChanges: tunableInt("breaker-max-changes"), Window: window.String()}
+	for _, at := range breakerChanges {
+		if time.Since(at) < window {
+			status.RecentChanges++
+		}
+	}
+	if breakerState == breakerOpen {
+		tripped := breakerTripped
+		status.TrippedAt = &tripped
+		if delay := viper.GetDuration("breaker-auto-resume"); delay > 0 {
+			resumeAt := tripped.Add(delay)
+			status.AutoResumeAt = &resumeAt
+		}
+	}
+	return status
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capability is a verb on a resource cre uses to roll out, pods/exec for the signal reloads
+type capability struct {
+	group, resource, verb string
+}
+
+func (c capability) String() string {
+	return c.verb + " " + c.resource
+}
+
+// workloadKindResources maps the workload kinds to their apps/v1 or batch/v1 resource
+var workloadKindResources = map[string]string{
+	"Deployment":  "deployments",
+	"StatefulSet": "statefulsets",
+	"DaemonSet":   "daemonsets",
+	"CronJob":     "cronjobs",
+}
+
+var capabilityGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cre_capabilities",
+	Help: "1 when the ServiceAccount of cre may use the verb on the resource in every watched namespace, cluster wide by default, 0 when RBAC denies it",
+}, []string{"resource", "verb"})
+
+func init() {
+	prometheus.MustRegister(capabilityGauge)
+}
+
+var (
+	capabilitiesMu sync.Mutex
+	// capabilities holds the review results, capabilities not reviewed or failing to be reviewed are assumed allowed
+	capabilities = map[capability]bool{}
+)
+
+func requiredCapabilities() []capability {
+	var required []capability
+	for _, resource := range workloadResources {
+		required = append(required, capability{workloadGroup(resource), resource, "list"}, capability{workloadGroup(resource), resource, "patch"})
+	}
+	return append(required, capability{"", "pods", "list"}, capability{"", "pods/exec", "create"})
+}
+
+// setupCapabilities reviews the capabilities of cre before the informers start, then every rbac-recheck-interval,
+// so RBAC changes apply without a restart. With --rbac-check=strict a denied capability stops cre instead.
+func setupCapabilities() {
+	mode := viper.GetString("rbac-check")
+	switch mode {
+	case "strict", "degrade":
+	case "off":
+		return
+	default:
+		logrus.Fatalf("unknown --rbac-check %s, expected degrade, strict or off", mode)
+	}
+	checkCapabilities()
+	if mode == "strict" {
+		for _, c := range requiredCapabilities() {
+			if !can(c) {
+				logrus.Fatalf("not allowed to %s %s, failing as --rbac-check is strict", c, capabilityScope())
+			}
+		}
+	}
+	interval := viper.GetDuration("rbac-recheck-interval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			checkCapabilities()
+			if mode != "strict" {
+				continue
+			}
+			for _, c := range requiredCapabilities() {
+				if !can(c) {
+					logrus.Fatalf("no longer allowed to %s %s, failing as --rbac-check is strict", c, capabilityScope())
+				}
+			}
+		}
+	}()
+}
+
+// capabilityScope tells where the capabilities are reviewed, cluster wide or in the watched namespaces
+func capabilityScope() string {
+	namespaces := watchedNamespaces()
+	if len(namespaces) == 1 && namespaces[0] == metav1.NamespaceAll {
+		return "cluster wide"
+	}
+	return "in namespaces " + strings.Join(namespaces, ", ")
+}
+
+// checkCapabilities reviews every capability in each watched namespace, so namespaced RBAC is enough with --namespace,
+// logging once when it's denied and once when it's granted again
+func checkCapabilities() {
+	for _, c := range requiredCapabilities() {
+		allowed := true
+		var err error
+		for _, ns := range watchedNamespaces() {
+			var inNamespace bool
+			if inNamespace, err = canI(ns, c.group, c.resource, c.verb); err != nil {
+				break
+			}
+			allowed = allowed && inNamespace
+		}
+		if err != nil {
+			logrus.Errorf("%s failed to review access to %s, keeping its previous state", err, c)
+			continue
+		}
+		capabilitiesMu.Lock()
+		was, reviewed := capabilities[c]
+		capabilities[c] = allowed
+		capabilitiesMu.Unlock()
+		value := 0.0
+		if allowed {
+			value = 1
+		}
+		capabilityGauge.WithLabelValues(c.resource, c.verb).Set(value)
+		switch {
+		case !allowed && (!reviewed || was):
+			logrus.Warnf("not allowed to %s %s, %s", c, capabilityScope(), capabilityImpact(c))
+		case allowed && reviewed && !was:
+			logrus.Infof("allowed to %s again", c)
+		}
+	}
+}
+
+func capabilityImpact(c capability) string {
+	switch c.resource {
+	case "pods":
+		return "in place reloads are replaced by restarts"
+	case "pods/exec":
+		return "signal reloads are replaced by restarts"
+	}
+	return "rollouts of " + c.resource + " are skipped"
+}
+
+func can(c capability) bool {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	allowed, reviewed := capabilities[c]
+	return allowed || !reviewed
+}
+
+// canList tells if cre may list the workloads of the kind in the local cluster
+func canList(kind string) bool {
+	resource := workloadKindResources[kind]
+	return can(capability{workloadGroup(resource), resource, "list"})
+}
+
+// canPatch tells if cre may restart w, spokes have RBAC of their own and are always tried
+func canPatch(w Workload) bool {
+	resource := workloadKindResources[w.Kind]
+	return w.Cluster != "" || can(capability{workloadGroup(resource), resource, "patch"})
+}
+
+// capableTargets drops the workloads cre may not patch, logged once per capability by checkCapabilities
+func capableTargets(src Source, targets []Workload) []Workload {
+	var capable []Workload
+	for _, w := range targets {
+		if !canPatch(w) {
+			src.log().Debugf("skipping %s, not allowed to patch %s", w, workloadKindResources[w.Kind])
+			traceDecision(src, stageTargets, "skipped", &w, "RBAC doesn't allow cre to patch %s", workloadKindResources[w.Kind])
+			continue
+		}
+		capable = append(capable, w)
+	}
+	return capable
+}
+
+// canReloadInPlace tells if cre may reach the pods of the profile strategy
+func canReloadInPlace(profile appProfile) bool {
+	if !can(capability{"", "pods", "list"}) {
+		return false
+	}
+	return profile.Strategy != "signal" || can(capability{"", "pods/exec", "create"})
+}
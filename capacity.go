@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// capacitySignalTTL keeps the workers of a batch from each listing the pending pods
+	capacitySignalTTL  = 10 * time.Second
+	maxCapacityBackoff = 5 * time.Minute
+)
+
+var pendingRolloutsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cre_pending_rollouts",
+	Help: "Workloads waiting for a rollout, by reason (queued, parked for a pause, the circuit breaker or the control ConfigMap, capacity)",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(pendingRolloutsGauge)
+}
+
+// capacityDeferral is a workload whose rollout waits for the cluster to have capacity again
+type capacityDeferral struct {
+	since    time.Time
+	attempts int
+}
+
+type capacitySignal struct {
+	pressure string
+	checked  time.Time
+}
+
+var (
+	capacityMu sync.Mutex
+	// capacityDeferred holds the workloads deferred for capacity
+	capacityDeferred = map[Workload]*capacityDeferral{}
+	// capacitySignals caches the last check by scope, a namespace or "" for the cluster
+	capacitySignals = map[string]capacitySignal{}
+)
+
+// capacityWait tells how long to defer the rollout of w while the cluster lacks capacity, 0 to go on.
+// It backs off from capacity-backoff, and lets the rollout go with a warning once capacity-max-delay passed.
+func capacityWait(src Source, w Workload) time.Duration {
+	mode := viper.GetString("capacity-check")
+	if mode == "" || mode == "off" || w.Cluster != "" {
+		return 0
+	}
+	scope := w.Namespace
+	if viper.GetString("capacity-scope") == "cluster" {
+		scope = ""
+	}
+	pressure := capacityPressure(mode, scope)
+	capacityMu.Lock()
+	deferral := capacityDeferred[w]
+	if pressure == "" {
+		delete(capacityDeferred, w)
+		capacityMu.Unlock()
+		if deferral != nil {
+			src.log().Infof("capacity recovered, rolling out %s deferred for %s", w, time.Since(deferral.since).Round(time.Second))
+			traceDecision(src, stageQueue, "capacity-recovered", &w, "capacity recovered after %s", time.Since(deferral.since).Round(time.Second))
+		}
+		reportPendingRollouts()
+		return 0
+	}
+	first := deferral == nil
+	if first {
+		deferral = &capacityDeferral{since: time.Now()}
+		capacityDeferred[w] = deferral
+	}
+	if maxDelay := viper.GetDuration("capacity-max-delay"); time.Since(deferral.since) >= maxDelay {
+		delete(capacityDeferred, w)
+		capacityMu.Unlock()
+		msg := fmt.Sprintf("rolling out %s despite %s, deferred for the %s of --capacity-max-delay", w, pressure, maxDelay)
+		src.log().Warn(msg)
+		traceDecision(src, stageQueue, "capacity-timed-out", &w, "%s", msg)
+		recordSourceEvent(src, corev1.EventTypeWarning, "RolloutCapacityTimeout", msg)
+		reportPendingRollouts()
+		return 0
+	}
+	wait := viper.GetDuration("capacity-backoff") << uint(deferral.attempts)
+	if wait <= 0 || wait > maxCapacityBackoff {
+		wait = maxCapacityBackoff
+	}
+	deferral.attempts++
+	capacityMu.Unlock()
+	src.log().Warnf("deferring rollout of %s by %s: %s", w, wait, pressure)
+	traceDecision(src, stageQueue, "capacity-deferred", &w, "%s, retrying in %s", pressure, wait)
+	if first {
+		recordSourceEvent(src, corev1.EventTypeWarning, "RolloutDeferred", fmt.Sprintf("rollout of %s deferred: %s", w, pressure))
+	}
+	reportPendingRollouts()
+	return wait
+}
+
+// capacityPressure returns why the scope lacks capacity, empty when it doesn't or the check failed
+func capacityPressure(mode, scope string) string {
+	capacityMu.Lock()
+	cached, ok := capacitySignals[scope]
+	capacityMu.Unlock()
+	if ok && time.Since(cached.checked) < capacitySignalTTL {
+		return cached.pressure
+	}
+	var pressure string
+	var err error
+	switch mode {
+	case "pending-pods":
+		pressure, err = unschedulablePods(scope)
+	case "promql":
+		pressure, err = promQLPressure()
+	default:
+		err = fmt.Errorf("unknown --capacity-check %s, expected off, pending-pods or promql", mode)
+	}
+	if err != nil {
+		// a failing signal mustn't hold the rollouts
+		logrus.Errorf("%s failed to check the cluster capacity, not deferring rollouts", err)
+	}
+	capacityMu.Lock()
+	capacitySignals[scope] = capacitySignal{pressure: pressure, checked: time.Now()}
+	capacityMu.Unlock()
+	return pressure
+}
+
+// unschedulablePods counts the Pending pods of scope the scheduler couldn't place,
+// more than capacity-max-pending is pressure
+func unschedulablePods(scope string) (string, error) {
+	pods, err := clientset().CoreV1().Pods(scope).List(context.Background(), metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("status.phase", string(corev1.PodPending)).String(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unschedulable := 0
+	for _, p := range pods.Items {
+		for _, c := range p.Status.Conditions {
+			if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse && c.Reason == corev1.PodReasonUnschedulable {
+				unschedulable++
+			}
+		}
+	}
+	if unschedulable <= viper.GetInt("capacity-max-pending") {
+		return "", nil
+	}
+	where := "the cluster"
+	if scope != "" {
+		where = "namespace " + scope
+	}
+	return fmt.Sprintf("%d unschedulable Pending pods in %s", unschedulable, where), nil
+}
+
+// promQLPressure runs capacity-promql, any sample above 0 is pressure
+func promQLPressure() (string, error) {
+	base, query := viper.GetString("capacity-prometheus-url"), viper.GetString("capacity-promql")
+	if base == "" || query == "" {
+		return "", fmt.Errorf("--capacity-check=promql needs --capacity-prometheus-url and --capacity-promql")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/api/v1/query?"+neturl.Values{"query": {query}}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("prometheus responded with %s", resp.Status)
+	}
+	var result struct {
+		Data struct {
+			Result []struct {
+				Value []interface{} `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	for _, r := range result.Data.Result {
+		if len(r.Value) != 2 {
+			continue
+		}
+		s, _ := r.Value[1].(string)
+		if v, err := strconv.ParseFloat(s, 64); err == nil && v > 0 {
+			return fmt.Sprintf("capacity query %s returned %s", query, s), nil
+		}
+	}
+	return "", nil
+}
+
+// reportPendingRollouts sets the pending rollouts gauge by reason
+func reportPendingRollouts() {
+	rolloutsMu.Lock()
+	queued := len(pendingBatches)
+	rolloutsMu.Unlock()
+	pauseMu.Lock()
+	parkedCount := len(parked)
+	pauseMu.Unlock()
+	capacityMu.Lock()
+	capacity := len(capacityDeferred)
+	capacityMu.Unlock()
+	pendingRolloutsGauge.WithLabelValues("parked").Set(float64(parkedCount))
+	pendingRolloutsGauge.WithLabelValues("capacity").Set(float64(capacity))
+	if queued -= parkedCount + capacity; queued < 0 {
+		queued = 0
+	}
+	pendingRolloutsGauge.WithLabelValues("queued").Set(float64(queued))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependsOnAnnotation declares the ConfigMaps and Secrets a config object is derived from, comma separated
+// kind/namespace/name or kind/name in its own namespace, e.g. configmap/pki/root-ca
+const dependsOnAnnotation = "cre.cnvrg.io/depends-on"
+
+// dependent is a watched config object declaring dependencies, the source its consumers are reloaded as
+type dependent struct {
+	src     Source
+	depends []string
+}
+
+// pendingCascade is a dependent waiting to change after one of its dependencies did
+type pendingCascade struct {
+	root  Source
+	chain []string
+	timer *time.Timer
+}
+
+var (
+	cascadeMu sync.Mutex
+	// dependents holds the config objects declaring dependencies, by source key
+	dependents = map[string]dependent{}
+	// pendingCascades holds the dependents whose consumers are reloaded once they change, or cascade-settle passed
+	pendingCascades = map[string]*pendingCascade{}
+)
+
+// parseDependsOn returns the source keys of the dependencies of an object of namespace ns
+func parseDependsOn(ns, annotation string) ([]string, error) {
+	var keys []string
+	for _, ref := range strings.Split(annotation, ",") {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		parts := strings.Split(ref, "/")
+		if len(parts) == 2 {
+			parts = []string{parts[0], ns, parts[1]}
+		}
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid dependency %q, expected kind/namespace/name or kind/name", ref)
+		}
+		var kind string
+		switch strings.ToLower(parts[0]) {
+		case "configmap", "cm":
+			kind = "ConfigMap"
+		case "secret":
+			kind = "Secret"
+		default:
+			return nil, fmt.Errorf("invalid dependency %q, expected a configmap or a secret", ref)
+		}
+		keys = append(keys, sourceKey(kind, parts[1], parts[2]))
+	}
+	return keys, nil
+}
+
+// indexDependencies records the dependencies an object declares with the depends-on annotation
+func indexDependencies(kind string, obj metav1.Object) {
+	key := sourceKey(kind, obj.GetNamespace(), obj.GetName())
+	annotation, ok := obj.GetAnnotations()[dependsOnAnnotation]
+	if !ok {
+		dropDependencies(kind, obj)
+		return
+	}
+	depends, err := parseDependsOn(obj.GetNamespace(), annotation)
+	if err != nil {
+		logrus.Errorf("%s, ignoring the dependencies of %s", err, key)
+		dropDependencies(kind, obj)
+		return
+	}
+	value, labeled := matchValue(obj)
+	cascadeMu.Lock()
+	defer cascadeMu.Unlock()
+	dependents[key] = dependent{
+		src: Source{
+			Kind:            kind,
+			Namespace:       obj.GetNamespace(),
+			Name:            obj.GetName(),
+			UID:             obj.GetUID(),
+			TargetNamespace: obj.GetAnnotations()[targetNamespaceAnnotation],
+			Unlabeled:       !labeled,
+			MatchLabelValue: value,
+		},
+		depends: depends,
+	}
+}
+
+func dropDependencies(kind string, obj metav1.Object) {
+	key := sourceKey(kind, obj.GetNamespace(), obj.GetName())
+	cascadeMu.Lock()
+	defer cascadeMu.Unlock()
+	delete(dependents, key)
+	if p := pendingCascades[key]; p != nil {
+		p.timer.Stop()
+		delete(pendingCascades, key)
+	}
+}
+
+// hasDependents tells if a watched object declares a dependency on the source, so its changes are cascaded
+// even when nothing consumes it directly
+func hasDependents(kind, ns, name string) bool {
+	key := sourceKey(kind, ns, name)
+	cascadeMu.Lock()
+	defer cascadeMu.Unlock()
+	for _, d := range dependents {
+		for _, dep := range d.depends {
+			if dep == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// joinCascade attaches a change of src to the cascade waiting for it, giving it the correlation id of the change
+// which started the cascade, and returns the chain of sources leading to src
+func joinCascade(src *Source) []string {
+	key := sourceKey(src.Kind, src.Namespace, src.Name)
+	cascadeMu.Lock()
+	p := pendingCascades[key]
+	delete(pendingCascades, key)
+	cascadeMu.Unlock()
+	if p == nil {
+		return []string{key}
+	}
+	p.timer.Stop()
+	chain := append(append([]string{}, p.chain...), key)
+	src.CorrelationID = p.root.CorrelationID
+	src.log().Infof("%s changed as part of the cascade %s", src, strings.Join(chain, " -> "))
+	traceDecision(*src, stageChange, "cascaded", nil, "cascade %s", strings.Join(chain, " -> "))
+	return chain
+}
+
+// cascade schedules the reload of the consumers of the objects depending on src, once they change themselves
+// or after cascade-settle, or cascade-timeout without a settle delay. The chain stops at cycles and cascade-max-depth.
+func cascade(src Source, chain []string) {
+	key := sourceKey(src.Kind, src.Namespace, src.Name)
+	cascadeMu.Lock()
+	var next []string
+	for dkey, d := range dependents {
+		for _, dep := range d.depends {
+			if dep == key {
+				next = append(next, dkey)
+			}
+		}
+	}
+	cascadeMu.Unlock()
+	if len(next) == 0 {
+		return
+	}
+	sort.Strings(next)
+	if max := viper.GetInt("cascade-max-depth"); max > 0 && len(chain) > max {
+		src.log().Warnf("cascade %s is deeper than --cascade-max-depth %d, not reloading the consumers of %s",
+			strings.Join(chain, " -> "), max, strings.Join(next, ", "))
+		return
+	}
+	delay, how := viper.GetDuration("cascade-settle"), "once it changes, or after the settle delay of"
+	if delay <= 0 {
+		delay, how = viper.GetDuration("cascade-timeout"), "once it changes, or at the latest after"
+	}
+	for _, dkey := range next {
+		if inChain(chain, dkey) {
+			src.log().Warnf("cascade %s -> %s is a cycle, stopping it", strings.Join(chain, " -> "), dkey)
+			continue
+		}
+		cascadeMu.Lock()
+		if _, waiting := pendingCascades[dkey]; waiting {
+			cascadeMu.Unlock()
+			continue
+		}
+		dkey := dkey
+		pendingCascades[dkey] = &pendingCascade{root: src, chain: chain, timer: time.AfterFunc(delay, func() { settleCascade(dkey) })}
+		cascadeMu.Unlock()
+		src.log().Infof("cascade %s -> %s, reloading its consumers %s %s", strings.Join(chain, " -> "), dkey, how, delay)
+		traceDecision(src, stageChange, "cascade", nil, "%s depends on %s, its consumers are reloaded %s %s", dkey, key, how, delay)
+	}
+}
+
+// settleCascade reloads the consumers of a dependent which didn't change within the cascade delay
+func settleCascade(key string) {
+	cascadeMu.Lock()
+	d, ok := dependents[key]
+	_, waiting := pendingCascades[key]
+	cascadeMu.Unlock()
+	if !waiting {
+		return
+	}
+	if !ok {
+		cascadeMu.Lock()
+		delete(pendingCascades, key)
+		cascadeMu.Unlock()
+		return
+	}
+	// the rollout joins the pending cascade, taking its correlation id and chain
+	rollout(d.src, d.src.MatchLabelValue)
+}
+
+func inChain(chain []string, key string) bool {
+	for _, k := range chain {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
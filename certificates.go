@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
+)
+
+var certificatesGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+// certificateNameAnnotation is set by cert-manager on the Secrets it issues
+const certificateNameAnnotation = "cert-manager.io/certificate-name"
+
+const certificateExpiryCheckInterval = time.Hour
+
+var (
+	certificatesMu    sync.Mutex
+	certificatesStore customResourceInformers
+)
+
+// CertificateInfo describes the certificate a cert-manager renewal put into a Secret
+type CertificateInfo struct {
+	Name     string    `json:"name"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// certificateInformer watches cert-manager Certificates, to restart consumers of a renewed
+// Secret only once the Certificate reports Ready for the new certificate
+func certificateInformer() {
+	if !viper.GetBool("watch-certificates") {
+		return
+	}
+	go warnExpiringCertificates()
+	informer := watchCustomResource(certificatesGVR, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			cert := newObj.(*unstructured.Unstructured)
+			releaseDeferredRollout(certificateKey(cert.GetNamespace(), cert.GetName()), func(d *deferredRollout) bool {
+				return d.src.Certificate != nil && certificateReady(cert, d.src.Certificate)
+			})
+		},
+	})
+	if informer == nil {
+		return
+	}
+	certificatesMu.Lock()
+	certificatesStore = informer
+	certificatesMu.Unlock()
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.Run(stopper)
+}
+
+func certificateKey(ns, name string) string {
+	return "Certificate " + ns + "/" + name
+}
+
+// certificateReady tells if the Certificate is Ready and its status matches info
+func certificateReady(cert *unstructured.Unstructured, info *CertificateInfo) bool {
+	if status, _, _, _ := statusCondition(cert, "Ready"); status != "True" {
+		return false
+	}
+	notAfter, _, _ := unstructured.NestedString(cert.Object, "status", "notAfter")
+	t, err := time.Parse(time.RFC3339, notAfter)
+	return err == nil && t.Equal(info.NotAfter.Truncate(time.Second))
+}
+
+// parseCertificate checks that tls.crt and tls.key of a TLS Secret form a pair and returns the leaf certificate
+func parseCertificate(s *corev1.Secret) (*x509.Certificate, error) {
+	if _, err := tls.X509KeyPair(s.Data[corev1.TLSCertKey], s.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(s.Data[corev1.TLSCertKey])
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", corev1.TLSCertKey)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certificateGate holds back the rollout of a Secret issued by cert-manager until the renewal completed,
+// that is tls.crt and tls.key form a pair again and the Certificate reports Ready for it.
+// When the rollout can go on, the new certificate is attached to src.
+func certificateGate(s *corev1.Secret, src *Source, matchLabelValue string) bool {
+	name := s.Annotations[certificateNameAnnotation]
+	if name == "" {
+		if owner := metav1.GetControllerOf(s); owner != nil && owner.Kind == "Certificate" {
+			name = owner.Name
+		}
+	}
+	certificatesMu.Lock()
+	store := certificatesStore
+	certificatesMu.Unlock()
+	if name == "" || store == nil {
+		return false
+	}
+	key := certificateKey(s.Namespace, name)
+	timeout := viper.GetDuration("certificate-renewal-timeout")
+	leaf, err := parseCertificate(s)
+	if err != nil {
+		src.log().Infof("%s is not a consistent key pair yet: %s", src, err)
+		deferRollout(key, *src, matchLabelValue, timeout)
+		return true
+	}
+	src.Certificate = &CertificateInfo{Name: name, Serial: leaf.SerialNumber.Text(16), NotAfter: leaf.NotAfter}
+	obj, exists, _ := store.GetByKey(s.Namespace + "/" + name)
+	if exists && !certificateReady(obj.(*unstructured.Unstructured), src.Certificate) {
+		deferRollout(key, *src, matchLabelValue, timeout)
+		return true
+	}
+	// The renewal completed, changes deferred while it was in progress are part of this rollout
+	if pending := takeDeferredRollout(key, func(d *deferredRollout) bool { return true }); pending != nil {
+		src.ChangedKeys = mergeKeys(pending.src.ChangedKeys, src.ChangedKeys)
+		src.CorrelationID = pending.src.CorrelationID
+	}
+	return false
+}
+
+// warnExpiringCertificates periodically warns about labeled TLS Secrets close to expiry,
+// which means the renewal didn't happen
+func warnExpiringCertificates() {
+	threshold := viper.GetDuration("certificate-expiry-warning")
+	if threshold <= 0 {
+		return
+	}
+	for {
+		checkExpiringCertificates(threshold)
+		time.Sleep(certificateExpiryCheckInterval)
+	}
+}
+
+func checkExpiringCertificates(threshold time.Duration) {
+	for _, ns := range watchedNamespaces() {
+		checkExpiringNamespace(ns, threshold)
+	}
+}
+
+func checkExpiringNamespace(ns string, threshold time.Duration) {
+	secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), metav1.ListOptions{
+		LabelSelector: viper.GetString("match-label"),
+		FieldSelector: "type=" + string(corev1.SecretTypeTLS),
+	})
+	if err != nil {
+		logrus.Errorf("%s failed to list TLS Secrets", err)
+		return
+	}
+	for i := range secrets.Items {
+		s := &secrets.Items[i]
+		leaf, err := parseCertificate(s)
+		if err != nil || time.Until(leaf.NotAfter) > threshold {
+			continue
+		}
+		msg := fmt.Sprintf("certificate expires at %s and wasn't renewed", leaf.NotAfter.Format(time.RFC3339))
+		logrus.Warnf("Secret %s/%s: %s", s.Namespace, s.Name, msg)
+		recordEvent(&corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Namespace:  s.Namespace,
+			Name:       s.Name,
+			UID:        s.UID,
+		}, corev1.EventTypeWarning, "CertificateExpiring", msg)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	cloudEventsStructured = "structured"
+	cloudEventsBinary     = "binary"
+	cloudEventsSpec       = "1.0"
+)
+
+// cloudEventsMode returns how outbound events are formatted, empty for the plain cre payload
+func cloudEventsMode() string {
+	return viper.GetString("cloudevents")
+}
+
+func validateCloudEvents() error {
+	switch cloudEventsMode() {
+	case "", cloudEventsStructured, cloudEventsBinary:
+	default:
+		return fmt.Errorf("unknown --cloudevents %q, expected structured|binary", cloudEventsMode())
+	}
+	for _, ext := range viper.GetStringSlice("cloudevents-extension") {
+		if !strings.Contains(ext, "=") {
+			return fmt.Errorf("invalid --cloudevents-extension %q, expected name=value", ext)
+		}
+	}
+	return nil
+}
+
+// cloudEventAttributes returns the context attributes of event, e.g.
+// type io.cnvrg.cre.rollout.completed, subject deployment/prod/web
+func cloudEventAttributes(event RolloutEvent) map[string]string {
+	attrs := map[string]string{
+		"specversion":     cloudEventsSpec,
+		"id":              string(uuid.NewUUID()),
+		"type":            viper.GetString("cloudevents-type-prefix") + "." + strings.Replace(string(event.Type), "-", ".", 1),
+		"source":          cloudEventsSource(),
+		"time":            event.Time.UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+		"subject":         cloudEventSubject(event),
+	}
+	if event.CorrelationID != "" {
+		attrs["correlationid"] = event.CorrelationID
+	}
+	for _, ext := range viper.GetStringSlice("cloudevents-extension") {
+		kv := strings.SplitN(ext, "=", 2)
+		attrs[strings.ToLower(kv[0])] = kv[1]
+	}
+	return attrs
+}
+
+func cloudEventsSource() string {
+	if source := viper.GetString("cloudevents-source"); source != "" {
+		return source
+	}
+	hostname, _ := os.Hostname()
+	return "/cre/" + hostname
+}
+
+// cloudEventSubject is the workload reference for single target events, the source otherwise
+func cloudEventSubject(event RolloutEvent) string {
+	if len(event.Targets) == 1 {
+		w := event.Targets[0]
+		return strings.ToLower(w.Kind) + "/" + w.Namespace + "/" + w.Name
+	}
+	return strings.ToLower(event.Source.Kind) + "/" + event.Source.Namespace + "/" + event.Source.Name
+}
+
+// structuredCloudEvent wraps the cre payload as the data of a structured mode CloudEvent
+func structuredCloudEvent(event RolloutEvent) ([]byte, error) {
+	ce := map[string]interface{}{}
+	for k, v := range cloudEventAttributes(event) {
+		ce[k] = v
+	}
+	ce["data"] = event
+	return json.Marshal(ce)
+}
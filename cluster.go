@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strings"
+)
+
+const (
+	// clusterAnnotation names the cluster of the cre instance which restarted a pod template
+	clusterAnnotation = "cre.cnvrg.io/reloader-cluster"
+	// clusterMetricLabel is the constant label of every metric, cluster is taken by the spoke metrics of hub mode
+	clusterMetricLabel = "cre_cluster"
+	// clusterNameKey of the --cluster-name-configmap
+	clusterNameKey = "cluster-name"
+)
+
+// setupClusterName detects the cluster name when --cluster-name isn't set, validates it
+// and adds it to every log line. It runs before anything logs, records or notifies.
+func setupClusterName() {
+	name, err := clusterName()
+	if err != nil {
+		logrus.Fatalf("%s failed to detect the cluster name", err)
+	}
+	if errs := validation.IsValidLabelValue(name); len(errs) > 0 {
+		logrus.Fatalf("invalid cluster name %q: %s", name, strings.Join(errs, ", "))
+	}
+	if name == "" {
+		return
+	}
+	viper.Set("cluster-name", name)
+	logrus.AddHook(clusterLogHook{name: name})
+	logrus.Infof("running in cluster %s", name)
+}
+
+// clusterName returns --cluster-name, or detects it with --cluster-name-detect
+func clusterName() (string, error) {
+	if name := viper.GetString("cluster-name"); name != "" {
+		return name, nil
+	}
+	switch mode := viper.GetString("cluster-name-detect"); mode {
+	case "", "off":
+		return "", nil
+	case "kube-system":
+		// the UID of kube-system lives as long as the cluster and is unique across clusters
+		ns, err := clientset().CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return string(ns.UID), nil
+	case "configmap":
+		ref := viper.GetString("cluster-name-configmap")
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("invalid --cluster-name-configmap %s, expected <namespace>/<name>", ref)
+		}
+		cm, err := clientset().CoreV1().ConfigMaps(parts[0]).Get(context.Background(), parts[1], metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		name := strings.TrimSpace(cm.Data[clusterNameKey])
+		if name == "" {
+			return "", fmt.Errorf("ConfigMap %s has no %s key", ref, clusterNameKey)
+		}
+		return name, nil
+	default:
+		return "", fmt.Errorf("unknown --cluster-name-detect %s, expected off, kube-system or configmap", mode)
+	}
+}
+
+// clusterLogHook adds the cluster field to every log line
+type clusterLogHook struct {
+	name string
+}
+
+func (h clusterLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h clusterLogHook) Fire(entry *logrus.Entry) error {
+	entry.Data["cluster"] = h.name
+	return nil
+}
+
+// clusterGatherer adds the cluster name as a constant label to the metrics gathered by g
+type clusterGatherer struct {
+	gatherer prometheus.Gatherer
+}
+
+func (g clusterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	cluster := viper.GetString("cluster-name")
+	if cluster == "" {
+		return families, err
+	}
+	name := clusterMetricLabel
+	for _, family := range families {
+		for _, m := range family.Metric {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &cluster})
+			sort.Slice(m.Label, func(i, j int) bool { return m.Label[i].GetName() < m.Label[j].GetName() })
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlEnabledKey of the control ConfigMap, "false" holds every rollout until it's "true" again or the ConfigMap is deleted
+const controlEnabledKey = "enabled"
+
+// controlTunables are the params the control ConfigMap may override at runtime, keyed by their flag name
+var controlTunables = []string{
+	"rollout-stagger",
+	"rollout-cooldown",
+	"max-batch-size",
+	"preflight-dry-run",
+	"dry-run",
+	"breaker-max-changes",
+	"breaker-window",
+	"breaker-drain-interval",
+}
+
+var (
+	controlMu sync.Mutex
+	// controlPresent tells the control ConfigMap exists, its keys only apply while it does
+	controlPresent  bool
+	controlDisabled bool
+	// controlOverrides holds the parsed overrides of the control ConfigMap, by flag name
+	controlOverrides = map[string]interface{}{}
+)
+
+// controlNamespace is the namespace of the control ConfigMap, the one cre runs in by default
+func controlNamespace() string {
+	if ns := viper.GetString("control-namespace"); ns != "" {
+		return ns
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "default"
+}
+
+// controlInformer watches the control ConfigMap, a kill switch and runtime overrides for incidents
+// which don't wait for a new rollout of cre itself
+func controlInformer() {
+	name := viper.GetString("control-configmap")
+	if name == "" {
+		return
+	}
+	ns := controlNamespace()
+	logrus.Infof("starting control ConfigMap Informer, watching %s/%s", ns, name)
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset(), 0, informers.WithNamespace(ns),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			applyControl(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			applyControl(newObj.(*corev1.ConfigMap))
+		},
+		DeleteFunc: func(obj interface{}) {
+			applyControl(nil)
+		},
+	})
+	informer.Run(stopper)
+}
+
+// applyControl applies the keys of the control ConfigMap, nil once it was deleted to revert to the flags.
+// Invalid values are logged and ignored, keeping the flag value.
+func applyControl(cm *corev1.ConfigMap) {
+	disabled := false
+	overrides := map[string]interface{}{}
+	if cm != nil {
+		for key, value := range cm.Data {
+			value = strings.TrimSpace(value)
+			if key == controlEnabledKey {
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					logrus.Errorf("%s failed to parse %s of the control ConfigMap %s/%s, rollouts stay enabled", err, key, cm.Namespace, cm.Name)
+					continue
+				}
+				disabled = !enabled
+				continue
+			}
+			parsed, err := parseTunable(key, value)
+			if err != nil {
+				logrus.Errorf("%s, ignoring %s of the control ConfigMap %s/%s", err, key, cm.Namespace, cm.Name)
+				continue
+			}
+			overrides[key] = parsed
+		}
+	}
+	controlMu.Lock()
+	wasDisabled := controlDisabled
+	controlPresent, controlDisabled, controlOverrides = cm != nil, disabled, overrides
+	controlMu.Unlock()
+	logControl(cm, disabled, overrides)
+	if wasDisabled && !disabled {
+		logrus.Warnf("rollouts enabled again by the control ConfigMap, applying %d queued rollouts", releaseParked("all"))
+	}
+}
+
+func logControl(cm *corev1.ConfigMap, disabled bool, overrides map[string]interface{}) {
+	if cm == nil {
+		logrus.Warn("control ConfigMap deleted, reverting to the flags")
+		return
+	}
+	var keys []string
+	for key := range overrides {
+		keys = append(keys, fmt.Sprintf("%s=%v", key, overrides[key]))
+	}
+	sort.Strings(keys)
+	state := "enabled"
+	if disabled {
+		state = "DISABLED, queued until enabled again"
+	}
+	if len(keys) == 0 {
+		keys = []string{"none"}
+	}
+	logrus.Warnf("control ConfigMap %s/%s applied: rollouts %s, overrides: %s", cm.Namespace, cm.Name, state, strings.Join(keys, ", "))
+}
+
+// parseTunable parses the override of a tunable to the type of its flag
+func parseTunable(key, value string) (interface{}, error) {
+	known := false
+	for _, t := range controlTunables {
+		known = known || t == key
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown key, expected %s or one of %s", controlEnabledKey, strings.Join(controlTunables, ", "))
+	}
+	for _, p := range rootParams {
+		if p.Name != key {
+			continue
+		}
+		switch p.Value.(type) {
+		case int:
+			return strconv.Atoi(value)
+		case bool:
+			return strconv.ParseBool(value)
+		case time.Duration:
+			return time.ParseDuration(value)
+		}
+	}
+	return nil, fmt.Errorf("%s can't be overridden", key)
+}
+
+// rolloutsDisabled tells if the control ConfigMap holds every rollout
+func rolloutsDisabled() bool {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	return controlDisabled
+}
+
+func controlOverride(key string) (interface{}, bool) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	value, ok := controlOverrides[key]
+	return value, ok
+}
+
+// tunableInt returns the param, overridden by the control ConfigMap when it sets it
+func tunableInt(key string) int {
+	if value, ok := controlOverride(key); ok {
+		return value.(int)
+	}
+	return viper.GetInt(key)
+}
+
+func tunableBool(key string) bool {
+	if value, ok := controlOverride(key); ok {
+		return value.(bool)
+	}
+	return viper.GetBool(key)
+}
+
+func tunableDuration(key string) time.Duration {
+	if value, ok := controlOverride(key); ok {
+		return value.(time.Duration)
+	}
+	return viper.GetDuration(key)
+}
+
+type controlState struct {
+	ControlConfigMap string            `json:"controlConfigMap,omitempty"`
+	Present          bool              `json:"present"`
+	RolloutsEnabled  bool              `json:"rolloutsEnabled"`
+	Overrides        map[string]string `json:"overrides"`
+	Effective        map[string]string `json:"effective"`
+}
+
+// debugConfigHandler serves the active overrides of the control ConfigMap and the effective value of every tunable
+func debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	state := controlState{Overrides: map[string]string{}, Effective: map[string]string{}}
+	if name := viper.GetString("control-configmap"); name != "" {
+		state.ControlConfigMap = controlNamespace() + "/" + name
+	}
+	controlMu.Lock()
+	state.Present, state.RolloutsEnabled = controlPresent, !controlDisabled
+	for key, value := range controlOverrides {
+		state.Overrides[key] = fmt.Sprint(value)
+	}
+	controlMu.Unlock()
+	for _, key := range controlTunables {
+		if value, ok := state.Overrides[key]; ok {
+			state.Effective[key] = value
+			continue
+		}
+		state.Effective[key] = fmt.Sprint(viper.Get(key))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		logrus.Errorf("%s failed to write the control state", err)
+	}
+}
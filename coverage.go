@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkOrphanLabel: the workload carries a match label value no ConfigMap or Secret restarting its namespace carries
+const checkOrphanLabel = "orphan-label"
+
+// coverageCmd reports the workloads whose labels won't restart them, or restart them on no change,
+// and exits 1 when there are any so CI can fail on regressions
+var coverageCmd = &cobra.Command{
+	Use:   "coverage",
+	Short: "report workloads whose reload labels don't match the ConfigMaps and Secrets they consume",
+	Run: func(cmd *cobra.Command, args []string) {
+		var namespaces []string
+		flag, _ := cmd.Flags().GetString("namespace")
+		for _, ns := range strings.Split(flag, ",") {
+			if ns = strings.TrimSpace(ns); ns != "" {
+				namespaces = append(namespaces, ns)
+			}
+		}
+		if len(namespaces) == 0 {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+		var gaps []coverageGap
+		for _, ns := range namespaces {
+			found, err := coverageReport(ns)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			gaps = append(gaps, found...)
+		}
+		if err := printCoverage(os.Stdout, gaps, viper.GetString("output")); err != nil {
+			logrus.Fatal(err)
+		}
+		if len(gaps) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// setupCoverageFlags adds the namespace filter of the report. It's local to the command, the root --namespace
+// being the watch scope of the controller, which switches to namespaced RBAC.
+func setupCoverageFlags() {
+	coverageCmd.Flags().StringP("namespace", "n", "", "namespace, or comma separated namespaces, to report the gaps of, all namespaces when empty")
+}
+
+var coverageGaps = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cre_coverage_gaps",
+	Help: "Workloads with a reload configuration gap at the last coverage sweep, by namespace and check (missing-label, label-mismatch, orphan-label)",
+}, []string{"namespace", "check"})
+
+func init() {
+	prometheus.MustRegister(coverageGaps)
+}
+
+// coverageGap is a workload which won't be restarted on the changes of a source it consumes,
+// or whose match label value restarts it on no change
+type coverageGap struct {
+	Check    string   `json:"check"`
+	Workload Workload `json:"workload"`
+	Message  string   `json:"message"`
+}
+
+// coveredWorkload is a workload with the metadata and pod spec the checks run on
+type coveredWorkload struct {
+	workload Workload
+	meta     metav1.ObjectMeta
+	spec     corev1.PodSpec
+}
+
+// coverageReport runs the checks of the validating webhook on the existing workloads of ns, all namespaces when empty,
+// plus the labeled workloads no labeled source restarts
+func coverageReport(ns string) ([]coverageGap, error) {
+	matchLabel := viper.GetString("match-label")
+	opts := metav1.ListOptions{LabelSelector: matchLabel}
+	// labeled sources by namespace and name, and the label values restarting each namespace
+	labeled := map[string]map[string]referencedSource{}
+	restarting := map[string]map[string]bool{}
+	add := func(src Source, labels map[string]string) {
+		key := src.Kind + "/" + src.Name
+		if labeled[src.Namespace] == nil {
+			labeled[src.Namespace] = map[string]referencedSource{}
+		}
+		labeled[src.Namespace][key] = referencedSource{kind: src.Kind, name: src.Name, labels: labels}
+		if restarting[src.RolloutNamespace()] == nil {
+			restarting[src.RolloutNamespace()] = map[string]bool{}
+		}
+		restarting[src.RolloutNamespace()][labels[matchLabel]] = true
+	}
+	configMaps, err := clientset().CoreV1().ConfigMaps(ns).List(context.Background(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list ConfigMaps", err)
+	}
+	for _, cm := range configMaps.Items {
+		add(Source{Kind: "ConfigMap", Namespace: cm.Namespace, Name: cm.Name, TargetNamespace: cm.Annotations[targetNamespaceAnnotation]}, cm.Labels)
+	}
+	secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list Secrets", err)
+	}
+	for _, s := range secrets.Items {
+		add(Source{Kind: "Secret", Namespace: s.Namespace, Name: s.Name, TargetNamespace: s.Annotations[targetNamespaceAnnotation]}, s.Labels)
+	}
+	workloads, err := coveredWorkloads(ns)
+	if err != nil {
+		return nil, err
+	}
+	var gaps []coverageGap
+	for _, cw := range workloads {
+		configMaps, secrets := podReferences(cw.spec)
+		var sources []referencedSource
+		for _, name := range sortedKeys(configMaps) {
+			if s, ok := labeled[cw.workload.Namespace]["ConfigMap/"+name]; ok {
+				sources = append(sources, s)
+			}
+		}
+		for _, name := range sortedKeys(secrets) {
+			if s, ok := labeled[cw.workload.Namespace]["Secret/"+name]; ok {
+				sources = append(sources, s)
+			}
+		}
+		// only labeled sources are looked up, unlabeled-sources is covered by orphan-label
+		for _, f := range validateWorkload(cw.workload.String(), cw.meta, cw.spec, sources) {
+			gaps = append(gaps, coverageGap{Check: f.check, Workload: cw.workload, Message: f.message})
+		}
+		if value, ok := cw.meta.Labels[matchLabel]; ok && !restarting[cw.workload.Namespace][value] {
+			gaps = append(gaps, coverageGap{Check: checkOrphanLabel, Workload: cw.workload, Message: fmt.Sprintf(
+				"%s is labeled %s=%s, but no ConfigMap or Secret restarting namespace %s is, it's restarted on no change",
+				cw.workload, matchLabel, value, cw.workload.Namespace)})
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool { return gaps[i].Workload.String() < gaps[j].Workload.String() })
+	return gaps, nil
+}
+
+// coveredWorkloads lists the Deployments, StatefulSets and DaemonSets of ns, labeled or not
+func coveredWorkloads(ns string) ([]coveredWorkload, error) {
+	apps := clientset().AppsV1()
+	var workloads []coveredWorkload
+	deployments, err := apps.Deployments(ns).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list Deployments", err)
+	}
+	for _, d := range deployments.Items {
+		workloads = append(workloads, coveredWorkload{Workload{Kind: "Deployment", Namespace: d.Namespace, Name: d.Name}, d.ObjectMeta, d.Spec.Template.Spec})
+	}
+	statefulSets, err := apps.StatefulSets(ns).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list StatefulSets", err)
+	}
+	for _, s := range statefulSets.Items {
+		workloads = append(workloads, coveredWorkload{Workload{Kind: "StatefulSet", Namespace: s.Namespace, Name: s.Name}, s.ObjectMeta, s.Spec.Template.Spec})
+	}
+	daemonSets, err := apps.DaemonSets(ns).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list DaemonSets", err)
+	}
+	for _, d := range daemonSets.Items {
+		workloads = append(workloads, coveredWorkload{Workload{Kind: "DaemonSet", Namespace: d.Namespace, Name: d.Name}, d.ObjectMeta, d.Spec.Template.Spec})
+	}
+	return workloads, nil
+}
+
+func printCoverage(out io.Writer, gaps []coverageGap, format string) error {
+	if format == "json" {
+		if gaps == nil {
+			gaps = []coverageGap{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(gaps)
+	}
+	if len(gaps) == 0 {
+		fmt.Fprintln(out, "no coverage gaps")
+		return nil
+	}
+	for _, g := range gaps {
+		fmt.Fprintf(out, "%-15s  %s\n", g.Check, g.Message)
+	}
+	return nil
+}
+
+// coverageSweep reports the coverage gaps every coverage-interval, as metrics, and logs and Warning events
+// on the workloads for the gaps not seen at the previous sweep
+func coverageSweep() {
+	interval := viper.GetDuration("coverage-interval")
+	if interval <= 0 {
+		return
+	}
+	reported := map[string]bool{}
+	for {
+		var gaps []coverageGap
+		var err error
+		for _, ns := range watchedNamespaces() {
+			var found []coverageGap
+			if found, err = coverageReport(ns); err != nil {
+				break
+			}
+			gaps = append(gaps, found...)
+		}
+		if err != nil {
+			logrus.Errorf("%s, coverage sweep failed", err)
+		} else {
+			coverageGaps.Reset()
+			current := map[string]bool{}
+			for _, g := range gaps {
+				coverageGaps.WithLabelValues(g.Workload.Namespace, g.Check).Inc()
+				key := g.Check + " " + g.Message
+				current[key] = true
+				if reported[key] {
+					continue
+				}
+				logrus.Warnf("coverage gap: %s", g.Message)
+				recordCorrelatedEvent(workloadRef(g.Workload), Source{}, corev1.EventTypeWarning, "ReloadCoverageGap", g.Message)
+			}
+			reported = current
+		}
+		time.Sleep(interval)
+	}
+}
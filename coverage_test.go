@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestCoverageNamespaceIsLocal(t *testing.T) {
+	setFlags(t, map[string]interface{}{"namespace": ""})
+	flags := coverageCmd.Flags()
+	previous, _ := flags.GetString("namespace")
+	t.Cleanup(func() { flags.Set("namespace", previous) })
+	if err := coverageCmd.ParseFlags([]string{"-n", "team-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ns, _ := flags.GetString("namespace"); ns != "team-a" {
+		t.Fatalf("expected the namespace of the report team-a, got %q", ns)
+	}
+	// the watch scope of the controller, switching it to namespaced RBAC, is left alone
+	if ns := viper.GetString("namespace"); ns != "" {
+		t.Fatalf("expected the root --namespace unset by cre coverage -n, got %q", ns)
+	}
+}
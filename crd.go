@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+)
+
+var (
+	servedMu sync.Mutex
+	served   = map[schema.GroupVersionResource]bool{}
+)
+
+// resourceServed tells if the API server serves gvr, custom resources of integrations
+// are optional and skipped on clusters without the CRD. The answer is cached.
+func resourceServed(gvr schema.GroupVersionResource) bool {
+	servedMu.Lock()
+	defer servedMu.Unlock()
+	if ok, cached := served[gvr]; cached {
+		return ok
+	}
+	served[gvr] = discoverResource(gvr)
+	return served[gvr]
+}
+
+func discoverResource(gvr schema.GroupVersionResource) bool {
+	resources, err := clientset().Discovery().ServerResourcesForGroupVersion(gvr.GroupVersion().String())
+	if err != nil {
+		logrus.Debugf("%s failed to discover %s", err, gvr.GroupVersion())
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == gvr.Resource {
+			return true
+		}
+	}
+	return false
+}
+
+// getCustomResource gets a single custom resource, nil when its CRD isn't served
+func getCustomResource(gvr schema.GroupVersionResource, ns, name string) (*unstructured.Unstructured, error) {
+	if !resourceServed(gvr) {
+		return nil, nil
+	}
+	return dynamicClient().Resource(gvr).Namespace(ns).Get(context.Background(), name, metav1.GetOptions{})
+}
+
+// customResourceInformers are the informers of a custom resource in each watched namespace
+type customResourceInformers []cache.SharedIndexInformer
+
+// watchCustomResource builds an informer of gvr in each watched namespace, like runSourceInformers, so --namespaces
+// only needs namespaced RBAC, handing *unstructured.Unstructured objects to handler.
+// It returns nil when gvr isn't served, the caller runs the informers otherwise.
+func watchCustomResource(gvr schema.GroupVersionResource, handler cache.ResourceEventHandler) customResourceInformers {
+	if !resourceServed(gvr) {
+		logrus.Warnf("%s isn't served by the cluster, not watching it", gvr)
+		return nil
+	}
+	logrus.Infof("starting %s Informer", gvr)
+	var informers customResourceInformers
+	for _, ns := range watchedNamespaces() {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient(), 0, ns, nil)
+		informer := factory.ForResource(gvr).Informer()
+		informer.AddEventHandler(handler)
+		informers = append(informers, informer)
+	}
+	return informers
+}
+
+// Run runs the informers until stopCh is closed
+func (c customResourceInformers) Run(stopCh <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, informer := range c {
+		wg.Add(1)
+		go func(informer cache.SharedIndexInformer) {
+			defer wg.Done()
+			informer.Run(stopCh)
+		}(informer)
+	}
+	wg.Wait()
+}
+
+// HasSynced tells if all the informers synced
+func (c customResourceInformers) HasSynced() bool {
+	for _, informer := range c {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// GetByKey gets the <namespace>/<name> object from the store of the informer of its namespace
+func (c customResourceInformers) GetByKey(key string) (interface{}, bool, error) {
+	for _, informer := range c {
+		if obj, exists, err := informer.GetStore().GetByKey(key); exists || err != nil {
+			return obj, exists, err
+		}
+	}
+	return nil, false, nil
+}
+
+// statusCondition returns the status, reason and message of the conditionType condition of obj
+func statusCondition(obj *unstructured.Unstructured, conditionType string) (status, reason, message string, found bool) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		status, _ = condition["status"].(string)
+		reason, _ = condition["reason"].(string)
+		message, _ = condition["message"].(string)
+		return status, reason, message, true
+	}
+	return "", "", "", false
+}
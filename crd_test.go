@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"testing"
+	"time"
+)
+
+// namespacedDynamicClient makes a fake dynamic client holding objects the dynamic client of cre for the test,
+// denying cluster wide lists and watches like the RBAC of --namespace does
+func namespacedDynamicClient(t *testing.T, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		reloadPoliciesGVR: "ReloadPolicyList",
+		reloadEventsGVR:   "ReloadEventList",
+	}, objects...)
+	forbidden := func(action k8stesting.Action) error {
+		gvr := action.GetResource()
+		return apierrors.NewForbidden(gvr.GroupResource(), "", fmt.Errorf("cannot %s %s at the cluster scope", action.GetVerb(), gvr.Resource))
+	}
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == metav1.NamespaceAll {
+			t.Errorf("listed %s at the cluster scope", action.GetResource().Resource)
+			return true, nil, forbidden(action)
+		}
+		return false, nil, nil
+	})
+	client.PrependWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if action.GetNamespace() == metav1.NamespaceAll {
+			t.Errorf("watched %s at the cluster scope", action.GetResource().Resource)
+			return true, nil, forbidden(action)
+		}
+		return false, nil, nil
+	})
+	clientsOnce.Do(func() {})
+	previous := sharedDynamicClient
+	sharedDynamicClient = client
+	t.Cleanup(func() { sharedDynamicClient = previous })
+	return client
+}
+
+func customResource(gvr schema.GroupVersionResource, kind, ns, name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(gvr.GroupVersion().String())
+	u.SetKind(kind)
+	u.SetNamespace(ns)
+	u.SetName(name)
+	return u
+}
+
+func TestCustomResourcesAreWatchedPerNamespace(t *testing.T) {
+	serveResources(t, fakeClientset(t), reloadPoliciesGVR)
+	namespacedDynamicClient(t,
+		customResource(reloadPoliciesGVR, "ReloadPolicy", "team-a", "web"),
+		customResource(reloadPoliciesGVR, "ReloadPolicy", "team-b", "db"),
+		customResource(reloadPoliciesGVR, "ReloadPolicy", "other", "unwatched"),
+	)
+	setFlags(t, map[string]interface{}{"namespace": "team-a,team-b", "namespaces": []string{}})
+	var mu sync.Mutex
+	added := map[string]bool{}
+	informers := watchCustomResource(reloadPoliciesGVR, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			u := obj.(*unstructured.Unstructured)
+			mu.Lock()
+			added[u.GetNamespace()+"/"+u.GetName()] = true
+			mu.Unlock()
+		},
+	})
+	if len(informers) != 2 {
+		t.Fatalf("expected an informer per watched namespace, got %d", len(informers))
+	}
+	stopper := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		informers.Run(stopper)
+		close(stopped)
+	}()
+	defer func() {
+		close(stopper)
+		<-stopped
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !informers.HasSynced() {
+		if time.Now().After(deadline) {
+			t.Fatal("the namespaced informers didn't sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(added) != 2 || !added["team-a/web"] || !added["team-b/db"] {
+		t.Fatalf("expected the ReloadPolicies of the watched namespaces, got %v", added)
+	}
+	if _, exists, _ := informers.GetByKey("team-b/db"); !exists {
+		t.Fatal("expected the ReloadPolicy found in the store of its namespace")
+	}
+	if _, exists, _ := informers.GetByKey("other/unwatched"); exists {
+		t.Fatal("expected the ReloadPolicy of an unwatched namespace not cached")
+	}
+}
+
+func TestReloadEventsArePrunedPerNamespace(t *testing.T) {
+	old := customResource(reloadEventsGVR, "ReloadEvent", "team-a", "old")
+	old.SetCreationTimestamp(metav1.NewTime(time.Now().Add(-2 * time.Hour)))
+	recent := customResource(reloadEventsGVR, "ReloadEvent", "team-a", "recent")
+	recent.SetCreationTimestamp(metav1.Now())
+	client := namespacedDynamicClient(t, old, recent)
+	setFlags(t, map[string]interface{}{"namespace": "team-a", "namespaces": []string{}})
+	pruneReloadEventsOnce(time.Hour, 0)
+	if _, err := client.Resource(reloadEventsGVR).Namespace("team-a").Get(context.Background(), "old", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the expired ReloadEvent pruned, got %v", err)
+	}
+	if _, err := client.Resource(reloadEventsGVR).Namespace("team-a").Get(context.Background(), "recent", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the recent ReloadEvent kept, got %v", err)
+	}
+}
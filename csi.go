@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var secretProviderClassPodStatusesGVR = schema.GroupVersionResource{
+	Group:    "secrets-store.csi.x-k8s.io",
+	Version:  "v1",
+	Resource: "secretproviderclasspodstatuses",
+}
+
+var (
+	csiRotationsMu sync.Mutex
+	// csiRotations holds the object versions last rolled out per workload and SecretProviderClass,
+	// the pods of a workload all report the same rotation
+	csiRotations = map[string]string{}
+)
+
+// csiInformer watches SecretProviderClassPodStatuses of the secrets store CSI driver, to restart the
+// labeled workloads of pods which mounted objects were rotated, even when syncSecret is disabled
+func csiInformer() {
+	if !viper.GetBool("watch-csi-rotations") {
+		return
+	}
+	if !resourceServed(secretProviderClassPodStatusesGVR) {
+		logrus.Infof("secrets store CSI driver isn't installed, not watching rotations")
+		return
+	}
+	informer := watchCustomResource(secretProviderClassPodStatusesGVR, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldO := oldObj.(*unstructured.Unstructured)
+			newO := newObj.(*unstructured.Unstructured)
+			oldVersions, newVersions := csiObjectVersions(oldO), csiObjectVersions(newO)
+			if len(oldVersions) == 0 || reflect.DeepEqual(oldVersions, newVersions) {
+				return
+			}
+			csiRotated(newO, changedKeys(oldVersions, newVersions), newVersions)
+		},
+	})
+	if informer == nil {
+		return
+	}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.Run(stopper)
+}
+
+// csiObjectVersions returns the version of every mounted object by its id
+func csiObjectVersions(status *unstructured.Unstructured) map[string]string {
+	objects, _, _ := unstructured.NestedSlice(status.Object, "status", "objects")
+	versions := map[string]string{}
+	for _, o := range objects {
+		object, ok := o.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := object["id"].(string)
+		version, _ := object["version"].(string)
+		versions[id] = version
+	}
+	return versions
+}
+
+func csiRotated(status *unstructured.Unstructured, changed []string, versions map[string]string) {
+	ns := status.GetNamespace()
+	podName, _, _ := unstructured.NestedString(status.Object, "status", "podName")
+	spc, _, _ := unstructured.NestedString(status.Object, "status", "secretProviderClassName")
+	w, labels, err := podWorkload(ns, podName)
+	if err != nil {
+		logrus.Debugf("%s failed to find the workload of pod %s/%s", err, ns, podName)
+		return
+	}
+	if _, ok := labels[viper.GetString("match-label")]; !ok {
+		return
+	}
+	var fingerprint []string
+	for id, version := range versions {
+		fingerprint = append(fingerprint, id+"="+version)
+	}
+	sort.Strings(fingerprint)
+	key := w.String() + " " + spc
+	csiRotationsMu.Lock()
+	seen := csiRotations[key] == strings.Join(fingerprint, ",")
+	csiRotations[key] = strings.Join(fingerprint, ",")
+	csiRotationsMu.Unlock()
+	if seen {
+		return
+	}
+	logrus.Infof("SecretProviderClass %s/%s rotated %s mounted by %s", ns, spc, strings.Join(changed, ", "), w)
+	src := Source{
+		Kind:          "SecretProviderClass",
+		Namespace:     ns,
+		Name:          spc,
+		ChangedKeys:   changed,
+		CorrelationID: string(uuid.NewUUID()),
+	}
+	notify(RolloutEvent{Type: EventRolloutMatched, Source: src, Outcome: "matched"})
+	enqueueRollouts(src, capableTargets(src, []Workload{w}))
+}
+
+// podWorkload follows the owner references of a pod up to its Deployment, StatefulSet or DaemonSet
+// and returns it with its labels
+func podWorkload(ns, podName string) (Workload, map[string]string, error) {
+	clientset := clientset()
+	pod, err := clientset.CoreV1().Pods(ns).Get(context.Background(), podName, metav1.GetOptions{})
+	if err != nil {
+		return Workload{}, nil, err
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return Workload{}, nil, fmt.Errorf("pod has no controller")
+	}
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, err := clientset.AppsV1().ReplicaSets(ns).Get(context.Background(), owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return Workload{}, nil, err
+		}
+		deploymentOwner := metav1.GetControllerOf(rs)
+		if deploymentOwner == nil || deploymentOwner.Kind != "Deployment" {
+			return Workload{}, nil, fmt.Errorf("ReplicaSet %s isn't controlled by a Deployment", rs.Name)
+		}
+		d, err := clientset.AppsV1().Deployments(ns).Get(context.Background(), deploymentOwner.Name, metav1.GetOptions{})
+		if err != nil {
+			return Workload{}, nil, err
+		}
+		return Workload{Kind: "Deployment", Namespace: ns, Name: d.Name}, d.Labels, nil
+	case "StatefulSet":
+		s, err := clientset.AppsV1().StatefulSets(ns).Get(context.Background(), owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return Workload{}, nil, err
+		}
+		return Workload{Kind: "StatefulSet", Namespace: ns, Name: s.Name}, s.Labels, nil
+	case "DaemonSet":
+		d, err := clientset.AppsV1().DaemonSets(ns).Get(context.Background(), owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return Workload{}, nil, err
+		}
+		return Workload{Kind: "DaemonSet", Namespace: ns, Name: d.Name}, d.Labels, nil
+	}
+	return Workload{}, nil, fmt.Errorf("unsupported pod controller kind %s", owner.Kind)
+}
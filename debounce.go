@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"sync"
+	"time"
+)
+
+// debouncedChange is a source change waiting for debounce without another change of the same source.
+// base are the data hashes before its first change, last the ones of its last change.
+type debouncedChange struct {
+	src             Source
+	matchLabelValue string
+	timer           *time.Timer
+	changes         int
+	base, last      map[string]string
+}
+
+var (
+	debounceMu sync.Mutex
+	// debounced holds the changes waiting to be rolled out, by source key
+	debounced = map[string]*debouncedChange{}
+)
+
+// debounceRollout rolls out src once debounce passed without another change of it, e.g. a helm upgrade
+// patching keys one at a time. Each change resets the timer, the rollout carries the keys of all of them
+// and the correlation id of the first one. old and new are the data of the change, the data before the first
+// change is compared with the last seen so keys changed back meanwhile aren't rolled out.
+// Without debounce the rollout starts right away.
+func debounceRollout(src Source, matchLabelValue string, old, new map[string][]byte) {
+	window := viper.GetDuration("debounce")
+	if window <= 0 {
+		rollout(src, matchLabelValue)
+		return
+	}
+	key := sourceKey(src.Kind, src.Namespace, src.Name)
+	debounceMu.Lock()
+	defer debounceMu.Unlock()
+	if pending, ok := debounced[key]; ok {
+		pending.timer.Stop()
+		keys := mergeKeys(pending.src.ChangedKeys, src.ChangedKeys)
+		correlationID := pending.src.CorrelationID
+		pending.src = src
+		pending.src.ChangedKeys = keys
+		pending.src.CorrelationID = correlationID
+		pending.matchLabelValue = matchLabelValue
+		pending.last = hashData(new)
+		pending.changes++
+		changes := pending.changes
+		pending.timer = time.AfterFunc(window, func() { fireDebounced(key, changes) })
+		src.log().Infof("%s changed again within %s, debouncing its rollout", src, window)
+		traceDecision(pending.src, stageChange, "debounced", nil, "changed again within --debounce %s, %d changes so far", window, pending.changes)
+		return
+	}
+	src.log().Infof("debouncing rollout of %s for %s", src, window)
+	traceDecision(src, stageChange, "debounced", nil, "rolled out once it didn't change for %s", window)
+	debounced[key] = &debouncedChange{src: src, matchLabelValue: matchLabelValue, changes: 1, base: hashData(old), last: hashData(new),
+		timer: time.AfterFunc(window, func() { fireDebounced(key, 1) })}
+}
+
+// fireDebounced rolls out the debounced change of key, unless it changed again since the timer of its changes-th change was set
+func fireDebounced(key string, changes int) {
+	debounceMu.Lock()
+	pending := debounced[key]
+	if pending == nil || pending.changes != changes {
+		debounceMu.Unlock()
+		return
+	}
+	delete(debounced, key)
+	debounceMu.Unlock()
+	if pending.changes > 1 {
+		var keys []string
+		for _, k := range pending.src.ChangedKeys {
+			if pending.base[k] != pending.last[k] {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			pending.src.log().Infof("%s changed back within %d changes, nothing to rollout", pending.src, pending.changes)
+			traceDecision(pending.src, stageChange, "reverted", nil, "its last seen data equals the data before its first change")
+			return
+		}
+		pending.src.ChangedKeys = keys
+		pending.src.log().Infof("rolling out %d changes of %s at once", pending.changes, pending.src)
+	}
+	rollout(pending.src, pending.matchLabelValue)
+}
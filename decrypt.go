@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// plaintextChanges narrows the changed keys of a Secret down to the ones which plaintext changed,
+// by running decrypt-command on both values of each key. Keys failing to decrypt are kept as changed.
+// Decrypted values are only compared, never logged.
+func plaintextChanges(ns, name string, old, new map[string][]byte, keys []string) []string {
+	if viper.GetString("decrypt-command") == "" {
+		return keys
+	}
+	var changed []string
+	for _, key := range keys {
+		oldValue, oldOk := old[key]
+		newValue, newOk := new[key]
+		if !oldOk || !newOk {
+			changed = append(changed, key)
+			continue
+		}
+		oldPlain, err := decrypt(ns, name, key, oldValue)
+		if err == nil {
+			var newPlain []byte
+			if newPlain, err = decrypt(ns, name, key, newValue); err == nil && bytes.Equal(oldPlain, newPlain) {
+				logrus.Debugf("key %s of Secret %s/%s was re-encrypted, its plaintext didn't change", key, ns, name)
+				continue
+			}
+		}
+		if err != nil {
+			logrus.Warnf("failed to decrypt key %s of Secret %s/%s, treating it as changed: %s", key, ns, name, err)
+		}
+		changed = append(changed, key)
+	}
+	return changed
+}
+
+// decrypt pipes value into decrypt-command and returns its output,
+// the command learns what it decrypts from the CRE_SECRET_* env
+func decrypt(ns, name, key string, value []byte) ([]byte, error) {
+	args := strings.Fields(viper.GetString("decrypt-command"))
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("decrypt-timeout"))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(value)
+	cmd.Env = append(os.Environ(),
+		"CRE_SECRET_NAMESPACE="+ns,
+		"CRE_SECRET_NAME="+name,
+		"CRE_SECRET_KEY="+key,
+	)
+	// stderr is dropped, it may echo the plaintext
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("decrypt command timed out after %s", viper.GetDuration("decrypt-timeout"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decrypt command failed: %s", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// stubDecrypt makes a decrypt-command running script for the test
+func stubDecrypt(t *testing.T, script string) {
+	t.Helper()
+	command := filepath.Join(t.TempDir(), "decrypt")
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, map[string]interface{}{"decrypt-command": command, "decrypt-timeout": time.Second})
+}
+
+func TestReencryptedKeysAreUnchanged(t *testing.T) {
+	// the stub ciphertext is <key version>:<plaintext>
+	stubDecrypt(t, "cut -d: -f2")
+	old := map[string][]byte{"password": []byte("v1:secret"), "token": []byte("v1:abc")}
+	new := map[string][]byte{"password": []byte("v2:secret"), "token": []byte("v2:xyz"), "user": []byte("v2:cre")}
+	changed := plaintextChanges("apps", "creds", old, new, changedSecretKeys(old, new))
+	if !reflect.DeepEqual(changed, []string{"token", "user"}) {
+		t.Fatalf("expected the plaintext changes of token and user, got %v", changed)
+	}
+}
+
+func TestUndecryptableKeysAreChanged(t *testing.T) {
+	stubDecrypt(t, "exit 1")
+	old, new := map[string][]byte{"password": []byte("v1:secret")}, map[string][]byte{"password": []byte("v2:secret")}
+	if changed := plaintextChanges("apps", "creds", old, new, []string{"password"}); !reflect.DeepEqual(changed, []string{"password"}) {
+		t.Fatalf("expected the failed key kept as changed, got %v", changed)
+	}
+}
+
+func TestDecryptTimesOut(t *testing.T) {
+	stubDecrypt(t, "exec sleep 5")
+	setFlags(t, map[string]interface{}{"decrypt-timeout": 100 * time.Millisecond})
+	started := time.Now()
+	if _, err := decrypt("apps", "creds", "password", []byte("v1:secret")); err == nil {
+		t.Fatal("expected the slow decrypt command to time out")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("the decrypt command ran for %s past its timeout", elapsed)
+	}
+}
+
+func TestDecryptSeesTheSecretKey(t *testing.T) {
+	stubDecrypt(t, `echo -n "$CRE_SECRET_NAMESPACE/$CRE_SECRET_NAME/$CRE_SECRET_KEY"`)
+	plain, err := decrypt("apps", "creds", "password", []byte("v1:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "apps/creds/password" {
+		t.Fatalf("expected the command to learn the key it decrypts, got %q", plain)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	deferredMu sync.Mutex
+	// deferredRollouts holds rollouts waiting on another object, e.g. a Secret on its ExternalSecret to be synced
+	deferredRollouts = map[string]*deferredRollout{}
+)
+
+type deferredRollout struct {
+	src             Source
+	matchLabelValue string
+	// changedAt is when the first deferred change was seen
+	changedAt time.Time
+}
+
+// deferRollout holds back the rollout of src until it's released under key. Changes deferred meanwhile
+// are merged into a single rollout keeping the first correlation id, and after timeout the rollout runs anyway.
+func deferRollout(key string, src Source, matchLabelValue string, timeout time.Duration) {
+	deferredMu.Lock()
+	defer deferredMu.Unlock()
+	if pending, ok := deferredRollouts[key]; ok {
+		keys := mergeKeys(pending.src.ChangedKeys, src.ChangedKeys)
+		correlationID := pending.src.CorrelationID
+		pending.src = src
+		pending.src.ChangedKeys = keys
+		pending.src.CorrelationID = correlationID
+		pending.matchLabelValue = matchLabelValue
+		src.log().Infof("%s changed again while its rollout is deferred on %s", src, key)
+		traceDecision(pending.src, stageGuard, "merged", nil, "changed again while deferred on %s", key)
+		return
+	}
+	src.log().Infof("deferring rollout of %s on %s", src, key)
+	traceDecision(src, stageGuard, "deferred", nil, "waiting on %s, for up to %s", key, timeout)
+	pending := &deferredRollout{src: src, matchLabelValue: matchLabelValue, changedAt: time.Now()}
+	deferredRollouts[key] = pending
+	time.AfterFunc(timeout, func() {
+		if d := takeDeferredRollout(key, func(d *deferredRollout) bool { return d == pending }); d != nil {
+			d.src.log().Warnf("%s wasn't released within %s, rolling out %s anyway", key, timeout, d.src)
+			traceDecision(d.src, stageGuard, "timed-out", nil, "%s wasn't released within %s, rolling out anyway", key, timeout)
+			rollout(d.src, d.matchLabelValue)
+		}
+	})
+}
+
+// takeDeferredRollout removes and returns the deferred rollout of key if ready accepts it
+func takeDeferredRollout(key string, ready func(d *deferredRollout) bool) *deferredRollout {
+	deferredMu.Lock()
+	defer deferredMu.Unlock()
+	pending, ok := deferredRollouts[key]
+	if !ok || !ready(pending) {
+		return nil
+	}
+	delete(deferredRollouts, key)
+	return pending
+}
+
+// releaseDeferredRollout runs the deferred rollout of key if ready accepts it
+func releaseDeferredRollout(key string, ready func(d *deferredRollout) bool) {
+	if pending := takeDeferredRollout(key, ready); pending != nil {
+		pending.src.log().Infof("%s released, rolling out %s", key, pending.src)
+		traceDecision(pending.src, stageGuard, "released", nil, "%s released", key)
+		rollout(pending.src, pending.matchLabelValue)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"sort"
+)
+
+var doctorParams = []Param{
+	{Name: "doctor-namespace", Shorthand: "", Value: "", Usage: "namespace to check sources and workloads in, all namespaces when empty"},
+}
+
+// doctorCmd runs the checks answering "why isn't it working?", from API access to sources nothing would restart
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "check access, sources and workloads for likely misconfigurations",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !doctor(os.Stdout, viper.GetString("doctor-namespace")) {
+			os.Exit(1)
+		}
+	},
+}
+
+type checkSeverity int
+
+const (
+	checkOK checkSeverity = iota
+	checkWarning
+	checkCritical
+)
+
+func (s checkSeverity) String() string {
+	switch s {
+	case checkCritical:
+		return "CRITICAL"
+	case checkWarning:
+		return "WARNING"
+	default:
+		return "OK"
+	}
+}
+
+type accessCheck struct {
+	group, resource, verb string
+}
+
+type checkResult struct {
+	severity checkSeverity
+	message  string
+}
+
+// doctor prints the report, most severe findings first, and returns false when a critical check failed
+func doctor(out io.Writer, ns string) bool {
+	var results []checkResult
+	report := func(severity checkSeverity, format string, args ...interface{}) {
+		results = append(results, checkResult{severity: severity, message: fmt.Sprintf(format, args...)})
+	}
+	defer func() {
+		sort.SliceStable(results, func(i, j int) bool { return results[i].severity > results[j].severity })
+		for _, r := range results {
+			fmt.Fprintf(out, "%-8s  %s\n", r.severity, r.message)
+		}
+	}()
+
+	version, err := clientset().Discovery().ServerVersion()
+	if err != nil {
+		report(checkCritical, "API server unreachable: %s", err)
+		return false
+	}
+	report(checkOK, "connected to the API server, version %s", version.GitVersion)
+
+	critical := false
+	required := []accessCheck{
+		{"", "configmaps", "list"}, {"", "configmaps", "watch"},
+		{"", "secrets", "list"}, {"", "secrets", "watch"},
+	}
+	for _, resource := range workloadResources {
+		required = append(required, accessCheck{workloadGroup(resource), resource, "list"}, accessCheck{workloadGroup(resource), resource, "patch"})
+	}
+	if viper.GetBool("record-events") {
+		required = append(required, accessCheck{"", "events", "create"})
+	}
+	scope := "all namespaces"
+	if ns != "" {
+		scope = "namespace " + ns
+	}
+	for _, r := range required {
+		allowed, err := canI(ns, r.group, r.resource, r.verb)
+		switch {
+		case err != nil:
+			report(checkCritical, "failed to review access to %s %s: %s", r.verb, r.resource, err)
+			critical = true
+		case !allowed:
+			severity := checkCritical
+			if r.resource == "events" {
+				severity = checkWarning
+			}
+			report(severity, "not allowed to %s %s in %s", r.verb, r.resource, scope)
+			critical = critical || severity == checkCritical
+		}
+	}
+	if !critical {
+		report(checkOK, "allowed to watch sources and restart workloads in %s", scope)
+	}
+
+	matchLabel := viper.GetString("match-label")
+	opts := metav1.ListOptions{LabelSelector: matchLabel}
+	var sources []Source
+	// match label value of each source
+	var values []string
+	configMaps, err := clientset().CoreV1().ConfigMaps(ns).List(context.Background(), opts)
+	if err != nil {
+		report(checkCritical, "failed to list ConfigMaps: %s", err)
+		return false
+	}
+	for _, cm := range configMaps.Items {
+		src := Source{Kind: "ConfigMap", Namespace: cm.Namespace, Name: cm.Name, TargetNamespace: cm.Annotations[targetNamespaceAnnotation]}
+		sources, values = append(sources, src), append(values, cm.Labels[matchLabel])
+	}
+	secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), opts)
+	if err != nil {
+		report(checkCritical, "failed to list Secrets: %s", err)
+		return false
+	}
+	for _, s := range secrets.Items {
+		src := Source{Kind: "Secret", Namespace: s.Namespace, Name: s.Name, TargetNamespace: s.Annotations[targetNamespaceAnnotation]}
+		sources, values = append(sources, src), append(values, s.Labels[matchLabel])
+	}
+	if critical {
+		// without access, matching the workloads would only fail
+		return false
+	}
+	if len(sources) == 0 {
+		report(checkWarning, "no ConfigMaps or Secrets in %s are labeled %s, nothing is watched", scope, matchLabel)
+	} else {
+		report(checkOK, "%d ConfigMaps and Secrets are labeled %s", len(sources), matchLabel)
+	}
+
+	// label values of the sources per rollout namespace, to find workloads no source restarts
+	sourceValues := map[string]map[string]bool{}
+	for i, src := range sources {
+		value := values[i]
+		rolloutNs := src.RolloutNamespace()
+		if sourceValues[rolloutNs] == nil {
+			sourceValues[rolloutNs] = map[string]bool{}
+		}
+		sourceValues[rolloutNs][value] = true
+		if len(matchingWorkloads(src, value)) == 0 {
+			report(checkWarning, "%s is labeled %s=%s, but no workload in namespace %s is, its changes restart nothing",
+				src, matchLabel, value, rolloutNs)
+		}
+		if rolloutNs != src.Namespace {
+			for _, resource := range workloadResources {
+				if err := canRollout(rolloutNs, resource); err != nil {
+					report(checkCritical, "%s redirects its rollout to namespace %s: %s", src, rolloutNs, err)
+					critical = true
+				}
+			}
+		}
+	}
+
+	var workloads []Workload
+	workloadValues := map[Workload]string{}
+	apps := clientset().AppsV1()
+	if list, err := apps.Deployments(ns).List(context.Background(), opts); err == nil {
+		for _, d := range list.Items {
+			w := Workload{Kind: "Deployment", Namespace: d.Namespace, Name: d.Name}
+			workloads = append(workloads, w)
+			workloadValues[w] = d.Labels[matchLabel]
+		}
+	}
+	if list, err := apps.StatefulSets(ns).List(context.Background(), opts); err == nil {
+		for _, s := range list.Items {
+			w := Workload{Kind: "StatefulSet", Namespace: s.Namespace, Name: s.Name}
+			workloads = append(workloads, w)
+			workloadValues[w] = s.Labels[matchLabel]
+		}
+	}
+	if list, err := apps.DaemonSets(ns).List(context.Background(), opts); err == nil {
+		for _, d := range list.Items {
+			w := Workload{Kind: "DaemonSet", Namespace: d.Namespace, Name: d.Name}
+			workloads = append(workloads, w)
+			workloadValues[w] = d.Labels[matchLabel]
+		}
+	}
+	orphans := 0
+	for _, w := range workloads {
+		if !sourceValues[w.Namespace][workloadValues[w]] {
+			orphans++
+			report(checkWarning, "%s is labeled %s=%s, but no ConfigMap or Secret restarting namespace %s is", w, matchLabel, workloadValues[w], w.Namespace)
+		}
+	}
+	if len(workloads) > 0 && orphans == 0 {
+		report(checkOK, "all %d labeled workloads have a labeled source", len(workloads))
+	}
+	return !critical
+}
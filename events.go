@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sort"
+	"strings"
+	"time"
+)
+
+var recorder record.EventRecorder
+
+func setupEventRecorder() {
+	if !viper.GetBool("record-events") {
+		return
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset().CoreV1().Events("")})
+	broadcaster.StartLogging(logrus.Debugf)
+	recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cre"})
+}
+
+// recordRolloutEvent records a single event on the source summarizing everything its change restarted,
+// rather than one event per workload, to stay clear of the events API spam filters.
+// also lists other sources whose changes restarted the same workloads at once.
+func recordRolloutEvent(src Source, targets []Workload, also []string) {
+	kinds := map[string]int{}
+	for _, w := range targets {
+		kinds[w.Kind]++
+	}
+	var counts []string
+	for kind, count := range kinds {
+		counts = append(counts, fmt.Sprintf("%d %s", count, kind))
+	}
+	sort.Strings(counts)
+	msg := fmt.Sprintf("Restarted %d workloads in namespace %s (%s), correlation id %s",
+		len(targets), src.RolloutNamespace(), strings.Join(counts, ", "), src.CorrelationID)
+	if clusters := targetClusters(targets); len(clusters) > 0 {
+		msg += ", in clusters " + strings.Join(clusters, ", ")
+	}
+	if len(also) > 0 {
+		msg += ", together with " + strings.Join(also, ", ")
+	}
+	if c := src.Certificate; c != nil {
+		msg += fmt.Sprintf(", certificate serial %s expiring %s", c.Serial, c.NotAfter.Format(time.RFC3339))
+	}
+	recordSourceEvent(src, corev1.EventTypeNormal, "ConfigReloaded", msg)
+}
+
+// recordWorkloadEvent records on w that the change of src restarted it, or failed to with err, so the users
+// of a workload see why it restarted without the source events. Workloads of spoke clusters have no event here.
+func recordWorkloadEvent(src Source, w Workload, err error) {
+	if w.Cluster != "" {
+		return
+	}
+	if err != nil {
+		recordCorrelatedEvent(workloadRef(w), src, corev1.EventTypeWarning, "RolloutFailed", fmt.Sprintf("Failed to restart for the change of %s: %s", src, err))
+		return
+	}
+	recordCorrelatedEvent(workloadRef(w), src, corev1.EventTypeNormal, "ConfigReloaded", fmt.Sprintf("Restarted for the change of %s, correlation id %s", src, src.CorrelationID))
+}
+
+func recordSourceEvent(src Source, eventType, reason, msg string) {
+	// Triggered match label values have no object to record events on
+	if src.Kind == triggerKind {
+		return
+	}
+	apiVersion := "v1"
+	if src.Kind == "SecretProviderClass" {
+		apiVersion = secretProviderClassPodStatusesGVR.GroupVersion().String()
+	}
+	recordCorrelatedEvent(&corev1.ObjectReference{
+		APIVersion: apiVersion,
+		Kind:       src.Kind,
+		Namespace:  src.Namespace,
+		Name:       src.Name,
+		UID:        src.UID,
+	}, src, eventType, reason, msg)
+}
+
+// recordCorrelatedEvent records an event caused by the change of src, annotated with its correlation id and the cluster name
+func recordCorrelatedEvent(ref *corev1.ObjectReference, src Source, eventType, reason, msg string) {
+	if recorder == nil {
+		return
+	}
+	annotations := map[string]string{}
+	if src.CorrelationID != "" {
+		annotations[correlationIDAnnotation] = src.CorrelationID
+	}
+	if cluster := viper.GetString("cluster-name"); cluster != "" {
+		annotations[clusterAnnotation] = cluster
+	}
+	recorder.AnnotatedEventf(ref, annotations, eventType, reason, "%s", msg)
+}
+
+func recordEvent(ref *corev1.ObjectReference, eventType, reason, msg string) {
+	if recorder == nil {
+		return
+	}
+	recorder.Event(ref, eventType, reason, msg)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"k8s.io/client-go/tools/record"
+	"strings"
+	"testing"
+)
+
+// fakeRecorder records the events of the test
+func fakeRecorder(t *testing.T) *record.FakeRecorder {
+	t.Helper()
+	fake := record.NewFakeRecorder(10)
+	previous := recorder
+	recorder = fake
+	t.Cleanup(func() { recorder = previous })
+	return fake
+}
+
+// recordedEvents drains the events recorded so far
+func recordedEvents(fake *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-fake.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestSourceChangeRecordsASingleEvent(t *testing.T) {
+	fake := fakeRecorder(t)
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", CorrelationID: "42"}
+	targets := []Workload{
+		{Kind: "Deployment", Namespace: "apps", Name: "web"},
+		{Kind: "Deployment", Namespace: "apps", Name: "api"},
+		{Kind: "StatefulSet", Namespace: "apps", Name: "db"},
+	}
+	batch := &rolloutBatch{src: src, remaining: len(targets)}
+	for _, w := range targets {
+		batch.done(w, true)
+	}
+	events := recordedEvents(fake)
+	if len(events) != 1 {
+		t.Fatalf("expected a single event for the change, got %v", events)
+	}
+	for _, summary := range []string{"Normal ConfigReloaded", "Restarted 3 workloads", "1 StatefulSet, 2 Deployment", "correlation id 42"} {
+		if !strings.Contains(events[0], summary) {
+			t.Fatalf("expected the event to summarize %q, got %q", summary, events[0])
+		}
+	}
+}
+
+func TestSkippedChangeRecordsNoRolloutEvent(t *testing.T) {
+	fake := fakeRecorder(t)
+	batch := &rolloutBatch{src: Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, remaining: 2}
+	batch.done(Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}, false)
+	batch.done(Workload{Kind: "Deployment", Namespace: "apps", Name: "api"}, false)
+	if events := recordedEvents(fake); len(events) != 0 {
+		t.Fatalf("expected no event without restarts, got %v", events)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var explainParams = []Param{
+	{Name: "kind", Shorthand: "k", Value: "ConfigMap", Usage: "kind of the source, ConfigMap|Secret"},
+	{Name: "last", Shorthand: "", Value: 5, Usage: "number of recent changes to print the decision traces of"},
+}
+
+// explainCmd prints what cre would do on a change of a source and why, without changing anything.
+// It goes through the same matching and skip decisions as a real rollout.
+// Given a workload it prints the decision traces of the recent changes which targeted it, or of the sources it consumes.
+var explainCmd = &cobra.Command{
+	Use:   "explain [deployment|statefulset|daemonset] <namespace>/<name>",
+	Short: "explain what a change of a ConfigMap or Secret would roll out, or why a workload was or wasn't reloaded",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		parts := strings.SplitN(args[len(args)-1], "/", 2)
+		if len(parts) != 2 {
+			logrus.Fatalf("expected <namespace>/<name>, got %s", args[len(args)-1])
+		}
+		var err error
+		if len(args) == 2 {
+			err = explainWorkloadTraces(os.Stdout, args[0], parts[0], parts[1])
+		} else {
+			err = explain(os.Stdout, viper.GetString("kind"), parts[0], parts[1])
+		}
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func explain(out io.Writer, kind, ns, name string) error {
+	var obj metav1.Object
+	var err error
+	switch strings.ToLower(kind) {
+	case "configmap", "cm":
+		kind = "ConfigMap"
+		obj, err = clientset().CoreV1().ConfigMaps(ns).Get(context.Background(), name, metav1.GetOptions{})
+	case "secret":
+		kind = "Secret"
+		obj, err = clientset().CoreV1().Secrets(ns).Get(context.Background(), name, metav1.GetOptions{})
+	default:
+		return fmt.Errorf("unknown kind %q, expected ConfigMap|Secret", kind)
+	}
+	if err != nil {
+		return err
+	}
+	src := Source{
+		Kind:            kind,
+		Namespace:       ns,
+		Name:            name,
+		UID:             obj.GetUID(),
+		TargetNamespace: obj.GetAnnotations()[targetNamespaceAnnotation],
+	}
+	matchLabel := viper.GetString("match-label")
+	fmt.Fprintf(out, "%s\n", src)
+	value, ok := obj.GetLabels()[matchLabel]
+	if !ok {
+		fmt.Fprintf(out, "  ignored: no %s label, changes aren't watched\n", matchLabel)
+		return nil
+	}
+	fmt.Fprintf(out, "  match label: %s=%s\n", matchLabel, value)
+	if !ownedByWatchedParent(obj) {
+		fmt.Fprintf(out, "  ignored: not controlled by --owner-kind %q --owner-name %q\n", viper.GetString("owner-kind"), viper.GetString("owner-name"))
+		return nil
+	}
+	rolloutNs := src.RolloutNamespace()
+	if rolloutNs != ns {
+		fmt.Fprintf(out, "  rollout namespace: %s, redirected by the %s annotation\n", rolloutNs, targetNamespaceAnnotation)
+		for _, resource := range workloadResources {
+			if err := canRollout(rolloutNs, resource); err != nil {
+				fmt.Fprintf(out, "  skipping %s: %s\n", resource, err)
+			}
+		}
+	}
+	candidates := matchingWorkloads(src, value)
+	if len(candidates) == 0 {
+		fmt.Fprintf(out, "  no workloads in namespace %s are labeled %s=%s, nothing to restart\n", rolloutNs, matchLabel, value)
+		return nil
+	}
+	limit := batchLimit(len(candidates))
+	fmt.Fprintln(out, "\nWorkloads:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	patches := map[string][]byte{}
+	var kinds []string
+	for i, workload := range candidates {
+		data, ok := patches[workload.Kind]
+		if !ok {
+			data = restartPatch(src, workload.Kind)
+			patches[workload.Kind] = data
+			kinds = append(kinds, workload.Kind)
+		}
+		decision, reason := explainWorkload(workload, i, limit, data)
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", decision, workload, reason)
+	}
+	w.Flush()
+	for _, kind := range kinds {
+		fmt.Fprintf(out, "\n%s patch (strategic merge, field manager cnvrg-cre-rollout):\n  %s\n", kind, patches[kind])
+	}
+	return nil
+}
+
+// explainWorkload returns what would happen to the i-th candidate and why
+func explainWorkload(workload Workload, i, limit int, data []byte) (string, string) {
+	matchLabel := viper.GetString("match-label")
+	if i >= limit {
+		return "skip", fmt.Sprintf("beyond --max-batch-size %d, set --allow-large-batches to restart it", limit)
+	}
+	if viper.GetBool("preflight-dry-run") {
+		if err := dryRunPatch(func(opts metav1.PatchOptions) error { return patchWorkload(workload, data, opts) }); err != nil {
+			return "skip", fmt.Sprintf("dry run rejected the patch: %s", err)
+		}
+	}
+	if cooldown := viper.GetDuration("rollout-cooldown"); cooldown > 0 {
+		if restartedAt, ok := lastRestartedAt(workload); ok && time.Since(restartedAt) < cooldown {
+			wait := (cooldown - time.Since(restartedAt)).Round(time.Second)
+			return "delay", fmt.Sprintf("restarted %s ago, within --rollout-cooldown %s, restart delayed by %s",
+				time.Since(restartedAt).Round(time.Second), cooldown, wait)
+		}
+	}
+	return "restart", fmt.Sprintf("labeled %s with the same value", matchLabel)
+}
+
+// lastRestartedAt reads the restartedAt annotation of the workload pod template
+func lastRestartedAt(w Workload) (time.Time, bool) {
+	_, template, err := getWorkload(w)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parseRestartedAt(template.Annotations["kubectl.kubernetes.io/restartedAt"])
+}
+
+// parseRestartedAt accepts RFC3339, as set by kubectl and cre, and the time.Time String format older cre versions set
+func parseRestartedAt(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	// drop the monotonic clock reading, e.g. " m=+12.345"
+	if i := strings.Index(v, " m="); i > 0 {
+		v = v[:i]
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", v)
+	return t, err == nil
+}
+
+// explainWorkloadTraces prints the decision traces of a workload, from the running controller with controller-url
+// and from the persisted ReloadEvents of its namespace
+func explainWorkloadTraces(out io.Writer, kind, ns, name string) error {
+	w := Workload{Namespace: ns, Name: name}
+	for k := range workloadKindResources {
+		if strings.EqualFold(k, kind) {
+			w.Kind = k
+		}
+	}
+	if w.Kind == "" {
+		return fmt.Errorf("unknown kind %q, expected deployment|statefulset|daemonset|cronjob", kind)
+	}
+	var traces []decisionTrace
+	if url := viper.GetString("controller-url"); url != "" {
+		live, err := controllerTraces(url, w)
+		if err != nil {
+			return err
+		}
+		traces = live
+	}
+	seen := map[string]bool{}
+	for _, t := range traces {
+		seen[t.CorrelationID] = true
+	}
+	persisted, err := persistedTraces(w)
+	if err != nil {
+		logrus.Warnf("%s failed to read the ReloadEvents of namespace %s, only showing the traces of the controller", err, ns)
+	}
+	for _, t := range persisted {
+		if !seen[t.CorrelationID] {
+			traces = append(traces, t)
+		}
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Started.After(traces[j].Started) })
+	if last := viper.GetInt("last"); last > 0 && len(traces) > last {
+		traces = traces[:last]
+	}
+	if viper.GetString("output") == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(traces)
+	}
+	fmt.Fprintf(out, "%s\n", w)
+	if len(traces) == 0 {
+		fmt.Fprintln(out, "  no recent changes targeted it or the sources it consumes")
+		if viper.GetString("controller-url") == "" {
+			fmt.Fprintln(out, "  set --controller-url to also read the traces the controller keeps in memory, e.g. of skipped changes")
+		}
+		return nil
+	}
+	for _, t := range traces {
+		from := "controller"
+		if t.Persisted {
+			from = "ReloadEvent"
+		}
+		fmt.Fprintf(out, "\n%s changed %s, correlation id %s (%s)\n", t.Source, t.Started.UTC().Format(time.RFC3339), t.CorrelationID, from)
+		for _, step := range t.Steps {
+			// the steps of the other workloads of the change don't tell anything about this one
+			if step.Workload != nil && *step.Workload != w {
+				continue
+			}
+			fmt.Fprintf(out, "  %s\n", step)
+		}
+	}
+	return nil
+}
+
+func controllerTraces(url string, w Workload) ([]decisionTrace, error) {
+	token, err := readSecret("admin-token", "admin-token-file")
+	if err != nil {
+		return nil, err
+	}
+	query := neturl.Values{"kind": {w.Kind}, "namespace": {w.Namespace}, "name": {w.Name}}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(url, "/")+"/explain?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("controller responded with %s, check --controller-url and the admin token", resp.Status)
+	}
+	var traces []decisionTrace
+	return traces, json.NewDecoder(resp.Body).Decode(&traces)
+}
+
+// persistedTraces reads the decision traces of the ReloadEvents of the namespace of w targeting it
+func persistedTraces(w Workload) ([]decisionTrace, error) {
+	list, err := dynamicClient().Resource(reloadEventsGVR).Namespace(w.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var traces []decisionTrace
+	for _, item := range list.Items {
+		spec, _ := item.Object["spec"].(map[string]interface{})
+		raw, err := json.Marshal(spec)
+		if err != nil {
+			continue
+		}
+		var event struct {
+			Source        Source      `json:"source"`
+			CorrelationID string      `json:"correlationID"`
+			DetectedAt    time.Time   `json:"detectedAt"`
+			Decisions     []traceStep `json:"decisions"`
+			Targets       []Workload  `json:"targets"`
+		}
+		if err := json.Unmarshal(raw, &event); err != nil {
+			continue
+		}
+		targeted := false
+		for _, t := range event.Targets {
+			targeted = targeted || (t.Kind == w.Kind && t.Name == w.Name && t.Namespace == w.Namespace)
+		}
+		if !targeted {
+			continue
+		}
+		traces = append(traces, decisionTrace{
+			CorrelationID: event.CorrelationID,
+			Source:        event.Source,
+			Started:       event.DetectedAt,
+			Steps:         event.Decisions,
+			Persisted:     true,
+		})
+	}
+	return traces, nil
+}
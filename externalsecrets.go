@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"sync"
+	"time"
+)
+
+var externalSecretsGVR = schema.GroupVersionResource{Group: "external-secrets.io", Version: "v1beta1", Resource: "externalsecrets"}
+
+var (
+	externalSecretsMu    sync.Mutex
+	externalSecretsStore customResourceInformers
+)
+
+// externalSecretInformer watches ExternalSecrets to release deferred rollouts once they are synced
+// and to warn about sync errors of Secrets which have labeled consumers
+func externalSecretInformer() {
+	if !viper.GetBool("watch-external-secrets") {
+		return
+	}
+	informer := watchCustomResource(externalSecretsGVR, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldO := oldObj.(*unstructured.Unstructured)
+			newO := newObj.(*unstructured.Unstructured)
+			status, _, msg, _ := statusCondition(newO, "Ready")
+			switch status {
+			case "True":
+				releaseDeferredRollout(externalSecretKey(newO.GetNamespace(), newO.GetName()), func(d *deferredRollout) bool {
+					return syncedSince(newO, d.changedAt)
+				})
+			case "False":
+				oldStatus, _, oldMsg, _ := statusCondition(oldO, "Ready")
+				if oldStatus != "False" || oldMsg != msg {
+					externalSecretFailed(newO, msg)
+				}
+			}
+		},
+	})
+	if informer == nil {
+		return
+	}
+	externalSecretsMu.Lock()
+	externalSecretsStore = informer
+	externalSecretsMu.Unlock()
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.Run(stopper)
+}
+
+// syncedSince tells if the ExternalSecret is Ready and was refreshed at or after t
+func syncedSince(es *unstructured.Unstructured, t time.Time) bool {
+	if status, reason, _, _ := statusCondition(es, "Ready"); status != "True" || reason != "SecretSynced" {
+		return false
+	}
+	refreshTime, _, _ := unstructured.NestedString(es.Object, "status", "refreshTime")
+	refreshed, err := time.Parse(time.RFC3339, refreshTime)
+	// refreshTime has a seconds precision
+	return err == nil && !refreshed.Before(t.Truncate(time.Second))
+}
+
+// deferUntilSynced holds back the rollout of a Secret owned by an ExternalSecret which didn't report
+// a completed sync since the change, the operator may still be writing it.
+// After external-secrets-sync-timeout the rollout runs anyway.
+func deferUntilSynced(s *corev1.Secret, src Source, matchLabelValue string) bool {
+	owner := metav1.GetControllerOf(s)
+	if owner == nil || owner.Kind != "ExternalSecret" {
+		return false
+	}
+	externalSecretsMu.Lock()
+	store := externalSecretsStore
+	externalSecretsMu.Unlock()
+	if store == nil {
+		return false
+	}
+	obj, exists, _ := store.GetByKey(s.Namespace + "/" + owner.Name)
+	if !exists || syncedSince(obj.(*unstructured.Unstructured), time.Now()) {
+		return false
+	}
+	deferRollout(externalSecretKey(s.Namespace, owner.Name), src, matchLabelValue, viper.GetDuration("external-secrets-sync-timeout"))
+	return true
+}
+
+func externalSecretKey(ns, name string) string {
+	return "ExternalSecret " + ns + "/" + name
+}
+
+// externalSecretFailed warns about an ExternalSecret in error state when its target Secret is watched
+// and there are workloads to restart on its changes
+func externalSecretFailed(es *unstructured.Unstructured, msg string) {
+	ns := es.GetNamespace()
+	target, _, _ := unstructured.NestedString(es.Object, "spec", "target", "name")
+	if target == "" {
+		target = es.GetName()
+	}
+	matchLabel := viper.GetString("match-label")
+	secret, err := clientset().CoreV1().Secrets(ns).Get(context.Background(), target, metav1.GetOptions{})
+	if err != nil {
+		logrus.Debugf("%s failed to get target Secret of ExternalSecret %s/%s", err, ns, es.GetName())
+		return
+	}
+	value, ok := secret.Labels[matchLabel]
+	if !ok || !hasConsumers(ns, matchLabel+"="+value) {
+		return
+	}
+	reason := fmt.Sprintf("ExternalSecret failed to sync Secret %s/%s which has labeled consumers: %s", ns, target, msg)
+	logrus.Warn(reason)
+	externalSecretErrors.WithLabelValues(ns).Inc()
+	recordEvent(&corev1.ObjectReference{
+		APIVersion: externalSecretsGVR.GroupVersion().String(),
+		Kind:       "ExternalSecret",
+		Namespace:  ns,
+		Name:       es.GetName(),
+		UID:        es.GetUID(),
+	}, corev1.EventTypeWarning, "SyncFailed", reason)
+}
+
+// hasConsumers tells if any workload in ns matches selector
+func hasConsumers(ns, selector string) bool {
+	clientset := clientset()
+	opts := metav1.ListOptions{LabelSelector: selector, Limit: 1}
+	if l, err := clientset.AppsV1().Deployments(ns).List(context.Background(), opts); err == nil && len(l.Items) > 0 {
+		return true
+	}
+	if l, err := clientset.AppsV1().StatefulSets(ns).List(context.Background(), opts); err == nil && len(l.Items) > 0 {
+		return true
+	}
+	if l, err := clientset.AppsV1().DaemonSets(ns).List(context.Background(), opts); err == nil && len(l.Items) > 0 {
+		return true
+	}
+	return false
+}
+
+// mergeKeys returns the sorted union of two key lists
+func mergeKeys(a, b []string) []string {
+	set := map[string]bool{}
+	for _, k := range append(append([]string{}, a...), b...) {
+		set[k] = true
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var filesParams = []Param{
+	{Name: "watch", Shorthand: "w", Value: []string{}, Usage: "file or directory to watch, can be repeated"},
+	{Name: "strategy", Shorthand: "", Value: "signal", Usage: "reload action, signal|http"},
+	{Name: "signal", Shorthand: "", Value: "HUP", Usage: "signal sent with --strategy signal, HUP|USR1|USR2|INT|TERM"},
+	{Name: "pid", Shorthand: "", Value: 1, Usage: "process to signal, needs shareProcessNamespace for other containers"},
+	{Name: "reload-url", Shorthand: "", Value: "", Usage: "url to POST to with --strategy http, e.g. http://localhost:8080/-/reload"},
+	{Name: "files-debounce", Shorthand: "", Value: 2 * time.Second, Usage: "quiet period after the last change before reloading"},
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"INT":  syscall.SIGINT,
+	"TERM": syscall.SIGTERM,
+}
+
+// filesCmd runs cre as a sidecar reloading the local process when mounted files change,
+// e.g. Vault Agent templates rendered into a shared emptyDir. It never talks to the Kubernetes API.
+var filesCmd = &cobra.Command{
+	Use:   "files",
+	Short: "watch local files and reload a process in the pod when they change",
+	Run: func(cmd *cobra.Command, args []string) {
+		paths := viper.GetStringSlice("watch")
+		if len(paths) == 0 {
+			logrus.Fatal("--watch is required")
+		}
+		reload, err := fileReloadAction()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.Fatalf("%s failed to start file watcher", err)
+		}
+		defer watcher.Close()
+		for _, path := range paths {
+			if err := watcher.Add(path); err != nil {
+				logrus.Fatalf("%s failed to watch %s", err, path)
+			}
+			logrus.Infof("watching %s", path)
+		}
+		go serveMetrics(context.Background())
+		watchFiles(watcher, viper.GetDuration("files-debounce"), reload)
+	},
+}
+
+// fileReloadAction returns the configured local reload action
+func fileReloadAction() (func() error, error) {
+	switch strategy := viper.GetString("strategy"); strategy {
+	case "signal":
+		name := strings.TrimPrefix(strings.ToUpper(viper.GetString("signal")), "SIG")
+		sig, ok := signals[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown --signal %q", viper.GetString("signal"))
+		}
+		pid := viper.GetInt("pid")
+		return func() error {
+			logrus.Infof("sending SIG%s to pid %d", name, pid)
+			process, err := os.FindProcess(pid)
+			if err != nil {
+				return err
+			}
+			return process.Signal(sig)
+		}, nil
+	case "http":
+		url := viper.GetString("reload-url")
+		if url == "" {
+			return nil, fmt.Errorf("--reload-url is required with --strategy http")
+		}
+		client := &http.Client{}
+		return func() error {
+			logrus.Infof("calling reload endpoint %s", url)
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			return post(ctx, client, url, "text/plain", nil, nil)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown --strategy %q, expected signal|http", strategy)
+	}
+}
+
+// watchFiles reloads once no change was seen for debounce, so a template rendering several files
+// or a file replaced through a rename reloads the process once
+func watchFiles(watcher *fsnotify.Watcher, debounce time.Duration, reload func() error) {
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	var changed []string
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			logrus.Debugf("%s: %s", event.Op, event.Name)
+			changed = append(changed, event.Name)
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Errorf("%s file watcher error", err)
+		case <-timer.C:
+			logrus.Infof("files changed: %s", strings.Join(mergeKeys(changed, nil), ", "))
+			changed = nil
+			if err := reload(); err != nil {
+				fileReloads.WithLabelValues("failure").Inc()
+				logrus.Errorf("%s reload failed", err)
+				continue
+			}
+			fileReloads.WithLabelValues("success").Inc()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// fluxOwners are the Flux objects applying resources, found through the labels they set on them
+var fluxOwners = []struct {
+	kind  string
+	label string
+	gvr   schema.GroupVersionResource
+}{
+	{"Kustomization", "kustomize.toolkit.fluxcd.io", schema.GroupVersionResource{Group: "kustomize.toolkit.fluxcd.io", Version: "v1beta2", Resource: "kustomizations"}},
+	{"HelmRelease", "helm.toolkit.fluxcd.io", schema.GroupVersionResource{Group: "helm.toolkit.fluxcd.io", Version: "v2beta1", Resource: "helmreleases"}},
+}
+
+// fluxReconciling tells if the Flux object is reconciling, or not ready yet with an unknown outcome
+func fluxReconciling(gvr schema.GroupVersionResource, ns, name string) (bool, error) {
+	obj, err := getCustomResource(gvr, ns, name)
+	if err != nil || obj == nil {
+		return false, err
+	}
+	if status, _, _, _ := statusCondition(obj, "Reconciling"); status == "True" {
+		return true, nil
+	}
+	status, _, _, found := statusCondition(obj, "Ready")
+	return found && status == "Unknown", nil
+}
+
+// fluxGate holds back the rollout of a source applied by a Flux Kustomization or HelmRelease
+// until its reconciliation settled, the reconciliation changes the workloads in quick succession as well
+func fluxGate(obj metav1.Object, src Source, matchLabelValue string) bool {
+	if !viper.GetBool("flux") {
+		return false
+	}
+	for _, owner := range fluxOwners {
+		owner := owner
+		name := obj.GetLabels()[owner.label+"/name"]
+		ns := obj.GetLabels()[owner.label+"/namespace"]
+		if name == "" || ns == "" {
+			continue
+		}
+		reconciling, err := fluxReconciling(owner.gvr, ns, name)
+		if err != nil {
+			logrus.Debugf("%s failed to get Flux %s %s/%s", err, owner.kind, ns, name)
+			continue
+		}
+		if !reconciling {
+			continue
+		}
+		holdRollout(fmt.Sprintf("Flux %s %s/%s reconciliation", owner.kind, ns, name), src, matchLabelValue, viper.GetDuration("flux-wait-timeout"),
+			func() (bool, error) { return fluxReconciling(owner.gvr, ns, name) },
+			func(o metav1.Object) bool {
+				return o.GetLabels()[owner.label+"/name"] == name && o.GetLabels()[owner.label+"/namespace"] == ns
+			})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+var kustomizations = fluxOwners[0].gvr
+
+// fluxKustomization fabricates the Kustomization flux-system/apps with the given condition statuses
+func fluxKustomization(conditions map[string]string) *unstructured.Unstructured {
+	var list []interface{}
+	for conditionType, status := range conditions {
+		list = append(list, map[string]interface{}{"type": conditionType, "status": status})
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": kustomizations.GroupVersion().String(),
+		"kind":       "Kustomization",
+		"metadata":   map[string]interface{}{"namespace": "flux-system", "name": "apps"},
+		"status":     map[string]interface{}{"conditions": list},
+	}}
+}
+
+// fluxApplied labels obj as applied by the Kustomization flux-system/apps
+func fluxApplied(obj metav1.Object) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels["kustomize.toolkit.fluxcd.io/name"] = "apps"
+	labels["kustomize.toolkit.fluxcd.io/namespace"] = "flux-system"
+	obj.SetLabels(labels)
+}
+
+func TestFluxReconciling(t *testing.T) {
+	cases := []struct {
+		name        string
+		conditions  map[string]string
+		reconciling bool
+	}{
+		{"reconciling", map[string]string{"Reconciling": "True", "Ready": "Unknown"}, true},
+		{"not ready yet", map[string]string{"Ready": "Unknown"}, true},
+		{"ready", map[string]string{"Ready": "True"}, false},
+		{"failed", map[string]string{"Ready": "False"}, false},
+	}
+	for _, c := range cases {
+		serveResources(t, fakeClientset(t), kustomizations)
+		fakeDynamicClient(t, fluxKustomization(c.conditions))
+		reconciling, err := fluxReconciling(kustomizations, "flux-system", "apps")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reconciling != c.reconciling {
+			t.Fatalf("%s: expected reconciling %v, got %v", c.name, c.reconciling, reconciling)
+		}
+	}
+}
+
+func TestFluxReconcilingWithoutTheCRD(t *testing.T) {
+	fakeClientset(t)
+	fakeDynamicClient(t, fluxKustomization(map[string]string{"Reconciling": "True"}))
+	if reconciling, err := fluxReconciling(kustomizations, "flux-system", "apps"); err != nil || reconciling {
+		t.Fatalf("expected clusters without Flux never reconciling, got %v, %v", reconciling, err)
+	}
+}
+
+func TestFluxGateDisabled(t *testing.T) {
+	serveResources(t, fakeClientset(t), kustomizations)
+	fakeDynamicClient(t, fluxKustomization(map[string]string{"Reconciling": "True"}))
+	setFlags(t, map[string]interface{}{"flux": false})
+	cm := ownedConfigMap(nil)
+	fluxApplied(cm)
+	if fluxGate(cm, Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, "app") {
+		t.Fatal("the rollout was held back with the Flux integration disabled")
+	}
+}
+
+func TestFluxGateIgnoresOtherSources(t *testing.T) {
+	serveResources(t, fakeClientset(t), kustomizations)
+	fakeDynamicClient(t, fluxKustomization(map[string]string{"Reconciling": "True"}))
+	setFlags(t, map[string]interface{}{"flux": true})
+	if fluxGate(ownedConfigMap(nil), Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, "app") {
+		t.Fatal("the rollout of a source not applied by Flux was held back")
+	}
+}
+
+func TestFluxGateHoldsUntilReconciled(t *testing.T) {
+	managed, other := labeledDeployment("apps", "managed", "app"), labeledDeployment("apps", "other", "app")
+	fluxApplied(managed)
+	managed.Generation = 1
+	client := fakeClientset(t, managed, other)
+	serveResources(t, client, kustomizations)
+	dynamic := fakeDynamicClient(t, fluxKustomization(map[string]string{"Reconciling": "True"}))
+	setFlags(t, map[string]interface{}{"flux": true, "pair-window": time.Duration(0), "preflight-dry-run": false})
+	previous := gatePollInterval
+	gatePollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { gatePollInterval = previous })
+	patches := patchCounter(client, false)
+
+	cm := ownedConfigMap(nil)
+	fluxApplied(cm)
+	if !fluxGate(cm, Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, "app") {
+		t.Fatal("the rollout wasn't held back by the reconciling Kustomization")
+	}
+	// the reconciliation changes the template of the managed Deployment, then settles
+	updated := managed.DeepCopy()
+	updated.Generation = 2
+	if _, err := client.AppsV1().Deployments("apps").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dynamic.Resource(kustomizations).Namespace("flux-system").Update(context.Background(), fluxKustomization(map[string]string{"Ready": "True"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, 1)
+	processQueuedRollouts(t)
+	if rolloutQueue.Len() != 0 || *patches != 1 {
+		t.Fatalf("expected only the Deployment not updated by the reconciliation restarted, got %d patches", *patches)
+	}
+	var restarted []string
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			restarted = append(restarted, patch.GetName())
+		}
+	}
+	if len(restarted) != 1 || restarted[0] != "other" {
+		t.Fatalf("expected Deployment other restarted, got %v", restarted)
+	}
+}
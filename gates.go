@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+var gatePollInterval = 5 * time.Second
+
+// heldByDeployTool tells if the rollout of src is held back by helm, Argo CD or Flux deploying it
+func heldByDeployTool(obj metav1.Object, src Source, matchLabelValue string) bool {
+	return helmGate(obj, src, matchLabelValue) || argoGate(obj, src, matchLabelValue) || fluxGate(obj, src, matchLabelValue)
+}
+
+// holdRollout holds back the rollout of src while the tool deploying it (helm, Argo CD, Flux) is applying changes,
+// as it updates the source and the workload templates together and restarting right away means a second restart.
+// Once inProgress reports the operation settled, or after timeout, the matching workloads are restarted,
+// except the ones managed by the same operation which spec changed meanwhile.
+func holdRollout(what string, src Source, matchLabelValue string, timeout time.Duration,
+	inProgress func() (bool, error), managed func(obj metav1.Object) bool) {
+	// Generations before the operation touched the workloads, any spec change bumps them
+	generations := map[Workload]int64{}
+	for _, w := range matchingWorkloads(src, matchLabelValue) {
+		if o, _, err := getWorkload(w); err == nil && managed(o) {
+			generations[w] = o.GetGeneration()
+		}
+	}
+	src.log().Infof("%s is in progress, holding back the rollout of %s", what, src)
+	traceDecision(src, stageGuard, "held", nil, "%s is in progress, for up to %s", what, timeout)
+	go func() {
+		deadline := time.Now().Add(timeout)
+		pending := true
+		for pending && time.Now().Before(deadline) {
+			time.Sleep(gatePollInterval)
+			var err error
+			if pending, err = inProgress(); err != nil {
+				logrus.Errorf("%s failed to check %s", err, what)
+				pending = true
+			}
+		}
+		if pending {
+			src.log().Warnf("%s is still in progress after %s, rolling out %s", what, timeout, src)
+			traceDecision(src, stageGuard, "timed-out", nil, "%s is still in progress after %s, rolling out anyway", what, timeout)
+		} else {
+			src.log().Infof("%s settled, rolling out %s", what, src)
+		}
+		candidates, ok := rolloutCandidates(src, matchLabelValue)
+		if !ok {
+			return
+		}
+		var targets []Workload
+		for _, w := range candidates {
+			if before, ok := generations[w]; ok {
+				if o, _, err := getWorkload(w); err == nil && o.GetGeneration() > before {
+					src.log().Infof("%s was already updated by %s, not restarting it", w, what)
+					notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: []Workload{w}, Outcome: "skipped",
+						Error: fmt.Sprintf("already updated by %s", what)})
+					continue
+				}
+			}
+			targets = append(targets, w)
+		}
+		enqueueInKindOrder(src, capBatch(src, inKindOrder(targets)))
+	}()
+}
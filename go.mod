@@ -3,12 +3,27 @@ module github.com/cre
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go-v2 v1.17.1
+	github.com/aws/aws-sdk-go-v2/config v1.18.0
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.29.2
+	github.com/aws/aws-sdk-go-v2/service/sns v1.18.4
 	github.com/d4l3k/messagediff v1.2.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/golang/protobuf v1.5.2
+	github.com/nats-io/nats.go v1.16.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/segmentio/kafka-go v0.4.38
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/viper v1.7.1
+	go.opentelemetry.io/proto/otlp v0.11.0
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/d4l3k/messagediff.v1 v1.2.1
 	k8s.io/api v0.21.1
 	k8s.io/apimachinery v0.21.1
 	k8s.io/client-go v0.21.1
+	sigs.k8s.io/yaml v1.2.0
 )
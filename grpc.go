@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	crev1 "github.com/cre/api/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// eventStreamBuffer is how many events a slow StreamEvents subscriber may lag behind before events are dropped for it
+const eventStreamBuffer = 256
+
+var (
+	subscribersMu sync.Mutex
+	subscribers   = map[chan RolloutEvent]bool{}
+)
+
+// publishEvent hands the event to the StreamEvents subscribers, never blocking the rollouts on them
+func publishEvent(event RolloutEvent) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for events := range subscribers {
+		select {
+		case events <- event:
+		default:
+			logrus.Warnf("event stream subscriber lags behind, dropped %s event of %s", event.Type, event.Source)
+		}
+	}
+}
+
+func subscribe() chan RolloutEvent {
+	events := make(chan RolloutEvent, eventStreamBuffer)
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers[events] = true
+	return events
+}
+
+func unsubscribe(events chan RolloutEvent) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	delete(subscribers, events)
+}
+
+// serveGRPC serves the Reloads gRPC API on grpc-addr, with the callers, rate limits and TLS of the trigger api
+func serveGRPC() {
+	addr := viper.GetString("grpc-addr")
+	if addr == "" {
+		return
+	}
+	api, tlsConfig, err := apiAuth()
+	if err != nil {
+		logrus.Fatalf("%s, invalid grpc api configuration", err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logrus.Fatalf("%s failed to listen on %s", err, addr)
+	}
+	if tlsConfig != nil {
+		logrus.Infof("serving the grpc api on %s", addr)
+	} else {
+		logrus.Warnf("serving the grpc api on %s without TLS, bearer tokens are sent in the clear", addr)
+	}
+	if err := newGRPCServer(api, tlsConfig).Serve(listener); err != nil {
+		logrus.Fatalf("%s grpc api server stopped", err)
+	}
+}
+
+// newGRPCServer builds the server of the Reloads API authenticating the callers of api, over TLS when tlsConfig is set
+func newGRPCServer(api *triggerAPI, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(api.unaryAuth),
+		grpc.StreamInterceptor(api.streamAuth),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	crev1.RegisterReloadsServer(server, &reloadsServer{})
+	// for grpcurl, listing the services is authenticated like every other call
+	reflection.Register(server)
+	return server
+}
+
+// callerKey holds the authenticated triggerCaller in the context of a call
+type callerKey struct{}
+
+func (api *triggerAPI) authorize(ctx context.Context) (triggerCaller, error) {
+	var auth string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		auth = md.Get("authorization")[0]
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	caller, ok := api.callerOf(state, auth)
+	if !ok {
+		triggerRequests.WithLabelValues("unauthorized").Inc()
+		remote := "unknown"
+		if p, found := peer.FromContext(ctx); found {
+			remote = p.Addr.String()
+		}
+		logrus.Warnf("rejected unauthenticated grpc api request from %s", remote)
+		return "", status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	if !api.limiter(caller).TryAccept() {
+		triggerRequests.WithLabelValues("rate-limited").Inc()
+		logrus.Warnf("rate limited grpc api requests of %s", caller)
+		return "", status.Error(codes.ResourceExhausted, "rate limited, retry later")
+	}
+	return caller, nil
+}
+
+func (api *triggerAPI) unaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	caller, err := api.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, callerKey{}, caller), req)
+}
+
+func (api *triggerAPI) streamAuth(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := api.authorize(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// reloadsServer serves the same state as the HTTP trigger api
+type reloadsServer struct {
+	crev1.UnimplementedReloadsServer
+}
+
+func (s *reloadsServer) Trigger(ctx context.Context, in *crev1.TriggerRequest) (*crev1.TriggerResponse, error) {
+	req := triggerRequest{Namespace: in.Namespace, Kind: in.Kind, Name: in.Name, Value: in.Value}
+	if err := req.validate(); err != nil {
+		triggerRequests.WithLabelValues("invalid").Inc()
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	caller, _ := ctx.Value(callerKey{}).(triggerCaller)
+	id, code, err := trigger(req, string(caller))
+	if err != nil {
+		switch code {
+		case http.StatusNotFound:
+			triggerRequests.WithLabelValues("not-found").Inc()
+			return nil, status.Error(codes.NotFound, err.Error())
+		case http.StatusUnprocessableEntity:
+			triggerRequests.WithLabelValues("not-found").Inc()
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		default:
+			triggerRequests.WithLabelValues("error").Inc()
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+	triggerRequests.WithLabelValues("accepted").Inc()
+	return &crev1.TriggerResponse{CorrelationId: id}, nil
+}
+
+func (s *reloadsServer) GetStatus(ctx context.Context, in *crev1.GetStatusRequest) (*crev1.ChangeStatus, error) {
+	st, ok := getChangeStatus(in.CorrelationId)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown correlation id, or it expired")
+	}
+	return &crev1.ChangeStatus{
+		CorrelationId: st.CorrelationID,
+		Source: &crev1.Source{
+			Kind:        st.Source.Kind,
+			Namespace:   st.Source.Namespace,
+			Name:        st.Source.Name,
+			ChangedKeys: st.Source.ChangedKeys,
+		},
+		State:           st.State,
+		CreatedUnixNano: st.Created.UnixNano(),
+		UpdatedUnixNano: st.Updated.UnixNano(),
+		Workloads:       st.Workloads,
+		Errors:          st.Errors,
+	}, nil
+}
+
+func (s *reloadsServer) ListPending(ctx context.Context, in *crev1.ListPendingRequest) (*crev1.ListPendingResponse, error) {
+	pauseMu.Lock()
+	parkedNow := map[Workload]bool{}
+	for w := range parked {
+		parkedNow[w] = true
+	}
+	pauseMu.Unlock()
+	resp := &crev1.ListPendingResponse{}
+	rolloutsMu.Lock()
+	for w, batches := range pendingBatches {
+		pending := &crev1.PendingRollout{
+			Workload: &crev1.Workload{Kind: w.Kind, Namespace: w.Namespace, Name: w.Name, Cluster: w.Cluster},
+			Parked:   parkedNow[w],
+		}
+		for _, b := range batches {
+			pending.CorrelationIds = append(pending.CorrelationIds, b.src.CorrelationID)
+		}
+		resp.Rollouts = append(resp.Rollouts, pending)
+	}
+	rolloutsMu.Unlock()
+	sort.Slice(resp.Rollouts, func(i, j int) bool {
+		a, b := resp.Rollouts[i].Workload, resp.Rollouts[j].Workload
+		return a.Cluster+"/"+a.Namespace+"/"+a.Kind+"/"+a.Name < b.Cluster+"/"+b.Namespace+"/"+b.Kind+"/"+b.Name
+	})
+	return resp, nil
+}
+
+func (s *reloadsServer) StreamEvents(in *crev1.StreamEventsRequest, stream crev1.Reloads_StreamEventsServer) error {
+	namespaces := map[string]bool{}
+	for _, ns := range in.Namespaces {
+		namespaces[ns] = true
+	}
+	events := subscribe()
+	defer unsubscribe(events)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event := <-events:
+			ns := event.Source.RolloutNamespace()
+			if len(namespaces) > 0 && !namespaces[ns] && !namespaces[event.Source.Namespace] {
+				continue
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err := stream.Send(&crev1.RolloutEvent{
+				Type:          string(event.Type),
+				CorrelationId: event.CorrelationID,
+				Namespace:     ns,
+				Json:          payload,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
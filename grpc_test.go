@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	crev1 "github.com/cre/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"net"
+	"testing"
+	"time"
+)
+
+// bearer authenticates the calls of a test client with a token
+type bearer string
+
+func (b bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (b bearer) RequireTransportSecurity() bool {
+	return false
+}
+
+// grpcConn serves the Reloads API to the token of the platform caller on an in-memory listener,
+// returning a connection calling it with token
+func grpcConn(t *testing.T, token string) *grpc.ClientConn {
+	t.Helper()
+	setFlags(t, map[string]interface{}{"grpc-addr": "bufconn", "trigger-api-rate-limit": 600, "trigger-api-burst": 100})
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(&triggerAPI{tokens: map[string]string{"platform": "secret"}, limiters: map[triggerCaller]flowcontrol.RateLimiter{}}, nil)
+	go server.Serve(listener)
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithInsecure(),
+	}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearer(token)))
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufconn", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+func grpcCode(err error) codes.Code {
+	return status.Code(err)
+}
+
+func TestGRPCRequiresToken(t *testing.T) {
+	for _, token := range []string{"", "wrong"} {
+		client := crev1.NewReloadsClient(grpcConn(t, token))
+		if _, err := client.ListPending(context.Background(), &crev1.ListPendingRequest{}); grpcCode(err) != codes.Unauthenticated {
+			t.Fatalf("token %q: expected the call unauthenticated, got %v", token, err)
+		}
+	}
+}
+
+func TestGRPCTrigger(t *testing.T) {
+	labeled := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "app-config", Labels: map[string]string{"mlops.cnvrg.io": "app"}}}
+	unlabeled := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "other"}}
+	fakeClientset(t, labeled, unlabeled)
+	client := crev1.NewReloadsClient(grpcConn(t, "secret"))
+	for _, c := range []struct {
+		req  *crev1.TriggerRequest
+		code codes.Code
+	}{
+		{&crev1.TriggerRequest{Namespace: "Not A Namespace", Kind: "ConfigMap", Name: "app-config"}, codes.InvalidArgument},
+		{&crev1.TriggerRequest{Namespace: "apps", Kind: "ConfigMap", Name: "missing"}, codes.NotFound},
+		{&crev1.TriggerRequest{Namespace: "apps", Kind: "ConfigMap", Name: "other"}, codes.FailedPrecondition},
+	} {
+		if _, err := client.Trigger(context.Background(), c.req); grpcCode(err) != c.code {
+			t.Fatalf("%v: expected %s, got %v", c.req, c.code, err)
+		}
+	}
+	triggered, err := client.Trigger(context.Background(), &crev1.TriggerRequest{Namespace: "apps", Kind: "ConfigMap", Name: "app-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	change, err := client.GetStatus(context.Background(), &crev1.GetStatusRequest{CorrelationId: triggered.CorrelationId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Source.Kind != "ConfigMap" || change.Source.Name != "app-config" {
+		t.Fatalf("expected the status of the triggered ConfigMap, got %v", change.Source)
+	}
+	if _, err := client.GetStatus(context.Background(), &crev1.GetStatusRequest{CorrelationId: "unknown"}); grpcCode(err) != codes.NotFound {
+		t.Fatalf("expected an unknown correlation id not found, got %v", err)
+	}
+}
+
+func TestGRPCListPending(t *testing.T) {
+	fakeClientset(t)
+	setFlags(t, map[string]interface{}{"pair-window": time.Duration(0)})
+	client := crev1.NewReloadsClient(grpcConn(t, "secret"))
+	enqueueRollouts(Source{Kind: "ConfigMap", Namespace: "pending", Name: "app-config", CorrelationID: "42"}, []Workload{{Kind: "Deployment", Namespace: "pending", Name: "web"}})
+	defer processQueuedRollouts(t)
+	pending, err := client.ListPending(context.Background(), &crev1.ListPendingRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending.Rollouts) != 1 || pending.Rollouts[0].Workload.Name != "web" || len(pending.Rollouts[0].CorrelationIds) != 1 || pending.Rollouts[0].CorrelationIds[0] != "42" {
+		t.Fatalf("expected the queued rollout of web for change 42, got %v", pending.Rollouts)
+	}
+}
+
+func TestGRPCStreamEvents(t *testing.T) {
+	client := crev1.NewReloadsClient(grpcConn(t, "secret"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamEvents(ctx, &crev1.StreamEventsRequest{Namespaces: []string{"streamed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription starts with the stream on the server, wait for it before publishing
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subscribersMu.Lock()
+		subscribed := len(subscribers) > 0
+		subscribersMu.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stream didn't subscribe to the events")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	publishEvent(RolloutEvent{Type: EventRolloutTriggered, Source: Source{Kind: "ConfigMap", Namespace: "other", Name: "app-config"}, CorrelationID: "other"})
+	publishEvent(RolloutEvent{Type: EventRolloutTriggered, Source: Source{Kind: "ConfigMap", Namespace: "streamed", Name: "app-config"}, CorrelationID: "streamed", Outcome: "triggered"})
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.CorrelationId != "streamed" || event.Namespace != "streamed" || event.Type != string(EventRolloutTriggered) {
+		t.Fatalf("expected only the event of the streamed namespace, got %v", event)
+	}
+	var notification RolloutEvent
+	if err := json.Unmarshal(event.Json, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.CorrelationID != "streamed" || notification.Outcome != "triggered" {
+		t.Fatalf("expected the event in the schema of the notifications, got %s", event.Json)
+	}
+}
+
+func TestGRPCReflection(t *testing.T) {
+	stream, err := rpb.NewServerReflectionClient(grpcConn(t, "secret")).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		if service.Name == "cre.v1.Reloads" {
+			return
+		}
+	}
+	t.Fatalf("expected the Reloads service listed, got %v", resp.GetListServicesResponse())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+)
+
+// helmRelease returns the helm release managing obj and its namespace
+func helmRelease(obj metav1.Object) (string, string) {
+	if name := obj.GetAnnotations()["meta.helm.sh/release-name"]; name != "" {
+		ns := obj.GetAnnotations()["meta.helm.sh/release-namespace"]
+		if ns == "" {
+			ns = obj.GetNamespace()
+		}
+		return name, ns
+	}
+	if obj.GetLabels()["app.kubernetes.io/managed-by"] == "Helm" {
+		return obj.GetLabels()["app.kubernetes.io/instance"], obj.GetNamespace()
+	}
+	return "", ""
+}
+
+// helmReleaseStatus returns the status of the latest revision of a release, from its helm storage Secrets
+func helmReleaseStatus(ns, release string) (string, error) {
+	secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), metav1.ListOptions{
+		LabelSelector: "owner=helm,name=" + release,
+	})
+	if err != nil {
+		return "", err
+	}
+	status, latest := "", -1
+	for _, s := range secrets.Items {
+		if version, err := strconv.Atoi(s.Labels["version"]); err == nil && version > latest {
+			status, latest = s.Labels["status"], version
+		}
+	}
+	return status, nil
+}
+
+func helmPending(status string) bool {
+	return status == "pending-install" || status == "pending-upgrade" || status == "pending-rollback"
+}
+
+// helmGate holds back the rollout of a source whose helm release is being installed, upgraded or rolled back,
+// until the release is deployed or failed
+func helmGate(obj metav1.Object, src Source, matchLabelValue string) bool {
+	timeout := viper.GetDuration("helm-wait-timeout")
+	release, ns := helmRelease(obj)
+	if release == "" || timeout <= 0 {
+		return false
+	}
+	status, err := helmReleaseStatus(ns, release)
+	if err != nil {
+		logrus.Debugf("%s failed to get helm release %s/%s", err, ns, release)
+		return false
+	}
+	if !helmPending(status) {
+		return false
+	}
+	holdRollout(fmt.Sprintf("helm release %s/%s %s", ns, release, status), src, matchLabelValue, timeout,
+		func() (bool, error) {
+			status, err := helmReleaseStatus(ns, release)
+			return helmPending(status), err
+		},
+		func(o metav1.Object) bool {
+			r, n := helmRelease(o)
+			return r == release && n == ns
+		})
+	return true
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of --http-auth
+const (
+	httpAuthNone        = "none"
+	httpAuthToken       = "token"
+	httpAuthTokenReview = "tokenreview"
+)
+
+const (
+	// tokenReviewTTL bounds how long a reviewed token is trusted, a revoked token is rejected at the latest after it
+	tokenReviewTTL = time.Minute
+	// tokenReviewFailureTTL keeps rejected tokens from costing a TokenReview per request
+	tokenReviewFailureTTL = 10 * time.Second
+	tokenReviewTimeout    = 5 * time.Second
+	maxCachedTokenReviews = 1000
+)
+
+// httpAuth authenticates the requests of the metrics server, the probes excepted
+type httpAuth struct {
+	mode       string
+	token      string
+	adminToken string
+	users      map[string]bool
+}
+
+type tokenReviewResult struct {
+	user    string
+	ok      bool
+	expires time.Time
+}
+
+var (
+	tokenReviewsMu sync.Mutex
+	// tokenReviews caches the reviews by sha256 of the token, never the token itself
+	tokenReviews = map[[sha256.Size]byte]tokenReviewResult{}
+)
+
+func newHTTPAuth(adminToken string) (*httpAuth, error) {
+	auth := &httpAuth{mode: viper.GetString("http-auth"), adminToken: adminToken, users: map[string]bool{}}
+	for _, user := range viper.GetStringSlice("http-auth-users") {
+		auth.users[user] = true
+	}
+	switch auth.mode {
+	case "", httpAuthNone:
+		auth.mode = httpAuthNone
+	case httpAuthToken:
+		token, err := readSecret("http-auth-token", "http-auth-token-file")
+		if err != nil {
+			return nil, err
+		}
+		if len(token) < 16 {
+			return nil, fmt.Errorf("--http-auth=token needs a token of at least 16 characters (HTTP_AUTH_TOKEN, --http-auth-token-file)")
+		}
+		auth.token = token
+	case httpAuthTokenReview:
+	default:
+		return nil, fmt.Errorf("unknown --http-auth %s, expected none, token or tokenreview", auth.mode)
+	}
+	return auth, nil
+}
+
+// authenticate lets requests through by the admin token, or by the bearer token of --http-auth
+func (a *httpAuth) authenticate(next http.Handler) http.Handler {
+	if a.mode == httpAuthNone {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.caller(r, false); !ok {
+			logrus.Warnf("rejected unauthenticated request of %s from %s", r.URL.Path, remoteHost(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cre"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeAdmin lets requests through by the admin token, or with --http-auth=tokenreview by the token
+// of one of the --http-auth-users, any authenticated user isn't enough to pause rollouts
+func (a *httpAuth) authorizeAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.caller(r, true); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *httpAuth) caller(r *http.Request, admin bool) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	got := strings.TrimPrefix(auth, "Bearer ")
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(a.adminToken)) == 1 {
+		return "admin", true
+	}
+	switch a.mode {
+	case httpAuthToken:
+		return "token", !admin && subtle.ConstantTimeCompare([]byte(got), []byte(a.token)) == 1
+	case httpAuthTokenReview:
+		user, ok := reviewToken(got)
+		if !ok || (admin && !a.users[user]) || (len(a.users) > 0 && !a.users[user]) {
+			return "", false
+		}
+		return user, true
+	}
+	return "", false
+}
+
+// reviewToken authenticates a Kubernetes token, e.g. the ServiceAccount token of Prometheus, with a TokenReview
+func reviewToken(token string) (string, bool) {
+	key := sha256.Sum256([]byte(token))
+	tokenReviewsMu.Lock()
+	cached, found := tokenReviews[key]
+	tokenReviewsMu.Unlock()
+	if found && time.Now().Before(cached.expires) {
+		return cached.user, cached.ok
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tokenReviewTimeout)
+	defer cancel()
+	review, err := clientset().AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		// not cached, the API server may be back for the next request
+		logrus.Errorf("%s failed to review a bearer token", err)
+		return "", false
+	}
+	result := tokenReviewResult{ok: review.Status.Authenticated, user: review.Status.User.Username, expires: time.Now().Add(tokenReviewTTL)}
+	if !result.ok {
+		result.expires = time.Now().Add(tokenReviewFailureTTL)
+	}
+	tokenReviewsMu.Lock()
+	defer tokenReviewsMu.Unlock()
+	if len(tokenReviews) >= maxCachedTokenReviews {
+		for k, r := range tokenReviews {
+			if time.Now().After(r.expires) {
+				delete(tokenReviews, k)
+			}
+		}
+		if len(tokenReviews) >= maxCachedTokenReviews {
+			tokenReviews = map[[sha256.Size]byte]tokenReviewResult{}
+		}
+	}
+	tokenReviews[key] = result
+	return result.user, result.ok
+}
+
+// metricsTLSConfig serves metrics-tls-cert, reloaded on renewal for new connections only, so in-flight requests go on
+func metricsTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := viper.GetString("metrics-tls-cert"), viper.GetString("metrics-tls-key")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	certs := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := certs.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+func registerProbes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+	mux.HandleFunc("/readyz", readyzHandler)
+}
+
+// serveHTTP serves handler on addr until ctx is done, over TLS when tlsConfig is set
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("%s failed to shut down the %s server", err, name)
+		}
+	}()
+	var err error
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		logrus.Infof("%s server stopped", name)
+		return
+	}
+	logrus.Errorf("%s %s server stopped", err, name)
+}
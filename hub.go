@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// clustersAnnotation lists the spoke clusters a ConfigMap or Secret of the hub rolls out to, comma separated
+	clustersAnnotation = "cre.cnvrg.io/clusters"
+	// capiClusterNameLabel names the cluster of a cluster-api kubeconfig Secret, <cluster>-kubeconfig
+	capiClusterNameLabel = "cluster.x-k8s.io/cluster-name"
+	spokeRequestTimeout  = 10 * time.Second
+)
+
+var (
+	spokeHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cre_spoke_cluster_healthy",
+		Help: "1 when the spoke cluster answered its last health check, 0 otherwise",
+	}, []string{"cluster"})
+	spokeRollouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_spoke_rollouts_total",
+		Help: "Workload rollouts in spoke clusters by cluster and result (triggered, skipped, unavailable)",
+	}, []string{"cluster", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(spokeHealthy, spokeRollouts)
+}
+
+// spokeCluster is a cached client of a spoke cluster, rebuilt only when its kubeconfig changes.
+// err holds why it's unhealthy, an invalid kubeconfig or a failed health check.
+type spokeCluster struct {
+	name       string
+	kubeconfig []byte
+	client     kubernetes.Interface
+	configErr  error
+	err        error
+}
+
+var (
+	spokesMu sync.Mutex
+	spokes   = map[string]*spokeCluster{}
+)
+
+// hubMode tells if cre rolls out to spoke clusters, sources without the clusters annotation still roll out locally
+func hubMode() bool {
+	return viper.GetString("spoke-kubeconfig-dir") != "" || viper.GetString("spoke-kubeconfig-namespace") != ""
+}
+
+// sourceClusters returns the spoke clusters of a source, only in hub mode
+func sourceClusters(annotations map[string]string) []string {
+	if !hubMode() || annotations[clustersAnnotation] == "" {
+		return nil
+	}
+	var clusters []string
+	for _, c := range strings.Split(annotations[clustersAnnotation], ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			clusters = append(clusters, c)
+		}
+	}
+	return mergeKeys(clusters, nil)
+}
+
+// setupSpokes loads the spoke kubeconfigs and health checks the spokes before the informers start,
+// then again every spoke-health-interval
+func setupSpokes() {
+	if !hubMode() {
+		return
+	}
+	refreshSpokes()
+	go func() {
+		for range time.Tick(viper.GetDuration("spoke-health-interval")) {
+			refreshSpokes()
+		}
+	}()
+}
+
+func refreshSpokes() {
+	kubeconfigs := spokeKubeconfigs()
+	spokesMu.Lock()
+	for name := range spokes {
+		if _, ok := kubeconfigs[name]; !ok {
+			logrus.Infof("kubeconfig of cluster %s was removed, no longer rolling out to it", name)
+			delete(spokes, name)
+			spokeHealthy.DeleteLabelValues(name)
+		}
+	}
+	var current []*spokeCluster
+	for name, kubeconfig := range kubeconfigs {
+		s := spokes[name]
+		if s == nil || !bytes.Equal(s.kubeconfig, kubeconfig) {
+			s = newSpokeCluster(name, kubeconfig)
+			spokes[name] = s
+		}
+		current = append(current, s)
+	}
+	spokesMu.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range current {
+		wg.Add(1)
+		go func(s *spokeCluster) {
+			defer wg.Done()
+			checkSpoke(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func newSpokeCluster(name string, kubeconfig []byte) *spokeCluster {
+	s := &spokeCluster{name: name, kubeconfig: kubeconfig}
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		s.configErr = fmt.Errorf("invalid kubeconfig: %s", err)
+		s.err = s.configErr
+		return s
+	}
+	config.Timeout = spokeRequestTimeout
+	if s.client, err = kubernetes.NewForConfig(config); err != nil {
+		s.configErr, s.err = err, err
+	}
+	return s
+}
+
+// checkSpoke health checks s by its server version, failures only affect the rollouts to s
+func checkSpoke(s *spokeCluster) {
+	err := s.configErr
+	if err == nil {
+		_, err = s.client.Discovery().ServerVersion()
+	}
+	spokesMu.Lock()
+	wasHealthy := s.err == nil
+	s.err = err
+	spokesMu.Unlock()
+	log := logrus.WithField("cluster", s.name)
+	if err != nil {
+		if wasHealthy {
+			log.Errorf("%s, cluster %s is unhealthy, rollouts to it are skipped", err, s.name)
+		}
+		spokeHealthy.WithLabelValues(s.name).Set(0)
+		return
+	}
+	if !wasHealthy {
+		log.Infof("cluster %s is healthy", s.name)
+	}
+	spokeHealthy.WithLabelValues(s.name).Set(1)
+}
+
+// spokeKubeconfigs reads the kubeconfigs of the spokes from spoke-kubeconfig-dir, one file per cluster named after it,
+// and from the cluster-api <cluster>-kubeconfig Secrets of spoke-kubeconfig-namespace
+func spokeKubeconfigs() map[string][]byte {
+	kubeconfigs := map[string][]byte{}
+	if dir := viper.GetString("spoke-kubeconfig-dir"); dir != "" {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			logrus.Errorf("%s failed to read spoke kubeconfigs", err)
+		}
+		for _, f := range files {
+			// skips the ..data links of mounted Secrets and ConfigMaps
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			kubeconfig, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				logrus.Errorf("%s failed to read spoke kubeconfig %s", err, f.Name())
+				continue
+			}
+			kubeconfigs[strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))] = kubeconfig
+		}
+	}
+	if ns := viper.GetString("spoke-kubeconfig-namespace"); ns != "" {
+		secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), metav1.ListOptions{LabelSelector: capiClusterNameLabel})
+		if err != nil {
+			logrus.Errorf("%s failed to list spoke kubeconfig Secrets in namespace %s", err, ns)
+			secrets = &corev1.SecretList{}
+		}
+		for _, secret := range secrets.Items {
+			name := secret.Labels[capiClusterNameLabel]
+			if secret.Name != name+"-kubeconfig" || len(secret.Data["value"]) == 0 {
+				continue
+			}
+			kubeconfigs[name] = secret.Data["value"]
+		}
+	}
+	return kubeconfigs
+}
+
+// spokeClient returns the client of a healthy spoke
+func spokeClient(cluster string) (kubernetes.Interface, error) {
+	spokesMu.Lock()
+	defer spokesMu.Unlock()
+	s, ok := spokes[cluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %s, no kubeconfig found for it", cluster)
+	}
+	if s.err != nil {
+		return nil, fmt.Errorf("cluster %s is unhealthy: %s", cluster, s.err)
+	}
+	return s.client, nil
+}
+
+// workloadClient returns the client of the cluster running w, the local one unless w runs in a spoke,
+// impersonating the identity of its namespace if it has one
+func workloadClient(w Workload) (kubernetes.Interface, error) {
+	if w.Cluster == "" {
+		return namespaceClient(w.Namespace)
+	}
+	return spokeClient(w.Cluster)
+}
+
+// spokeTargets lists the labeled workloads of every spoke of src, in the rollout namespace.
+// An unavailable spoke is skipped and reported, the others still roll out.
+func spokeTargets(src Source, matchLabelValue string) []Workload {
+	if src.Unlabeled {
+		return nil
+	}
+	var targets []Workload
+	for _, cluster := range src.Clusters {
+		found, err := spokeWorkloads(cluster, src.RolloutNamespace(), matchLabelValue)
+		if err != nil {
+			msg := fmt.Sprintf("skipping rollout of %s to cluster %s: %s", src, cluster, err)
+			src.log().WithField("cluster", cluster).Error(msg)
+			spokeRollouts.WithLabelValues(cluster, "unavailable").Inc()
+			notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Outcome: "skipped", Error: msg})
+			recordSourceEvent(src, corev1.EventTypeWarning, "ClusterUnavailable", msg)
+			continue
+		}
+		targets = append(targets, found...)
+	}
+	return targets
+}
+
+func spokeWorkloads(cluster, ns, matchLabelValue string) ([]Workload, error) {
+	client, err := spokeClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+	matchLabel := viper.GetString("match-label")
+	opts := metav1.ListOptions{LabelSelector: matchLabel + "=" + matchLabelValue}
+	apps := client.AppsV1()
+	var targets []Workload
+	deployments, err := apps.Deployments(ns).List(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deployments.Items {
+		targets = append(targets, Workload{Kind: "Deployment", Namespace: ns, Name: d.Name, Cluster: cluster})
+	}
+	statefulSets, err := apps.StatefulSets(ns).List(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range statefulSets.Items {
+		targets = append(targets, Workload{Kind: "StatefulSet", Namespace: ns, Name: s.Name, Cluster: cluster})
+	}
+	daemonSets, err := apps.DaemonSets(ns).List(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range daemonSets.Items {
+		targets = append(targets, Workload{Kind: "DaemonSet", Namespace: ns, Name: d.Name, Cluster: cluster})
+	}
+	return targets, nil
+}
+
+// recordSpokeRollout counts the rollouts of spoke workloads per cluster
+func recordSpokeRollout(w Workload, triggered bool) {
+	if w.Cluster == "" {
+		return
+	}
+	result := "skipped"
+	if triggered {
+		result = "triggered"
+	}
+	spokeRollouts.WithLabelValues(w.Cluster, result).Inc()
+}
+
+// targetClusters lists the spokes of the targets, for the events of the hub
+func targetClusters(targets []Workload) []string {
+	seen := map[string]bool{}
+	var clusters []string
+	for _, w := range targets {
+		if w.Cluster != "" && !seen[w.Cluster] {
+			seen[w.Cluster] = true
+			clusters = append(clusters, w.Cluster)
+		}
+	}
+	sort.Strings(clusters)
+	return clusters
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Namespace annotations naming the identity rollouts in the namespace are performed as, with --impersonate-annotations
+const (
+	impersonateUserAnnotation   = "cre.cnvrg.io/impersonate-user"
+	impersonateGroupsAnnotation = "cre.cnvrg.io/impersonate-groups"
+	// namespaceIdentityTTL bounds how long an annotation change takes to apply
+	namespaceIdentityTTL = 30 * time.Second
+)
+
+// impersonation is the tenant identity of a namespace, from the impersonation mapping of the config file
+// or the namespace annotations
+type impersonation struct {
+	User   string   `mapstructure:"user"`
+	Groups []string `mapstructure:"groups"`
+}
+
+func (i impersonation) String() string {
+	if len(i.Groups) == 0 {
+		return "user " + i.User
+	}
+	return fmt.Sprintf("user %s (groups %s)", i.User, strings.Join(i.Groups, ", "))
+}
+
+// key identifies the cached client of the identity
+func (i impersonation) key() string {
+	groups := append([]string{}, i.Groups...)
+	sort.Strings(groups)
+	return i.User + "|" + strings.Join(groups, ",")
+}
+
+type namespaceIdentity struct {
+	identity impersonation
+	found    bool
+	fetched  time.Time
+}
+
+var (
+	impersonationMu sync.Mutex
+	// namespaceIdentities caches the identity of each namespace for namespaceIdentityTTL
+	namespaceIdentities = map[string]namespaceIdentity{}
+	// impersonatedClients caches a client per identity, dropped once no namespace maps to it anymore
+	impersonatedClients = map[string]kubernetes.Interface{}
+)
+
+// errNoIdentity skips rollouts to namespaces without an identity when --impersonate-required is set
+var errNoIdentity = errors.New("no impersonation identity")
+
+func impersonationEnabled() bool {
+	return viper.GetBool("impersonate-annotations") || viper.IsSet("impersonation")
+}
+
+// namespaceImpersonation returns the identity of ns, the mapping of the config file takes precedence over the annotations
+func namespaceImpersonation(ns string) (impersonation, bool) {
+	var mapping map[string]impersonation
+	if err := viper.UnmarshalKey("impersonation", &mapping); err != nil {
+		logrus.Errorf("%s failed to read the impersonation mapping of the config file", err)
+	}
+	if identity, ok := mapping[ns]; ok && identity.User != "" {
+		invalidateImpersonation(ns, identity, true)
+		return identity, true
+	}
+	if !viper.GetBool("impersonate-annotations") {
+		invalidateImpersonation(ns, impersonation{}, false)
+		return impersonation{}, false
+	}
+	impersonationMu.Lock()
+	cached, ok := namespaceIdentities[ns]
+	impersonationMu.Unlock()
+	if ok && time.Since(cached.fetched) < namespaceIdentityTTL {
+		return cached.identity, cached.found
+	}
+	namespace, err := clientset().CoreV1().Namespaces().Get(context.Background(), ns, metav1.GetOptions{})
+	if err != nil {
+		logrus.Errorf("%s failed to get namespace %s for its impersonation annotations", err, ns)
+		// keeps the previous identity, a failed lookup mustn't widen the permissions of the rollouts
+		return cached.identity, cached.found
+	}
+	identity, found := annotatedImpersonation(namespace)
+	invalidateImpersonation(ns, identity, found)
+	return identity, found
+}
+
+func annotatedImpersonation(namespace *corev1.Namespace) (impersonation, bool) {
+	user := namespace.Annotations[impersonateUserAnnotation]
+	if user == "" {
+		return impersonation{}, false
+	}
+	identity := impersonation{User: user}
+	for _, g := range strings.Split(namespace.Annotations[impersonateGroupsAnnotation], ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			identity.Groups = append(identity.Groups, g)
+		}
+	}
+	return identity, true
+}
+
+// invalidateImpersonation caches the identity of ns, dropping the client of its previous identity when it changed
+func invalidateImpersonation(ns string, identity impersonation, found bool) {
+	impersonationMu.Lock()
+	defer impersonationMu.Unlock()
+	previous, ok := namespaceIdentities[ns]
+	namespaceIdentities[ns] = namespaceIdentity{identity: identity, found: found, fetched: time.Now()}
+	if !ok || (previous.found == found && previous.identity.key() == identity.key()) {
+		return
+	}
+	logrus.Infof("impersonation of namespace %s changed, rolling out as %s", ns, describeIdentity(identity, found))
+	for _, other := range namespaceIdentities {
+		if other.found && other.identity.key() == previous.identity.key() {
+			return
+		}
+	}
+	delete(impersonatedClients, previous.identity.key())
+}
+
+func describeIdentity(identity impersonation, found bool) string {
+	if !found {
+		return "cre"
+	}
+	return identity.String()
+}
+
+// namespaceRESTConfig returns the config of the rollout calls in ns, impersonating its identity if it has one
+func namespaceRESTConfig(ns string) (*rest.Config, error) {
+	config := restConfig()
+	if !impersonationEnabled() {
+		return config, nil
+	}
+	identity, found := namespaceImpersonation(ns)
+	if !found {
+		if viper.GetBool("impersonate-required") {
+			return nil, fmt.Errorf("%w for namespace %s, skipping as --impersonate-required is set", errNoIdentity, ns)
+		}
+		return config, nil
+	}
+	config.Impersonate = rest.ImpersonationConfig{UserName: identity.User, Groups: identity.Groups}
+	return config, nil
+}
+
+// namespaceClient returns the client of the rollout calls in ns, cached per identity
+func namespaceClient(ns string) (kubernetes.Interface, error) {
+	if !impersonationEnabled() {
+		return clientset(), nil
+	}
+	identity, found := namespaceImpersonation(ns)
+	if !found {
+		if viper.GetBool("impersonate-required") {
+			return nil, fmt.Errorf("%w for namespace %s, skipping as --impersonate-required is set", errNoIdentity, ns)
+		}
+		return clientset(), nil
+	}
+	impersonationMu.Lock()
+	defer impersonationMu.Unlock()
+	if client, ok := impersonatedClients[identity.key()]; ok {
+		return client, nil
+	}
+	config := restConfig()
+	config.Impersonate = rest.ImpersonationConfig{UserName: identity.User, Groups: identity.Groups}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	impersonatedClients[identity.key()] = client
+	return client, nil
+}
+
+// impersonationFailed records the patch errors caused by impersonation on the source, attributed to the tenant identity
+// whose role denied them, true when err is one of them
+func impersonationFailed(src Source, w Workload, err error) bool {
+	if errors.Is(err, errNoIdentity) {
+		recordSourceEvent(src, corev1.EventTypeWarning, "RolloutSkipped", err.Error())
+		return true
+	}
+	if !impersonationEnabled() || !apierrors.IsForbidden(err) {
+		return false
+	}
+	identity, found := namespaceImpersonation(w.Namespace)
+	if !found {
+		return false
+	}
+	msg := fmt.Sprintf("the role of %s in namespace %s denied restarting %s: %s", identity, w.Namespace, w, err)
+	src.log().Warn(msg)
+	recordSourceEvent(src, corev1.EventTypeWarning, "RolloutForbidden", msg)
+	return true
+}
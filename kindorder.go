@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// rolloutKindOrder returns the order of the workload kinds of --rollout-kind-order, the kinds it leaves out
+// appended in the default order. Unknown and repeated kinds are rejected.
+func rolloutKindOrder() ([]string, error) {
+	var order []string
+	seen := map[string]bool{}
+	for _, resource := range viper.GetStringSlice("rollout-kind-order") {
+		resource = strings.ToLower(strings.TrimSpace(resource))
+		known := false
+		for _, r := range workloadResources {
+			known = known || r == resource
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown kind %s in --rollout-kind-order, expected %s", resource, strings.Join(workloadResources, ", "))
+		}
+		if seen[resource] {
+			return nil, fmt.Errorf("%s is repeated in --rollout-kind-order", resource)
+		}
+		seen[resource] = true
+		order = append(order, resource)
+	}
+	for _, r := range workloadResources {
+		if !seen[r] {
+			order = append(order, r)
+		}
+	}
+	return order, nil
+}
+
+// setupRolloutKindOrder fails on an invalid --rollout-kind-order before any change is rolled out
+func setupRolloutKindOrder() {
+	order, err := rolloutKindOrder()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if !viper.IsSet("rollout-kind-order") && !viper.GetBool("rollout-kind-wait") {
+		return
+	}
+	msg := "rolling out " + strings.Join(order, ", ")
+	if viper.GetBool("rollout-kind-wait") {
+		msg += ", each kind once the previous one is ready"
+	}
+	logrus.Info(msg)
+}
+
+// kindGroups splits the targets by kind, in the order of --rollout-kind-order, keeping their order within a kind
+func kindGroups(targets []Workload) [][]Workload {
+	order, _ := rolloutKindOrder()
+	rank := map[string]int{}
+	for i, resource := range order {
+		rank[resource] = i
+	}
+	sorted := append([]Workload{}, targets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank[workloadKindResources[sorted[i].Kind]] < rank[workloadKindResources[sorted[j].Kind]]
+	})
+	var groups [][]Workload
+	for i, w := range sorted {
+		if i == 0 || w.Kind != sorted[i-1].Kind {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], w)
+	}
+	return groups
+}
+
+// inKindOrder sorts the targets by kind, in the order of --rollout-kind-order
+func inKindOrder(targets []Workload) []Workload {
+	var ordered []Workload
+	for _, g := range kindGroups(targets) {
+		ordered = append(ordered, g...)
+	}
+	return ordered
+}
+
+// enqueueInKindOrder queues the targets of src kind by kind. Without --rollout-kind-wait they're all queued at once,
+// the order being the one they start in. With it each kind is queued once the previous one was restarted and is ready,
+// the remaining kinds being skipped when it isn't within rollout-timeout. All kinds are part of a single batch,
+// reported once the last one was processed.
+func enqueueInKindOrder(src Source, targets []Workload) {
+	groups := kindGroups(targets)
+	if !viper.GetBool("rollout-kind-wait") || len(groups) < 2 {
+		enqueueRollouts(src, inKindOrder(targets))
+		return
+	}
+	batch := newRolloutBatch(src, len(targets))
+	go func() {
+		for i, g := range groups {
+			queueBatch(batch, g)
+			if i == len(groups)-1 {
+				return
+			}
+			if err := waitKindReady(g); err != nil {
+				var skipped []Workload
+				for _, rest := range groups[i+1:] {
+					skipped = append(skipped, rest...)
+				}
+				msg := fmt.Sprintf("%s, not rolling out the %d remaining workloads", err, len(skipped))
+				src.log().Warn(msg)
+				notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: skipped, Outcome: "skipped", Error: msg})
+				for _, w := range skipped {
+					batch.done(w, false)
+				}
+				return
+			}
+			traceDecision(src, stageQueue, "kind-ready", nil, "%s ready, rolling out %s", workloadKindResources[g[0].Kind], workloadKindResources[groups[i+1][0].Kind])
+		}
+	}()
+}
+
+// waitKindReady waits for the workloads to leave the rollout queue and complete their rollout
+func waitKindReady(workloads []Workload) error {
+	timeout := viper.GetDuration("rollout-timeout")
+	deadline := time.Now().Add(timeout)
+	for {
+		ready := 0
+		for _, w := range workloads {
+			rolloutsMu.Lock()
+			queued := len(pendingBatches[w]) > 0
+			rolloutsMu.Unlock()
+			if queued {
+				continue
+			}
+			// a deleted workload has nothing left to wait for
+			if done, err := rolloutDone(w); apierrors.IsNotFound(err) || (err == nil && done) {
+				ready++
+			}
+		}
+		if ready == len(workloads) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d of %d %s weren't ready within %s", len(workloads)-ready, len(workloads), workloadKindResources[workloads[0].Kind], timeout)
+		}
+		time.Sleep(rolloutPollInterval)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKindOrderedChangeIsReportedOnce(t *testing.T) {
+	web := labeledDeployment("apps", "ordered-web", "app")
+	web.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+	db := &appsv1.StatefulSet{ObjectMeta: labeledDeployment("apps", "ordered-db", "app").ObjectMeta}
+	client := fakeClientset(t, web, db)
+	events := fakeRecorder(t)
+	notifier := &fakeNotifier{name: "fake"}
+	fakeNotifiers(t, notifier)
+	setFlags(t, map[string]interface{}{"rollout-kind-wait": true, "pair-window": time.Duration(0), "preflight-dry-run": false, "track-rollouts": false})
+	interval := rolloutPollInterval
+	rolloutPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { rolloutPollInterval = interval })
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", CorrelationID: "ordered"}
+	enqueueInKindOrder(src, []Workload{{Kind: "StatefulSet", Namespace: "apps", Name: "ordered-db"}, {Kind: "Deployment", Namespace: "apps", Name: "ordered-web"}})
+	// the StatefulSet is queued once the Deployment restarted and is ready
+	deadline := time.Now().Add(5 * time.Second)
+	var reported []RolloutEvent
+	for len(reported) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the change wasn't reported")
+		}
+		processQueuedRollouts(t)
+		drainNotifiers(time.Second)
+		for _, event := range notifier.delivered() {
+			if event.Type == EventRolloutTriggered {
+				reported = append(reported, event)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var patched []string
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" {
+			patched = append(patched, action.GetResource().Resource)
+		}
+	}
+	if len(patched) != 2 || patched[0] != "deployments" || patched[1] != "statefulsets" {
+		t.Fatalf("expected the Deployment then the StatefulSet restarted, got the patches of %v", patched)
+	}
+	if len(reported) != 1 || len(reported[0].Targets) != 2 {
+		t.Fatalf("expected a single rollout-triggered notification for both kinds, got %v", reported)
+	}
+	// the workloads get an event each, the source a single one
+	var reloaded []string
+	for _, event := range recordedEvents(events) {
+		if strings.Contains(event, "ConfigReloaded Restarted ") && strings.Contains(event, " workloads ") {
+			reloaded = append(reloaded, event)
+		}
+	}
+	if len(reloaded) != 1 || !strings.Contains(reloaded[0], "Restarted 2 workloads") {
+		t.Fatalf("expected a single event for the change, got %v", reloaded)
+	}
+}
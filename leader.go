@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// leaderElectionLease is the Lease the replicas of cre contest
+const leaderElectionLease = "cnvrg-cre-leader"
+
+// leader is 1 while this replica holds the Lease
+var leader int32
+
+// leading tells if this replica may roll out, always without --enable-leader-election
+func leading() bool {
+	return !viper.GetBool("enable-leader-election") || atomic.LoadInt32(&leader) == 1
+}
+
+// leaderElectionNamespace returns the namespace of the Lease, --leader-election-namespace or the namespace of the pod
+func leaderElectionNamespace() (string, error) {
+	if ns := viper.GetString("leader-election-namespace"); ns != "" {
+		return ns, nil
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	return "", fmt.Errorf("--enable-leader-election needs --leader-election-namespace or the POD_NAMESPACE env")
+}
+
+// runLeaderElection runs lead once this replica holds the Lease, until ctx is done. Losing the Lease exits,
+// so the pod restarts and contests it again instead of rolling out next to the new leader.
+func runLeaderElection(ctx context.Context, lead func(ctx context.Context)) {
+	ns, err := leaderElectionNamespace()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	identity := hostname + "_" + string(uuid.NewUUID())
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: ns, Name: leaderElectionLease},
+		Client:     clientset().CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	logrus.Infof("contesting the leadership on Lease %s/%s as %s", ns, leaderElectionLease, identity)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            leaderElectionLease,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logrus.Infof("leading as %s, watching config changes", identity)
+				atomic.StoreInt32(&leader, 1)
+				lead(ctx)
+			},
+			OnStoppedLeading: func() {
+				atomic.StoreInt32(&leader, 0)
+				if ctx.Err() != nil {
+					logrus.Infof("released the leadership of Lease %s/%s", ns, leaderElectionLease)
+					return
+				}
+				logrus.Fatalf("lost the leadership of Lease %s/%s, exiting to contest it again", ns, leaderElectionLease)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logrus.Infof("%s leads, standing by", leader)
+				}
+			},
+		},
+	})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadtestOwnerLabel marks the namespaces, ConfigMaps and Deployments created by cre loadtest, its value the prefix.
+// Existing namespaces without it are never touched.
+const loadtestOwnerLabel = "cre.cnvrg.io/loadtest-owner"
+
+// loadtestCmd drives changes of labeled ConfigMaps against the running controller and reports the reload latency.
+// Its flags aren't bound to viper, --namespaces would clash with the controller flags.
+var loadtestCmd = &cobra.Command{
+	Use:   "loadtest",
+	Short: "measure the reload latency of the running controller under churn, against a test cluster",
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		cfg := loadtestConfig{}
+		cfg.prefix, _ = flags.GetString("namespace-prefix")
+		cfg.namespaces, _ = flags.GetInt("namespaces")
+		cfg.configMaps, _ = flags.GetInt("configmaps-per-ns")
+		cfg.duration, _ = flags.GetDuration("duration")
+		cfg.drain, _ = flags.GetDuration("drain-timeout")
+		cfg.waitReady, _ = flags.GetBool("wait-ready")
+		cfg.keep, _ = flags.GetBool("keep")
+		rate, _ := flags.GetString("change-rate")
+		var err error
+		if cfg.interval, err = parseChangeRate(rate); err != nil {
+			logrus.Fatal(err)
+		}
+		if err := runLoadtest(os.Stdout, cfg); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+func setupLoadtestFlags() {
+	flags := loadtestCmd.Flags()
+	flags.String("namespace-prefix", "", "prefix of the test namespaces, <prefix>-<n>, required. Existing namespaces not created by cre loadtest are refused")
+	flags.Int("namespaces", 50, "test namespaces to create")
+	flags.Int("configmaps-per-ns", 20, "labeled ConfigMaps, each with a Deployment consuming it, per test namespace")
+	flags.String("change-rate", "10/s", "ConfigMap updates to drive, <n>/s, <n>/m or <n>/h")
+	flags.Duration("duration", 10*time.Minute, "time to drive updates for")
+	flags.Duration("drain-timeout", 2*time.Minute, "time to wait for the last changes to be rolled out, changes rolled out later are reported as errors")
+	flags.Bool("wait-ready", false, "also measure the latency until the restarted Deployments are ready")
+	flags.Bool("keep", false, "keep the test namespaces instead of deleting them")
+}
+
+type loadtestConfig struct {
+	prefix          string
+	namespaces      int
+	configMaps      int
+	interval        time.Duration
+	duration, drain time.Duration
+	waitReady, keep bool
+	matchLabel      string
+}
+
+// parseChangeRate returns the interval between two updates of a rate like 10/s
+func parseChangeRate(rate string) (time.Duration, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	unit := time.Second
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "s":
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		default:
+			return 0, fmt.Errorf("invalid --change-rate %s, expected <n>/s, <n>/m or <n>/h", rate)
+		}
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid --change-rate %s, expected <n>/s, <n>/m or <n>/h", rate)
+	}
+	return time.Duration(float64(unit) / n), nil
+}
+
+// loadtestTarget tracks the updates of a test ConfigMap until its Deployment is restarted for them
+type loadtestTarget struct {
+	// pending holds when the updates not rolled out yet were made
+	pending []time.Time
+	// restarted is when the updates of the last restart were first made, until it's ready with --wait-ready
+	restarted     time.Time
+	correlationID string
+}
+
+type loadtestStats struct {
+	mu        sync.Mutex
+	targets   map[string]*loadtestTarget
+	updates   int
+	coalesced int
+	patch     []time.Duration
+	ready     []time.Duration
+	errors    map[string]int
+}
+
+func (s *loadtestStats) fail(what string) {
+	s.mu.Lock()
+	s.errors[what]++
+	s.mu.Unlock()
+}
+
+func runLoadtest(out io.Writer, cfg loadtestConfig) error {
+	if cfg.prefix == "" {
+		return fmt.Errorf("--namespace-prefix is required, cre loadtest only touches the namespaces it creates under it")
+	}
+	if errs := validation.IsDNS1123Label(fmt.Sprintf("%s-%d", cfg.prefix, cfg.namespaces)); len(errs) > 0 {
+		return fmt.Errorf("invalid --namespace-prefix %s: %s", cfg.prefix, strings.Join(errs, ", "))
+	}
+	if cfg.namespaces <= 0 || cfg.configMaps <= 0 {
+		return fmt.Errorf("--namespaces and --configmaps-per-ns must be positive")
+	}
+	cfg.matchLabel = viper.GetString("match-label")
+	cs := clientset()
+	if err := checkLoadtestOwnership(cs, cfg); err != nil {
+		return err
+	}
+	before := scrapeControllerMetrics()
+	if !cfg.keep {
+		defer cleanupLoadtest(cs, cfg)
+	}
+	if err := createLoadtestObjects(cs, cfg); err != nil {
+		return err
+	}
+	stats := &loadtestStats{targets: map[string]*loadtestTarget{}, errors: map[string]int{}}
+	for i := 0; i < cfg.namespaces; i++ {
+		for j := 0; j < cfg.configMaps; j++ {
+			stats.targets[loadtestKey(loadtestNamespace(cfg, i), loadtestName(j))] = &loadtestTarget{}
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := watchLoadtestDeployments(cs, cfg, stats, stop); err != nil {
+		return err
+	}
+	logrus.Infof("driving an update every %s for %s over %d ConfigMaps", cfg.interval, cfg.duration, cfg.namespaces*cfg.configMaps)
+	driveLoadtestUpdates(cs, cfg, stats)
+	drainLoadtest(cfg, stats)
+	printLoadtest(out, cfg, stats, before, scrapeControllerMetrics())
+	return nil
+}
+
+func loadtestNamespace(cfg loadtestConfig, i int) string {
+	return fmt.Sprintf("%s-%d", cfg.prefix, i)
+}
+
+func loadtestName(j int) string {
+	return fmt.Sprintf("loadtest-%d", j)
+}
+
+func loadtestKey(ns, name string) string {
+	return ns + "/" + name
+}
+
+// checkLoadtestOwnership refuses to run when a test namespace exists and wasn't created by cre loadtest with the prefix
+func checkLoadtestOwnership(cs kubernetes.Interface, cfg loadtestConfig) error {
+	for i := 0; i < cfg.namespaces; i++ {
+		name := loadtestNamespace(cfg, i)
+		ns, err := cs.CoreV1().Namespaces().Get(context.Background(), name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s failed to check namespace %s", err, name)
+		}
+		if ns.Labels[loadtestOwnerLabel] != cfg.prefix {
+			return fmt.Errorf("namespace %s exists and isn't labeled %s=%s, refusing to run, pick a --namespace-prefix cre loadtest owns", name, loadtestOwnerLabel, cfg.prefix)
+		}
+	}
+	return nil
+}
+
+// createLoadtestObjects creates the test namespaces, their labeled ConfigMaps and a Deployment of a single pause pod per ConfigMap
+func createLoadtestObjects(cs kubernetes.Interface, cfg loadtestConfig) error {
+	owner := map[string]string{loadtestOwnerLabel: cfg.prefix}
+	replicas := int32(1)
+	for i := 0; i < cfg.namespaces; i++ {
+		ns := loadtestNamespace(cfg, i)
+		_, err := cs.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns, Labels: owner}}, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("%s failed to create namespace %s", err, ns)
+		}
+		for j := 0; j < cfg.configMaps; j++ {
+			name := loadtestName(j)
+			labels := map[string]string{loadtestOwnerLabel: cfg.prefix, cfg.matchLabel: name}
+			cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels}, Data: map[string]string{"seq": "0"}}
+			if _, err := cs.CoreV1().ConfigMaps(ns).Create(context.Background(), cm, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("%s failed to create ConfigMap %s/%s", err, ns, name)
+			}
+			selector := map[string]string{loadtestOwnerLabel: cfg.prefix, "app": name}
+			d := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels},
+				Spec: appsv1.DeploymentSpec{
+					Replicas: &replicas,
+					Selector: &metav1.LabelSelector{MatchLabels: selector},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: selector},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name:         "pause",
+								Image:        "registry.k8s.io/pause:3.9",
+								VolumeMounts: []corev1.VolumeMount{{Name: "config", MountPath: "/config"}},
+							}},
+							Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+							}}},
+						},
+					},
+				},
+			}
+			if _, err := cs.AppsV1().Deployments(ns).Create(context.Background(), d, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+				return fmt.Errorf("%s failed to create Deployment %s/%s", err, ns, name)
+			}
+		}
+	}
+	logrus.Infof("created %d namespaces of %d ConfigMaps and Deployments", cfg.namespaces, cfg.configMaps)
+	return nil
+}
+
+// watchLoadtestDeployments measures the latencies as the controller restarts the test Deployments,
+// a restart being a new correlation id on their pod template
+func watchLoadtestDeployments(cs kubernetes.Interface, cfg loadtestConfig, stats *loadtestStats, stop chan struct{}) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = loadtestOwnerLabel + "=" + cfg.prefix
+	}))
+	informer := factory.Apps().V1().Deployments().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			d := newObj.(*appsv1.Deployment)
+			now := time.Now()
+			stats.mu.Lock()
+			defer stats.mu.Unlock()
+			t := stats.targets[loadtestKey(d.Namespace, d.Name)]
+			if t == nil {
+				return
+			}
+			if id := d.Spec.Template.Annotations[correlationIDAnnotation]; id != "" && id != t.correlationID {
+				t.correlationID = id
+				if len(t.pending) == 0 {
+					stats.errors["restart without a change"]++
+					return
+				}
+				stats.patch = append(stats.patch, now.Sub(t.pending[0]))
+				stats.coalesced += len(t.pending) - 1
+				t.restarted, t.pending = t.pending[0], nil
+			}
+			if cfg.waitReady && !t.restarted.IsZero() && deploymentReady(d) {
+				stats.ready = append(stats.ready, now.Sub(t.restarted))
+				t.restarted = time.Time{}
+			}
+		},
+	})
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, informer.HasSynced) {
+		return fmt.Errorf("failed to sync the test Deployments")
+	}
+	return nil
+}
+
+func deploymentReady(d *appsv1.Deployment) bool {
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return d.Status.ObservedGeneration >= d.Generation && d.Status.UpdatedReplicas == replicas &&
+		d.Status.AvailableReplicas == replicas && d.Status.Replicas == replicas
+}
+
+// driveLoadtestUpdates updates a random test ConfigMap every interval for the duration
+func driveLoadtestUpdates(cs kubernetes.Interface, cfg loadtestConfig, stats *loadtestStats) {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	deadline := time.After(cfg.duration)
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-ticker.C:
+			ns, name := loadtestNamespace(cfg, rand.Intn(cfg.namespaces)), loadtestName(rand.Intn(cfg.configMaps))
+			go func() {
+				patch := []byte(fmt.Sprintf(`{"data":{"seq":"%d"}}`, time.Now().UnixNano()))
+				if _, err := cs.CoreV1().ConfigMaps(ns).Patch(context.Background(), name, "application/merge-patch+json", patch, metav1.PatchOptions{}); err != nil {
+					logrus.Errorf("%s failed to update ConfigMap %s/%s", err, ns, name)
+					stats.fail("update failed")
+					return
+				}
+				stats.mu.Lock()
+				t := stats.targets[loadtestKey(ns, name)]
+				t.pending = append(t.pending, time.Now())
+				stats.updates++
+				stats.mu.Unlock()
+			}()
+		}
+	}
+}
+
+// drainLoadtest waits for the changes still pending to be rolled out, and counts the ones which weren't
+func drainLoadtest(cfg loadtestConfig, stats *loadtestStats) {
+	deadline := time.Now().Add(cfg.drain)
+	for {
+		stats.mu.Lock()
+		pending, notReady := 0, 0
+		for _, t := range stats.targets {
+			pending += len(t.pending)
+			if cfg.waitReady && !t.restarted.IsZero() {
+				notReady++
+			}
+		}
+		if pending+notReady == 0 || time.Now().After(deadline) {
+			if pending > 0 {
+				stats.errors["change never rolled out"] += pending
+			}
+			if notReady > 0 {
+				stats.errors["restart never ready"] += notReady
+			}
+			stats.mu.Unlock()
+			return
+		}
+		stats.mu.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// cleanupLoadtest deletes the test namespaces, only the ones labeled with the prefix
+func cleanupLoadtest(cs kubernetes.Interface, cfg loadtestConfig) {
+	for i := 0; i < cfg.namespaces; i++ {
+		name := loadtestNamespace(cfg, i)
+		ns, err := cs.CoreV1().Namespaces().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil || ns.Labels[loadtestOwnerLabel] != cfg.prefix {
+			continue
+		}
+		if err := cs.CoreV1().Namespaces().Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			logrus.Errorf("%s failed to delete namespace %s", err, name)
+		}
+	}
+	logrus.Infof("deleting the %d test namespaces", cfg.namespaces)
+}
+
+// scrapeControllerMetrics reads the cre_ samples of the running controller at --controller-url, nil without it
+func scrapeControllerMetrics() map[string]float64 {
+	url := viper.GetString("controller-url")
+	if url == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(url, "/")+"/metrics", nil)
+	if err != nil {
+		return nil
+	}
+	if token, _ := readSecret("admin-token", "admin-token-file"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := (&http.Client{Timeout: notifyTimeout}).Do(req)
+	if err != nil {
+		logrus.Errorf("%s failed to scrape the controller metrics", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "cre_") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if v, err := strconv.ParseFloat(line[i+1:], 64); i > 0 && err == nil {
+			samples[line[:i]] = v
+		}
+	}
+	return samples
+}
+
+func printLoadtest(out io.Writer, cfg loadtestConfig, stats *loadtestStats, before, after map[string]float64) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	fmt.Fprintf(out, "updates: %d, restarts: %d, updates coalesced into a restart with others: %d\n", stats.updates, len(stats.patch), stats.coalesced)
+	printPercentiles(out, "update to patch", stats.patch)
+	if cfg.waitReady {
+		printPercentiles(out, "update to ready", stats.ready)
+	}
+	if len(stats.errors) == 0 {
+		fmt.Fprintln(out, "errors: none")
+	}
+	var failures []string
+	for what := range stats.errors {
+		failures = append(failures, what)
+	}
+	sort.Strings(failures)
+	for _, what := range failures {
+		fmt.Fprintf(out, "error: %s: %d\n", what, stats.errors[what])
+	}
+	if after == nil {
+		return
+	}
+	var changed []string
+	for sample, v := range after {
+		if v != before[sample] {
+			changed = append(changed, sample)
+		}
+	}
+	sort.Strings(changed)
+	for _, sample := range changed {
+		fmt.Fprintf(out, "controller %s: %g -> %g\n", sample, before[sample], after[sample])
+	}
+}
+
+func printPercentiles(out io.Writer, what string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Fprintf(out, "%s: no samples\n", what)
+		return
+	}
+	sorted := append([]time.Duration{}, latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := func(q float64) time.Duration { return sorted[int(q*float64(len(sorted)-1))].Round(time.Millisecond) }
+	fmt.Fprintf(out, "%s: p50 %s, p90 %s, p99 %s, max %s over %d samples\n", what, p(0.5), p(0.9), p(0.99), sorted[len(sorted)-1].Round(time.Millisecond), len(sorted))
+}
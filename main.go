@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/d4l3k/messagediff.v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -17,9 +21,15 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,6 +46,234 @@ var rootParams = []Param{
 	{Name: "match-label", Shorthand: "", Value: "mlops.cnvrg.io", Usage: "label to use for matching"},
 	{Name: "json-log", Shorthand: "J", Value: false, Usage: "--json-log=true|false"},
 	{Name: "kubeconfig", Shorthand: "", Value: kubeconfigDefaultLocation(), Usage: "absolute path to the kubeconfig file"},
+	{Name: "spoke-kubeconfig-dir", Shorthand: "", Value: "", Usage: "directory of kubeconfig files named after their spoke cluster, enables rolling out to spokes with the cre.cnvrg.io/clusters annotation"},
+	{Name: "spoke-kubeconfig-namespace", Shorthand: "", Value: "", Usage: "namespace of cluster-api <cluster>-kubeconfig Secrets of the spoke clusters, enables rolling out to spokes"},
+	{Name: "spoke-health-interval", Shorthand: "", Value: 30 * time.Second, Usage: "interval of the spoke health checks and kubeconfig reloads"},
+	{Name: "config", Shorthand: "c", Value: "", Usage: "path to a yaml config file, flags and env take precedence over it"},
+	{Name: "owner-kind", Shorthand: "", Value: "", Usage: "only react to ConfigMaps/Secrets controlled by an owner of this kind"},
+	{Name: "owner-name", Shorthand: "", Value: "", Usage: "only react to ConfigMaps/Secrets controlled by an owner with this name"},
+	{Name: "namespace", Shorthand: "n", Value: "", Usage: "namespace, or comma separated namespaces, to watch and roll out in with namespaced RBAC only, defaults to POD_NAMESPACE"},
+	{Name: "namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to watch and roll out in, overrides --namespace, all namespaces when both are empty, needing cluster wide RBAC"},
+	{Name: "namespace-regex", Shorthand: "", Value: "", Usage: "regular expression the namespaces rolled out in must match, e.g. ^team-.*-prod$, within --namespaces if set"},
+	{Name: "exclude-namespace-regex", Shorthand: "", Value: "", Usage: "regular expression of namespaces never rolled out in, winning over --namespace-regex"},
+	{Name: "auto-discover", Shorthand: "", Value: false, Usage: "also restart the workloads whose volumes mount a changed ConfigMap or Secret, neither needing the match label"},
+	{Name: "auto-discover-env", Shorthand: "", Value: false, Usage: "also restart the workloads whose env or envFrom reference a changed ConfigMap or Secret, single key references only when that key changed"},
+	{Name: "require-reference", Shorthand: "", Value: false, Usage: "only restart the labeled workloads whose volumes, envFrom or env reference the changed ConfigMap or Secret"},
+	{Name: "skip-annotation", Shorthand: "", Value: "cre.cnvrg.io/skip-rollout", Usage: "workload annotation which set to true keeps it from being restarted by any change, empty to disable"},
+	{Name: "rollout-namespace", Shorthand: "", Value: []string{}, Usage: "namespaces searched for the workloads of a change, can be repeated, defaults to the namespace of the change"},
+	{Name: "match-annotation", Shorthand: "", Value: "", Usage: "annotation key matching sources and workloads like the match label, for tools stripping unknown labels, winning over the label when both are set"},
+	{Name: "exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces never rolled out in, even for labeled sources, globs like vendor-* are supported"},
+	{Name: "list-page-size", Shorthand: "", Value: 0, Usage: "page size of the informers initial list, 0 for the client-go default"},
+	{Name: "decrypt-command", Shorthand: "", Value: "", Usage: "command decrypting Secret values from stdin to stdout, so only plaintext changes trigger rollouts"},
+	{Name: "decrypt-timeout", Shorthand: "", Value: 5 * time.Second, Usage: "timeout of a single decrypt-command run"},
+	{Name: "max-concurrent-rollouts", Shorthand: "", Value: 4, Usage: "workloads restarted in parallel"},
+	{Name: "configmap-workers", Shorthand: "", Value: 0, Usage: "dedicated workers for rollouts caused by ConfigMap changes, 0 to share the --max-concurrent-rollouts workers"},
+	{Name: "secret-workers", Shorthand: "", Value: 0, Usage: "dedicated workers for rollouts caused by Secret changes, 0 to share the --max-concurrent-rollouts workers"},
+	{Name: "app-profiles", Shorthand: "", Value: false, Usage: "reload known applications (nginx, haproxy, fluent-bit, prometheus) in place, selected by their container image"},
+	{Name: "in-place-reload-delay", Shorthand: "", Value: 90 * time.Second, Usage: "wait before an in-place reload, for the kubelet to update the mounted files"},
+	{Name: "rollout-stagger", Shorthand: "", Value: time.Duration(0), Usage: "minimal delay between the start of two rollouts"},
+	{Name: "capacity-check", Shorthand: "", Value: "off", Usage: "defers rollouts while the cluster lacks capacity, off|pending-pods (unschedulable Pending pods)|promql"},
+	{Name: "capacity-scope", Shorthand: "", Value: "namespace", Usage: "where pending-pods looks for unschedulable pods, namespace (of the workload)|cluster"},
+	{Name: "capacity-max-pending", Shorthand: "", Value: 0, Usage: "unschedulable Pending pods tolerated before deferring rollouts"},
+	{Name: "capacity-promql", Shorthand: "", Value: "", Usage: "PromQL query signaling a lack of capacity with any sample above 0, with capacity-check=promql"},
+	{Name: "capacity-prometheus-url", Shorthand: "", Value: "", Usage: "url of the Prometheus API capacity-promql runs on"},
+	{Name: "capacity-backoff", Shorthand: "", Value: 30 * time.Second, Usage: "first delay of a rollout deferred for capacity, doubled on each check up to 5m"},
+	{Name: "capacity-max-delay", Shorthand: "", Value: 15 * time.Minute, Usage: "time after which a rollout deferred for capacity runs anyway, with a warning"},
+	{Name: "rollout-kind-order", Shorthand: "", Value: []string{"deployments", "statefulsets", "daemonsets"}, Usage: "order the workload kinds of a change are rolled out in, kinds left out are appended in the default order"},
+	{Name: "rollout-kind-wait", Shorthand: "", Value: false, Usage: "roll out each kind of rollout-kind-order once the workloads of the previous one are ready, within rollout-timeout"},
+	{Name: "rollout-cooldown", Shorthand: "", Value: time.Duration(0), Usage: "minimal time between two restarts of the same workload, later ones are delayed"},
+	{Name: "breaker-max-changes", Shorthand: "", Value: 0, Usage: "matched changes within breaker-window above which rollouts are held until resumed, 0 to disable the circuit breaker"},
+	{Name: "breaker-window", Shorthand: "", Value: time.Minute, Usage: "window the matched changes are counted over by the circuit breaker"},
+	{Name: "breaker-auto-resume", Shorthand: "", Value: time.Duration(0), Usage: "delay after which a tripped circuit breaker resumes by itself, 0 to require cre resume"},
+	{Name: "breaker-drain-interval", Shorthand: "", Value: 10 * time.Second, Usage: "minimal delay between two rollouts while the ones held by the circuit breaker drain"},
+	{Name: "control-configmap", Shorthand: "", Value: "", Usage: "name of the control ConfigMap, enabled: \"false\" holds all rollouts and other keys override tunables at runtime"},
+	{Name: "control-namespace", Shorthand: "", Value: "", Usage: "namespace of the control ConfigMap, defaults to POD_NAMESPACE"},
+	{Name: "resync-period", Shorthand: "", Value: time.Duration(0), Usage: "period the informers redeliver their cached ConfigMaps and Secrets at, rolling out those differing from the data last seen, 0 to disable"},
+	{Name: "reconcile-interval", Shorthand: "", Value: time.Duration(0), Usage: "periodically look for source changes the informers missed, 0 to disable"},
+	{Name: "helm-wait-timeout", Shorthand: "", Value: 10 * time.Minute, Usage: "time a rollout is held back while the helm release of its source is upgrading, 0 to not wait"},
+	{Name: "argocd", Shorthand: "", Value: false, Usage: "hold rollouts back while the Argo CD Application tracking the source is syncing"},
+	{Name: "argocd-namespace", Shorthand: "", Value: "argocd", Usage: "namespace of the Argo CD Applications"},
+	{Name: "argocd-tracking-label", Shorthand: "", Value: "app.kubernetes.io/instance", Usage: "label Argo CD tracks resources with, when they don't carry the tracking-id annotation"},
+	{Name: "argocd-wait-timeout", Shorthand: "", Value: 10 * time.Minute, Usage: "time a rollout is held back by a running Argo CD sync"},
+	{Name: "flux", Shorthand: "", Value: true, Usage: "hold rollouts back while the Flux Kustomization or HelmRelease applying the source is reconciling"},
+	{Name: "flux-wait-timeout", Shorthand: "", Value: 10 * time.Minute, Usage: "time a rollout is held back by a Flux reconciliation"},
+	{Name: "min-changed-keys", Shorthand: "", Value: "", Usage: "rollout only when at least this many keys, or percentage of keys (e.g. 25%), changed, empty to rollout on every change"},
+	{Name: "require-key", Shorthand: "", Value: []string{}, Usage: "keys always triggering a rollout when changed, regardless of --min-changed-keys"},
+	{Name: "set-change-cause", Shorthand: "", Value: false, Usage: "set the kubernetes.io/change-cause annotation on restarted workloads, shown by kubectl rollout history"},
+	{Name: "summary-on-exit", Shorthand: "", Value: true, Usage: "log lifetime statistics and rollout latency percentiles on shutdown"},
+	{Name: "reload-policies", Shorthand: "", Value: true, Usage: "watch ReloadPolicy custom resources, set to false on clusters that can't install the CRD"},
+	{Name: "stakater-compat", Shorthand: "", Value: false, Usage: "also honor the stakater/Reloader workload annotations, watching all ConfigMaps and Secrets"},
+	{Name: "cascade-settle", Shorthand: "", Value: time.Duration(0), Usage: "delay after a change of a dependency before reloading the consumers of its dependents which didn't change meanwhile, 0 to wait for them to change"},
+	{Name: "cascade-timeout", Shorthand: "", Value: 10 * time.Minute, Usage: "time a cascade waits for a dependent to change before reloading its consumers anyway, without cascade-settle"},
+	{Name: "cascade-max-depth", Shorthand: "", Value: 5, Usage: "maximum length of a chain of depends-on annotations"},
+	{Name: "enable-leader-election", Shorthand: "", Value: false, Usage: "contest a Lease so that only one of several replicas watches changes and rolls out, the others standing by"},
+	{Name: "leader-election-namespace", Shorthand: "", Value: "", Usage: "namespace of the leader election Lease, defaults to POD_NAMESPACE"},
+	{Name: "kube-api-qps", Shorthand: "", Value: 50, Usage: "requests per second to the API server, shared by all the rollouts"},
+	{Name: "kube-api-burst", Shorthand: "", Value: 100, Usage: "requests to the API server allowed in a burst above --kube-api-qps"},
+	{Name: "shutdown-timeout", Shorthand: "", Value: 25 * time.Second, Usage: "time given to in-flight rollouts to complete on SIGTERM before exiting, below the terminationGracePeriodSeconds of the pod"},
+	{Name: "debounce", Shorthand: "", Value: 3 * time.Second, Usage: "delay the rollout of a changed ConfigMap or Secret until it didn't change for this long, rolling out successive changes once, 0 to disable"},
+	{Name: "coalesce-window", Shorthand: "", Value: time.Duration(0), Usage: "delay before restarting a workload, changes of other sources targeting it meanwhile are applied by the same restart"},
+	{Name: "pair-window", Shorthand: "", Value: 2 * time.Second, Usage: "delay before rolling out a ConfigMap or Secret sharing its name with a source of the other kind, to restart once for both"},
+	{Name: "max-batch-size", Shorthand: "", Value: 100, Usage: "maximum workloads restarted for a single change, 0 for no limit"},
+	{Name: "allow-large-batches", Shorthand: "", Value: false, Usage: "restart all matching workloads even beyond --max-batch-size"},
+	{Name: "verify-targets", Shorthand: "", Value: true, Usage: "get each workload right before patching it and skip the ones deleted or relabeled since they were matched"},
+	{Name: "dry-run", Shorthand: "", Value: false, Usage: "detect changes and log the workloads that would be patched, without patching them"},
+	{Name: "preflight-dry-run", Shorthand: "", Value: false, Usage: "validate each patch with a server side dry run and skip workloads it rejects"},
+	{Name: "rbac-check", Shorthand: "", Value: "degrade", Usage: "on RBAC denying a capability, degrade to skip the workload kinds and reload strategies needing it, strict to fail, off to not check"},
+	{Name: "rbac-recheck-interval", Shorthand: "", Value: 5 * time.Minute, Usage: "interval between reviews of the RBAC capabilities, picking up RBAC changes without a restart, 0 to only review on start"},
+	{Name: "impersonate-annotations", Shorthand: "", Value: false, Usage: "roll out as the user and groups of the cre.cnvrg.io/impersonate-user and impersonate-groups annotations of the namespace"},
+	{Name: "impersonate-required", Shorthand: "", Value: false, Usage: "skip rollouts to namespaces without an impersonation identity instead of rolling out as cre"},
+	{Name: "record-events", Shorthand: "", Value: true, Usage: "record a kubernetes event on the changed ConfigMap/Secret for every rollout, and on every workload it restarted or failed to"},
+	{Name: "record-reload-events", Shorthand: "", Value: false, Usage: "record every finished rollout as a ReloadEvent custom resource in the source namespace"},
+	{Name: "reload-events-max-age", Shorthand: "", Value: 30 * 24 * time.Hour, Usage: "prune ReloadEvents older than this, 0 to keep them"},
+	{Name: "reload-events-max-count", Shorthand: "", Value: 500, Usage: "ReloadEvents kept per namespace, the oldest beyond are pruned, 0 for no limit"},
+	{Name: "metrics-addr", Shorthand: "", Value: ":9090", Usage: "address to serve prometheus metrics on, empty to disable"},
+	{Name: "metrics-tls-cert", Shorthand: "", Value: "", Usage: "TLS certificate file of the metrics, admin and probe endpoints, reloaded when it changes"},
+	{Name: "metrics-tls-key", Shorthand: "", Value: "", Usage: "TLS key file of --metrics-tls-cert"},
+	{Name: "health-addr", Shorthand: "", Value: ":8081", Usage: "address to serve /healthz and /readyz on, apart from the authenticated endpoints, empty to serve them on metrics-addr"},
+	{Name: "http-auth", Shorthand: "", Value: "none", Usage: "authentication of the metrics endpoint, none|token|tokenreview, tokenreview also authenticates trigger api callers, the probes stay open"},
+	{Name: "http-auth-token-file", Shorthand: "", Value: "", Usage: "file holding the bearer token of --http-auth=token, HTTP_AUTH_TOKEN env takes precedence"},
+	{Name: "http-auth-users", Shorthand: "", Value: []string{}, Usage: "users allowed with --http-auth=tokenreview, e.g. system:serviceaccount:monitoring:prometheus, defaults to any authenticated user, the admin endpoints need a listed one"},
+	{Name: "otlp-metrics-endpoint", Shorthand: "", Value: "", Usage: "opentelemetry collector to push metrics to, host:port for grpc, a url for http, empty to disable"},
+	{Name: "otlp-metrics-protocol", Shorthand: "", Value: "grpc", Usage: "otlp protocol, grpc|http"},
+	{Name: "otlp-metrics-interval", Shorthand: "", Value: 30 * time.Second, Usage: "interval of otlp metrics pushes"},
+	{Name: "otlp-metrics-insecure", Shorthand: "", Value: false, Usage: "push otlp metrics over grpc without TLS"},
+	{Name: "otlp-metrics-ca-file", Shorthand: "", Value: "", Usage: "CA bundle to verify the collector with, defaults to the system roots"},
+	{Name: "otlp-metrics-header", Shorthand: "", Value: []string{}, Usage: "header to send with otlp metrics as name=value, can be repeated, e.g. for collector auth"},
+	{Name: "trigger-api-addr", Shorthand: "", Value: "", Usage: "address to serve the trigger api on, e.g. :8444, empty to disable it"},
+	{Name: "grpc-addr", Shorthand: "", Value: "", Usage: "address to serve the grpc api on, e.g. :9090, with the tokens, client ca and TLS of the trigger api, empty to disable it"},
+	{Name: "trigger-api-token-file", Shorthand: "", Value: "", Usage: "file of the trigger api bearer tokens, one name=token per line, TRIGGER_API_TOKEN env takes precedence"},
+	{Name: "trigger-api-tls-cert", Shorthand: "", Value: "", Usage: "TLS certificate file of the trigger api, reloaded when it changes"},
+	{Name: "trigger-api-tls-key", Shorthand: "", Value: "", Usage: "TLS key file of the trigger api"},
+	{Name: "trigger-api-client-ca", Shorthand: "", Value: "", Usage: "ca bundle authenticating trigger api callers by their client certificate"},
+	{Name: "trigger-api-rate-limit", Shorthand: "", Value: 30, Usage: "trigger api requests allowed per minute and caller"},
+	{Name: "trigger-api-burst", Shorthand: "", Value: 5, Usage: "trigger api requests a caller may send at once"},
+	{Name: "approval-timeout", Shorthand: "", Value: time.Hour, Usage: "time the rollout of a workload annotated cre.cnvrg.io/approval-required waits for its approval before it's dropped"},
+	{Name: "admin-token-file", Shorthand: "", Value: "", Usage: "file holding the bearer token of the admin endpoints, ADMIN_TOKEN env takes precedence, admin endpoints are disabled without it"},
+	{Name: "output", Shorthand: "o", Value: "text", Usage: "format of the workload decision traces of cre explain and of the report of cre coverage, text|json"},
+	{Name: "controller-url", Shorthand: "", Value: "", Usage: "metrics url of the running controller, e.g. http://cre.cre:9090, for cre explain and cre resume to call its admin endpoints"},
+	{Name: "track-rollouts", Shorthand: "", Value: true, Usage: "follow triggered rollouts and notify when they complete or get stuck"},
+	{Name: "rollout-timeout", Shorthand: "", Value: 10 * time.Minute, Usage: "time after which a rollout that didn't complete is reported as stuck"},
+	{Name: "watch-sealed-secrets", Shorthand: "", Value: false, Usage: "watch bitnami SealedSecrets to report unseal failures and skip duplicate rewrites of their Secrets"},
+	{Name: "sealed-secrets-unseal-timeout", Shorthand: "", Value: 2 * time.Minute, Usage: "time a changed SealedSecret has to rewrite its Secret before a warning is raised"},
+	{Name: "sealed-secrets-dedup-window", Shorthand: "", Value: 30 * time.Second, Usage: "repeated rewrites of a Secret for the same SealedSecret change within this window are rolled out once"},
+	{Name: "watch-external-secrets", Shorthand: "", Value: false, Usage: "defer rollouts of Secrets synced by external-secrets.io until their ExternalSecret is synced, and warn about sync errors"},
+	{Name: "external-secrets-sync-timeout", Shorthand: "", Value: 5 * time.Minute, Usage: "time a deferred rollout waits for its ExternalSecret to sync before it runs anyway"},
+	{Name: "watch-certificates", Shorthand: "", Value: false, Usage: "restart consumers of cert-manager Secrets only once the renewal completed"},
+	{Name: "certificate-renewal-timeout", Shorthand: "", Value: 5 * time.Minute, Usage: "time a deferred rollout waits for a renewal to complete before it runs anyway"},
+	{Name: "certificate-expiry-warning", Shorthand: "", Value: time.Duration(0), Usage: "warn about labeled TLS Secrets expiring within this duration, 0 to disable"},
+	{Name: "watch-csi-rotations", Shorthand: "", Value: false, Usage: "restart labeled workloads when the secrets store CSI driver rotates their mounted objects"},
+	{Name: "coverage-interval", Shorthand: "", Value: time.Duration(0), Usage: "interval of the sweeps reporting workloads with reload label gaps as metrics, logs and events, 0 to disable"},
+	{Name: "cluster-name", Shorthand: "", Value: "", Usage: "name of the cluster cre runs in, added to logs, metrics, events, notifications and audit records, available to notification templates as .Cluster"},
+	{Name: "cluster-name-detect", Shorthand: "", Value: "off", Usage: "detects the cluster name when cluster-name isn't set, off|kube-system (its namespace UID)|configmap"},
+	{Name: "cluster-name-configmap", Shorthand: "", Value: "kube-public/cluster-identity", Usage: "<namespace>/<name> of the ConfigMap holding the cluster name in its cluster-name key, with cluster-name-detect=configmap"},
+	{Name: "notifiers", Shorthand: "", Value: []string{}, Usage: "notifiers to enable, slack|teams|webhook|email|pagerduty|opsgenie|datadog|grafana|github|jira|kafka|nats|sns|stdout|noop, defaults to all configured ones"},
+	{Name: "notifier-timeout", Shorthand: "", Value: 10 * time.Second, Usage: "timeout of a single notification delivery attempt"},
+	{Name: "slack-webhook-url", Shorthand: "", Value: "", Usage: "slack incoming webhook url, empty to disable slack notifications"},
+	{Name: "slack-channel", Shorthand: "", Value: "", Usage: "slack channel to post to, defaults to the webhook channel"},
+	{Name: "slack-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to send slack notifications for, empty for all"},
+	{Name: "slack-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never send slack notifications for"},
+	{Name: "slack-bot-token-file", Shorthand: "", Value: "", Usage: "file holding the slack bot token posting interactive approvals of approval-required workloads, SLACK_BOT_TOKEN env takes precedence"},
+	{Name: "slack-signing-secret-file", Shorthand: "", Value: "", Usage: "file holding the signing secret of the slack app, authenticating approval callbacks on /slack/actions of --metrics-addr, SLACK_SIGNING_SECRET env takes precedence"},
+	{Name: "slack-approval-channel", Shorthand: "", Value: "", Usage: "slack channel to post approvals to, defaults to slack-channel"},
+	{Name: "slack-min-severity", Shorthand: "", Value: "info", Usage: "minimal severity of slack notifications, info|warning|error"},
+	{Name: "teams-webhook-url", Shorthand: "", Value: "", Usage: "microsoft teams incoming webhook url, empty to disable teams notifications"},
+	{Name: "teams-link", Shorthand: "", Value: "", Usage: "console link making the namespace, trigger and workloads of teams cards clickable, {namespace}, {kind} and {name} are replaced"},
+	{Name: "teams-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to send teams notifications for, empty for all"},
+	{Name: "teams-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never send teams notifications for"},
+	{Name: "teams-min-severity", Shorthand: "", Value: "info", Usage: "minimal severity of teams notifications, info|warning|error"},
+	{Name: "datadog-api-key-file", Shorthand: "", Value: "", Usage: "file holding the datadog api key, DATADOG_API_KEY env takes precedence, no key disables datadog"},
+	{Name: "datadog-site", Shorthand: "", Value: "datadoghq.com", Usage: "datadog site, e.g. datadoghq.eu"},
+	{Name: "datadog-tags", Shorthand: "", Value: []string{}, Usage: "extra tags for datadog events and metrics, e.g. cluster:prod"},
+	{Name: "datadog-metrics", Shorthand: "", Value: false, Usage: "also ship the cre counters to the datadog metrics api"},
+	{Name: "datadog-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to submit datadog events for, empty for all"},
+	{Name: "datadog-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never submit datadog events for"},
+	{Name: "datadog-min-severity", Shorthand: "", Value: "info", Usage: "minimal severity of datadog events, info|warning|error"},
+	{Name: "grafana-url", Shorthand: "", Value: "", Usage: "grafana base url to create rollout annotations in, empty to disable grafana annotations"},
+	{Name: "grafana-api-token-file", Shorthand: "", Value: "", Usage: "file holding the grafana api token, GRAFANA_API_TOKEN env takes precedence"},
+	{Name: "grafana-tags", Shorthand: "", Value: []string{}, Usage: "extra tags for grafana annotations, dashboards select annotations by tags"},
+	{Name: "grafana-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to annotate rollouts for in grafana, empty for all"},
+	{Name: "grafana-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never annotate rollouts for in grafana"},
+	{Name: "grafana-min-severity", Shorthand: "", Value: "info", Usage: "minimal severity of grafana annotations, info|warning|error"},
+	{Name: "email-smtp-host", Shorthand: "", Value: "", Usage: "smtp relay host, empty to disable email notifications"},
+	{Name: "email-smtp-port", Shorthand: "", Value: 587, Usage: "smtp relay port"},
+	{Name: "email-smtp-tls", Shorthand: "", Value: "starttls", Usage: "smtp transport security, none|starttls|tls"},
+	{Name: "email-smtp-username", Shorthand: "", Value: "", Usage: "smtp username"},
+	{Name: "email-smtp-password-file", Shorthand: "", Value: "", Usage: "file holding the smtp password, EMAIL_SMTP_PASSWORD env takes precedence"},
+	{Name: "email-from", Shorthand: "", Value: "", Usage: "sender address of notification mails"},
+	{Name: "email-to", Shorthand: "", Value: []string{}, Usage: "recipients for all namespaces, per namespace recipients are set with email.recipients in the config file"},
+	{Name: "email-mode", Shorthand: "", Value: "immediate", Usage: "immediate mails every failed or stuck rollout, digest mails a summary of all activity, immediate|digest"},
+	{Name: "email-digest-interval", Shorthand: "", Value: 24 * time.Hour, Usage: "how often a digest is sent in digest mode"},
+	{Name: "email-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to send emails for, empty for all"},
+	{Name: "email-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never send emails for"},
+	{Name: "email-min-severity", Shorthand: "", Value: "info", Usage: "minimal severity of emails, info|warning|error"},
+	{Name: "pagerduty-routing-key", Shorthand: "", Value: "", Usage: "pagerduty events api v2 routing key, empty to disable pagerduty alerts"},
+	{Name: "pagerduty-failed-severity", Shorthand: "", Value: "critical", Usage: "pagerduty severity of failed rollouts, critical|error|warning|info"},
+	{Name: "pagerduty-stuck-severity", Shorthand: "", Value: "error", Usage: "pagerduty severity of stuck rollouts, critical|error|warning|info"},
+	{Name: "pagerduty-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to raise pagerduty alerts for, empty for all"},
+	{Name: "pagerduty-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never raise pagerduty alerts for"},
+	{Name: "opsgenie-api-key-file", Shorthand: "", Value: "", Usage: "file holding the opsgenie api key, OPSGENIE_API_KEY env takes precedence, no key disables opsgenie alerts"},
+	{Name: "opsgenie-api-url", Shorthand: "", Value: "https://api.opsgenie.com", Usage: "opsgenie api url, https://api.eu.opsgenie.com for the EU instance"},
+	{Name: "opsgenie-failed-priority", Shorthand: "", Value: "P1", Usage: "opsgenie priority of failed rollouts, P1|P2|P3|P4|P5"},
+	{Name: "opsgenie-stuck-priority", Shorthand: "", Value: "P2", Usage: "opsgenie priority of stuck rollouts, P1|P2|P3|P4|P5"},
+	{Name: "opsgenie-tags", Shorthand: "", Value: []string{}, Usage: "extra tags for opsgenie alerts, e.g. cluster:prod"},
+	{Name: "opsgenie-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to raise opsgenie alerts for, empty for all"},
+	{Name: "opsgenie-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never raise opsgenie alerts for"},
+	{Name: "cloudevents", Shorthand: "", Value: "", Usage: "format webhook and message bus events as CloudEvents, structured|binary, binary applies to webhooks only"},
+	{Name: "cloudevents-type-prefix", Shorthand: "", Value: "io.cnvrg.cre", Usage: "prefix of the CloudEvents type, e.g. io.cnvrg.cre.rollout.completed"},
+	{Name: "cloudevents-source", Shorthand: "", Value: "", Usage: "CloudEvents source, defaults to /cre/<hostname>"},
+	{Name: "cloudevents-extension", Shorthand: "", Value: []string{}, Usage: "extra CloudEvents attribute as name=value, can be repeated"},
+	{Name: "github-api-url", Shorthand: "", Value: "https://api.github.com", Usage: "github api url, e.g. https://github.example.com/api/v3 for GitHub Enterprise"},
+	{Name: "github-token-file", Shorthand: "", Value: "", Usage: "file holding the github token, GITHUB_TOKEN env takes precedence"},
+	{Name: "github-app-id", Shorthand: "", Value: 0, Usage: "github app id to authenticate as instead of a token"},
+	{Name: "github-app-installation-id", Shorthand: "", Value: 0, Usage: "installation id of the github app"},
+	{Name: "github-app-private-key-file", Shorthand: "", Value: "", Usage: "file holding the PEM private key of the github app"},
+	{Name: "github-repo", Shorthand: "", Value: "", Usage: "owner/name repository of sources without the cre.cnvrg.io/git-repo annotation"},
+	{Name: "github-status", Shorthand: "", Value: "commit", Usage: "report rollouts as commit statuses per workload or as deployments per environment, commit|deployment"},
+	{Name: "github-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to report github statuses for, empty for all"},
+	{Name: "github-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never report github statuses for"},
+	{Name: "jira-url", Shorthand: "", Value: "", Usage: "jira base url to open issues for persistently failing rollouts in, empty to disable jira"},
+	{Name: "jira-user", Shorthand: "", Value: "", Usage: "jira cloud user email for api token auth, empty to send the token as a bearer personal access token"},
+	{Name: "jira-api-token-file", Shorthand: "", Value: "", Usage: "file holding the jira api token, JIRA_API_TOKEN env takes precedence"},
+	{Name: "jira-project", Shorthand: "", Value: "", Usage: "key of the jira project to open issues in"},
+	{Name: "jira-issue-type", Shorthand: "", Value: "Bug", Usage: "type of the opened jira issues"},
+	{Name: "jira-labels", Shorthand: "", Value: []string{}, Usage: "extra labels of the opened jira issues"},
+	{Name: "jira-failure-threshold", Shorthand: "", Value: 3, Usage: "failed or stuck rollouts of a workload in a row opening a jira issue"},
+	{Name: "jira-close-transition", Shorthand: "", Value: "Done", Usage: "transition closing the issue once the workload recovers, empty to only comment"},
+	{Name: "jira-workload-link", Shorthand: "", Value: "", Usage: "link to workloads in issues, {namespace}, {kind} and {name} are replaced, e.g. a console url"},
+	{Name: "jira-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to open jira issues for, empty for all"},
+	{Name: "jira-exclude-namespaces", Shorthand: "", Value: []string{}, Usage: "namespaces to never open jira issues for"},
+	{Name: "sns-topic-arn", Shorthand: "", Value: "", Usage: "aws sns topic arn to publish events to, empty to disable sns, needs a build with -tags sns"},
+	{Name: "sns-region", Shorthand: "", Value: "", Usage: "aws region of the sns topic, defaults to the region of the topic arn"},
+	{Name: "kafka-brokers", Shorthand: "", Value: []string{}, Usage: "kafka brokers to publish events to, empty to disable kafka"},
+	{Name: "kafka-topic", Shorthand: "", Value: "", Usage: "kafka topic to publish events to"},
+	{Name: "kafka-sasl-mechanism", Shorthand: "", Value: "", Usage: "kafka sasl mechanism, plain|scram-sha-256|scram-sha-512, empty for none"},
+	{Name: "kafka-sasl-username", Shorthand: "", Value: "", Usage: "kafka sasl username"},
+	{Name: "kafka-sasl-password-file", Shorthand: "", Value: "", Usage: "file holding the kafka sasl password, KAFKA_SASL_PASSWORD env takes precedence"},
+	{Name: "kafka-tls", Shorthand: "", Value: false, Usage: "connect to the kafka brokers over tls"},
+	{Name: "kafka-tls-ca-file", Shorthand: "", Value: "", Usage: "ca bundle to verify the kafka brokers with, system roots when empty"},
+	{Name: "nats-url", Shorthand: "", Value: "", Usage: "nats server url to publish events to, empty to disable nats"},
+	{Name: "nats-subject", Shorthand: "", Value: "", Usage: "nats subject to publish events to"},
+	{Name: "nats-creds-file", Shorthand: "", Value: "", Usage: "nats user credentials file"},
+	{Name: "nats-tls-ca-file", Shorthand: "", Value: "", Usage: "ca bundle to verify the nats server with"},
+	{Name: "bus-buffer-size", Shorthand: "", Value: 1000, Usage: "events buffered per message bus before new ones are dropped"},
+	{Name: "notify-webhook-url", Shorthand: "", Value: []string{}, Usage: "url to POST rollout events to, can be repeated"},
+	{Name: "notify-webhook-secret-file", Shorthand: "", Value: "", Usage: "file holding the HMAC secret to sign webhook payloads with, NOTIFY_WEBHOOK_SECRET env takes precedence"},
+	{Name: "audit-url", Shorthand: "", Value: "", Usage: "url to POST audit records of changes to, with their full data, empty to disable auditing"},
+	{Name: "audit-client-cert", Shorthand: "", Value: "", Usage: "client certificate to authenticate to the audit endpoint with, reloaded when renewed"},
+	{Name: "audit-client-key", Shorthand: "", Value: "", Usage: "key of --audit-client-cert"},
+	{Name: "audit-ca-file", Shorthand: "", Value: "", Usage: "ca bundle to verify the audit endpoint with, defaults to the system roots"},
+	{Name: "audit-spool-dir", Shorthand: "", Value: "/var/lib/cre/audit", Usage: "directory audit records are spooled in until delivered, mount a volume to keep them across restarts"},
+	{Name: "audit-spool-max-bytes", Shorthand: "", Value: 64 << 20, Usage: "size of the audit spool beyond which the oldest records are dropped"},
+	{Name: "audit-spool-retention", Shorthand: "", Value: 7 * 24 * time.Hour, Usage: "age after which undelivered audit records are dropped, 0 to keep them until delivered"},
+	{Name: "audit-log-dir", Shorthand: "", Value: "", Usage: "directory to append audit records to as JSON lines, rotated and uploaded with --audit-upload-url, empty to disable"},
+	{Name: "audit-log-rotate-size", Shorthand: "", Value: 10 << 20, Usage: "size at which the audit log is rotated"},
+	{Name: "audit-log-rotate-interval", Shorthand: "", Value: time.Hour, Usage: "age at which the audit log is rotated"},
+	{Name: "audit-log-max-bytes", Shorthand: "", Value: 256 << 20, Usage: "disk budget of the rotated audit logs waiting for upload, the oldest are dropped beyond it"},
+	{Name: "audit-upload-url", Shorthand: "", Value: "", Usage: "s3://bucket/prefix or gs://bucket/prefix to upload rotated audit logs to, the prefix may hold {cluster} and {date}"},
+	{Name: "audit-upload-interval", Shorthand: "", Value: 5 * time.Minute, Usage: "interval between uploads of rotated audit logs"},
+	{Name: "audit-upload-endpoint", Shorthand: "", Value: "", Usage: "endpoint of an S3 compatible store, or of a GCS emulator"},
+	{Name: "audit-upload-region", Shorthand: "", Value: "", Usage: "region of the s3 bucket, defaults to the AWS chain"},
 }
 
 var rootCmd = &cobra.Command{
@@ -46,12 +284,72 @@ var rootCmd = &cobra.Command{
 
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		setupClusterName()
 		logrus.Info("starting cre...")
-		stopper := make(chan bool)
-		defer close(stopper)
-		go cmInformer()
-		go secretInformer()
-		<-stopper
+		if viper.GetBool("dry-run") {
+			logrus.Warn("DRY-RUN: changes are detected and matched, but no workload is patched")
+		}
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		setupNotifiers()
+		setupEventRecorder()
+		setupChangeThreshold()
+		setupSpokes()
+		setupCapabilities()
+		setupRolloutKindOrder()
+		logWatchedNamespaces()
+		setupNamespaceRegex()
+		expectSourceSync(viper.GetBool("enable-leader-election"))
+		go serveMetrics(ctx)
+		startRolloutWorkers(ctx)
+		var sourceInformers sync.WaitGroup
+		// watchSources starts everything that rolls out on changes, on the leader only with leader election
+		watchSources := func(ctx context.Context) {
+			go reconcile()
+			sourceInformers.Add(2)
+			go func() {
+				defer sourceInformers.Done()
+				cmInformer(ctx)
+			}()
+			go func() {
+				defer sourceInformers.Done()
+				secretInformer(ctx)
+			}()
+			go sealedSecretInformer()
+			go externalSecretInformer()
+			go certificateInformer()
+			go csiInformer()
+			go coverageSweep()
+			go pruneReloadEvents()
+			go reloadPolicyInformer()
+			go controlInformer()
+		}
+		if viper.GetBool("enable-leader-election") {
+			// waiting for it releases the Lease on shutdown, so another replica takes over right away
+			sourceInformers.Add(1)
+			go func() {
+				defer sourceInformers.Done()
+				runLeaderElection(ctx, watchSources)
+			}()
+		} else {
+			watchSources(ctx)
+		}
+		go exportOTLPMetrics()
+		go serveTriggerAPI()
+		go serveGRPC()
+		go sendAuditRecords()
+		go runAuditLog()
+		sig := <-shutdown
+		logrus.Infof("received %s, shutting down", sig)
+		// Stops the informers and the rollout workers, in-flight patches complete
+		cancel()
+		sourceInformers.Wait()
+		if timeout := viper.GetDuration("shutdown-timeout"); !drainRolloutWorkers(timeout) {
+			logrus.Warnf("in-flight rollouts didn't complete within --shutdown-timeout %s, exiting anyway", timeout)
+		}
+		logSummary()
 	},
 }
 
@@ -83,6 +381,10 @@ func setParams(params []Param, command *cobra.Command) {
 			command.PersistentFlags().StringP(param.Name, param.Shorthand, v, param.Usage)
 		case bool:
 			command.PersistentFlags().BoolP(param.Name, param.Shorthand, v, param.Usage)
+		case time.Duration:
+			command.PersistentFlags().DurationP(param.Name, param.Shorthand, v, param.Usage)
+		case []string:
+			command.PersistentFlags().StringSliceP(param.Name, param.Shorthand, v, param.Usage)
 		}
 		if err := viper.BindPFlag(param.Name, command.PersistentFlags().Lookup(param.Name)); err != nil {
 			panic(err)
@@ -94,6 +396,25 @@ func setupCommands() {
 	// Init config
 	cobra.OnInitialize(initConfig)
 	setParams(rootParams, rootCmd)
+	setParams(filesParams, filesCmd)
+	rootCmd.AddCommand(filesCmd)
+	setParams(explainParams, explainCmd)
+	rootCmd.AddCommand(explainCmd)
+	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(versionCmd)
+	setupCoverageFlags()
+	rootCmd.AddCommand(coverageCmd)
+	setParams(doctorParams, doctorCmd)
+	rootCmd.AddCommand(doctorCmd)
+	setParams(webhookParams, webhookCmd)
+	setParams(webhookManifestParams, webhookManifestCmd)
+	webhookCmd.AddCommand(webhookManifestCmd)
+	rootCmd.AddCommand(webhookCmd)
+	setupRoutesTestFlags()
+	routesCmd.AddCommand(routesTestCmd)
+	rootCmd.AddCommand(routesCmd)
+	setupLoadtestFlags()
+	rootCmd.AddCommand(loadtestCmd)
 
 }
 
@@ -108,19 +429,69 @@ func kubeconfigDefaultLocation() string {
 func initConfig() {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	// the downward API exposes the namespace of the pod as POD_NAMESPACE
+	if err := viper.BindEnv("namespace", "POD_NAMESPACE"); err != nil {
+		logrus.Fatalf("%s failed to bind POD_NAMESPACE", err)
+	}
+	if config := viper.GetString("config"); config != "" {
+		viper.SetConfigFile(config)
+		if err := viper.ReadInConfig(); err != nil {
+			logrus.Fatalf("%s failed to read config file", err)
+		}
+	}
+}
+
+// exitNoCredentials is the exit code when there is neither a kubeconfig nor an in-cluster config
+const exitNoCredentials = 2
+
+var (
+	clientsOnce sync.Once
+	// sharedConfig, sharedClientset and sharedDynamicClient are built once, rather than reading the kubeconfig
+	// and dropping the connection pool of a new client on every call
+	sharedConfig        *rest.Config
+	sharedClientset     kubernetes.Interface
+	sharedDynamicClient dynamic.Interface
+)
+
+// restConfig returns a copy of the shared config, which callers may change, e.g. to impersonate
+func restConfig() *rest.Config {
+	clientsOnce.Do(buildClients)
+	return rest.CopyConfig(sharedConfig)
 }
 
-func clientset() *kubernetes.Clientset {
+func clientset() kubernetes.Interface {
+	clientsOnce.Do(buildClients)
+	return sharedClientset
+}
+
+func buildClients() {
+	sharedConfig = loadRESTConfig()
+	// a single client shares its rate limiter between all the rollouts
+	sharedConfig.QPS = float32(viper.GetInt("kube-api-qps"))
+	sharedConfig.Burst = viper.GetInt("kube-api-burst")
+	clientset, err := kubernetes.NewForConfig(sharedConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	sharedClientset = clientset
+	dynamicClient, err := dynamic.NewForConfig(sharedConfig)
+	if err != nil {
+		panic(err.Error())
+	}
+	sharedDynamicClient = dynamicClient
+}
+
+func loadRESTConfig() *rest.Config {
 	if _, err := os.Stat(viper.GetString("kubeconfig")); os.IsNotExist(err) {
 		config, err := rest.InClusterConfig()
-		if err != nil {
-			panic(err.Error())
+		if err == rest.ErrNotInCluster {
+			logrus.Errorf("no kubeconfig found at %s and not running in-cluster; set --kubeconfig or run inside a pod", viper.GetString("kubeconfig"))
+			logrus.Exit(exitNoCredentials)
 		}
-		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
 			panic(err.Error())
 		}
-		return clientset
+		return config
 	} else if err != nil {
 		logrus.Fatalf("%s failed to check kubeconfig location", err)
 	}
@@ -129,172 +500,861 @@ func clientset() *kubernetes.Clientset {
 	if err != nil {
 		panic(err.Error())
 	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
-	return clientset
+	return config
+}
 
+// dynamicClient is used for the custom resources of integrations, e.g. SealedSecrets
+func dynamicClient() dynamic.Interface {
+	clientsOnce.Do(buildClients)
+	return sharedDynamicClient
 }
 
-func secretInformer() {
+func secretInformer(ctx context.Context) {
 	matchLabel := viper.GetString("match-label")
 	logrus.Infof("starting Secrets Informer, match-label: %s", matchLabel)
-	factory := informers.NewSharedInformerFactory(clientset(), 0)
-	informer := factory.Core().V1().Secrets().Informer()
-	stopper := make(chan struct{})
-	defer close(stopper)
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	runSourceInformers(ctx, "Secret", func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Core().V1().Secrets().Informer()
+	}, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			o := obj.(*corev1.Secret)
+			indexDependencies("Secret", o)
+			// rolled out when its data differs from the one last seen, e.g. recreated while the watch was down
+			reconcileSource("Secret", o, secretData(o))
+		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldO := oldObj.(*corev1.Secret)
 			newO := newObj.(*corev1.Secret)
-			if _, ok := oldO.Labels[matchLabel]; !ok {
+			indexDependencies("Secret", newO)
+			if skipExcluded("Secret", newO.Namespace, newO.Name) {
 				return
 			}
-			if !reflect.DeepEqual(oldO.Data, newO.Data) || !reflect.DeepEqual(oldO.StringData, newO.StringData) {
-				diff, _ := messagediff.PrettyDiff(oldO.Data, newO.Data)
-				logrus.Infof("Data diff: %s", diff)
-				diff, _ = messagediff.PrettyDiff(oldO.StringData, newO.StringData)
-				logrus.Infof("String Data diff: %s", diff)
-				logrus.Infof("going to rollout resources labeld with %s:%s", matchLabel, oldO.Labels[matchLabel])
-				rollout(oldO.Namespace, oldO.Labels[matchLabel])
+			if oldO.ResourceVersion == newO.ResourceVersion {
+				// a resync redelivers the cached object, rolled out if it differs from the data last seen
+				reconcileSource("Secret", newO, secretData(newO))
+			}
+			matchLabelValue, labeled := matchValue(oldO)
+			policy := policyFor("Secret", newO)
+			if !labeled && policy == nil && !viper.GetBool("stakater-compat") && !autoDiscovering() && !hasDependents("Secret", newO.Namespace, newO.Name) {
+				return
+			}
+			oldData, newData := secretData(oldO), secretData(newO)
+			if skippedUpdate("Secret", oldO, newO, func() bool { return reflect.DeepEqual(oldData, newData) }) {
+				return
+			}
+			observeInformerLag("Secret", newO)
+			if !ownedByWatchedParent(newO) {
+				return
+			}
+			if alreadyReconciled("Secret", newO, newData) {
+				return
+			}
+			if duplicateSealedChange(newO) {
+				return
+			}
+			changed := plaintextChanges(newO.Namespace, newO.Name, oldData, newData, changedSecretKeys(oldData, newData))
+			if len(changed) == 0 {
+				logrus.Infof("Secret %s/%s was only re-encrypted, nothing to rollout", newO.Namespace, newO.Name)
+				noopUpdates.WithLabelValues(newO.Namespace, "re-encrypted").Inc()
+				return
+			}
+			src := Source{
+				Kind:            "Secret",
+				Namespace:       oldO.Namespace,
+				Name:            oldO.Name,
+				UID:             newO.UID,
+				TargetNamespace: newO.Annotations[targetNamespaceAnnotation],
+				ChangedKeys:     changed,
+				CorrelationID:   string(uuid.NewUUID()),
+				Unlabeled:       !labeled,
+				Policy:          policy,
+				MatchLabelValue: matchLabelValue,
+				GitSHA:          newO.Annotations[gitSHAAnnotation],
+				GitRepo:         newO.Annotations[gitRepoAnnotation],
+				Clusters:        sourceClusters(newO.Annotations),
+			}
+			if labeled {
+				src.log().Infof("Data diff: %s", secretDiff(oldData, newData))
+				src.log().Infof("going to rollout resources labeld with %s:%s", matchKey(oldO), matchLabelValue)
+			}
+			if belowChangeThreshold(src, secretKeyCount(oldData, newData)) {
+				return
+			}
+			auditSecretChange(src, newO, oldData, newData)
+			if deferUntilSynced(newO, src, matchLabelValue) {
+				return
+			}
+			if certificateGate(newO, &src, matchLabelValue) {
+				return
+			}
+			if heldByDeployTool(newO, src, matchLabelValue) {
+				return
+			}
+			debounceRollout(src, matchLabelValue, oldData, newData)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if o, ok := obj.(metav1.Object); ok {
+				dropDependencies("Secret", o)
+				forgetSource("Secret", o)
 			}
 		},
 	})
-	informer.Run(stopper)
 }
 
-func cmInformer() {
+func cmInformer(ctx context.Context) {
 	matchLabel := viper.GetString("match-label")
 	logrus.Infof("starting ConfigMap Informer, match-label: %s", matchLabel)
-	factory := informers.NewSharedInformerFactory(clientset(), 0)
-	informer := factory.Core().V1().ConfigMaps().Informer()
-	stopper := make(chan struct{})
-	defer close(stopper)
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	runSourceInformers(ctx, "ConfigMap", func(factory informers.SharedInformerFactory) cache.SharedIndexInformer {
+		return factory.Core().V1().ConfigMaps().Informer()
+	}, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			o := obj.(*corev1.ConfigMap)
+			indexDependencies("ConfigMap", o)
+			// rolled out when its data differs from the one last seen, e.g. recreated while the watch was down
+			reconcileSource("ConfigMap", o, configMapData(o.Data))
+		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldO := oldObj.(*corev1.ConfigMap)
 			newO := newObj.(*corev1.ConfigMap)
-			if _, ok := oldO.Labels[matchLabel]; !ok {
+			indexDependencies("ConfigMap", newO)
+			if skipExcluded("ConfigMap", newO.Namespace, newO.Name) {
+				return
+			}
+			if oldO.ResourceVersion == newO.ResourceVersion {
+				// a resync redelivers the cached object, rolled out if it differs from the data last seen
+				reconcileSource("ConfigMap", newO, configMapData(newO.Data))
+			}
+			matchLabelValue, labeled := matchValue(oldO)
+			policy := policyFor("ConfigMap", newO)
+			if !labeled && policy == nil && !viper.GetBool("stakater-compat") && !autoDiscovering() && !hasDependents("ConfigMap", newO.Namespace, newO.Name) {
 				return
 			}
-			if !reflect.DeepEqual(oldO.Data, newO.Data) {
+			if skippedUpdate("ConfigMap", oldO, newO, func() bool { return reflect.DeepEqual(oldO.Data, newO.Data) }) {
+				return
+			}
+			observeInformerLag("ConfigMap", newO)
+			if !ownedByWatchedParent(newO) {
+				return
+			}
+			if alreadyReconciled("ConfigMap", newO, configMapData(newO.Data)) {
+				return
+			}
+			src := Source{
+				Kind:            "ConfigMap",
+				Namespace:       oldO.Namespace,
+				Name:            oldO.Name,
+				UID:             newO.UID,
+				TargetNamespace: newO.Annotations[targetNamespaceAnnotation],
+				ChangedKeys:     changedKeys(oldO.Data, newO.Data),
+				CorrelationID:   string(uuid.NewUUID()),
+				Unlabeled:       !labeled,
+				Policy:          policy,
+				MatchLabelValue: matchLabelValue,
+				GitSHA:          newO.Annotations[gitSHAAnnotation],
+				GitRepo:         newO.Annotations[gitRepoAnnotation],
+				Clusters:        sourceClusters(newO.Annotations),
+			}
+			if labeled {
 				diff, _ := messagediff.PrettyDiff(oldO.Data, newO.Data)
-				logrus.Infof("%s", diff)
-				logrus.Infof("going to rollout resources labeld with %s:%s", matchLabel, oldO.Labels[matchLabel])
-				rollout(oldO.Namespace, oldO.Labels[matchLabel])
+				src.log().Infof("%s", diff)
+				src.log().Infof("going to rollout resources labeld with %s:%s", matchKey(oldO), matchLabelValue)
+			}
+			if belowChangeThreshold(src, keyCount(oldO.Data, newO.Data)) {
+				return
+			}
+			auditChange(src, newO, oldO.Data, newO.Data)
+			if heldByDeployTool(newO, src, matchLabelValue) {
+				return
+			}
+			debounceRollout(src, matchLabelValue, configMapData(oldO.Data), configMapData(newO.Data))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if o, ok := obj.(metav1.Object); ok {
+				dropDependencies("ConfigMap", o)
+				forgetSource("ConfigMap", o)
 			}
 		},
 	})
-	informer.Run(stopper)
 }
 
-func rollout(ns string, matchLabelValue string) {
-	rolloutDeployments(ns, matchLabelValue)
-	rolloutStatefulSets(ns, matchLabelValue)
-	rolloutDaemonSets(ns, matchLabelValue)
+// watchedNamespaces returns the namespaces of --namespaces, or the comma separated ones of --namespace,
+// metav1.NamespaceAll when both are empty
+func watchedNamespaces() []string {
+	if namespaces := viper.GetStringSlice("namespaces"); len(namespaces) > 0 {
+		return namespaces
+	}
+	var namespaces []string
+	for _, ns := range strings.Split(viper.GetString("namespace"), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) > 0 {
+		return namespaces
+	}
+	return []string{metav1.NamespaceAll}
 }
 
-func rolloutDeployments(ns string, matchLabelValue string) {
-	clientset := clientset()
-	matchLabel := viper.GetString("match-label")
-	listOptions := metav1.ListOptions{
-		LabelSelector: matchLabel,
+// watched tells if ns is one of the watched namespaces
+func watched(ns string) bool {
+	for _, w := range watchedNamespaces() {
+		if w == metav1.NamespaceAll || w == ns {
+			return true
+		}
 	}
-	deploymentList, err := clientset.AppsV1().Deployments(ns).List(context.Background(), listOptions)
-	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("failed to list deployments in namespace: %s ", ns)
+	return false
+}
+
+var (
+	// namespaceRegex and excludeNamespaceRegex are compiled by setupNamespaceRegex, nil when unset
+	namespaceRegex, excludeNamespaceRegex *regexp.Regexp
+)
+
+// setupNamespaceRegex compiles --namespace-regex and --exclude-namespace-regex, failing on an invalid one
+// instead of silently matching nothing
+func setupNamespaceRegex() {
+	compile := func(name string) *regexp.Regexp {
+		expr := viper.GetString(name)
+		if expr == "" {
+			return nil
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			logrus.Fatalf("%s failed to compile --%s %s", err, name, expr)
+		}
+		return re
+	}
+	namespaceRegex, excludeNamespaceRegex = compile("namespace-regex"), compile("exclude-namespace-regex")
+	if namespaceRegex != nil {
+		logrus.Infof("only rolling out in namespaces matching %s", namespaceRegex)
 	}
+}
 
-	for _, deployment := range deploymentList.Items {
-		if _, ok := deployment.Labels[matchLabel]; ok {
-			if deployment.Labels[matchLabel] == matchLabelValue {
-				triggerDeploymentRollout(ns, deployment.Name)
+// excludedNamespace returns the flag and pattern ns is excluded by, false when it isn't: a --exclude-namespaces glob
+// or --exclude-namespace-regex it matches, or --namespace-regex it doesn't match. Exclusions win over the regex.
+func excludedNamespace(ns string) (string, bool) {
+	for _, pattern := range viper.GetStringSlice("exclude-namespaces") {
+		if ok, _ := path.Match(pattern, ns); ok {
+			return "--exclude-namespaces " + pattern, true
+		}
+	}
+	if excludeNamespaceRegex != nil && excludeNamespaceRegex.MatchString(ns) {
+		return "--exclude-namespace-regex " + excludeNamespaceRegex.String(), true
+	}
+	if namespaceRegex != nil && !namespaceRegex.MatchString(ns) {
+		return "--namespace-regex " + namespaceRegex.String() + ", not matching it", true
+	}
+	return "", false
+}
+
+// skipExcluded tells if the change of an object in an excluded namespace is ignored, logging why
+func skipExcluded(kind, ns, name string) bool {
+	reason, excluded := excludedNamespace(ns)
+	if excluded {
+		logrus.Debugf("%s %s/%s changed in namespace %s excluded by %s, nothing to rollout", kind, ns, name, ns, reason)
+	}
+	return excluded
+}
+
+// logWatchedNamespaces tells at startup what is watched, a typo in --namespaces otherwise silently watches nothing
+func logWatchedNamespaces() {
+	if namespaces := watchedNamespaces(); namespaces[0] != metav1.NamespaceAll {
+		logrus.Infof("watching namespaces %s", strings.Join(namespaces, ", "))
+		return
+	}
+	logrus.Info("watching all namespaces")
+}
+
+var (
+	sourceFactoriesMu sync.Mutex
+	// sourceFactories are the informer factories of the watched namespaces, shared by the ConfigMap and Secret informers
+	sourceFactories = map[string]informers.SharedInformerFactory{}
+)
+
+func sourceFactory(ns string) informers.SharedInformerFactory {
+	sourceFactoriesMu.Lock()
+	defer sourceFactoriesMu.Unlock()
+	factory, ok := sourceFactories[ns]
+	if !ok {
+		factory = informers.NewSharedInformerFactoryWithOptions(clientset(), viper.GetDuration("resync-period"), informers.WithNamespace(ns), informers.WithTweakListOptions(sourceListOptions))
+		sourceFactories[ns] = factory
+	}
+	return factory
+}
+
+// runSourceInformers runs the informer built by newInformer with handler, on the shared factory of each watched namespace,
+// so --namespaces only needs namespaced RBAC. /readyz waits for all of them to sync. It returns once all of them stopped with ctx.
+func runSourceInformers(ctx context.Context, kind string, newInformer func(factory informers.SharedInformerFactory) cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	var sourceInformers []cache.SharedIndexInformer
+	var synced []cache.InformerSynced
+	for _, ns := range watchedNamespaces() {
+		informer := newInformer(sourceFactory(ns))
+		informer.AddEventHandler(handler)
+		sourceInformers = append(sourceInformers, informer)
+		synced = append(synced, informer.HasSynced)
+	}
+	trackSourceSync(kind, synced)
+	var wg sync.WaitGroup
+	for _, informer := range sourceInformers {
+		informer := informer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			informer.Run(ctx.Done())
+		}()
+	}
+	wg.Wait()
+}
+
+// ownedByWatchedParent tells if obj is controlled by the parent set with owner-kind and owner-name,
+// always true when no owner filter is set
+func ownedByWatchedParent(obj metav1.Object) bool {
+	kind, name := viper.GetString("owner-kind"), viper.GetString("owner-name")
+	if kind == "" && name == "" {
+		return true
+	}
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil || (kind != "" && owner.Kind != kind) || (name != "" && owner.Name != name) {
+		logrus.Debugf("%s/%s isn't controlled by the watched owner %s/%s, ignoring", obj.GetNamespace(), obj.GetName(), kind, name)
+		return false
+	}
+	return true
+}
+
+// skippedUpdate classifies and counts updates carrying nothing to rollout, before any diffing:
+// resyncs redeliver an unchanged object, metadata-only updates changed the resourceVersion,
+// labels, annotations or managedFields but not the data, e.g. a re-apply of the same content
+// or a write by another controller. Counting them tells "nothing changed" apart from "the change was never seen".
+func skippedUpdate(kind string, old, new metav1.Object, dataEqual func() bool) bool {
+	var reason string
+	switch {
+	case old.GetResourceVersion() == new.GetResourceVersion():
+		reason = "resync"
+	case dataEqual():
+		reason = "metadata-only"
+	default:
+		return false
+	}
+	logrus.Debugf("%s %s/%s %s update, nothing to rollout", kind, new.GetNamespace(), new.GetName(), reason)
+	noopUpdates.WithLabelValues(new.GetNamespace(), reason).Inc()
+	return true
+}
+
+// matchValue returns the value a source or workload is matched by, the match-annotation taking precedence
+// over the match label when both are set, and whether it carries either of them
+func matchValue(obj metav1.Object) (string, bool) {
+	if key := viper.GetString("match-annotation"); key != "" {
+		if value, ok := obj.GetAnnotations()[key]; ok {
+			return value, true
+		}
+	}
+	key := viper.GetString("match-label")
+	if key == "" {
+		return "", false
+	}
+	value, ok := obj.GetLabels()[key]
+	return value, ok
+}
+
+// matchKey returns the annotation or label key obj is matched by, for the logs
+func matchKey(obj metav1.Object) string {
+	if key := viper.GetString("match-annotation"); key != "" {
+		if _, ok := obj.GetAnnotations()[key]; ok {
+			return key
+		}
+	}
+	return viper.GetString("match-label")
+}
+
+// matchSelector is the label selector of the matched objects, none with match-annotation
+// as annotations can't be selected on server side
+func matchSelector() string {
+	if viper.GetString("match-annotation") != "" {
+		return ""
+	}
+	return viper.GetString("match-label")
+}
+
+// sourceListOptions restricts the informers to labeled objects, all of them are watched with stakater-compat,
+// auto discovery, match-annotation and ReloadPolicies, as stakater annotated workloads and policies name unlabeled sources. When list-page-size is set,
+// makes them list in pages of that size instead of loading all objects at once.
+// The tweak is applied to every page request, so the label selector holds on each page.
+// The reflector lists at resourceVersion 0, which the watch cache of the API server serves whole ignoring the limit,
+// so paged lists are read from etcd at the latest resourceVersion instead.
+func sourceListOptions(options *metav1.ListOptions) {
+	if !viper.GetBool("stakater-compat") && !autoDiscovering() && !policiesEnabled() {
+		options.LabelSelector = matchSelector()
+	}
+	if pageSize := viper.GetInt64("list-page-size"); pageSize > 0 && !options.Watch {
+		options.Limit = pageSize
+		if options.ResourceVersion == "0" {
+			options.ResourceVersion = ""
+		}
+	}
+}
+
+// changedKeys returns the sorted names of keys added, removed or modified between old and new
+func changedKeys(old, new map[string]string) []string {
+	var keys []string
+	for k, v := range new {
+		if ov, ok := old[k]; !ok || ov != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// secretData returns the effective data of a Secret.
+// StringData is write only and the API server merges it into Data,
+// it's only honored here for objects which didn't go through the API server yet.
+func secretData(s *corev1.Secret) map[string][]byte {
+	if len(s.StringData) == 0 {
+		return s.Data
+	}
+	data := make(map[string][]byte, len(s.Data)+len(s.StringData))
+	for k, v := range s.Data {
+		data[k] = v
+	}
+	for k, v := range s.StringData {
+		data[k] = []byte(v)
+	}
+	return data
+}
+
+func changedSecretKeys(old, new map[string][]byte) []string {
+	return changedKeys(secretStrings(old), secretStrings(new))
+}
+
+// secretDiff diffs the values of Secret data as strings, a diff of the byte slices lists every changed byte
+func secretDiff(old, new map[string][]byte) string {
+	diff, _ := messagediff.PrettyDiff(secretStrings(old), secretStrings(new))
+	return diff
+}
+
+func secretStrings(data map[string][]byte) map[string]string {
+	m := make(map[string]string, len(data))
+	for k, v := range data {
+		m[k] = string(v)
+	}
+	return m
+}
+
+func rollout(src Source, matchLabelValue string) {
+	chain := joinCascade(&src)
+	cascade(src, chain)
+	candidates, ok := rolloutCandidates(src, matchLabelValue)
+	if !ok {
+		return
+	}
+	enqueueInKindOrder(src, capBatch(src, inKindOrder(candidates)))
+}
+
+// rolloutCandidates returns the workloads matching src, false when its rollout is skipped
+func rolloutCandidates(src Source, matchLabelValue string) ([]Workload, bool) {
+	var candidates []Workload
+	if src.Unlabeled && src.Policy == nil {
+		// Only stakater annotated workloads may ask for it, most unlabeled sources aren't consumed by any
+		if candidates = matchingWorkloads(src, matchLabelValue); len(candidates) == 0 {
+			return nil, false
+		}
+	}
+	lifetime.sourceChange()
+	configChanges.WithLabelValues(src.Kind, src.Namespace).Inc()
+	sourceChanges.WithLabelValues(src.Kind).Inc()
+	traceDecision(src, stageChange, "detected", nil, "changed keys: %s", strings.Join(src.ChangedKeys, ", "))
+	notify(RolloutEvent{Type: EventRolloutMatched, Source: src, Outcome: "matched"})
+	recordMatchedChange(src)
+	matched := candidates != nil
+	namespaces := rolloutNamespaces(src)
+	skipped := 0
+	for _, ns := range namespaces {
+		target := src
+		target.TargetNamespace = ""
+		if ns != src.Namespace {
+			target.TargetNamespace = ns
+		}
+		if !watched(ns) {
+			msg := fmt.Sprintf("%s redirects its rollout to namespace %s, which isn't one of --namespaces", src, ns)
+			src.log().Errorf("skipping rollout of %s: %s", src, msg)
+			notify(RolloutEvent{Type: EventRolloutSkipped, Source: target, Outcome: "skipped", Error: msg})
+			recordSourceEvent(src, corev1.EventTypeWarning, "RolloutSkipped", msg)
+			skipped++
+			continue
+		}
+		if ns != src.Namespace {
+			src.log().Infof("%s redirects its rollout to namespace %s", src, ns)
+		}
+		if !matched {
+			candidates = append(candidates, matchingWorkloads(target, matchLabelValue)...)
+		}
+	}
+	if skipped == len(namespaces) {
+		return nil, false
+	}
+	traceTargets(src, matchLabelValue, candidates)
+	return capableTargets(src, candidates), true
+}
+
+// rolloutNamespaces returns the namespaces searched for the workloads of src: the one its target-namespace annotation
+// redirects it to, else the --rollout-namespace ones, else its own. ReloadPolicies name their targets, they're searched once.
+func rolloutNamespaces(src Source) []string {
+	namespaces := viper.GetStringSlice("rollout-namespace")
+	if src.TargetNamespace != "" || src.Policy != nil || len(namespaces) == 0 {
+		return []string{src.RolloutNamespace()}
+	}
+	return namespaces
+}
+
+// matchingWorkloads returns the workloads labeled like src, plus the ones asking for it with stakater annotations
+// and, with auto discovery, the ones consuming it.
+// The targets of a ReloadPolicy selecting src take precedence over both.
+// In hub mode the labeled workloads of the spoke clusters of src replace all of them.
+func matchingWorkloads(src Source, matchLabelValue string) []Workload {
+	if len(src.Clusters) > 0 {
+		return spokeTargets(src, matchLabelValue)
+	}
+	if src.Policy != nil {
+		return policyTargets(src)
+	}
+	var candidates []Workload
+	if !src.Unlabeled {
+		// A failed list skips that kind only, the next change or the reconcile loop rolls it out
+		for _, matching := range []func(Source, string) ([]Workload, error){matchingDeployments, matchingStatefulSets, matchingDaemonSets, matchingCronJobs} {
+			targets, err := matching(src, matchLabelValue)
+			if err != nil {
+				src.log().Errorf("%s, skipping them for %s", err, src)
+				continue
 			}
+			candidates = append(candidates, targets...)
+		}
+	}
+	candidates = append(candidates, stakaterWorkloads(src)...)
+	for _, w := range discoveredWorkloads(src) {
+		if !containsWorkload(candidates, w) {
+			candidates = append(candidates, w)
 		}
 	}
+	return candidates
 }
 
-func rolloutStatefulSets(ns string, matchLabelValue string) {
-	clientset := clientset()
-	matchLabel := viper.GetString("match-label")
-	listOptions := metav1.ListOptions{
-		LabelSelector: matchLabel,
+// optedOut tells if the workload w is annotated with skip-annotation "true", never restarting it for src,
+// e.g. a long running job mustn't be restarted mid run
+func optedOut(src Source, w Workload, annotations map[string]string) bool {
+	annotation := viper.GetString("skip-annotation")
+	if annotation == "" || annotations[annotation] != "true" {
+		return false
 	}
-	deploymentList, err := clientset.AppsV1().StatefulSets(ns).List(context.Background(), listOptions)
-	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("failed to list deployments in namespace: %s ", ns)
+	src.log().Debugf("%s is annotated %s, not restarting it", w, annotation)
+	traceDecision(src, stageTargets, "opted-out", &w, "annotated %s", annotation)
+	return true
+}
+
+func containsWorkload(workloads []Workload, w Workload) bool {
+	for _, other := range workloads {
+		if other == w {
+			return true
+		}
 	}
+	return false
+}
 
+func matchingDeployments(src Source, matchLabelValue string) ([]Workload, error) {
+	ns, ok := labeledNamespace(src, "Deployment")
+	if !ok {
+		return nil, nil
+	}
+	deploymentList, err := clientset().AppsV1().Deployments(ns).List(context.Background(), metav1.ListOptions{LabelSelector: matchSelector()})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list Deployments in namespace %s", err, ns)
+	}
+	var targets []Workload
 	for _, deployment := range deploymentList.Items {
-		if _, ok := deployment.Labels[matchLabel]; ok {
-			if deployment.Labels[matchLabel] == matchLabelValue {
-				triggerStatefulRollout(ns, deployment.Name)
-			}
+		w := Workload{Kind: "Deployment", Namespace: ns, Name: deployment.Name}
+		if labeledTarget(src, matchLabelValue, w, &deployment, deployment.Spec.Template.Spec) {
+			targets = append(targets, w)
 		}
 	}
+	return targets, nil
 }
 
-func rolloutDaemonSets(ns string, matchLabelValue string) {
-	clientset := clientset()
-	matchLabel := viper.GetString("match-label")
-	listOptions := metav1.ListOptions{
-		LabelSelector: matchLabel,
+func matchingStatefulSets(src Source, matchLabelValue string) ([]Workload, error) {
+	ns, ok := labeledNamespace(src, "StatefulSet")
+	if !ok {
+		return nil, nil
 	}
-	deploymentList, err := clientset.AppsV1().DaemonSets(ns).List(context.Background(), listOptions)
+	statefulSetList, err := clientset().AppsV1().StatefulSets(ns).List(context.Background(), metav1.ListOptions{LabelSelector: matchSelector()})
 	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("failed to list DaemonSets in namespace: %s ", ns)
+		return nil, fmt.Errorf("%s failed to list StatefulSets in namespace %s", err, ns)
 	}
+	var targets []Workload
+	for _, statefulSet := range statefulSetList.Items {
+		w := Workload{Kind: "StatefulSet", Namespace: ns, Name: statefulSet.Name}
+		if labeledTarget(src, matchLabelValue, w, &statefulSet, statefulSet.Spec.Template.Spec) {
+			targets = append(targets, w)
+		}
+	}
+	return targets, nil
+}
 
-	for _, deployment := range deploymentList.Items {
-		if _, ok := deployment.Labels[matchLabel]; ok {
-			if deployment.Labels[matchLabel] == matchLabelValue {
-				triggerDaemonsetRollout(ns, deployment.Name)
-			}
+func matchingDaemonSets(src Source, matchLabelValue string) ([]Workload, error) {
+	ns, ok := labeledNamespace(src, "DaemonSet")
+	if !ok {
+		return nil, nil
+	}
+	daemonSetList, err := clientset().AppsV1().DaemonSets(ns).List(context.Background(), metav1.ListOptions{LabelSelector: matchSelector()})
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to list DaemonSets in namespace %s", err, ns)
+	}
+	var targets []Workload
+	for _, daemonSet := range daemonSetList.Items {
+		w := Workload{Kind: "DaemonSet", Namespace: ns, Name: daemonSet.Name}
+		if labeledTarget(src, matchLabelValue, w, &daemonSet, daemonSet.Spec.Template.Spec) {
+			targets = append(targets, w)
 		}
 	}
+	return targets, nil
 }
 
-func triggerDeploymentRollout(ns string, deploymentName string) {
-	clientset := clientset()
-	data := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, time.Now().String())
-	_, err := clientset.
-		AppsV1().
-		Deployments(ns).
-		Patch(context.Background(), deploymentName, types.StrategicMergePatchType, []byte(data), metav1.PatchOptions{FieldManager: "cnvrg-cre-rollout"})
+// matchingCronJobs restarts the pod template of the job template, the next scheduled Jobs pick up the change
+func matchingCronJobs(src Source, matchLabelValue string) ([]Workload, error) {
+	ns, ok := labeledNamespace(src, "CronJob")
+	if !ok {
+		return nil, nil
+	}
+	cronJobList, err := clientset().BatchV1().CronJobs(ns).List(context.Background(), metav1.ListOptions{LabelSelector: matchSelector()})
 	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("error triggering deployment rolout")
+		return nil, fmt.Errorf("%s failed to list CronJobs in namespace %s", err, ns)
+	}
+	var targets []Workload
+	for _, cronJob := range cronJobList.Items {
+		w := Workload{Kind: "CronJob", Namespace: ns, Name: cronJob.Name}
+		if labeledTarget(src, matchLabelValue, w, &cronJob, cronJob.Spec.JobTemplate.Spec.Template.Spec) {
+			targets = append(targets, w)
+		}
 	}
+	return targets, nil
 }
 
-func triggerStatefulRollout(ns string, deploymentName string) {
-	clientset := clientset()
-	data := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, time.Now().String())
-	_, err := clientset.
-		AppsV1().
-		StatefulSets(ns).
-		Patch(context.Background(), deploymentName, types.StrategicMergePatchType, []byte(data), metav1.PatchOptions{FieldManager: "cnvrg-cre-rollout"})
+// labeledNamespace returns the namespace to list the labeled workloads of kind in for src, false when RBAC
+// denies listing them, the namespace is excluded, or cre may not roll them out in the namespace src redirects to
+func labeledNamespace(src Source, kind string) (string, bool) {
+	if !canList(kind) {
+		return "", false
+	}
+	ns := src.RolloutNamespace()
+	if reason, excluded := excludedNamespace(ns); excluded {
+		logrus.Debugf("namespace %s is excluded by %s, not rolling out its %ss for %s", ns, reason, kind, src)
+		return "", false
+	}
+	if ns != src.Namespace {
+		if err := canRollout(ns, workloadKindResources[kind]); err != nil {
+			src.log().Errorf("skipping the %ss of %s: %s", kind, src, err)
+			notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Outcome: "skipped", Error: err.Error()})
+			recordSourceEvent(src, corev1.EventTypeWarning, "RolloutSkipped", err.Error())
+			return "", false
+		}
+	}
+	return ns, true
+}
+
+// labeledTarget tells if the listed workload w is a target of src: it carries the match label value of src,
+// isn't opted out and, with require-reference, its pod spec consumes src
+func labeledTarget(src Source, matchLabelValue string, w Workload, obj metav1.Object, spec corev1.PodSpec) bool {
+	if value, ok := matchValue(obj); !ok || value != matchLabelValue {
+		return false
+	}
+	return !optedOut(src, w, obj.GetAnnotations()) && !unreferenced(src, w, spec)
+}
+
+// capBatch guards against a stray shared label restarting a large part of the cluster at once,
+// only the first max-batch-size candidates are rolled out unless allow-large-batches is set
+func capBatch(src Source, candidates []Workload) []Workload {
+	max := batchLimit(len(candidates))
+	if max == len(candidates) {
+		return candidates
+	}
+	msg := fmt.Sprintf("%s matches %d workloads, more than --max-batch-size %d, only the first %d are restarted. "+
+		"This is likely a misconfigured label, set --allow-large-batches to restart all of them", src, len(candidates), max, max)
+	src.log().Warnf("!!! %s", msg)
+	notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: candidates[max:], Outcome: "skipped", Error: msg})
+	recordSourceEvent(src, corev1.EventTypeWarning, "BatchCapped", msg)
+	return candidates[:max]
+}
+
+// batchLimit returns how many of n candidates may be restarted for a single change
+func batchLimit(n int) int {
+	max := tunableInt("max-batch-size")
+	if max <= 0 || n <= max || viper.GetBool("allow-large-batches") {
+		return n
+	}
+	return max
+}
+
+// triggerRollout reloads w in place when a reload profile applies, restarts it otherwise.
+// With dry-run it only logs the workload it would patch, the rollout being counted as skipped.
+func triggerRollout(src Source, w Workload) bool {
+	if tunableBool("dry-run") {
+		src.log().WithFields(logrus.Fields{"dry_run": true, "kind": w.Kind, "namespace": w.Namespace, "name": w.Name}).
+			Infof("DRY-RUN: would patch %s/%s in %s", strings.ToLower(w.Kind), w.Name, w.Namespace)
+		traceDecision(src, stageRollout, "dry-run", &w, "--dry-run is set, not patching")
+		return false
+	}
+	// Spoke pods aren't reachable for in place reloads, they're restarted, and so are CronJobs whose Jobs run to completion
+	if profile, ok := reloadProfile(src, w); ok && w.Cluster == "" && w.Kind != "CronJob" && canReloadInPlace(profile) {
+		traceDecision(src, stageRollout, "reload-in-place", &w, "reload profile %s", profile)
+		return triggerInPlaceReload(src, w, profile)
+	}
+	return triggerRestart(src, w)
+}
+
+// triggerRestart restarts w by bumping the restartedAt annotation of its pod template, after the preflight dry run.
+// A failed patch is notified and recorded on the workload, a restarted one is tracked until its rollout completes.
+func triggerRestart(src Source, w Workload) bool {
+	if _, ok := workloadKindResources[w.Kind]; !ok {
+		return false
+	}
+	data := restartPatch(src, w.Kind)
+	patch := func(opts metav1.PatchOptions) error {
+		return patchWorkload(w, data, opts)
+	}
+	if !preflightPatch(src, w, patch) {
+		return false
+	}
+	err := patch(metav1.PatchOptions{FieldManager: "cnvrg-cre-rollout"})
 	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("error triggering statefulset rolout")
+		// A failed patch only fails this workload, the other rollouts go on
+		src.log().Errorf("%s failed to restart %s", err, w)
+		notify(RolloutEvent{Type: EventRolloutFailed, Source: src, Targets: []Workload{w}, Outcome: "failed", Error: err.Error()})
+		impersonationFailed(src, w, err)
+		recordWorkloadEvent(src, w, err)
+		return false
+	}
+	recordWorkloadEvent(src, w, nil)
+	trackRollout(src, w)
+	return true
+}
+
+// restartPatch bumps the restartedAt annotation of the pod template in RFC3339, like kubectl rollout restart,
+// and sets the correlation id of the change on it, so the restarted pods tell which change they picked up,
+// and the cluster name, telling which cre instance restarted them.
+// The triggered-by annotation lists src and the sources coalesced into the restart.
+// With set-change-cause the workload also gets a change-cause annotation naming src, shown by kubectl rollout history.
+// It's set on the workload and not the pod template, so it doesn't change the pod template hash.
+// The pod template of a CronJob is the one of its job template.
+func restartPatch(src Source, kind string) []byte {
+	annotations := map[string]string{
+		"kubectl.kubernetes.io/restartedAt": time.Now().Format(time.RFC3339),
+		correlationIDAnnotation:             src.CorrelationID,
+		triggeredByAnnotation:               strings.Join(append([]string{src.String()}, src.CoalescedWith...), ", "),
+	}
+	if name := viper.GetString("cluster-name"); name != "" {
+		annotations[clusterAnnotation] = name
+	}
+	spec := map[string]interface{}{"template": map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}}}
+	if kind == "CronJob" {
+		spec = map[string]interface{}{"jobTemplate": map[string]interface{}{"spec": spec}}
+	}
+	patch := map[string]interface{}{"spec": spec}
+	if viper.GetBool("set-change-cause") {
+		changed := fmt.Sprintf("%s %s", src.Kind, src.Name)
+		for _, other := range src.CoalescedWith {
+			changed += ", " + other
+		}
+		patch["metadata"] = map[string]interface{}{"annotations": map[string]string{"kubernetes.io/change-cause": fmt.Sprintf("config-reloader: %s changed", changed)}}
+	}
+	// marshalled rather than formatted, so a cluster name or source name needing escapes keeps it valid
+	data, _ := json.Marshal(patch)
+	return data
+}
+
+// getWorkload returns the object of w and its pod template
+func getWorkload(w Workload) (metav1.Object, *corev1.PodTemplateSpec, error) {
+	client, err := workloadClient(w)
+	if err != nil {
+		return nil, nil, err
+	}
+	apps := client.AppsV1()
+	switch w.Kind {
+	case "Deployment":
+		d, err := apps.Deployments(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &d.Spec.Template, nil
+	case "StatefulSet":
+		s, err := apps.StatefulSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, &s.Spec.Template, nil
+	case "DaemonSet":
+		d, err := apps.DaemonSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &d.Spec.Template, nil
+	case "CronJob":
+		c, err := client.BatchV1().CronJobs(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, &c.Spec.JobTemplate.Spec.Template, nil
 	}
+	return nil, nil, fmt.Errorf("unsupported workload kind %s", w.Kind)
 }
 
-func triggerDaemonsetRollout(ns string, deploymentName string) {
-	clientset := clientset()
-	data := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, time.Now().String())
-	_, err := clientset.
-		AppsV1().
-		DaemonSets(ns).
-		Patch(context.Background(), deploymentName, types.StrategicMergePatchType, []byte(data), metav1.PatchOptions{FieldManager: "cnvrg-cre-rollout"})
+func patchWorkload(w Workload, data []byte, opts metav1.PatchOptions) error {
+	client, err := workloadClient(w)
 	if err != nil {
-		logrus.Error(err)
-		logrus.Fatalf("error triggering statefulset rolout")
+		return err
+	}
+	apps := client.AppsV1()
+	switch w.Kind {
+	case "Deployment":
+		_, err = apps.Deployments(w.Namespace).Patch(context.Background(), w.Name, types.StrategicMergePatchType, data, opts)
+	case "StatefulSet":
+		_, err = apps.StatefulSets(w.Namespace).Patch(context.Background(), w.Name, types.StrategicMergePatchType, data, opts)
+	case "DaemonSet":
+		_, err = apps.DaemonSets(w.Namespace).Patch(context.Background(), w.Name, types.StrategicMergePatchType, data, opts)
+	case "CronJob":
+		_, err = client.BatchV1().CronJobs(w.Namespace).Patch(context.Background(), w.Name, types.StrategicMergePatchType, data, opts)
+	default:
+		err = fmt.Errorf("unsupported workload kind %s", w.Kind)
 	}
+	// dry runs validate the patch, they aren't restarts
+	if err != nil && len(opts.DryRun) == 0 {
+		patchErrors.WithLabelValues(w.Kind, w.Namespace).Inc()
+	}
+	return err
+}
+
+// preflightPatch validates the patch with a server side dry run when preflight-dry-run is enabled,
+// so RBAC or admission webhook rejections are reported without mutating the workload
+func preflightPatch(src Source, w Workload, patch func(opts metav1.PatchOptions) error) bool {
+	if !tunableBool("preflight-dry-run") {
+		return true
+	}
+	if err := dryRunPatch(patch); err != nil {
+		src.log().Warnf("skipping rollout of %s, dry run rejected the patch (%s): %s", w, apierrors.ReasonForError(err), err)
+		notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: []Workload{w}, Outcome: "skipped", Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+func dryRunPatch(patch func(opts metav1.PatchOptions) error) error {
+	return patch(metav1.PatchOptions{FieldManager: "cnvrg-cre-rollout", DryRun: []string{metav1.DryRunAll}})
 }
 
 func main() {
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// binds the flags, so the tests see their defaults
+	setupCommands()
+	logrus.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeClientset makes a fake clientset holding objects the clientset of cre for the test
+func fakeClientset(t *testing.T, objects ...runtime.Object) *fake.Clientset {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	clientsOnce.Do(func() {})
+	previous := sharedClientset
+	sharedClientset = client
+	t.Cleanup(func() { sharedClientset = previous })
+	return client
+}
+
+// fakeDynamicClient makes a fake dynamic client holding objects the dynamic client of cre for the test
+func fakeDynamicClient(t *testing.T, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	t.Helper()
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+	clientsOnce.Do(func() {})
+	previous := sharedDynamicClient
+	sharedDynamicClient = client
+	t.Cleanup(func() { sharedDynamicClient = previous })
+	return client
+}
+
+// serveResources makes the discovery of client serve the custom resources gvrs, forgetting the served resources after the test
+func serveResources(t *testing.T, client *fake.Clientset, gvrs ...schema.GroupVersionResource) {
+	t.Helper()
+	servedMu.Lock()
+	for _, gvr := range gvrs {
+		// discovered as not served by an earlier test
+		delete(served, gvr)
+	}
+	servedMu.Unlock()
+	for _, gvr := range gvrs {
+		client.Resources = append(client.Resources, &metav1.APIResourceList{
+			GroupVersion: gvr.GroupVersion().String(),
+			APIResources: []metav1.APIResource{{Name: gvr.Resource, Namespaced: true}},
+		})
+	}
+	t.Cleanup(func() {
+		servedMu.Lock()
+		served = map[schema.GroupVersionResource]bool{}
+		servedMu.Unlock()
+	})
+}
+
+// setFlags sets the flags for the test, restoring their values after it
+func setFlags(t *testing.T, flags map[string]interface{}) {
+	t.Helper()
+	for key, value := range flags {
+		key, previous := key, viper.Get(key)
+		viper.Set(key, value)
+		t.Cleanup(func() { viper.Set(key, previous) })
+	}
+}
+
+func labeledDeployment(ns, name, value string) *appsv1.Deployment {
+	return &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: map[string]string{"mlops.cnvrg.io": value}}}
+}
+
+func TestClientsetIsShared(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "web", "app"))
+	if clientset() != clientset() {
+		t.Fatal("clientset returned a new client")
+	}
+	targets, err := matchingDeployments(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Name != "web" {
+		t.Fatalf("expected the labeled Deployment web, got %v", targets)
+	}
+	lists := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "list" {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Fatalf("expected a single list through the shared client, got %d", lists)
+	}
+}
+
+func TestSourceFactoryIsSharedByKind(t *testing.T) {
+	fakeClientset(t)
+	factory := sourceFactory("shared")
+	if sourceFactory("shared") != factory {
+		t.Fatal("the ConfigMap and Secret informers of a namespace got different factories")
+	}
+	if sourceFactory("other") == factory {
+		t.Fatal("two namespaces share a factory")
+	}
+}
+
+// patchCounter counts the Deployment patches, rejecting the first one (the dry run when preflight-dry-run is set)
+func patchCounter(client *fake.Clientset, rejectFirst bool) *int {
+	patches := 0
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if rejectFirst && patches == 1 {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "deployments"}, action.(k8stesting.PatchAction).GetName(), errors.New("admission webhook denied the request"))
+		}
+		return false, nil, nil
+	})
+	return &patches
+}
+
+func TestRejectedDryRunSkipsTheRollout(t *testing.T) {
+	patches := patchCounter(fakeClientset(t, labeledDeployment("apps", "web", "app")), true)
+	setFlags(t, map[string]interface{}{"preflight-dry-run": true})
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}
+	if triggerRestart(src, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("rolled out although the dry run was rejected")
+	}
+	if *patches != 1 {
+		t.Fatalf("expected only the dry run patch, got %d patches", *patches)
+	}
+}
+
+func TestAcceptedDryRunRollsOut(t *testing.T) {
+	patches := patchCounter(fakeClientset(t, labeledDeployment("apps", "web", "app")), false)
+	setFlags(t, map[string]interface{}{"preflight-dry-run": true})
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}
+	if !triggerRestart(src, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("the rollout failed")
+	}
+	if *patches != 2 {
+		t.Fatalf("expected the dry run and the restart patches, got %d patches", *patches)
+	}
+}
+
+func TestPreflightOffPatchesOnce(t *testing.T) {
+	patches := patchCounter(fakeClientset(t, labeledDeployment("apps", "web", "app")), true)
+	setFlags(t, map[string]interface{}{"preflight-dry-run": false})
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}
+	if triggerRestart(src, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("rolled out although the patch was rejected")
+	}
+	if *patches != 1 {
+		t.Fatalf("expected a single patch without the dry run, got %d patches", *patches)
+	}
+}
+
+func TestSecretUpdateHasASingleDiff(t *testing.T) {
+	old := &corev1.Secret{Data: map[string][]byte{"user": []byte("cre"), "password": []byte("old")}}
+	// a write with StringData, as read back from the API server which merged it into Data
+	written := &corev1.Secret{Data: map[string][]byte{"user": []byte("cre")}, StringData: map[string]string{"password": "new"}}
+	read := &corev1.Secret{Data: map[string][]byte{"user": []byte("cre"), "password": []byte("new")}}
+	for name, new := range map[string]*corev1.Secret{"written": written, "read": read} {
+		oldData, newData := secretData(old), secretData(new)
+		if changed := changedSecretKeys(oldData, newData); !reflect.DeepEqual(changed, []string{"password"}) {
+			t.Fatalf("%s: expected password to change, got %v", name, changed)
+		}
+		diff := secretDiff(oldData, newData)
+		if strings.Count(diff, "password") != 1 || strings.Contains(diff, "user") {
+			t.Fatalf("%s: expected a single diff of password, got %q", name, diff)
+		}
+	}
+	if changed := changedSecretKeys(secretData(written), secretData(read)); len(changed) != 0 {
+		t.Fatalf("StringData and the Data it's merged into differ by %v", changed)
+	}
+}
+
+func TestSourceListOptionsArePaged(t *testing.T) {
+	setFlags(t, map[string]interface{}{"list-page-size": 500, "stakater-compat": false, "reload-policies": false})
+	options := metav1.ListOptions{ResourceVersion: "0"}
+	sourceListOptions(&options)
+	if options.Limit != 500 {
+		t.Fatalf("expected pages of 500, got a limit of %d", options.Limit)
+	}
+	if options.LabelSelector != "mlops.cnvrg.io" {
+		t.Fatalf("expected the match label selector on the page, got %q", options.LabelSelector)
+	}
+	if options.ResourceVersion != "" {
+		t.Fatalf("expected a list from etcd, got resourceVersion %q", options.ResourceVersion)
+	}
+	watch := metav1.ListOptions{Watch: true, ResourceVersion: "42"}
+	sourceListOptions(&watch)
+	if watch.Limit != 0 || watch.ResourceVersion != "42" {
+		t.Fatalf("expected the watch unpaged at its resourceVersion, got %+v", watch)
+	}
+}
+
+func TestSourceListOptionsUnpagedByDefault(t *testing.T) {
+	setFlags(t, map[string]interface{}{"list-page-size": 0, "reload-policies": false})
+	options := metav1.ListOptions{ResourceVersion: "0"}
+	sourceListOptions(&options)
+	if options.Limit != 0 || options.ResourceVersion != "0" {
+		t.Fatalf("expected an unpaged list from the watch cache, got %+v", options)
+	}
+}
+
+func TestIdenticalUpdateCountsANoop(t *testing.T) {
+	old := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "noop", Name: "app-config", ResourceVersion: "1"}, Data: map[string]string{"key": "value"}}
+	reapplied := old.DeepCopy()
+	reapplied.ResourceVersion = "2"
+	noops := noopUpdates.WithLabelValues("noop", "metadata-only")
+	before := testutil.ToFloat64(noops)
+	if !skippedUpdate("ConfigMap", old, reapplied, func() bool { return reflect.DeepEqual(old.Data, reapplied.Data) }) {
+		t.Fatal("a re-apply of the same content wasn't skipped")
+	}
+	if counted := testutil.ToFloat64(noops) - before; counted != 1 {
+		t.Fatalf("expected the no-op update counted once in its namespace, got %v", counted)
+	}
+}
+
+func TestRolloutInTheSourceNamespace(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "web", "app"), labeledDeployment("prod-apps", "web", "app"))
+	reviews := reviewer(t, client)
+	targets, err := matchingDeployments(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Namespace != "apps" {
+		t.Fatalf("expected the Deployment of the source namespace, got %v", targets)
+	}
+	if *reviews != 0 {
+		t.Fatalf("expected no access review in the source namespace, got %d", *reviews)
+	}
+}
+
+func TestRolloutInTheTargetNamespace(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("control", "web", "app"), labeledDeployment("prod-apps", "web", "app"))
+	reviewer(t, client, "prod-apps")
+	src := Source{Kind: "ConfigMap", Namespace: "control", Name: "app-config", TargetNamespace: "prod-apps"}
+	targets, err := matchingDeployments(src, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].Namespace != "prod-apps" {
+		t.Fatalf("expected the Deployment of the target namespace, got %v", targets)
+	}
+}
+
+func TestRolloutInADeniedTargetNamespace(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("prod-apps", "web", "app"))
+	reviewer(t, client)
+	src := Source{Kind: "ConfigMap", Namespace: "control", Name: "app-config", TargetNamespace: "prod-apps"}
+	targets, err := matchingDeployments(src, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 0 {
+		t.Fatalf("expected the denied namespace skipped, got %v", targets)
+	}
+}
+
+func ownedConfigMap(controller *metav1.OwnerReference) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "app-config"}}
+	if controller != nil {
+		isController := true
+		controller.Controller = &isController
+		cm.OwnerReferences = []metav1.OwnerReference{*controller}
+	}
+	return cm
+}
+
+func TestOwnedByWatchedParent(t *testing.T) {
+	setFlags(t, map[string]interface{}{"owner-kind": "AppConfig", "owner-name": "web"})
+	cases := []struct {
+		name  string
+		owner *metav1.OwnerReference
+		owned bool
+	}{
+		{"matching owner", &metav1.OwnerReference{Kind: "AppConfig", Name: "web"}, true},
+		{"other kind", &metav1.OwnerReference{Kind: "Helm", Name: "web"}, false},
+		{"other name", &metav1.OwnerReference{Kind: "AppConfig", Name: "api"}, false},
+		{"no owner", nil, false},
+	}
+	for _, c := range cases {
+		if owned := ownedByWatchedParent(ownedConfigMap(c.owner)); owned != c.owned {
+			t.Fatalf("%s: expected owned %v, got %v", c.name, c.owned, owned)
+		}
+	}
+}
+
+func TestOwnedByAnyParentWithoutFilter(t *testing.T) {
+	setFlags(t, map[string]interface{}{"owner-kind": "", "owner-name": ""})
+	if !ownedByWatchedParent(ownedConfigMap(nil)) {
+		t.Fatal("expected sources without owner filter watched")
+	}
+}
+
+func TestMetadataOnlyUpdateIsSkippedEarly(t *testing.T) {
+	old := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "metadata", Name: "app-config", ResourceVersion: "1"}, Data: map[string]string{"key": "value"}}
+	relabeled := old.DeepCopy()
+	relabeled.ResourceVersion = "2"
+	relabeled.Labels = map[string]string{"team": "web"}
+	relabeled.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "other-controller"}}
+	metadataOnly, resyncs := noopUpdates.WithLabelValues("metadata", "metadata-only"), noopUpdates.WithLabelValues("metadata", "resync")
+	before, resynced := testutil.ToFloat64(metadataOnly), testutil.ToFloat64(resyncs)
+	if !skippedUpdate("ConfigMap", old, relabeled, func() bool { return reflect.DeepEqual(old.Data, relabeled.Data) }) {
+		t.Fatal("the metadata-only update wasn't skipped")
+	}
+	if testutil.ToFloat64(metadataOnly)-before != 1 || testutil.ToFloat64(resyncs) != resynced {
+		t.Fatal("expected the update counted as metadata-only")
+	}
+	compared := false
+	if !skippedUpdate("ConfigMap", old, old, func() bool { compared = true; return true }) || compared {
+		t.Fatal("expected the resync skipped without comparing the data")
+	}
+	if testutil.ToFloat64(resyncs)-resynced != 1 {
+		t.Fatal("expected the resync counted apart from the metadata-only updates")
+	}
+	changed := relabeled.DeepCopy()
+	changed.Data["key"] = "other"
+	if skippedUpdate("ConfigMap", old, changed, func() bool { return reflect.DeepEqual(old.Data, changed.Data) }) {
+		t.Fatal("a data change was skipped")
+	}
+}
+
+func deploymentsNamed(names ...string) []Workload {
+	var workloads []Workload
+	for _, name := range names {
+		workloads = append(workloads, Workload{Kind: "Deployment", Namespace: "apps", Name: name})
+	}
+	return workloads
+}
+
+func TestBatchIsCapped(t *testing.T) {
+	setFlags(t, map[string]interface{}{"max-batch-size": 2, "allow-large-batches": false})
+	fake := &fakeNotifier{name: "fake"}
+	fakeNotifiers(t, fake)
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "shared"}
+	batch := capBatch(src, deploymentsNamed("a", "b", "c"))
+	if !reflect.DeepEqual(batch, deploymentsNamed("a", "b")) {
+		t.Fatalf("expected the first 2 candidates, got %v", batch)
+	}
+	drainNotifiers(time.Second)
+	if events := fake.delivered(); len(events) != 1 || events[0].Type != EventRolloutSkipped || !reflect.DeepEqual(events[0].Targets, deploymentsNamed("c")) {
+		t.Fatalf("expected the capped candidate notified as skipped, got %v", events)
+	}
+	small := deploymentsNamed("a", "b")
+	if batch := capBatch(src, small); !reflect.DeepEqual(batch, small) {
+		t.Fatalf("expected a batch within the cap untouched, got %v", batch)
+	}
+}
+
+func TestLargeBatchIsAllowed(t *testing.T) {
+	setFlags(t, map[string]interface{}{"max-batch-size": 2, "allow-large-batches": true})
+	candidates := deploymentsNamed("a", "b", "c")
+	if batch := capBatch(Source{Kind: "ConfigMap", Namespace: "apps", Name: "shared"}, candidates); !reflect.DeepEqual(batch, candidates) {
+		t.Fatalf("expected all candidates with allow-large-batches, got %v", batch)
+	}
+}
+
+func TestNoCredentialsExits(t *testing.T) {
+	// logrus.Exit exits the process, so the no-credentials path runs in a child test process
+	if kubeconfig := os.Getenv("CRE_TEST_NO_CREDENTIALS"); kubeconfig != "" {
+		logrus.SetOutput(os.Stderr)
+		viper.Set("kubeconfig", kubeconfig)
+		loadRESTConfig()
+		return
+	}
+	missing := filepath.Join(t.TempDir(), "config")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestNoCredentialsExits$")
+	cmd.Env = []string{"CRE_TEST_NO_CREDENTIALS=" + missing}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != exitNoCredentials {
+		t.Fatalf("expected exit code %d without credentials, got %v", exitNoCredentials, err)
+	}
+	if msg := "no kubeconfig found at " + missing + " and not running in-cluster; set --kubeconfig or run inside a pod"; !strings.Contains(stderr.String(), msg) {
+		t.Fatalf("expected the actionable error %q, got %q", msg, stderr.String())
+	}
+}
+
+func TestChangeCauseAfterRollout(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "web", "app"))
+	setFlags(t, map[string]interface{}{"set-change-cause": true, "preflight-dry-run": false})
+	if !triggerRestart(Source{Kind: "Secret", Namespace: "apps", Name: "db-creds"}, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("the rollout failed")
+	}
+	deployment, err := client.AppsV1().Deployments("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cause := deployment.Annotations["kubernetes.io/change-cause"]; cause != "config-reloader: Secret db-creds changed" {
+		t.Fatalf("expected the change-cause of the Secret, got %q", cause)
+	}
+	// set on the Deployment only, a pod template annotation would change the pod template hash on every change
+	if _, ok := deployment.Spec.Template.Annotations["kubernetes.io/change-cause"]; ok {
+		t.Fatal("the change-cause was set on the pod template")
+	}
+}
+
+func TestNoChangeCauseByDefault(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "web", "app"))
+	setFlags(t, map[string]interface{}{"set-change-cause": false, "preflight-dry-run": false})
+	triggerRestart(Source{Kind: "Secret", Namespace: "apps", Name: "db-creds"}, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"})
+	deployment, err := client.AppsV1().Deployments("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cause, ok := deployment.Annotations["kubernetes.io/change-cause"]; ok {
+		t.Fatalf("expected no change-cause without set-change-cause, got %q", cause)
+	}
+}
+
+func TestRestartedAtIsRFC3339(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "web", "app"))
+	setFlags(t, map[string]interface{}{"preflight-dry-run": false})
+	before := time.Now().Truncate(time.Second)
+	if !triggerRestart(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("the rollout failed")
+	}
+	deployment, err := client.AppsV1().Deployments("apps").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := deployment.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"]
+	restartedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatalf("expected restartedAt in RFC3339 like kubectl sets it, got %q: %s", value, err)
+	}
+	if restartedAt.Before(before) || restartedAt.After(time.Now()) {
+		t.Fatalf("expected restartedAt the time of the rollout, got %s", restartedAt)
+	}
+}
+
+func TestRestartPatchIsValidJSON(t *testing.T) {
+	setFlags(t, map[string]interface{}{"cluster-name": `prod "eu"\west`, "set-change-cause": true})
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", CorrelationID: "42"}
+	annotations := templateAnnotations(t, restartPatch(src, "Deployment"))
+	if annotations[clusterAnnotation] != `prod "eu"\west` || annotations[correlationIDAnnotation] != "42" {
+		t.Fatalf("expected the cluster name and correlation id kept through the escapes, got %v", annotations)
+	}
+	var cronJob struct {
+		Spec struct {
+			JobTemplate struct {
+				Spec struct {
+					Template struct {
+						Metadata struct {
+							Annotations map[string]string `json:"annotations"`
+						} `json:"metadata"`
+					} `json:"template"`
+				} `json:"spec"`
+			} `json:"jobTemplate"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(restartPatch(src, "CronJob"), &cronJob); err != nil {
+		t.Fatal(err)
+	}
+	value := cronJob.Spec.JobTemplate.Spec.Template.Metadata.Annotations["kubectl.kubernetes.io/restartedAt"]
+	if _, err := time.Parse(time.RFC3339, value); err != nil {
+		t.Fatalf("expected the job template of the CronJob restarted in RFC3339, got %q: %s", value, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"time"
+)
+
+var (
+	notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_notifications_total",
+		Help: "Notification deliveries by notifier and result (success, failure, dropped)",
+	}, []string{"notifier", "result"})
+	noopUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_noop_updates_total",
+		Help: "Updates of watched ConfigMaps and Secrets which carried no data change, by reason (resync, metadata-only, re-encrypted)",
+	}, []string{"namespace", "reason"})
+	sealedSecretWarnings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_sealed_secret_warnings_total",
+		Help: "SealedSecrets which failed to unseal or whose Secret wasn't rewritten in time",
+	}, []string{"namespace", "reason"})
+	externalSecretErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_external_secret_errors_total",
+		Help: "ExternalSecrets which failed to sync a Secret with labeled consumers",
+	}, []string{"namespace"})
+	certificateRollouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_certificate_rollouts_total",
+		Help: "cert-manager renewals whose consumers were restarted",
+	}, []string{"namespace", "certificate"})
+	fileReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_file_reloads_total",
+		Help: "Reloads triggered by changes of watched local files, by result",
+	}, []string{"result"})
+	rolloutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_rollout_total",
+		Help: "Workloads restarted for a source change, by workload kind, namespace and result (triggered, skipped, failed)",
+	}, []string{"resource_type", "namespace", "result"})
+	configChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_config_change_total",
+		Help: "Changes of watched sources matched for a rollout, by source kind and namespace",
+	}, []string{"resource_type", "namespace"})
+	// rolloutResults and sourceChanges are rolloutsTotal and configChanges under the names and labels of the
+	// rollout dashboards, kept next to them so neither set of dashboards breaks
+	rolloutResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_rollouts_total",
+		Help: "Workloads restarted for a source change, by namespace, workload kind and result (triggered, skipped, failed)",
+	}, []string{"namespace", "kind", "result"})
+	sourceChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_config_changes_total",
+		Help: "Changes of watched sources matched for a rollout, by source kind",
+	}, []string{"kind"})
+	patchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cre_patch_errors_total",
+		Help: "Failed restart patches, by workload kind and namespace",
+	}, []string{"resource_type", "namespace"})
+	rolloutDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cre_rollout_duration_seconds",
+		Help:    "Time from a change being queued until the restart of its workload was triggered, by workload kind",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"resource_type"})
+	informerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cre_informer_lag_seconds",
+		Help: "Time between the last write of a source and its informer delivering the update, as of the last update, by source kind",
+	}, []string{"resource_type"})
+)
+
+func init() {
+	prometheus.MustRegister(notificationsTotal, noopUpdates, sealedSecretWarnings, externalSecretErrors, certificateRollouts, fileReloads,
+		rolloutsTotal, configChanges, rolloutResults, sourceChanges, patchErrors, rolloutDuration, informerLag)
+}
+
+// countRollouts counts the targets of the triggered, skipped and failed rollout events
+func countRollouts(event RolloutEvent) {
+	var result string
+	switch event.Type {
+	case EventRolloutTriggered:
+		result = "triggered"
+	case EventRolloutSkipped:
+		result = "skipped"
+	case EventRolloutFailed:
+		result = "failed"
+	default:
+		return
+	}
+	for _, w := range event.Targets {
+		rolloutsTotal.WithLabelValues(w.Kind, w.Namespace, result).Inc()
+		rolloutResults.WithLabelValues(w.Namespace, w.Kind, result).Inc()
+	}
+}
+
+// observeInformerLag sets the lag of the informer of kind from the latest managedFields time of an updated object.
+// The times have a second precision, the lag is as precise.
+func observeInformerLag(kind string, obj metav1.Object) {
+	var last time.Time
+	for _, f := range obj.GetManagedFields() {
+		if f.Time != nil && f.Time.After(last) {
+			last = f.Time.Time
+		}
+	}
+	if last.IsZero() {
+		return
+	}
+	lag := time.Since(last).Seconds()
+	if lag < 0 {
+		lag = 0
+	}
+	informerLag.WithLabelValues(kind).Set(lag)
+}
+
+// serveMetrics serves the metrics and admin endpoints on metrics-addr, and the probes on health-addr,
+// or unauthenticated on metrics-addr without it, until ctx is done
+func serveMetrics(ctx context.Context) {
+	addr, healthAddr := viper.GetString("metrics-addr"), viper.GetString("health-addr")
+	if addr == "" && healthAddr == "" {
+		return
+	}
+	adminToken, err := readSecret("admin-token", "admin-token-file")
+	if err != nil {
+		logrus.Fatalf("%s failed to read the admin token", err)
+	}
+	auth, err := newHTTPAuth(adminToken)
+	if err != nil {
+		logrus.Fatalf("%s, invalid http auth configuration", err)
+	}
+	tlsConfig, err := metricsTLSConfig()
+	if err != nil {
+		logrus.Fatalf("%s failed to load the metrics certificate", err)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	if healthAddr != "" {
+		health := http.NewServeMux()
+		registerProbes(health)
+		logrus.Infof("serving probes on %s://%s/healthz and /readyz", scheme, healthAddr)
+		go serveHTTP(ctx, "health", healthAddr, health, tlsConfig)
+	}
+	if addr == "" {
+		return
+	}
+	logrus.Infof("serving metrics on %s://%s/metrics, http auth: %s", scheme, addr, auth.mode)
+	mux := http.NewServeMux()
+	metrics := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(clusterGatherer{prometheus.DefaultGatherer}, promhttp.HandlerOpts{}))
+	mux.Handle("/metrics", auth.authenticate(metrics))
+	mux.Handle("/debug/config", auth.authenticate(http.HandlerFunc(debugConfigHandler)))
+	registerAdminRoutes(mux, auth)
+	registerSlackActions(mux)
+	if healthAddr == "" {
+		registerProbes(mux)
+	}
+	serveHTTP(ctx, "metrics", addr, mux, tlsConfig)
+}
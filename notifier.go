@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies a step of the rollout lifecycle
+type EventType string
+
+const (
+	EventRolloutMatched   EventType = "rollout-matched"
+	EventRolloutTriggered EventType = "rollout-triggered"
+	EventRolloutCompleted EventType = "rollout-completed"
+	EventRolloutFailed    EventType = "rollout-failed"
+	EventRolloutStuck     EventType = "rollout-stuck"
+	EventRolloutSkipped   EventType = "rollout-skipped"
+	// EventBreakerTripped is sent once when the mass-change circuit breaker starts holding the rollouts
+	EventBreakerTripped EventType = "breaker-tripped"
+	// EventRolloutPendingApproval is sent when the rollout of an approval-required workload starts waiting for its approval
+	EventRolloutPendingApproval EventType = "rollout-pending-approval"
+)
+
+// Severity of a rollout event, used to filter notifications
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+func parseSeverity(s string) (Severity, error) {
+	switch strings.ToLower(s) {
+	case "", "info":
+		return SeverityInfo, nil
+	case "warning", "warn":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	}
+	return SeverityInfo, fmt.Errorf("unknown severity %q, expected info|warning|error", s)
+}
+
+const (
+	// correlationIDField is the log field holding the correlation id of a change
+	correlationIDField = "correlation_id"
+	// correlationIDAnnotation carries the correlation id on Kubernetes Events and restarted pod templates
+	correlationIDAnnotation = "cre.cnvrg.io/correlation-id"
+	// triggeredByAnnotation lists the sources whose changes a restart of the pod template applied
+	triggeredByAnnotation = "cre.cnvrg.io/triggered-by"
+)
+
+// Source is the ConfigMap or Secret which change caused the rollout.
+// ChangedKeys holds key names only, values are never carried around.
+// CorrelationID is generated once per change and shared by all the events it leads to.
+// Certificate is set for Secrets renewed by cert-manager.
+// Unlabeled sources lack the match label and only restart stakater annotated workloads.
+// Policy is the ReloadPolicy selecting the source, its targets replace the label based matching.
+// MatchLabelValue is the value of its match label, for notification routes to match on.
+// GitSHA and GitRepo are the commit it was applied from, set with the git-sha and git-repo annotations.
+// Clusters are the spoke clusters it rolls out to in hub mode, set with the clusters annotation.
+// CoalescedWith are the other sources whose changes a restart of a workload applies at once, set for that restart only.
+type Source struct {
+	Kind            string           `json:"kind"`
+	Namespace       string           `json:"namespace"`
+	Name            string           `json:"name"`
+	UID             types.UID        `json:"-"`
+	TargetNamespace string           `json:"targetNamespace,omitempty"`
+	ChangedKeys     []string         `json:"changedKeys,omitempty"`
+	CorrelationID   string           `json:"-"`
+	Certificate     *CertificateInfo `json:"certificate,omitempty"`
+	Unlabeled       bool             `json:"-"`
+	Policy          *reloadPolicy    `json:"-"`
+	MatchLabelValue string           `json:"-"`
+	GitSHA          string           `json:"-"`
+	GitRepo         string           `json:"-"`
+	Clusters        []string         `json:"clusters,omitempty"`
+	CoalescedWith   []string         `json:"coalescedWith,omitempty"`
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%s %s/%s", s.Kind, s.Namespace, s.Name)
+}
+
+// log returns a logger tagging every line with the correlation id of the change
+func (s Source) log() *logrus.Entry {
+	return logrus.WithField(correlationIDField, s.CorrelationID)
+}
+
+// RolloutNamespace is where the workloads to rollout are looked up,
+// the source namespace unless redirected with the target-namespace annotation
+func (s Source) RolloutNamespace() string {
+	if s.TargetNamespace != "" {
+		return s.TargetNamespace
+	}
+	return s.Namespace
+}
+
+// Workload is a rollout target
+type Workload struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Cluster is the spoke cluster running the workload in hub mode, empty for the local cluster
+	Cluster string `json:"cluster,omitempty"`
+}
+
+func (w Workload) String() string {
+	if w.Cluster != "" {
+		return fmt.Sprintf("%s %s/%s in cluster %s", w.Kind, w.Namespace, w.Name, w.Cluster)
+	}
+	return fmt.Sprintf("%s %s/%s", w.Kind, w.Namespace, w.Name)
+}
+
+// RolloutEvent is what notifiers receive
+type RolloutEvent struct {
+	Type          EventType  `json:"type"`
+	Time          time.Time  `json:"time"`
+	CorrelationID string     `json:"correlationId"`
+	Source        Source     `json:"source"`
+	Targets       []Workload `json:"targets"`
+	Outcome       string     `json:"outcome"`
+	Error         string     `json:"error,omitempty"`
+	Cluster       string     `json:"cluster,omitempty"`
+}
+
+func (e RolloutEvent) Severity() Severity {
+	switch e.Type {
+	case EventRolloutFailed:
+		return SeverityError
+	case EventRolloutStuck, EventBreakerTripped, EventRolloutPendingApproval:
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+// Notifier delivers rollout events to an external system
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event RolloutEvent) error
+}
+
+type notifierOptions struct {
+	namespaces        []string
+	excludeNamespaces []string
+	minSeverity       Severity
+	// events the notifier is interested in, empty for all
+	events []EventType
+	// events buffered before new ones are dropped, notifyQueueSize when not set
+	queueSize int
+}
+
+func (o notifierOptions) accepts(event RolloutEvent) bool {
+	if event.Severity() < o.minSeverity {
+		return false
+	}
+	if len(o.events) > 0 {
+		wanted := false
+		for _, t := range o.events {
+			wanted = wanted || t == event.Type
+		}
+		if !wanted {
+			return false
+		}
+	}
+	for _, ns := range o.excludeNamespaces {
+		if ns == event.Source.Namespace {
+			return false
+		}
+	}
+	if len(o.namespaces) == 0 {
+		return true
+	}
+	for _, ns := range o.namespaces {
+		if ns == event.Source.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	notifyQueueSize   = 100
+	notifyMaxAttempts = 5
+	notifyTimeout     = 10 * time.Second
+)
+
+// asyncNotifier queues events for a Notifier and delivers them from its own goroutine,
+// so every event fans out to all notifiers concurrently and a slow or broken receiver never blocks a rollout.
+// Delivery errors are logged and counted per notifier, they never fail the rollout.
+type asyncNotifier struct {
+	notifier Notifier
+	opts     notifierOptions
+	queue    chan RolloutEvent
+	pending  sync.WaitGroup
+}
+
+var notifiers []*asyncNotifier
+
+func newAsyncNotifier(n Notifier, opts notifierOptions) *asyncNotifier {
+	size := opts.queueSize
+	if size <= 0 {
+		size = notifyQueueSize
+	}
+	an := &asyncNotifier{notifier: n, opts: opts, queue: make(chan RolloutEvent, size)}
+	go an.run()
+	return an
+}
+
+func (an *asyncNotifier) enqueue(event RolloutEvent) {
+	if !an.opts.accepts(event) {
+		return
+	}
+	an.pending.Add(1)
+	select {
+	case an.queue <- event:
+	default:
+		an.pending.Done()
+		notificationsTotal.WithLabelValues(an.notifier.Name(), "dropped").Inc()
+		event.Source.log().Errorf("%s notifier queue is full, dropping %s event for %s", an.notifier.Name(), event.Type, event.Source)
+	}
+}
+
+func (an *asyncNotifier) run() {
+	for event := range an.queue {
+		an.deliver(event)
+		an.pending.Done()
+	}
+}
+
+func (an *asyncNotifier) deliver(event RolloutEvent) {
+	err := withRetries(an.notifier.Name(), func(ctx context.Context) error {
+		return an.notifier.Notify(ctx, event)
+	})
+	if err != nil {
+		notificationsTotal.WithLabelValues(an.notifier.Name(), "failure").Inc()
+		event.Source.log().Errorf("%s notifier failed to deliver %s event for %s after %d attempts: %s", an.notifier.Name(), event.Type, event.Source, notifyMaxAttempts, err)
+		return
+	}
+	notificationsTotal.WithLabelValues(an.notifier.Name(), "success").Inc()
+}
+
+// withRetries calls fn until it succeeds or notifyMaxAttempts is reached, backing off exponentially.
+// Each attempt is bounded by notifier-timeout.
+func withRetries(name string, fn func(ctx context.Context) error) error {
+	backoff := time.Second
+	timeout := viper.GetDuration("notifier-timeout")
+	if timeout <= 0 {
+		timeout = notifyTimeout
+	}
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := fn(ctx)
+		cancel()
+		if err == nil || attempt == notifyMaxAttempts {
+			return err
+		}
+		logrus.Debugf("%s notifier attempt %d failed: %s, retrying in %s", name, attempt, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// chatEvents are the events worth a chat message
+var chatEvents = []EventType{EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck, EventBreakerTripped}
+
+// optionsFor reads the <prefix>-namespaces, <prefix>-exclude-namespaces and <prefix>-min-severity params
+func optionsFor(prefix string, events []EventType) notifierOptions {
+	minSeverity, err := parseSeverity(viper.GetString(prefix + "-min-severity"))
+	if err != nil {
+		logrus.Fatalf("%s, invalid --%s-min-severity", err, prefix)
+	}
+	return notifierOptions{
+		namespaces:        viper.GetStringSlice(prefix + "-namespaces"),
+		excludeNamespaces: viper.GetStringSlice(prefix + "-exclude-namespaces"),
+		minSeverity:       minSeverity,
+		events:            events,
+	}
+}
+
+// notifierBackend builds the notifiers of one backend, e.g. one per webhook url.
+// Backends register themselves from init, selected with --notifiers or,
+// when it isn't set, enabled by their own settings being present.
+type notifierBackend struct {
+	configured   func() bool
+	build        func() ([]*asyncNotifier, error)
+	explicitOnly bool
+}
+
+var notifierBackends = map[string]notifierBackend{}
+
+func registerNotifierBackend(name string, backend notifierBackend) {
+	notifierBackends[name] = backend
+}
+
+func setupNotifiers() {
+	if err := validateCloudEvents(); err != nil {
+		logrus.Fatal(err)
+	}
+	names := viper.GetStringSlice("notifiers")
+	explicit := len(names) > 0
+	if !explicit {
+		for name, backend := range notifierBackends {
+			if !backend.explicitOnly && backend.configured() {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		backend, ok := notifierBackends[name]
+		if !ok {
+			logrus.Fatalf("unknown notifier %q in --notifiers", name)
+		}
+		if !backend.configured() {
+			logrus.Fatalf("notifier %s is selected with --notifiers but isn't configured", name)
+		}
+		built, err := backend.build()
+		if err != nil {
+			logrus.Fatalf("%s, invalid %s notifier configuration", err, name)
+		}
+		notifiers = append(notifiers, built...)
+	}
+	setupRoutes()
+	// Give queued notifications a chance to go out when the process exits on fatal errors
+	logrus.RegisterExitHandler(func() { drainNotifiers(notifyTimeout) })
+}
+
+func notify(event RolloutEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.CorrelationID = event.Source.CorrelationID
+	event.Cluster = viper.GetString("cluster-name")
+	if event.Type == EventRolloutFailed {
+		lifetime.error()
+	}
+	recordChangeStatus(event)
+	countRollouts(event)
+	traceEvent(event)
+	publishEvent(event)
+	_, route := routeFor(event)
+	for _, n := range notifiers {
+		if route.selects(n.notifier.Name()) && notifierAllowed(event.Source, n.notifier.Name()) {
+			n.enqueue(event)
+		}
+	}
+}
+
+// drainNotifiers waits up to timeout for all queued notifications to be delivered
+func drainNotifiers(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		for _, n := range notifiers {
+			n.pending.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logrus.Warn("timed out waiting for pending notifications")
+	}
+}
+
+// postJSON sends body as JSON and treats any non 2xx response as an error
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}, headers map[string]string) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return post(ctx, client, url, "application/json", payload, headers)
+}
+
+func post(ctx context.Context, client *http.Client, url string, contentType string, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return redactURL(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return redactURL(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		// Don't echo the url, webhook urls usually embed a secret
+		return fmt.Errorf("endpoint responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// redactURL strips the url from the errors of the http client, webhook urls usually embed a secret
+func redactURL(err error) error {
+	if urlErr, ok := err.(*neturl.Error); ok {
+		return fmt.Errorf("%s of the endpoint failed: %s", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// readSecret returns the value of key, usually set through its env,
+// falling back to the content of the file named by the fileKey param, e.g. a mounted Secret
+func readSecret(key, fileKey string) (string, error) {
+	if secret := viper.GetString(key); secret != "" {
+		return secret, nil
+	}
+	file := viper.GetString(fileKey)
+	if file == "" {
+		return "", nil
+	}
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
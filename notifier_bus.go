@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"strings"
+)
+
+func init() {
+	registerNotifierBackend("kafka", notifierBackend{
+		configured: func() bool { return len(viper.GetStringSlice("kafka-brokers")) > 0 },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newKafkaNotifier()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("publishing events to kafka topic %s", viper.GetString("kafka-topic"))
+			return []*asyncNotifier{newAsyncNotifier(n, notifierOptions{queueSize: viper.GetInt("bus-buffer-size")})}, nil
+		},
+	})
+	registerNotifierBackend("nats", notifierBackend{
+		configured: func() bool { return viper.GetString("nats-url") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newNatsNotifier()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("publishing events to nats subject %s", n.subject)
+			return []*asyncNotifier{newAsyncNotifier(n, notifierOptions{queueSize: viper.GetInt("bus-buffer-size")})}, nil
+		},
+	})
+}
+
+// busPayload is the JSON event, wrapped as a structured CloudEvent when CloudEvents are enabled
+func busPayload(event RolloutEvent) ([]byte, error) {
+	if cloudEventsMode() != "" {
+		return structuredCloudEvent(event)
+	}
+	return json.Marshal(event)
+}
+
+// busKey keeps the messages of a workload on the same partition,
+// events with several targets are keyed by their source instead
+func busKey(event RolloutEvent) string {
+	if len(event.Targets) == 1 {
+		return event.Targets[0].Namespace + "/" + event.Targets[0].Name
+	}
+	return event.Source.Namespace + "/" + event.Source.Name
+}
+
+// kafkaNotifier publishes every RolloutEvent as a JSON message to a kafka topic,
+// the payload is the same as the one of the webhook notifier
+type kafkaNotifier struct {
+	writer *kafka.Writer
+}
+
+func newKafkaNotifier() (*kafkaNotifier, error) {
+	transport := &kafka.Transport{DialTimeout: notifyTimeout}
+	mechanism, err := kafkaSASL()
+	if err != nil {
+		return nil, err
+	}
+	transport.SASL = mechanism
+	if viper.GetBool("kafka-tls") {
+		tlsConfig, err := tlsConfigWithCA(viper.GetString("kafka-tls-ca-file"))
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+	topic := viper.GetString("kafka-topic")
+	if topic == "" {
+		return nil, fmt.Errorf("--kafka-topic is required")
+	}
+	return &kafkaNotifier{writer: &kafka.Writer{
+		Addr:         kafka.TCP(viper.GetStringSlice("kafka-brokers")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		Transport:    transport,
+		RequiredAcks: kafka.RequireAll,
+		// retries are done by the notifier queue
+		MaxAttempts: 1,
+	}}, nil
+}
+
+func kafkaSASL() (sasl.Mechanism, error) {
+	mechanism := strings.ToLower(viper.GetString("kafka-sasl-mechanism"))
+	if mechanism == "" {
+		return nil, nil
+	}
+	username := viper.GetString("kafka-sasl-username")
+	password, err := readSecret("kafka-sasl-password", "kafka-sasl-password-file")
+	if err != nil {
+		return nil, err
+	}
+	switch mechanism {
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	}
+	return nil, fmt.Errorf("unknown --kafka-sasl-mechanism %q, expected plain|scram-sha-256|scram-sha-512", mechanism)
+}
+
+func (k *kafkaNotifier) Name() string {
+	return "kafka"
+}
+
+func (k *kafkaNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	payload, err := busPayload(event)
+	if err != nil {
+		return err
+	}
+	return k.writer.WriteMessages(ctx, kafka.Message{Key: []byte(busKey(event)), Value: payload})
+}
+
+// natsNotifier publishes every RolloutEvent as a JSON message to a nats subject
+type natsNotifier struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNatsNotifier() (*natsNotifier, error) {
+	subject := viper.GetString("nats-subject")
+	if subject == "" {
+		return nil, fmt.Errorf("--nats-subject is required")
+	}
+	opts := []nats.Option{nats.Name("cre"), nats.MaxReconnects(-1)}
+	if creds := viper.GetString("nats-creds-file"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	if ca := viper.GetString("nats-tls-ca-file"); ca != "" {
+		opts = append(opts, nats.RootCAs(ca))
+	}
+	conn, err := nats.Connect(viper.GetString("nats-url"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsNotifier{conn: conn, subject: subject}, nil
+}
+
+func (n *natsNotifier) Name() string {
+	return "nats"
+}
+
+func (n *natsNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	payload, err := busPayload(event)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(n.subject)
+	msg.Header.Set("Cre-Key", busKey(event))
+	msg.Data = payload
+	if err := n.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	// make sure the server got it, otherwise the queue retries
+	return n.conn.FlushWithContext(ctx)
+}
+
+func tlsConfigWithCA(caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile == "" {
+		return config, nil
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerNotifierBackend("datadog", notifierBackend{
+		configured: func() bool {
+			return viper.GetString("datadog-api-key") != "" || viper.GetString("datadog-api-key-file") != ""
+		},
+		build: func() ([]*asyncNotifier, error) {
+			apiKey, err := readSecret("datadog-api-key", "datadog-api-key-file")
+			if err != nil {
+				return nil, err
+			}
+			site := viper.GetString("datadog-site")
+			logrus.Infof("datadog integration enabled, site: %s", site)
+			n := newDatadogNotifier(apiKey, site, viper.GetStringSlice("datadog-tags"), viper.GetBool("datadog-metrics"))
+			events := []EventType{EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck, EventRolloutSkipped}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("datadog", events))}, nil
+		},
+	})
+}
+
+const (
+	datadogFlushInterval = 10 * time.Second
+	datadogMaxBuffered   = 1000
+)
+
+// datadogNotifier submits rollout events to the Datadog Events API and, optionally,
+// ships the cre counters to the metrics API. Submissions are buffered and flushed
+// periodically, and 429 responses are honored by waiting for the rate limit reset.
+type datadogNotifier struct {
+	apiKey  string
+	baseURL string
+	tags    []string
+	client  *http.Client
+
+	mu     sync.Mutex
+	events []RolloutEvent
+	// last value of every shipped counter, to submit deltas
+	lastCounts map[string]float64
+}
+
+type datadogEvent struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Tags           []string `json:"tags"`
+	AlertType      string   `json:"alert_type"`
+	SourceTypeName string   `json:"source_type_name"`
+	AggregationKey string   `json:"aggregation_key"`
+}
+
+type datadogSeries struct {
+	Series []datadogMetric `json:"series"`
+}
+
+type datadogMetric struct {
+	Metric   string       `json:"metric"`
+	Type     string       `json:"type"`
+	Interval int64        `json:"interval"`
+	Points   [][2]float64 `json:"points"`
+	Tags     []string     `json:"tags"`
+}
+
+func newDatadogNotifier(apiKey, site string, tags []string, shipMetrics bool) *datadogNotifier {
+	d := &datadogNotifier{
+		apiKey:     apiKey,
+		baseURL:    "https://api." + site,
+		tags:       tags,
+		client:     &http.Client{Timeout: notifyTimeout},
+		lastCounts: map[string]float64{},
+	}
+	go d.run(shipMetrics)
+	return d
+}
+
+func (d *datadogNotifier) Name() string {
+	return "datadog"
+}
+
+func (d *datadogNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.events) >= datadogMaxBuffered {
+		return fmt.Errorf("datadog buffer is full")
+	}
+	d.events = append(d.events, event)
+	return nil
+}
+
+func (d *datadogNotifier) run(shipMetrics bool) {
+	for range time.Tick(datadogFlushInterval) {
+		d.mu.Lock()
+		events := d.events
+		d.events = nil
+		d.mu.Unlock()
+		for _, event := range events {
+			for _, e := range d.toDatadogEvents(event) {
+				d.submit("/api/v1/events", e, "event")
+			}
+		}
+		if shipMetrics {
+			if series := d.series(); len(series.Series) > 0 {
+				d.submit("/api/v1/series", series, "metrics")
+			}
+		}
+	}
+}
+
+// toDatadogEvents makes one event per target, so every workload can be found by its tags
+func (d *datadogNotifier) toDatadogEvents(event RolloutEvent) []datadogEvent {
+	alertType := "info"
+	switch event.Severity() {
+	case SeverityWarning:
+		alertType = "warning"
+	case SeverityError:
+		alertType = "error"
+	}
+	if event.Type == EventRolloutCompleted {
+		alertType = "success"
+	}
+	targets := event.Targets
+	if len(targets) == 0 {
+		targets = []Workload{{Namespace: event.Source.RolloutNamespace()}}
+	}
+	var events []datadogEvent
+	for _, w := range targets {
+		tags := append([]string{
+			"namespace:" + w.Namespace,
+			"outcome:" + event.Outcome,
+			"source_kind:" + strings.ToLower(event.Source.Kind),
+			"source:" + event.Source.Name,
+		}, d.tags...)
+		if cluster := viper.GetString("cluster-name"); cluster != "" {
+			tags = append(tags, "cluster:"+cluster)
+		}
+		title := fmt.Sprintf("cre %s for %s", event.Type, event.Source)
+		if w.Name != "" {
+			tags = append(tags, "kind:"+strings.ToLower(w.Kind), "workload:"+w.Name)
+			title = fmt.Sprintf("cre %s of %s", event.Type, w)
+		}
+		text := fmt.Sprintf("Source: %s\nChanged keys: %s\nCorrelation ID: %s",
+			event.Source, valueOrNone(strings.Join(event.Source.ChangedKeys, ", ")), event.CorrelationID)
+		if event.Error != "" {
+			text += "\nError: " + event.Error
+		}
+		events = append(events, datadogEvent{
+			Title:          title,
+			Text:           text,
+			Tags:           tags,
+			AlertType:      alertType,
+			SourceTypeName: "cre",
+			AggregationKey: event.CorrelationID,
+		})
+	}
+	return events
+}
+
+// series turns the increase of every cre counter since the last flush into datadog count metrics
+func (d *datadogNotifier) series() datadogSeries {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logrus.Errorf("%s failed to gather metrics for datadog", err)
+	}
+	now := float64(time.Now().Unix())
+	var series datadogSeries
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "cre_") || family.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			tags := append([]string{}, d.tags...)
+			if cluster := viper.GetString("cluster-name"); cluster != "" {
+				tags = append(tags, "cluster:"+cluster)
+			}
+			for _, l := range m.GetLabel() {
+				tags = append(tags, l.GetName()+":"+l.GetValue())
+			}
+			key := family.GetName() + "," + strings.Join(tags, ",")
+			value := m.GetCounter().GetValue()
+			delta := value - d.lastCounts[key]
+			d.lastCounts[key] = value
+			if delta <= 0 {
+				continue
+			}
+			series.Series = append(series.Series, datadogMetric{
+				Metric:   strings.Replace(family.GetName(), "cre_", "cre.", 1),
+				Type:     "count",
+				Interval: int64(datadogFlushInterval.Seconds()),
+				Points:   [][2]float64{{now, delta}},
+				Tags:     tags,
+			})
+		}
+	}
+	return series
+}
+
+// submit posts body, waiting for the rate limit to reset on 429 responses
+func (d *datadogNotifier) submit(path string, body interface{}, what string) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		logrus.Errorf("%s failed to marshal datadog %s", err, what)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; attempt <= notifyMaxAttempts; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, d.baseURL+path, bytes.NewReader(payload))
+		if err != nil {
+			logrus.Errorf("%s failed to build datadog request", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("DD-API-KEY", d.apiKey)
+		resp, err := d.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+				notificationsTotal.WithLabelValues("datadog-"+what, "success").Inc()
+				return
+			}
+			err = fmt.Errorf("datadog responded with %s", resp.Status)
+			if resp.StatusCode == http.StatusTooManyRequests {
+				if reset, convErr := strconv.Atoi(resp.Header.Get("X-RateLimit-Reset")); convErr == nil && reset > 0 {
+					backoff = time.Duration(reset) * time.Second
+				}
+			} else if resp.StatusCode < 500 {
+				// the request itself is wrong, retrying won't help
+				attempt = notifyMaxAttempts
+			}
+		}
+		if attempt == notifyMaxAttempts {
+			notificationsTotal.WithLabelValues("datadog-"+what, "failure").Inc()
+			logrus.Errorf("failed to submit datadog %s: %s", what, err)
+			return
+		}
+		logrus.Debugf("datadog %s submission failed: %s, retrying in %s", what, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
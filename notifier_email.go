@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net"
+	"net/smtp"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerNotifierBackend("email", notifierBackend{
+		configured: func() bool { return viper.GetString("email-smtp-host") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newEmailNotifier()
+			if err != nil {
+				return nil, err
+			}
+			events := []EventType{EventRolloutFailed, EventRolloutStuck}
+			if n.digest {
+				logrus.Infof("email notifications enabled, sending a digest every %s", n.digestInterval)
+				events = []EventType{EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck, EventRolloutSkipped}
+			} else {
+				logrus.Info("email notifications enabled for failed and stuck rollouts")
+			}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("email", events))}, nil
+		},
+	})
+}
+
+// emailRecipients routes mails for namespaces matching any of the glob patterns
+type emailRecipients struct {
+	Namespaces []string `mapstructure:"namespaces"`
+	To         []string `mapstructure:"to"`
+}
+
+// emailNotifier sends rollout events over SMTP.
+// In immediate mode every event is a mail, in digest mode events are collected
+// and a summary is mailed every digestInterval.
+type emailNotifier struct {
+	host       string
+	port       int
+	tlsMode    string
+	username   string
+	password   string
+	from       string
+	recipients []emailRecipients
+
+	digest         bool
+	digestInterval time.Duration
+	mu             sync.Mutex
+	digestEvents   []RolloutEvent
+}
+
+func newEmailNotifier() (*emailNotifier, error) {
+	password, err := readSecret("email-smtp-password", "email-smtp-password-file")
+	if err != nil {
+		return nil, err
+	}
+	en := &emailNotifier{
+		host:           viper.GetString("email-smtp-host"),
+		port:           viper.GetInt("email-smtp-port"),
+		tlsMode:        viper.GetString("email-smtp-tls"),
+		username:       viper.GetString("email-smtp-username"),
+		password:       password,
+		from:           viper.GetString("email-from"),
+		digestInterval: viper.GetDuration("email-digest-interval"),
+	}
+	switch en.tlsMode {
+	case "none", "starttls", "tls":
+	default:
+		return nil, fmt.Errorf("unknown --email-smtp-tls %q, expected none|starttls|tls", en.tlsMode)
+	}
+	switch mode := viper.GetString("email-mode"); mode {
+	case "immediate":
+	case "digest":
+		if en.digestInterval <= 0 {
+			return nil, fmt.Errorf("--email-digest-interval must be positive")
+		}
+		en.digest = true
+	default:
+		return nil, fmt.Errorf("unknown --email-mode %q, expected immediate|digest", mode)
+	}
+	if to := viper.GetStringSlice("email-to"); len(to) > 0 {
+		en.recipients = append(en.recipients, emailRecipients{Namespaces: []string{"*"}, To: to})
+	}
+	var rules []emailRecipients
+	if err := viper.UnmarshalKey("email.recipients", &rules); err != nil {
+		return nil, err
+	}
+	en.recipients = append(en.recipients, rules...)
+	if len(en.recipients) == 0 {
+		return nil, fmt.Errorf("no recipients, set --email-to or email.recipients in the config file")
+	}
+	if en.from == "" {
+		return nil, fmt.Errorf("--email-from is required")
+	}
+	if en.digest {
+		go en.sendDigests()
+	}
+	return en, nil
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	if e.digest {
+		e.mu.Lock()
+		e.digestEvents = append(e.digestEvents, event)
+		e.mu.Unlock()
+		return nil
+	}
+	to := e.recipientsFor(event.Source.Namespace)
+	if len(to) == 0 {
+		return nil
+	}
+	subject := fmt.Sprintf("[cre] %s for %s", event.Type, event.Source)
+	return e.send(ctx, to, subject, formatEmailEvent(event))
+}
+
+// recipientsFor returns the union of recipients of all rules matching the namespace
+func (e *emailNotifier) recipientsFor(ns string) []string {
+	set := map[string]bool{}
+	for _, r := range e.recipients {
+		for _, pattern := range r.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				for _, to := range r.To {
+					set[to] = true
+				}
+				break
+			}
+		}
+	}
+	var to []string
+	for addr := range set {
+		to = append(to, addr)
+	}
+	sort.Strings(to)
+	return to
+}
+
+func (e *emailNotifier) sendDigests() {
+	for range time.Tick(e.digestInterval) {
+		e.mu.Lock()
+		events := e.digestEvents
+		e.digestEvents = nil
+		e.mu.Unlock()
+		if len(events) == 0 {
+			continue
+		}
+		// One digest per recipient, holding only the events of namespaces routed to them
+		byRecipient := map[string][]RolloutEvent{}
+		for _, event := range events {
+			for _, to := range e.recipientsFor(event.Source.Namespace) {
+				byRecipient[to] = append(byRecipient[to], event)
+			}
+		}
+		for to, events := range byRecipient {
+			subject := fmt.Sprintf("[cre] reload activity digest, %d events", len(events))
+			var body strings.Builder
+			for _, event := range events {
+				body.WriteString(formatEmailEvent(event))
+				body.WriteString("\n")
+			}
+			recipient := to
+			err := withRetries(e.Name(), func(ctx context.Context) error {
+				return e.send(ctx, []string{recipient}, subject, body.String())
+			})
+			if err != nil {
+				notificationsTotal.WithLabelValues("email-digest", "failure").Inc()
+				logrus.Errorf("failed to send email digest to %s: %s", recipient, err)
+				continue
+			}
+			notificationsTotal.WithLabelValues("email-digest", "success").Inc()
+		}
+	}
+}
+
+// formatEmailEvent renders an event as plain text, secret values are never part of an event
+func formatEmailEvent(event RolloutEvent) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", event.Time.Format(time.RFC3339), event.Type)
+	fmt.Fprintf(&b, "  source:         %s\n", event.Source)
+	fmt.Fprintf(&b, "  changed keys:   %s\n", valueOrNone(strings.Join(event.Source.ChangedKeys, ", ")))
+	for _, t := range event.Targets {
+		fmt.Fprintf(&b, "  target:         %s\n", t)
+	}
+	fmt.Fprintf(&b, "  outcome:        %s\n", event.Outcome)
+	if event.Error != "" {
+		fmt.Fprintf(&b, "  error:          %s\n", event.Error)
+	}
+	fmt.Fprintf(&b, "  correlation id: %s\n", event.CorrelationID)
+	return b.String()
+}
+
+func (e *emailNotifier) send(ctx context.Context, to []string, subject, body string) error {
+	addr := net.JoinHostPort(e.host, strconv.Itoa(e.port))
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	var conn net.Conn
+	var err error
+	if e.tlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: e.host})
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if e.tlsMode == "starttls" {
+		if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, e.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
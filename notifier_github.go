@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// gitSHAAnnotation names the commit a ConfigMap or Secret was applied from
+	gitSHAAnnotation = "cre.cnvrg.io/git-sha"
+	// gitRepoAnnotation names the owner/name GitHub repository of the commit, defaulting to github-repo
+	gitRepoAnnotation = "cre.cnvrg.io/git-repo"
+	// githubSecondaryRateLimitWait is how long to back off from secondary rate limits without a Retry-After
+	githubSecondaryRateLimitWait = time.Minute
+	githubMaxDescription         = 140
+)
+
+func init() {
+	registerNotifierBackend("github", notifierBackend{
+		configured: func() bool {
+			return viper.GetString("github-token") != "" || viper.GetString("github-token-file") != "" || viper.GetInt64("github-app-id") != 0
+		},
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newGitHubNotifier()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("github %s statuses enabled for sources annotated with %s", n.mode, gitSHAAnnotation)
+			events := []EventType{EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("github", events))}, nil
+		},
+	})
+}
+
+// githubNotifier reports rollouts of sources applied from a commit back to GitHub, as commit statuses
+// per workload or as a deployment per commit and environment, so a PR shows whether its change reached running pods.
+// It authenticates with a token or as a GitHub App installation, and waits out primary and secondary rate limits.
+type githubNotifier struct {
+	baseURL string
+	repo    string
+	mode    string
+	track   bool
+	client  *http.Client
+
+	token string
+	app   *githubApp
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+	// deployments by commit and environment, while their rollouts are in progress
+	deployments map[string]*githubDeployment
+}
+
+type githubApp struct {
+	id             int64
+	installationID int64
+	key            *rsa.PrivateKey
+	// installation token and its expiry
+	token     string
+	expiresAt time.Time
+}
+
+type githubDeployment struct {
+	id      int64
+	pending map[Workload]bool
+	failed  bool
+}
+
+func newGitHubNotifier() (*githubNotifier, error) {
+	g := &githubNotifier{
+		baseURL:     strings.TrimSuffix(viper.GetString("github-api-url"), "/"),
+		repo:        viper.GetString("github-repo"),
+		mode:        viper.GetString("github-status"),
+		track:       viper.GetBool("track-rollouts"),
+		client:      &http.Client{Timeout: notifyTimeout},
+		deployments: map[string]*githubDeployment{},
+	}
+	switch g.mode {
+	case "commit", "deployment":
+	default:
+		return nil, fmt.Errorf("unknown --github-status %q, expected commit|deployment", g.mode)
+	}
+	if appID := viper.GetInt64("github-app-id"); appID != 0 {
+		pemBytes, err := ioutil.ReadFile(viper.GetString("github-app-private-key-file"))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseRSAPrivateKey(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		installationID := viper.GetInt64("github-app-installation-id")
+		if installationID == 0 {
+			return nil, fmt.Errorf("--github-app-installation-id is required with --github-app-id")
+		}
+		g.app = &githubApp{id: appID, installationID: installationID, key: key}
+		return g, nil
+	}
+	token, err := readSecret("github-token", "github-token-file")
+	if err != nil {
+		return nil, err
+	}
+	g.token = token
+	return g, nil
+}
+
+func parseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in the github app private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the github app private key isn't an RSA key")
+	}
+	return key, nil
+}
+
+func (g *githubNotifier) Name() string {
+	return "github"
+}
+
+func (g *githubNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	sha := event.Source.GitSHA
+	if sha == "" {
+		return nil
+	}
+	repo := g.repo
+	if event.Source.GitRepo != "" {
+		repo = event.Source.GitRepo
+	}
+	if repo == "" {
+		event.Source.log().Warnf("%s is annotated with %s but has no %s and --github-repo isn't set, no github status", event.Source, gitSHAAnnotation, gitRepoAnnotation)
+		return nil
+	}
+	state, description := g.state(event)
+	if g.mode == "deployment" {
+		return g.deploymentStatus(event, repo, sha, state, description)
+	}
+	for _, w := range event.Targets {
+		err := g.request(http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", repo, sha), map[string]string{
+			"state":       state,
+			"context":     fmt.Sprintf("cre/%s/%s/%s", githubEnvironment(w.Namespace), strings.ToLower(w.Kind), w.Name),
+			"description": truncate(description, githubMaxDescription),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// state maps the event to a commit status state, commit states are mapped to deployment states later
+func (g *githubNotifier) state(event RolloutEvent) (string, string) {
+	switch event.Type {
+	case EventRolloutTriggered:
+		if !g.track {
+			// without tracking there won't be a completion
+			return "success", fmt.Sprintf("restarted for %s", event.Source)
+		}
+		return "pending", fmt.Sprintf("rolling out %s", event.Source)
+	case EventRolloutCompleted:
+		return "success", fmt.Sprintf("running with %s", event.Source)
+	default:
+		return "failure", fmt.Sprintf("%s: %s", event.Outcome, event.Error)
+	}
+}
+
+func (g *githubNotifier) deploymentStatus(event RolloutEvent, repo, sha, state, description string) error {
+	if len(event.Targets) == 0 {
+		return nil
+	}
+	environment := githubEnvironment(event.Targets[0].Namespace)
+	key := repo + "@" + sha + "/" + environment
+	g.mu.Lock()
+	d, ok := g.deployments[key]
+	g.mu.Unlock()
+	if !ok {
+		if event.Type != EventRolloutTriggered {
+			return nil
+		}
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		err := g.request(http.MethodPost, fmt.Sprintf("/repos/%s/deployments", repo), map[string]interface{}{
+			"ref":               sha,
+			"environment":       environment,
+			"task":              "deploy:config",
+			"description":       truncate(fmt.Sprintf("cre rollout of %s", event.Source), githubMaxDescription),
+			"auto_merge":        false,
+			"required_contexts": []string{},
+		}, &created)
+		if err != nil {
+			return err
+		}
+		d = &githubDeployment{id: created.ID, pending: map[Workload]bool{}}
+		g.mu.Lock()
+		g.deployments[key] = d
+		g.mu.Unlock()
+	}
+	g.mu.Lock()
+	switch event.Type {
+	case EventRolloutTriggered:
+		for _, w := range event.Targets {
+			d.pending[w] = true
+		}
+		state = "in_progress"
+		if !g.track {
+			state = "success"
+		}
+	case EventRolloutCompleted:
+		for _, w := range event.Targets {
+			delete(d.pending, w)
+		}
+		state = "in_progress"
+		if !d.failed && len(d.pending) == 0 {
+			state = "success"
+		}
+	default:
+		d.failed = true
+	}
+	if state == "success" || state == "failure" {
+		delete(g.deployments, key)
+	}
+	g.mu.Unlock()
+	return g.request(http.MethodPost, fmt.Sprintf("/repos/%s/deployments/%d/statuses", repo, d.id), map[string]string{
+		"state":       state,
+		"environment": environment,
+		"description": truncate(description, githubMaxDescription),
+	}, nil)
+}
+
+// githubEnvironment is <cluster-name>/<namespace>, or the namespace without a cluster name
+func githubEnvironment(ns string) string {
+	if cluster := viper.GetString("cluster-name"); cluster != "" {
+		return cluster + "/" + ns
+	}
+	return ns
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+// request calls the GitHub API. Rate limited responses block all requests until the limit resets
+// and fail the attempt, so the notifier queue retries it afterwards.
+func (g *githubNotifier) request(method, path string, body, out interface{}) error {
+	g.mu.Lock()
+	wait := time.Until(g.blockedUntil)
+	g.mu.Unlock()
+	if wait > 0 {
+		logrus.Infof("github rate limit exceeded, waiting %s", wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+	token, err := g.authToken()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, g.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		if out != nil {
+			return json.Unmarshal(msg, out)
+		}
+		return nil
+	}
+	if wait, limited := githubRateLimited(resp, msg); limited {
+		g.mu.Lock()
+		g.blockedUntil = time.Now().Add(wait)
+		g.mu.Unlock()
+		return fmt.Errorf("github rate limit exceeded, retrying after %s", wait.Round(time.Second))
+	}
+	return fmt.Errorf("github responded with %s: %s", resp.Status, strings.TrimSpace(truncate(string(msg), 512)))
+}
+
+// githubRateLimited tells how long to wait when resp is a primary or secondary rate limit response
+func githubRateLimited(resp *http.Response, body []byte) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if after, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(after) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			if wait := time.Until(time.Unix(reset, 0)); wait > 0 {
+				return wait, true
+			}
+		}
+		return githubSecondaryRateLimitWait, true
+	}
+	if strings.Contains(strings.ToLower(string(body)), "secondary rate limit") {
+		return githubSecondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+// authToken returns the token, or an installation token of the app, renewed a minute before it expires
+func (g *githubNotifier) authToken() (string, error) {
+	if g.app == nil {
+		return g.token, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.app.token != "" && time.Until(g.app.expiresAt) > time.Minute {
+		return g.app.token, nil
+	}
+	jwt, err := g.app.jwt()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/app/installations/%d/access_tokens", g.baseURL, g.app.installationID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("github responded with %s to the installation token request", resp.Status)
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	g.app.token, g.app.expiresAt = token.Token, token.ExpiresAt
+	return token.Token, nil
+}
+
+// jwt signs the short lived token authenticating as the app, backdated for clock drift as GitHub recommends
+func (a *githubApp) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerNotifierBackend("grafana", notifierBackend{
+		configured: func() bool { return viper.GetString("grafana-url") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			token, err := readSecret("grafana-api-token", "grafana-api-token-file")
+			if err != nil {
+				return nil, err
+			}
+			if token == "" {
+				return nil, fmt.Errorf("no grafana api token, set the GRAFANA_API_TOKEN env or --grafana-api-token-file")
+			}
+			track := viper.GetBool("track-rollouts")
+			logrus.Infof("grafana annotations enabled, spanning rollouts until ready: %t", track)
+			n := newGrafanaNotifier(viper.GetString("grafana-url"), token, viper.GetStringSlice("grafana-tags"), track)
+			events := []EventType{EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("grafana", events))}, nil
+		},
+	})
+}
+
+// grafanaStartedTTL bounds how long the start of a tracked rollout is kept waiting for its completion
+const grafanaStartedTTL = 24 * time.Hour
+
+// grafanaNotifier creates organization wide Grafana annotations for rollouts, dashboards pick them up by tags.
+// With track-rollouts an annotation spans a workload from the restart until it's ready, otherwise it marks the restart.
+type grafanaNotifier struct {
+	url    string
+	token  string
+	tags   []string
+	track  bool
+	client *http.Client
+
+	mu sync.Mutex
+	// started holds the restart time of tracked rollouts, by correlation id and workload
+	started map[string]time.Time
+}
+
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"`
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+func newGrafanaNotifier(url, token string, tags []string, track bool) *grafanaNotifier {
+	return &grafanaNotifier{
+		url:     strings.TrimSuffix(url, "/"),
+		token:   token,
+		tags:    tags,
+		track:   track,
+		client:  &http.Client{},
+		started: map[string]time.Time{},
+	}
+}
+
+func (g *grafanaNotifier) Name() string {
+	return "grafana"
+}
+
+func (g *grafanaNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	for _, w := range event.Targets {
+		key := event.CorrelationID + " " + w.String()
+		annotation := grafanaAnnotation{Time: event.Time.UnixNano() / int64(time.Millisecond)}
+		switch event.Type {
+		case EventRolloutTriggered:
+			if g.track {
+				g.start(key, event.Time)
+				continue
+			}
+		case EventRolloutCompleted:
+			if start, ok := g.finish(key); ok {
+				annotation.Time, annotation.TimeEnd = start.UnixNano()/int64(time.Millisecond), annotation.Time
+			}
+		case EventRolloutFailed:
+			g.finish(key)
+		}
+		annotation.Tags = append([]string{
+			"cre",
+			"namespace:" + w.Namespace,
+			"workload:" + strings.ToLower(w.Kind) + "/" + w.Name,
+			"trigger:" + strings.ToLower(event.Source.Kind) + "/" + event.Source.Name,
+			"outcome:" + event.Outcome,
+		}, g.tags...)
+		annotation.Text = fmt.Sprintf("cre %s of %s for %s", event.Type, w, event.Source)
+		if keys := event.Source.ChangedKeys; len(keys) > 0 {
+			annotation.Text += ", changed keys: " + strings.Join(keys, ", ")
+		}
+		if event.Error != "" {
+			annotation.Text += ", error: " + event.Error
+		}
+		err := postJSON(ctx, g.client, g.url+"/api/annotations", annotation, map[string]string{"Authorization": "Bearer " + g.token})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grafanaNotifier) start(key string, at time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for k, t := range g.started {
+		if time.Since(t) > grafanaStartedTTL {
+			delete(g.started, k)
+		}
+	}
+	g.started[key] = at
+}
+
+func (g *grafanaNotifier) finish(key string) (time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	start, ok := g.started[key]
+	delete(g.started, key)
+	return start, ok
+}
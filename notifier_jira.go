@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerNotifierBackend("jira", notifierBackend{
+		configured: func() bool { return viper.GetString("jira-url") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newJiraNotifier()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("jira issues enabled in project %s after %d failed or stuck rollouts", n.project, n.threshold)
+			events := []EventType{EventRolloutFailed, EventRolloutStuck, EventRolloutCompleted}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("jira", events))}, nil
+		},
+	})
+}
+
+// jiraNotifier opens a Jira issue once a workload failed or got stuck failure-threshold times in a row,
+// comments on it while it keeps failing, and comments and closes it when the workload recovers.
+// Issues are found again by a label per workload, so there's a single open issue per workload, across restarts of cre.
+type jiraNotifier struct {
+	baseURL         string
+	user            string
+	token           string
+	project         string
+	issueType       string
+	labels          []string
+	threshold       int
+	closeTransition string
+	workloadLink    string
+	client          *http.Client
+
+	mu sync.Mutex
+	// consecutive failures per workload
+	failures map[Workload]int
+}
+
+func newJiraNotifier() (*jiraNotifier, error) {
+	token, err := readSecret("jira-api-token", "jira-api-token-file")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no jira api token, set the JIRA_API_TOKEN env or --jira-api-token-file")
+	}
+	j := &jiraNotifier{
+		baseURL:         strings.TrimSuffix(viper.GetString("jira-url"), "/"),
+		user:            viper.GetString("jira-user"),
+		token:           token,
+		project:         viper.GetString("jira-project"),
+		issueType:       viper.GetString("jira-issue-type"),
+		labels:          viper.GetStringSlice("jira-labels"),
+		threshold:       viper.GetInt("jira-failure-threshold"),
+		closeTransition: viper.GetString("jira-close-transition"),
+		workloadLink:    viper.GetString("jira-workload-link"),
+		client:          &http.Client{},
+		failures:        map[Workload]int{},
+	}
+	if j.project == "" {
+		return nil, fmt.Errorf("--jira-project is required")
+	}
+	if j.threshold < 1 {
+		j.threshold = 1
+	}
+	return j, nil
+}
+
+func (j *jiraNotifier) Name() string {
+	return "jira"
+}
+
+func (j *jiraNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	for _, w := range event.Targets {
+		if err := j.notifyWorkload(ctx, event, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jiraNotifier) notifyWorkload(ctx context.Context, event RolloutEvent, w Workload) error {
+	j.mu.Lock()
+	failures := j.failures[w]
+	j.mu.Unlock()
+	if event.Type == EventRolloutCompleted {
+		if failures == 0 {
+			return nil
+		}
+		if failures >= j.threshold {
+			if err := j.resolve(ctx, event, w); err != nil {
+				return err
+			}
+		}
+		j.mu.Lock()
+		delete(j.failures, w)
+		j.mu.Unlock()
+		return nil
+	}
+	// Counted once per event, retries of a failed delivery see the same count
+	if event.Type == EventRolloutFailed || event.Type == EventRolloutStuck {
+		failures++
+	}
+	if failures < j.threshold {
+		j.mu.Lock()
+		j.failures[w] = failures
+		j.mu.Unlock()
+		return nil
+	}
+	key, err := j.openIssue(ctx, w)
+	if err != nil {
+		return err
+	}
+	details := j.details(event, w, failures)
+	if key != "" {
+		err = j.request(ctx, http.MethodPost, "/rest/api/2/issue/"+key+"/comment", map[string]string{"body": details}, nil)
+	} else {
+		var created struct {
+			Key string `json:"key"`
+		}
+		err = j.request(ctx, http.MethodPost, "/rest/api/2/issue", map[string]interface{}{
+			"fields": map[string]interface{}{
+				"project":     map[string]string{"key": j.project},
+				"issuetype":   map[string]string{"name": j.issueType},
+				"summary":     fmt.Sprintf("cre: rollouts of %s keep failing", w),
+				"description": details,
+				"labels":      append([]string{"cre", jiraWorkloadLabel(w)}, j.labels...),
+			},
+		}, &created)
+		if err == nil {
+			event.Source.log().Infof("opened jira issue %s for %s", created.Key, w)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.failures[w] = failures
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *jiraNotifier) details(event RolloutEvent, w Workload, failures int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s of %s, %d failed or stuck rollouts in a row.\n\n", event.Type, w, failures)
+	fmt.Fprintf(&b, "Workload: %s\n", w)
+	if j.workloadLink != "" {
+		link := strings.NewReplacer("{namespace}", w.Namespace, "{kind}", strings.ToLower(w.Kind), "{name}", w.Name).Replace(j.workloadLink)
+		fmt.Fprintf(&b, "Link: %s\n", link)
+	}
+	fmt.Fprintf(&b, "Source: %s\n", event.Source)
+	fmt.Fprintf(&b, "Changed keys: %s\n", valueOrNone(strings.Join(event.Source.ChangedKeys, ", ")))
+	fmt.Fprintf(&b, "Error: %s\n", valueOrNone(event.Error))
+	fmt.Fprintf(&b, "Correlation ID: %s\n", event.CorrelationID)
+	if cluster := viper.GetString("cluster-name"); cluster != "" {
+		fmt.Fprintf(&b, "Cluster: %s\n", cluster)
+	}
+	return b.String()
+}
+
+// resolve comments on the open issue of w and closes it with close-transition
+func (j *jiraNotifier) resolve(ctx context.Context, event RolloutEvent, w Workload) error {
+	key, err := j.openIssue(ctx, w)
+	if err != nil || key == "" {
+		return err
+	}
+	comment := fmt.Sprintf("%s recovered, its rollout for %s completed (correlation id %s).", w, event.Source, event.CorrelationID)
+	if err := j.request(ctx, http.MethodPost, "/rest/api/2/issue/"+key+"/comment", map[string]string{"body": comment}, nil); err != nil {
+		return err
+	}
+	if j.closeTransition == "" {
+		return nil
+	}
+	var transitions struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"transitions"`
+	}
+	if err := j.request(ctx, http.MethodGet, "/rest/api/2/issue/"+key+"/transitions", nil, &transitions); err != nil {
+		return err
+	}
+	for _, t := range transitions.Transitions {
+		if strings.EqualFold(t.Name, j.closeTransition) {
+			event.Source.log().Infof("closing jira issue %s, %s recovered", key, w)
+			return j.request(ctx, http.MethodPost, "/rest/api/2/issue/"+key+"/transitions", map[string]interface{}{
+				"transition": map[string]string{"id": t.ID},
+			}, nil)
+		}
+	}
+	event.Source.log().Warnf("jira issue %s has no %q transition, leaving it open", key, j.closeTransition)
+	return nil
+}
+
+// openIssue returns the key of the unresolved issue of w, empty when there's none
+func (j *jiraNotifier) openIssue(ctx context.Context, w Workload) (string, error) {
+	jql := fmt.Sprintf(`project = %q AND labels = %q AND statusCategory != Done ORDER BY created DESC`, j.project, jiraWorkloadLabel(w))
+	var result struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	err := j.request(ctx, http.MethodGet, "/rest/api/2/search?fields=key&maxResults=1&jql="+url.QueryEscape(jql), nil, &result)
+	if err != nil || len(result.Issues) == 0 {
+		return "", err
+	}
+	return result.Issues[0].Key, nil
+}
+
+// jiraWorkloadLabel identifies the issues of w, labels can't hold spaces
+func jiraWorkloadLabel(w Workload) string {
+	return fmt.Sprintf("cre-%s-%s-%s", strings.ToLower(w.Kind), w.Namespace, w.Name)
+}
+
+// request calls the Jira REST API, with basic auth for Jira Cloud api tokens and bearer auth for personal access tokens
+func (j *jiraNotifier) request(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, j.baseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if j.user != "" {
+		req.SetBasicAuth(j.user, j.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+j.token)
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("jira responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
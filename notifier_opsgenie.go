@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+func init() {
+	registerNotifierBackend("opsgenie", notifierBackend{
+		configured: func() bool {
+			return viper.GetString("opsgenie-api-key") != "" || viper.GetString("opsgenie-api-key-file") != ""
+		},
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newOpsgenieNotifier()
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("opsgenie alerts enabled for failed and stuck rollouts, api: %s", n.baseURL)
+			events := []EventType{EventRolloutFailed, EventRolloutStuck, EventRolloutCompleted}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("opsgenie", events))}, nil
+		},
+	})
+}
+
+// opsgenieMaxMessage is the length limit of alert messages in the Alerts API
+const opsgenieMaxMessage = 130
+
+// opsgenieResponders routes alerts of namespaces matching any of the glob patterns to teams and users
+type opsgenieResponders struct {
+	Namespaces []string `mapstructure:"namespaces"`
+	Teams      []string `mapstructure:"teams"`
+	Users      []string `mapstructure:"users"`
+}
+
+// opsgenieNotifier creates Opsgenie alerts for failed and stuck rollouts through the Alerts API,
+// and closes them once the workload completes its rollout.
+// Alerts are aliased per workload, so Opsgenie deduplicates repeated failures into one alert.
+type opsgenieNotifier struct {
+	apiKey      string
+	baseURL     string
+	priorityFor map[EventType]string
+	responders  []opsgenieResponders
+	tags        []string
+	client      *http.Client
+	mu          sync.Mutex
+	openAlerts  map[string]bool
+}
+
+type opsgenieResponder struct {
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type opsgenieAlert struct {
+	Message     string              `json:"message"`
+	Alias       string              `json:"alias"`
+	Description string              `json:"description"`
+	Responders  []opsgenieResponder `json:"responders,omitempty"`
+	Tags        []string            `json:"tags"`
+	Details     map[string]string   `json:"details"`
+	Entity      string              `json:"entity"`
+	Source      string              `json:"source"`
+	Priority    string              `json:"priority"`
+}
+
+type opsgenieClose struct {
+	Source string `json:"source"`
+	Note   string `json:"note"`
+}
+
+func newOpsgenieNotifier() (*opsgenieNotifier, error) {
+	apiKey, err := readSecret("opsgenie-api-key", "opsgenie-api-key-file")
+	if err != nil {
+		return nil, err
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("no opsgenie api key, set the OPSGENIE_API_KEY env or --opsgenie-api-key-file")
+	}
+	priorityFor := map[EventType]string{
+		EventRolloutFailed: viper.GetString("opsgenie-failed-priority"),
+		EventRolloutStuck:  viper.GetString("opsgenie-stuck-priority"),
+	}
+	for _, priority := range priorityFor {
+		switch priority {
+		case "P1", "P2", "P3", "P4", "P5":
+		default:
+			return nil, fmt.Errorf("unknown opsgenie priority %q, expected P1|P2|P3|P4|P5", priority)
+		}
+	}
+	var responders []opsgenieResponders
+	if err := viper.UnmarshalKey("opsgenie.responders", &responders); err != nil {
+		return nil, err
+	}
+	return &opsgenieNotifier{
+		apiKey:      apiKey,
+		baseURL:     strings.TrimSuffix(viper.GetString("opsgenie-api-url"), "/"),
+		priorityFor: priorityFor,
+		responders:  responders,
+		tags:        viper.GetStringSlice("opsgenie-tags"),
+		client:      &http.Client{},
+		openAlerts:  map[string]bool{},
+	}, nil
+}
+
+func (o *opsgenieNotifier) Name() string {
+	return "opsgenie"
+}
+
+func (o *opsgenieNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	for _, w := range event.Targets {
+		if err := o.notifyWorkload(ctx, event, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *opsgenieNotifier) notifyWorkload(ctx context.Context, event RolloutEvent, w Workload) error {
+	alias := fmt.Sprintf("cre/%s/%s/%s", w.Kind, w.Namespace, w.Name)
+	headers := map[string]string{"Authorization": "GenieKey " + o.apiKey}
+	if event.Type == EventRolloutCompleted {
+		o.mu.Lock()
+		open := o.openAlerts[alias]
+		o.mu.Unlock()
+		if !open {
+			return nil
+		}
+		closeURL := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", o.baseURL, url.PathEscape(alias))
+		err := postJSON(ctx, o.client, closeURL, opsgenieClose{Source: "cre", Note: fmt.Sprintf("%s recovered, its rollout completed", w)}, headers)
+		if err == nil {
+			o.mu.Lock()
+			delete(o.openAlerts, alias)
+			o.mu.Unlock()
+		}
+		return err
+	}
+	priority, ok := o.priorityFor[event.Type]
+	if !ok {
+		return nil
+	}
+	message := fmt.Sprintf("%s of %s after %s change", event.Type, w, event.Source)
+	if len(message) > opsgenieMaxMessage {
+		message = message[:opsgenieMaxMessage]
+	}
+	description := fmt.Sprintf("%s of %s after a change of %s", event.Type, w, event.Source)
+	if event.Error != "" {
+		description += ": " + event.Error
+	}
+	err := postJSON(ctx, o.client, o.baseURL+"/v2/alerts", opsgenieAlert{
+		Message:     message,
+		Alias:       alias,
+		Description: description,
+		Responders:  o.respondersFor(w.Namespace),
+		Tags:        append([]string{"cre", string(event.Type), "namespace:" + w.Namespace}, o.tags...),
+		Details: map[string]string{
+			"source":         event.Source.String(),
+			"workload":       w.String(),
+			"changed_keys":   strings.Join(event.Source.ChangedKeys, ", "),
+			"correlation_id": event.CorrelationID,
+		},
+		Entity:   w.String(),
+		Source:   "cre",
+		Priority: priority,
+	}, headers)
+	if err == nil {
+		o.mu.Lock()
+		o.openAlerts[alias] = true
+		o.mu.Unlock()
+	}
+	return err
+}
+
+// respondersFor returns the teams and users of all rules matching the namespace, none leaves routing to Opsgenie
+func (o *opsgenieNotifier) respondersFor(ns string) []opsgenieResponder {
+	var responders []opsgenieResponder
+	seen := map[opsgenieResponder]bool{}
+	add := func(r opsgenieResponder) {
+		if !seen[r] {
+			seen[r] = true
+			responders = append(responders, r)
+		}
+	}
+	for _, r := range o.responders {
+		for _, pattern := range r.Namespaces {
+			if ok, _ := path.Match(pattern, ns); ok {
+				for _, team := range r.Teams {
+					add(opsgenieResponder{Type: "team", Name: team})
+				}
+				for _, user := range r.Users {
+					add(opsgenieResponder{Type: "user", Username: user})
+				}
+				break
+			}
+		}
+	}
+	return responders
+}
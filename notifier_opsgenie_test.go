@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// opsgenieCall is a request received by the stubbed Alerts API
+type opsgenieCall struct {
+	path          string
+	query         string
+	authorization string
+	body          map[string]interface{}
+}
+
+// opsgenieStub serves the Alerts API for the test, answering status to every call
+type opsgenieStub struct {
+	*httptest.Server
+	mu     sync.Mutex
+	calls  []opsgenieCall
+	status int
+}
+
+func newOpsgenieStub(t *testing.T) *opsgenieStub {
+	t.Helper()
+	stub := &opsgenieStub{status: http.StatusAccepted}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := opsgenieCall{path: r.URL.EscapedPath(), query: r.URL.RawQuery, authorization: r.Header.Get("Authorization")}
+		if err := json.NewDecoder(r.Body).Decode(&call.body); err != nil {
+			t.Errorf("%s failed to decode the opsgenie request", err)
+		}
+		stub.mu.Lock()
+		stub.calls = append(stub.calls, call)
+		status := stub.status
+		stub.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (s *opsgenieStub) received() []opsgenieCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]opsgenieCall(nil), s.calls...)
+}
+
+// opsgenieFor builds the opsgenie notifier of the flags for the stub
+func opsgenieFor(t *testing.T, stub *opsgenieStub, flags map[string]interface{}) *opsgenieNotifier {
+	t.Helper()
+	setFlags(t, map[string]interface{}{"opsgenie-api-key": "key", "opsgenie-api-url": stub.URL + "/"})
+	setFlags(t, flags)
+	n, err := newOpsgenieNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+var opsgenieWeb = Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}
+
+func opsgenieEvent(eventType EventType) RolloutEvent {
+	return RolloutEvent{Type: eventType, Source: Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, Targets: []Workload{opsgenieWeb}, Error: "boom", CorrelationID: "42"}
+}
+
+func TestOpsgenieAlertsFailedRollouts(t *testing.T) {
+	stub := newOpsgenieStub(t)
+	n := opsgenieFor(t, stub, map[string]interface{}{
+		"opsgenie-failed-priority": "P1",
+		"opsgenie-stuck-priority":  "P3",
+		"opsgenie.responders": []map[string]interface{}{
+			{"namespaces": []string{"app*"}, "teams": []string{"web-team"}, "users": []string{"oncall@example.com"}},
+			{"namespaces": []string{"other"}, "teams": []string{"other-team"}},
+		},
+	})
+	for _, eventType := range []EventType{EventRolloutFailed, EventRolloutStuck} {
+		if err := n.Notify(context.Background(), opsgenieEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := stub.received()
+	if len(calls) != 2 {
+		t.Fatalf("expected an alert per event, got %d calls", len(calls))
+	}
+	for i, priority := range []string{"P1", "P3"} {
+		call := calls[i]
+		if call.path != "/v2/alerts" || call.authorization != "GenieKey key" {
+			t.Fatalf("expected an authorized alert creation, got %s with %q", call.path, call.authorization)
+		}
+		if call.body["priority"] != priority {
+			t.Fatalf("expected priority %s from the severity table, got %v", priority, call.body["priority"])
+		}
+		if call.body["alias"] != "cre/Deployment/apps/web" {
+			t.Fatalf("expected the alias of the workload, got %v", call.body["alias"])
+		}
+		responders := call.body["responders"]
+		want := []interface{}{
+			map[string]interface{}{"type": "team", "name": "web-team"},
+			map[string]interface{}{"type": "user", "username": "oncall@example.com"},
+		}
+		if !reflect.DeepEqual(responders, want) {
+			t.Fatalf("expected the responders of the namespace, got %v", responders)
+		}
+	}
+}
+
+func TestOpsgenieClosesRecoveredAlerts(t *testing.T) {
+	stub := newOpsgenieStub(t)
+	n := opsgenieFor(t, stub, nil)
+	if err := n.Notify(context.Background(), opsgenieEvent(EventRolloutCompleted)); err != nil || len(stub.received()) != 0 {
+		t.Fatalf("expected nothing to close without an alert, got %v after %d calls", err, len(stub.received()))
+	}
+	for _, eventType := range []EventType{EventRolloutFailed, EventRolloutFailed, EventRolloutCompleted, EventRolloutCompleted} {
+		if err := n.Notify(context.Background(), opsgenieEvent(eventType)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := stub.received()
+	if len(calls) != 3 || calls[0].body["alias"] != calls[1].body["alias"] {
+		t.Fatalf("expected 2 alerts of the same alias and a single close, got %v", calls)
+	}
+	closing := calls[2]
+	if closing.path != "/v2/alerts/cre%2FDeployment%2Fapps%2Fweb/close" || closing.query != "identifierType=alias" {
+		t.Fatalf("expected the alert closed by its alias, got %s?%s", closing.path, closing.query)
+	}
+}
+
+func TestOpsgenieKeepsRejectedAlertsClosed(t *testing.T) {
+	stub := newOpsgenieStub(t)
+	stub.status = http.StatusUnprocessableEntity
+	n := opsgenieFor(t, stub, nil)
+	if err := n.Notify(context.Background(), opsgenieEvent(EventRolloutFailed)); err == nil {
+		t.Fatal("expected the rejected alert reported")
+	}
+	if err := n.Notify(context.Background(), opsgenieEvent(EventRolloutCompleted)); err != nil || len(stub.received()) != 1 {
+		t.Fatalf("expected no close of the rejected alert, got %v after %d calls", err, len(stub.received()))
+	}
+}
+
+func TestOpsgenieRejectsUnknownPriorities(t *testing.T) {
+	setFlags(t, map[string]interface{}{"opsgenie-api-key": "key", "opsgenie-failed-priority": "urgent"})
+	if _, err := newOpsgenieNotifier(); err == nil {
+		t.Fatal("expected an unknown priority rejected")
+	}
+}
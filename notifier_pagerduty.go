@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"sync"
+)
+
+func init() {
+	registerNotifierBackend("pagerduty", notifierBackend{
+		configured: func() bool { return viper.GetString("pagerduty-routing-key") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newPagerDutyNotifier(
+				viper.GetString("pagerduty-routing-key"),
+				viper.GetString("pagerduty-failed-severity"),
+				viper.GetString("pagerduty-stuck-severity"),
+			)
+			if err != nil {
+				return nil, err
+			}
+			logrus.Info("pagerduty notifications enabled for failed and stuck rollouts")
+			events := []EventType{EventRolloutFailed, EventRolloutStuck, EventRolloutCompleted}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("pagerduty", events))}, nil
+		},
+	})
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyNotifier raises PagerDuty incidents for failed and stuck rollouts through the Events API v2,
+// and resolves them once the workload completes its rollout.
+// Incidents are deduplicated per workload, so repeated failures don't open new incidents.
+type pagerDutyNotifier struct {
+	routingKey    string
+	severityFor   map[EventType]string
+	client        *http.Client
+	mu            sync.Mutex
+	openIncidents map[string]bool
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Component     string            `json:"component"`
+	Group         string            `json:"group"`
+	Class         string            `json:"class"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+func newPagerDutyNotifier(routingKey, failedSeverity, stuckSeverity string) (*pagerDutyNotifier, error) {
+	for _, severity := range []string{failedSeverity, stuckSeverity} {
+		switch severity {
+		case "critical", "error", "warning", "info":
+		default:
+			return nil, fmt.Errorf("unknown pagerduty severity %q, expected critical|error|warning|info", severity)
+		}
+	}
+	return &pagerDutyNotifier{
+		routingKey:    routingKey,
+		severityFor:   map[EventType]string{EventRolloutFailed: failedSeverity, EventRolloutStuck: stuckSeverity},
+		client:        &http.Client{},
+		openIncidents: map[string]bool{},
+	}, nil
+}
+
+func (p *pagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+func (p *pagerDutyNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	for _, w := range event.Targets {
+		if err := p.notifyWorkload(ctx, event, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pagerDutyNotifier) notifyWorkload(ctx context.Context, event RolloutEvent, w Workload) error {
+	dedupKey := fmt.Sprintf("cre/%s/%s/%s", w.Kind, w.Namespace, w.Name)
+	if event.Type == EventRolloutCompleted {
+		p.mu.Lock()
+		open := p.openIncidents[dedupKey]
+		p.mu.Unlock()
+		if !open {
+			return nil
+		}
+		err := postJSON(ctx, p.client, pagerDutyEventsURL, pagerDutyEvent{RoutingKey: p.routingKey, EventAction: "resolve", DedupKey: dedupKey}, nil)
+		if err == nil {
+			p.mu.Lock()
+			delete(p.openIncidents, dedupKey)
+			p.mu.Unlock()
+		}
+		return err
+	}
+	severity, ok := p.severityFor[event.Type]
+	if !ok {
+		return nil
+	}
+	err := postJSON(ctx, p.client, pagerDutyEventsURL, pagerDutyEvent{
+		RoutingKey:  p.routingKey,
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Payload: &pagerDutyPayload{
+			Summary:   fmt.Sprintf("%s of %s after %s change", event.Type, w, event.Source),
+			Source:    "cre",
+			Severity:  severity,
+			Component: fmt.Sprintf("%s/%s", w.Kind, w.Name),
+			Group:     w.Namespace,
+			Class:     string(event.Type),
+			CustomDetails: map[string]string{
+				"source":         event.Source.String(),
+				"error":          event.Error,
+				"correlation_id": event.CorrelationID,
+			},
+		},
+	}, nil)
+	if err == nil {
+		p.mu.Lock()
+		p.openIncidents[dedupKey] = true
+		p.mu.Unlock()
+	}
+	return err
+}
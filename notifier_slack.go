@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerNotifierBackend("slack", notifierBackend{
+		configured: func() bool { return viper.GetString("slack-webhook-url") != "" },
+		build: func() (built []*asyncNotifier, err error) {
+			logrus.Info("slack notifications enabled")
+			n := newSlackNotifier(viper.GetString("slack-webhook-url"), viper.GetString("slack-channel"))
+			if n.template, err = loadTemplate("slack"); err != nil {
+				return nil, err
+			}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("slack", chatEvents))}, nil
+		},
+	})
+}
+
+// slackNotifier posts rollout events to a Slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+	channel    string
+	template   *notificationTemplate
+	client     *http.Client
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func newSlackNotifier(webhookURL, channel string) *slackNotifier {
+	return &slackNotifier{webhookURL: webhookURL, channel: channel, client: &http.Client{}}
+}
+
+func (s *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	payload, err := s.template.body(event, func() ([]byte, error) { return json.Marshal(s.message(event)) })
+	if err != nil {
+		return err
+	}
+	return post(ctx, s.client, s.webhookURL, "application/json", payload, nil)
+}
+
+func (s *slackNotifier) message(event RolloutEvent) slackMessage {
+	color := "good"
+	switch event.Severity() {
+	case SeverityWarning:
+		color = "warning"
+	case SeverityError:
+		color = "danger"
+	}
+	var targets []string
+	for _, t := range event.Targets {
+		targets = append(targets, t.String())
+	}
+	fields := []slackField{
+		{Title: "Source", Value: event.Source.String(), Short: true},
+		{Title: "Outcome", Value: event.Outcome, Short: true},
+		{Title: "Changed keys", Value: valueOrNone(strings.Join(event.Source.ChangedKeys, ", "))},
+		{Title: "Targets", Value: valueOrNone(strings.Join(targets, "\n"))},
+		{Title: "Correlation ID", Value: valueOrNone(event.CorrelationID)},
+	}
+	if event.Cluster != "" {
+		fields = append(fields, slackField{Title: "Cluster", Value: event.Cluster, Short: true})
+	}
+	if event.Error != "" {
+		fields = append(fields, slackField{Title: "Error", Value: event.Error})
+	}
+	return slackMessage{
+		Channel:     s.channel,
+		Text:        fmt.Sprintf("*cre* %s for %s", event.Type, event.Source),
+		Attachments: []slackAttachment{{Color: color, Fields: fields}},
+	}
+}
+
+func valueOrNone(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+const (
+	slackAPIURL = "https://slack.com/api/"
+	// slackSignatureMaxAge rejects replayed interactive callbacks
+	slackSignatureMaxAge = 5 * time.Minute
+	slackActionsPath     = "/slack/actions"
+)
+
+// slackApprovalsEnabled tells if held rollouts are posted as interactive messages, which need the bot token
+// to post and update them and the signing secret to trust the callbacks
+func slackApprovalsEnabled() bool {
+	token, _ := readSecret("slack-bot-token", "slack-bot-token-file")
+	secret, _ := readSecret("slack-signing-secret", "slack-signing-secret-file")
+	return token != "" && secret != ""
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`
+	Text     *slackText    `json:"text,omitempty"`
+	Elements []slackButton `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackButton struct {
+	Type     string    `json:"type"`
+	Text     slackText `json:"text"`
+	ActionID string    `json:"action_id"`
+	Value    string    `json:"value"`
+	Style    string    `json:"style,omitempty"`
+}
+
+// postSlackApproval posts the pending approval with Approve and Reject buttons,
+// and returns the channel and timestamp of the message to update it later on
+func postSlackApproval(a *pendingApproval) (string, string, error) {
+	channel := viper.GetString("slack-approval-channel")
+	if channel == "" {
+		channel = viper.GetString("slack-channel")
+	}
+	text := approvalText(a)
+	blocks := []slackBlock{
+		{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}},
+		{Type: "actions", Elements: []slackButton{
+			{Type: "button", Text: slackText{Type: "plain_text", Text: "Approve"}, ActionID: approvalApproved, Value: a.ID, Style: "primary"},
+			{Type: "button", Text: slackText{Type: "plain_text", Text: "Reject"}, ActionID: approvalRejected, Value: a.ID, Style: "danger"},
+		}},
+	}
+	return callSlackAPI("chat.postMessage", map[string]interface{}{"channel": channel, "text": text, "blocks": blocks})
+}
+
+// updateSlackApproval replaces the buttons of the approval message by its final disposition
+func updateSlackApproval(a *pendingApproval, decision, by string) error {
+	disposition := fmt.Sprintf("*%s* by %s", decision, by)
+	if decision == approvalExpired {
+		disposition = fmt.Sprintf("*expired* after %s without an approval", viper.GetDuration("approval-timeout"))
+	}
+	text := approvalText(a) + "\n" + disposition
+	_, _, err := callSlackAPI("chat.update", map[string]interface{}{
+		"channel": a.slackChannel,
+		"ts":      a.slackTS,
+		"text":    text,
+		"blocks":  []slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}},
+	})
+	return err
+}
+
+func approvalText(a *pendingApproval) string {
+	text := fmt.Sprintf("*cre* rollout of %s for %s waits for an approval", a.Workload, a.Source)
+	if keys := strings.Join(a.Source.ChangedKeys, ", "); keys != "" {
+		text += "\nChanged keys: " + keys
+	}
+	if cluster := viper.GetString("cluster-name"); cluster != "" {
+		text += "\nCluster: " + cluster
+	}
+	return text
+}
+
+// callSlackAPI calls a Web API method with the bot token, returning the channel and ts of the message
+func callSlackAPI(method string, body interface{}) (string, string, error) {
+	token, err := readSecret("slack-bot-token", "slack-bot-token-file")
+	if err != nil {
+		return "", "", err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, slackAPIURL+method, bytes.NewReader(payload))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "", fmt.Errorf("%s failed to decode the %s response", err, method)
+	}
+	if !result.OK {
+		return "", "", fmt.Errorf("slack %s failed: %s", method, result.Error)
+	}
+	return result.Channel, result.TS, nil
+}
+
+// registerSlackActions serves the interactivity request url of the Slack app, authenticated by the signing secret
+func registerSlackActions(mux *http.ServeMux) {
+	if !slackApprovalsEnabled() {
+		return
+	}
+	logrus.Infof("slack approvals enabled, serving the interactivity callbacks on %s", slackActionsPath)
+	mux.HandleFunc(slackActionsPath, serveSlackActions)
+}
+
+func serveSlackActions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read the request", http.StatusBadRequest)
+		return
+	}
+	if err := verifySlackSignature(r.Header, body, time.Now()); err != nil {
+		logrus.Warnf("%s, rejecting a slack callback", err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := neturl.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		Type string `json:"type"`
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	by := fmt.Sprintf("slack user %s (%s)", payload.User.Username, payload.User.ID)
+	for _, action := range payload.Actions {
+		if action.ActionID != approvalApproved && action.ActionID != approvalRejected {
+			continue
+		}
+		// a stale button is answered by the message update of the first decision already
+		if err := decideApproval(action.Value, action.ActionID, by); err != nil {
+			logrus.Warnf("%s, ignoring the %s of %s", err, action.ActionID, by)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifySlackSignature checks the v0 signature Slack computes over the timestamp and body with the signing secret
+func verifySlackSignature(header http.Header, body []byte, now time.Time) error {
+	secret, err := readSecret("slack-signing-secret", "slack-signing-secret-file")
+	if err != nil {
+		return err
+	}
+	ts, err := strconv.ParseInt(header.Get("X-Slack-Request-Timestamp"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid X-Slack-Request-Timestamp")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return fmt.Errorf("slack request timestamp is %s old", age.Round(time.Second))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%d:%s", ts, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("slack signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+//go:build sns
+// +build sns
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+// The SNS notifier pulls in the AWS SDK, it's only built with -tags sns
+
+func init() {
+	registerNotifierBackend("sns", notifierBackend{
+		configured: func() bool { return viper.GetString("sns-topic-arn") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			n, err := newSNSNotifier(viper.GetString("sns-topic-arn"), viper.GetString("sns-region"))
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("sns notifications enabled for %s", n.topicARN)
+			return []*asyncNotifier{newAsyncNotifier(n, notifierOptions{})}, nil
+		},
+	})
+}
+
+// snsNotifier publishes every RolloutEvent as JSON to an SNS topic, with the namespace, kind and outcome
+// as message attributes for subscription filter policies. Credentials come from the default AWS chain,
+// e.g. IRSA web identity tokens, the env or the instance profile.
+type snsNotifier struct {
+	topicARN string
+	client   *sns.Client
+}
+
+func newSNSNotifier(topicARN, region string) (*snsNotifier, error) {
+	// Failed publishes are retried by the notifier queue, like for every other notifier
+	opts := []func(*config.LoadOptions) error{config.WithRetryMaxAttempts(1)}
+	if region == "" {
+		// arn:aws:sns:<region>:<account>:<topic>
+		if parts := strings.Split(topicARN, ":"); len(parts) == 6 {
+			region = parts[3]
+		}
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &snsNotifier{topicARN: topicARN, client: sns.NewFromConfig(cfg)}, nil
+}
+
+func (s *snsNotifier) Name() string {
+	return "sns"
+}
+
+func (s *snsNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	attributes := map[string]types.MessageAttributeValue{}
+	for name, value := range map[string]string{
+		"type":      string(event.Type),
+		"namespace": event.Source.Namespace,
+		"kind":      event.Source.Kind,
+		"outcome":   event.Outcome,
+	} {
+		if value != "" {
+			attributes[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	_, err = s.client.Publish(ctx, &sns.PublishInput{
+		TopicArn:          aws.String(s.topicARN),
+		Message:           aws.String(string(payload)),
+		MessageAttributes: attributes,
+	})
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !sns
+// +build !sns
+
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+)
+
+// Without -tags sns the AWS SDK isn't linked, a configured topic fails the startup rather than being ignored
+func init() {
+	registerNotifierBackend("sns", notifierBackend{
+		configured: func() bool { return viper.GetString("sns-topic-arn") != "" },
+		build: func() ([]*asyncNotifier, error) {
+			return nil, fmt.Errorf("cre was built without sns support, rebuild it with -tags sns")
+		},
+	})
+}
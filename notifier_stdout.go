@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+func init() {
+	registerNotifierBackend("stdout", notifierBackend{
+		configured: func() bool { return true },
+		build: func() ([]*asyncNotifier, error) {
+			return []*asyncNotifier{newAsyncNotifier(&stdoutNotifier{}, notifierOptions{})}, nil
+		},
+		explicitOnly: true,
+	})
+	registerNotifierBackend("noop", notifierBackend{
+		configured: func() bool { return true },
+		build: func() ([]*asyncNotifier, error) {
+			return []*asyncNotifier{newAsyncNotifier(noopNotifier{}, notifierOptions{})}, nil
+		},
+		explicitOnly: true,
+	})
+}
+
+// stdoutNotifier writes every event as a JSON line to stdout, next to the logs
+type stdoutNotifier struct {
+	mu sync.Mutex
+}
+
+func (s *stdoutNotifier) Name() string {
+	return "stdout"
+}
+
+func (s *stdoutNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(os.Stdout).Encode(event)
+}
+
+// noopNotifier drops every event, handy to check the notification pipeline without a receiver
+type noopNotifier struct{}
+
+func (noopNotifier) Name() string {
+	return "noop"
+}
+
+func (noopNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	return nil
+}
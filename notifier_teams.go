@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	registerNotifierBackend("teams", notifierBackend{
+		configured: func() bool { return viper.GetString("teams-webhook-url") != "" },
+		build: func() (built []*asyncNotifier, err error) {
+			logrus.Info("teams notifications enabled")
+			n := newTeamsNotifier(viper.GetString("teams-webhook-url"), viper.GetString("teams-link"))
+			if n.template, err = loadTemplate("teams"); err != nil {
+				return nil, err
+			}
+			return []*asyncNotifier{newAsyncNotifier(n, optionsFor("teams", chatEvents))}, nil
+		},
+	})
+}
+
+const (
+	// teamsMaxTargets is the number of targets listed before the list is truncated
+	teamsMaxTargets = 10
+	// teamsMaxActions is the number of buttons opening the trigger and the targets in the console
+	teamsMaxActions = 4
+)
+
+// teamsNotifier posts rollout events as MessageCards to a Microsoft Teams incoming webhook
+// link is the console link of teams-link, empty to send the facts as plain text.
+type teamsNotifier struct {
+	webhookURL string
+	link       string
+	template   *notificationTemplate
+	client     *http.Client
+}
+
+type teamsMessageCard struct {
+	Type            string         `json:"@type"`
+	Context         string         `json:"@context"`
+	ThemeColor      string         `json:"themeColor"`
+	Summary         string         `json:"summary"`
+	Sections        []teamsSection `json:"sections"`
+	PotentialAction []teamsAction  `json:"potentialAction,omitempty"`
+}
+
+type teamsSection struct {
+	ActivityTitle    string      `json:"activityTitle"`
+	ActivitySubtitle string      `json:"activitySubtitle,omitempty"`
+	Facts            []teamsFact `json:"facts"`
+	Markdown         bool        `json:"markdown"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// teamsAction is an OpenUri button of the card
+type teamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []teamsTarget `json:"targets"`
+}
+
+type teamsTarget struct {
+	OS  string `json:"os"`
+	URI string `json:"uri"`
+}
+
+func newTeamsNotifier(webhookURL, link string) *teamsNotifier {
+	return &teamsNotifier{webhookURL: webhookURL, link: link, client: &http.Client{}}
+}
+
+func (t *teamsNotifier) Name() string {
+	return "teams"
+}
+
+func (t *teamsNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	payload, err := t.template.body(event, func() ([]byte, error) { return json.Marshal(t.card(event)) })
+	if err != nil {
+		return err
+	}
+	return post(ctx, t.client, t.webhookURL, "application/json", payload, nil)
+}
+
+func (t *teamsNotifier) card(event RolloutEvent) teamsMessageCard {
+	// green, orange and red, by outcome
+	color := "2EB886"
+	switch event.Severity() {
+	case SeverityWarning:
+		color = "DAA038"
+	case SeverityError:
+		color = "A30200"
+	}
+	src := event.Source
+	facts := []teamsFact{
+		{Name: "Namespace", Value: t.linked(src.Namespace, "Namespace", src.Namespace, src.Namespace)},
+		{Name: "Trigger", Value: t.linked(fmt.Sprintf("%s %s", src.Kind, src.Name), src.Kind, src.Namespace, src.Name)},
+		{Name: "Changed keys", Value: valueOrNone(strings.Join(src.ChangedKeys, ", "))},
+		{Name: "Workloads", Value: valueOrNone(t.targets(event.Targets))},
+		{Name: "Outcome", Value: event.Outcome},
+	}
+	if event.Cluster != "" {
+		facts = append(facts, teamsFact{Name: "Cluster", Value: event.Cluster})
+	}
+	if event.Error != "" {
+		facts = append(facts, teamsFact{Name: "Error", Value: event.Error})
+	}
+	title := fmt.Sprintf("cre %s for %s", event.Type, event.Source)
+	return teamsMessageCard{
+		Type:       "MessageCard",
+		Context:    "http://schema.org/extensions",
+		ThemeColor: color,
+		Summary:    title,
+		Sections: []teamsSection{{
+			ActivityTitle:    title,
+			ActivitySubtitle: event.CorrelationID,
+			Facts:            facts,
+			Markdown:         true,
+		}},
+		PotentialAction: t.actions(event),
+	}
+}
+
+func (t *teamsNotifier) targets(targets []Workload) string {
+	var names []string
+	for i, w := range targets {
+		if i == teamsMaxTargets {
+			names = append(names, fmt.Sprintf("... and %d more", len(targets)-teamsMaxTargets))
+			break
+		}
+		names = append(names, t.linked(fmt.Sprintf("%s %s", w.Kind, w.Name), w.Kind, w.Namespace, w.Name))
+	}
+	return strings.Join(names, ", ")
+}
+
+// uri returns the console link of the object, empty without teams-link
+func (t *teamsNotifier) uri(kind, ns, name string) string {
+	if t.link == "" {
+		return ""
+	}
+	return strings.NewReplacer("{namespace}", ns, "{kind}", strings.ToLower(kind), "{name}", name).Replace(t.link)
+}
+
+// linked returns text as a markdown link to the object, text itself without teams-link
+func (t *teamsNotifier) linked(text, kind, ns, name string) string {
+	if uri := t.uri(kind, ns, name); uri != "" {
+		return fmt.Sprintf("[%s](%s)", text, uri)
+	}
+	return text
+}
+
+// actions returns the buttons opening the trigger and the first targets, none without teams-link
+func (t *teamsNotifier) actions(event RolloutEvent) []teamsAction {
+	if t.link == "" {
+		return nil
+	}
+	open := func(name, uri string) teamsAction {
+		return teamsAction{Type: "OpenUri", Name: name, Targets: []teamsTarget{{OS: "default", URI: uri}}}
+	}
+	src := event.Source
+	actions := []teamsAction{open(fmt.Sprintf("Open %s %s", src.Kind, src.Name), t.uri(src.Kind, src.Namespace, src.Name))}
+	for _, w := range event.Targets {
+		if len(actions) == teamsMaxActions {
+			break
+		}
+		actions = append(actions, open(fmt.Sprintf("Open %s %s", w.Kind, w.Name), t.uri(w.Kind, w.Namespace, w.Name)))
+	}
+	return actions
+}
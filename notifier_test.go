@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the events delivered to it, blocking on release when set
+type fakeNotifier struct {
+	name    string
+	release chan struct{}
+	mu      sync.Mutex
+	events  []RolloutEvent
+}
+
+func (f *fakeNotifier) Name() string { return f.name }
+
+func (f *fakeNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	if f.release != nil {
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeNotifier) delivered() []RolloutEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RolloutEvent(nil), f.events...)
+}
+
+// fakeNotifiers makes fake notifiers the notifiers of cre for the test
+func fakeNotifiers(t *testing.T, fakes ...Notifier) {
+	t.Helper()
+	previous := notifiers
+	notifiers = nil
+	for _, f := range fakes {
+		notifiers = append(notifiers, newAsyncNotifier(f, notifierOptions{}))
+	}
+	t.Cleanup(func() {
+		// deliveries read the flags, which the next test sets
+		drainNotifiers(time.Second)
+		notifiers = previous
+	})
+}
+
+func TestNotifyFansOutToAllNotifiers(t *testing.T) {
+	a, b := &fakeNotifier{name: "a"}, &fakeNotifier{name: "b"}
+	fakeNotifiers(t, a, b)
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", CorrelationID: "42"}
+	notify(RolloutEvent{Type: EventRolloutTriggered, Source: src, Targets: []Workload{{Kind: "Deployment", Namespace: "apps", Name: "web"}}, Outcome: "triggered"})
+	drainNotifiers(time.Second)
+	for _, f := range []*fakeNotifier{a, b} {
+		events := f.delivered()
+		if len(events) != 1 || events[0].Type != EventRolloutTriggered || events[0].CorrelationID != "42" {
+			t.Fatalf("expected notifier %s to get the triggered event, got %v", f.name, events)
+		}
+	}
+}
+
+func TestSlowNotifierDoesNotBlockTheOthers(t *testing.T) {
+	slow, fast := &fakeNotifier{name: "slow", release: make(chan struct{})}, &fakeNotifier{name: "fast"}
+	fakeNotifiers(t, slow, fast)
+	defer close(slow.release)
+	notify(RolloutEvent{Type: EventRolloutTriggered, Source: Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, Outcome: "triggered"})
+	deadline := time.Now().Add(time.Second)
+	for len(fast.delivered()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the slow notifier held back the delivery to the fast one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// annotatedEvent is an event recorded by annotationRecorder
+type annotatedEvent struct {
+	reason      string
+	annotations map[string]string
+}
+
+// annotationRecorder records the annotations of events, which the fake recorder of client-go drops
+type annotationRecorder struct {
+	mu     sync.Mutex
+	events []annotatedEvent
+}
+
+func (r *annotationRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.AnnotatedEventf(object, nil, eventtype, reason, "%s", message)
+}
+
+func (r *annotationRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.AnnotatedEventf(object, nil, eventtype, reason, messageFmt, args...)
+}
+
+func (r *annotationRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, annotatedEvent{reason: reason, annotations: annotations})
+}
+
+func TestCorrelationIDAcrossArtifacts(t *testing.T) {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "correlated", Name: "app-config", ResourceVersion: "1", Labels: map[string]string{"mlops.cnvrg.io": "app"}}, Data: map[string]string{"key": "old"}}
+	client := fakeClientset(t, cm, labeledDeployment("correlated", "web", "app"))
+	patches := recordPatches(client)
+	setFlags(t, map[string]interface{}{"namespace": "correlated", "track-rollouts": false, "debounce": time.Duration(0), "pair-window": time.Duration(0), "preflight-dry-run": false})
+	events := &annotationRecorder{}
+	previous := recorder
+	recorder = events
+	t.Cleanup(func() { recorder = previous })
+	var payloads []map[string]interface{}
+	var payloadsMu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("%s failed to decode the webhook payload", err)
+		}
+		payloadsMu.Lock()
+		payloads = append(payloads, payload)
+		payloadsMu.Unlock()
+	}))
+	defer server.Close()
+	webhook, err := newWebhookNotifier(server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeNotifiers(t, webhook)
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	t.Cleanup(func() {
+		logrus.SetOutput(ioutil.Discard)
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		cmInformer(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+		sourceFactoriesMu.Lock()
+		delete(sourceFactories, "correlated")
+		sourceFactoriesMu.Unlock()
+		observedMu.Lock()
+		delete(observedSources, sourceKey("ConfigMap", "correlated", "app-config"))
+		observedMu.Unlock()
+	})
+	if !cache.WaitForCacheSync(ctx.Done(), sourceFactory("correlated").Core().V1().ConfigMaps().Informer().HasSynced) {
+		t.Fatal("the ConfigMap informer didn't sync")
+	}
+	changed := cm.DeepCopy()
+	changed.ResourceVersion = "2"
+	changed.Data["key"] = "new"
+	if _, err := client.CoreV1().ConfigMaps("correlated").Update(context.Background(), changed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, 1)
+	processQueuedRollouts(t)
+	drainNotifiers(time.Second)
+
+	recorded := patches.recorded()
+	if len(recorded) != 1 {
+		t.Fatalf("expected a single restart for the change, got %d patches", len(recorded))
+	}
+	id := templateAnnotations(t, recorded[0])[correlationIDAnnotation]
+	if id == "" {
+		t.Fatal("expected the restarted pods annotated with the correlation id")
+	}
+	if len(events.events) == 0 {
+		t.Fatal("expected events for the change")
+	}
+	for _, event := range events.events {
+		if event.annotations[correlationIDAnnotation] != id {
+			t.Fatalf("expected the %s event annotated with %s, got %v", event.reason, id, event.annotations)
+		}
+	}
+	payloadsMu.Lock()
+	defer payloadsMu.Unlock()
+	if len(payloads) == 0 {
+		t.Fatal("expected webhook notifications for the change")
+	}
+	for _, payload := range payloads {
+		if payload["correlationId"] != id {
+			t.Fatalf("expected the %v webhook payload to carry %s, got %v", payload["type"], id, payload["correlationId"])
+		}
+	}
+	tagged := 0
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var line map[string]interface{}
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := line[correlationIDField]; ok {
+			if value != id {
+				t.Fatalf("expected the log lines of the change tagged with %s, got %v", id, line)
+			}
+			tagged++
+		}
+	}
+	if tagged == 0 {
+		t.Fatal("expected log lines tagged with the correlation id")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/url"
+)
+
+func init() {
+	registerNotifierBackend("webhook", notifierBackend{
+		configured: func() bool { return len(viper.GetStringSlice("notify-webhook-url")) > 0 },
+		build: func() ([]*asyncNotifier, error) {
+			secret, err := readSecret("notify-webhook-secret", "notify-webhook-secret-file")
+			if err != nil {
+				return nil, err
+			}
+			tmpl, err := loadTemplate("webhook")
+			if err != nil {
+				return nil, err
+			}
+			if tmpl != nil && cloudEventsMode() != "" {
+				logrus.Warnf("webhook notifications are formatted as CloudEvents, the webhook template %s is ignored", tmpl.file)
+			}
+			var built []*asyncNotifier
+			for _, url := range viper.GetStringSlice("notify-webhook-url") {
+				n, err := newWebhookNotifier(url, secret)
+				if err != nil {
+					return nil, err
+				}
+				n.template = tmpl
+				logrus.Infof("webhook notifications enabled for %s", n.Name())
+				built = append(built, newAsyncNotifier(n, notifierOptions{}))
+			}
+			return built, nil
+		},
+	})
+}
+
+const webhookSignatureHeader = "X-Cre-Signature"
+
+// webhookNotifier POSTs every RolloutEvent as JSON to an endpoint.
+// When a secret is configured the body is signed with HMAC-SHA256
+// and the hex digest is sent as "X-Cre-Signature: sha256=<digest>".
+type webhookNotifier struct {
+	url    string
+	name   string
+	secret []byte
+	// template renders plain JSON payloads, CloudEvents keep their format
+	template *notificationTemplate
+	client   *http.Client
+}
+
+func newWebhookNotifier(rawURL string, secret string) (*webhookNotifier, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook url scheme %q", u.Scheme)
+	}
+	// Only the host ends up in logs and metrics, paths and queries tend to carry tokens
+	return &webhookNotifier{url: rawURL, name: "webhook-" + u.Host, secret: []byte(secret), client: &http.Client{}}, nil
+}
+
+func (w *webhookNotifier) Name() string {
+	return w.name
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, event RolloutEvent) error {
+	var payload []byte
+	var err error
+	contentType := "application/json"
+	headers := map[string]string{"X-Cre-Event": string(event.Type)}
+	switch cloudEventsMode() {
+	case cloudEventsStructured:
+		contentType = "application/cloudevents+json"
+		payload, err = structuredCloudEvent(event)
+	case cloudEventsBinary:
+		for k, v := range cloudEventAttributes(event) {
+			if k != "datacontenttype" {
+				headers["ce-"+k] = v
+			}
+		}
+		payload, err = json.Marshal(event)
+	default:
+		payload, err = w.template.body(event, func() ([]byte, error) { return json.Marshal(event) })
+	}
+	if err != nil {
+		return err
+	}
+	if len(w.secret) > 0 {
+		headers[webhookSignatureHeader] = "sha256=" + sign(w.secret, payload)
+	}
+	return post(ctx, w.client, w.url, contentType, payload, headers)
+}
+
+func sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
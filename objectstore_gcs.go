@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2/google"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+func init() {
+	registerObjectStore("gs", newGCSStore)
+}
+
+// gcsStore uploads with the GCS JSON API, credentials come from the Application Default Credentials chain
+// (GOOGLE_APPLICATION_CREDENTIALS, workload identity, the metadata server)
+type gcsStore struct {
+	bucket   string
+	endpoint string
+	client   *http.Client
+}
+
+func newGCSStore(bucket string) (objectStore, error) {
+	client, err := google.DefaultClient(context.Background(), gcsScope)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := viper.GetString("audit-upload-endpoint")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	return &gcsStore{bucket: bucket, endpoint: strings.TrimSuffix(endpoint, "/"), client: client}, nil
+}
+
+func (g *gcsStore) upload(ctx context.Context, key, path string, size int64, md5sum []byte) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", g.endpoint, url.PathEscape(g.bucket), url.QueryEscape(key))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("gcs responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var object struct {
+		Size    string `json:"size"`
+		MD5Hash []byte `json:"md5Hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return err
+	}
+	// a mismatching object is overwritten by the next upload
+	if stored, _ := strconv.ParseInt(object.Size, 10, 64); stored != size || !bytes.Equal(object.MD5Hash, md5sum) {
+		return fmt.Errorf("gs://%s/%s doesn't match the local file, %s bytes stored, expected %d", g.bucket, key, object.Size, size)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/spf13/viper"
+	"os"
+)
+
+// The S3 uploads pull in the AWS SDK, they're only built with -tags s3
+
+func init() {
+	registerObjectStore("s3", newS3Store)
+}
+
+// s3Store uploads to S3 or S3 compatible stores with --audit-upload-endpoint, credentials come from the default AWS chain
+type s3Store struct {
+	bucket string
+	client *s3.Client
+}
+
+func newS3Store(bucket string) (objectStore, error) {
+	// Failed uploads are retried by the next upload round
+	opts := []func(*config.LoadOptions) error{config.WithRetryMaxAttempts(1)}
+	if region := viper.GetString("audit-upload-region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := viper.GetString("audit-upload-endpoint"); endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			// S3 compatible stores rarely support virtual hosted buckets
+			o.UsePathStyle = true
+		}
+	})
+	return &s3Store{bucket: bucket, client: client}, nil
+}
+
+func (s *s3Store) upload(ctx context.Context, key, path string, size int64, md5sum []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// S3 rejects the object when its content doesn't match Content-MD5
+	if _, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          f,
+		ContentLength: size,
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(md5sum)),
+		ContentType:   aws.String("application/x-ndjson"),
+	}); err != nil {
+		return err
+	}
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	if head.ContentLength != size {
+		return fmt.Errorf("s3://%s/%s holds %d bytes, expected %d", s.bucket, key, head.ContentLength, size)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !s3
+// +build !s3
+
+package main
+
+import "fmt"
+
+// Without -tags s3 the AWS SDK isn't linked, an s3:// upload url fails the startup rather than being ignored
+func init() {
+	registerObjectStore("s3", func(string) (objectStore, error) {
+		return nil, fmt.Errorf("cre was built without s3 support, rebuild it with -tags s3")
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// otlpExportTimeout bounds a single push of all metrics
+const otlpExportTimeout = 10 * time.Second
+
+// otlpExporter pushes the cre metrics of the Prometheus registry to an OpenTelemetry collector.
+// It translates what the registry gathers rather than keeping instruments of its own,
+// so the scraped and the pushed metrics can't diverge.
+type otlpExporter struct {
+	export    func(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) error
+	resource  *resourcepb.Resource
+	startTime uint64
+}
+
+// exportOTLPMetrics pushes the metrics every otlp-metrics-interval, nothing is started without otlp-metrics-endpoint
+func exportOTLPMetrics() {
+	endpoint := viper.GetString("otlp-metrics-endpoint")
+	if endpoint == "" {
+		return
+	}
+	e, err := newOTLPExporter(endpoint, viper.GetString("otlp-metrics-protocol"))
+	if err != nil {
+		logrus.Fatalf("%s, invalid otlp metrics configuration", err)
+	}
+	interval := viper.GetDuration("otlp-metrics-interval")
+	logrus.Infof("pushing metrics to %s every %s", endpoint, interval)
+	for range time.Tick(interval) {
+		if err := e.push(); err != nil {
+			logrus.Errorf("%s failed to push metrics to %s", err, endpoint)
+		}
+	}
+}
+
+func newOTLPExporter(endpoint, protocol string) (*otlpExporter, error) {
+	headers := map[string]string{}
+	for _, h := range viper.GetStringSlice("otlp-metrics-header") {
+		parts := strings.SplitN(h, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --otlp-metrics-header %q, expected name=value", h)
+		}
+		headers[parts[0]] = parts[1]
+	}
+	tlsConfig, err := otlpTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	e := &otlpExporter{
+		resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			otlpString("service.name", "cre"),
+			otlpString("host.name", hostname),
+		}},
+		startTime: uint64(time.Now().UnixNano()),
+	}
+	if cluster := viper.GetString("cluster-name"); cluster != "" {
+		e.resource.Attributes = append(e.resource.Attributes, otlpString("k8s.cluster.name", cluster))
+	}
+	switch protocol {
+	case "grpc":
+		creds := grpc.WithInsecure()
+		if tlsConfig != nil {
+			creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+		}
+		conn, err := grpc.Dial(endpoint, creds)
+		if err != nil {
+			return nil, err
+		}
+		client := collectorpb.NewMetricsServiceClient(conn)
+		e.export = func(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) error {
+			_, err := client.Export(metadata.NewOutgoingContext(ctx, metadata.New(headers)), req)
+			return err
+		}
+	case "http":
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("expected an http(s) url as --otlp-metrics-endpoint with --otlp-metrics-protocol=http, got %s", endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		e.export = func(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) error {
+			return postProtobuf(ctx, client, u.String(), req, headers)
+		}
+	default:
+		return nil, fmt.Errorf("unknown --otlp-metrics-protocol %q, expected grpc|http", protocol)
+	}
+	return e, nil
+}
+
+// otlpTLSConfig returns nil for plaintext gRPC with otlp-metrics-insecure, http urls pick their scheme themselves
+func otlpTLSConfig() (*tls.Config, error) {
+	if viper.GetBool("otlp-metrics-insecure") {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := viper.GetString("otlp-metrics-ca-file"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func postProtobuf(ctx context.Context, client *http.Client, url string, msg proto.Message, headers map[string]string) error {
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (e *otlpExporter) push() error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return err
+	}
+	now := uint64(time.Now().UnixNano())
+	var metrics []*metricspb.Metric
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "cre_") {
+			continue
+		}
+		if m := e.metric(family, now); m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+	defer cancel()
+	return e.export(ctx, &collectorpb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: e.resource,
+		InstrumentationLibraryMetrics: []*metricspb.InstrumentationLibraryMetrics{{
+			InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: "github.com/cre"},
+			Metrics:                metrics,
+		}},
+	}}})
+}
+
+// metric translates a Prometheus family, counters become cumulative monotonic sums.
+// Summaries have no OTLP counterpart and are skipped.
+func (e *otlpExporter) metric(family *dto.MetricFamily, now uint64) *metricspb.Metric {
+	m := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		sum := &metricspb.Sum{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, IsMonotonic: true}
+		for _, metric := range family.GetMetric() {
+			sum.DataPoints = append(sum.DataPoints, e.numberPoint(metric, metric.GetCounter().GetValue(), now))
+		}
+		m.Data = &metricspb.Metric_Sum{Sum: sum}
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		gauge := &metricspb.Gauge{}
+		for _, metric := range family.GetMetric() {
+			value := metric.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				value = metric.GetUntyped().GetValue()
+			}
+			gauge.DataPoints = append(gauge.DataPoints, e.numberPoint(metric, value, now))
+		}
+		m.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+	case dto.MetricType_HISTOGRAM:
+		histogram := &metricspb.Histogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE}
+		for _, metric := range family.GetMetric() {
+			h := metric.GetHistogram()
+			point := &metricspb.HistogramDataPoint{
+				Attributes:        otlpAttributes(metric),
+				StartTimeUnixNano: e.startTime,
+				TimeUnixNano:      now,
+				Count:             h.GetSampleCount(),
+				Sum:               h.GetSampleSum(),
+			}
+			// Prometheus buckets are cumulative, OTLP ones count the samples of each bucket only
+			var previous uint64
+			for _, b := range h.GetBucket() {
+				if math.IsInf(b.GetUpperBound(), 1) {
+					continue
+				}
+				point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+				point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+				previous = b.GetCumulativeCount()
+			}
+			point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+			histogram.DataPoints = append(histogram.DataPoints, point)
+		}
+		m.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+	default:
+		return nil
+	}
+	return m
+}
+
+func (e *otlpExporter) numberPoint(metric *dto.Metric, value float64, now uint64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        otlpAttributes(metric),
+		StartTimeUnixNano: e.startTime,
+		TimeUnixNano:      now,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+func otlpAttributes(metric *dto.Metric) []*commonpb.KeyValue {
+	var attributes []*commonpb.KeyValue
+	for _, label := range metric.GetLabel() {
+		attributes = append(attributes, otlpString(label.GetName(), label.GetValue()))
+	}
+	return attributes
+}
+
+func otlpString(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var reloadPoliciesGVR = schema.GroupVersionResource{Group: "cre.cnvrg.io", Version: "v1alpha1", Resource: "reloadpolicies"}
+
+// ReloadPolicySpec declares which sources restart which workloads of the policy namespace, see crds/reloadpolicy.yaml
+type ReloadPolicySpec struct {
+	Sources   []PolicyRef `json:"sources"`
+	Targets   []PolicyRef `json:"targets"`
+	Strategy  string      `json:"strategy,omitempty"`
+	Cooldown  string      `json:"cooldown,omitempty"`
+	Windows   []string    `json:"windows,omitempty"`
+	Notifiers []string    `json:"notifiers,omitempty"`
+}
+
+// PolicyRef selects objects of a kind, any kind the field allows when empty, by name or label selector
+type PolicyRef struct {
+	Kind     string                `json:"kind,omitempty"`
+	Name     string                `json:"name,omitempty"`
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// reloadPolicy is a parsed ReloadPolicy
+type reloadPolicy struct {
+	namespace, name string
+	sources         []PolicyRef
+	targets         []PolicyRef
+	cooldown        time.Duration
+	windows         []rolloutWindow
+	notifiers       []string
+}
+
+func (p *reloadPolicy) String() string {
+	return "ReloadPolicy " + p.namespace + "/" + p.name
+}
+
+// rolloutWindow is a daily UTC time range rollouts are allowed in, crossing midnight when end is before start
+type rolloutWindow struct {
+	start, end time.Duration
+}
+
+var (
+	policiesMu sync.Mutex
+	policies   = map[string]*reloadPolicy{}
+)
+
+// policiesEnabled tells if ReloadPolicies are watched, unless disabled with --reload-policies=false
+// on clusters without the CRD they are ignored
+func policiesEnabled() bool {
+	return viper.GetBool("reload-policies") && resourceServed(reloadPoliciesGVR)
+}
+
+func reloadPolicyInformer() {
+	if !viper.GetBool("reload-policies") {
+		return
+	}
+	update := func(obj interface{}) {
+		u := obj.(*unstructured.Unstructured)
+		key := u.GetNamespace() + "/" + u.GetName()
+		policy, err := parseReloadPolicy(u)
+		policiesMu.Lock()
+		if err != nil {
+			delete(policies, key)
+		} else {
+			policies[key] = policy
+		}
+		policiesMu.Unlock()
+		if err != nil {
+			logrus.Errorf("%s, ignoring invalid ReloadPolicy %s", err, key)
+			patchPolicyStatus(u.GetNamespace(), u.GetName(), map[string]interface{}{"lastError": err.Error(), "observedGeneration": u.GetGeneration()})
+			return
+		}
+		if errMsg, _, _ := unstructured.NestedString(u.Object, "status", "lastError"); errMsg != "" || statusGeneration(u) != u.GetGeneration() {
+			patchPolicyStatus(u.GetNamespace(), u.GetName(), map[string]interface{}{"lastError": nil, "observedGeneration": u.GetGeneration()})
+		}
+	}
+	informer := watchCustomResource(reloadPoliciesGVR, cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(oldObj, newObj interface{}) { update(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				policiesMu.Lock()
+				delete(policies, u.GetNamespace()+"/"+u.GetName())
+				policiesMu.Unlock()
+			}
+		},
+	})
+	if informer == nil {
+		return
+	}
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.Run(stopper)
+}
+
+func statusGeneration(u *unstructured.Unstructured) int64 {
+	generation, _, _ := unstructured.NestedInt64(u.Object, "status", "observedGeneration")
+	return generation
+}
+
+func parseReloadPolicy(u *unstructured.Unstructured) (*reloadPolicy, error) {
+	raw, _, _ := unstructured.NestedMap(u.Object, "spec")
+	var spec ReloadPolicySpec
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &spec); err != nil {
+		return nil, err
+	}
+	if len(spec.Sources) == 0 || len(spec.Targets) == 0 {
+		return nil, fmt.Errorf("sources and targets are required")
+	}
+	for _, ref := range spec.Sources {
+		if err := validatePolicyRef(ref, "ConfigMap", "Secret"); err != nil {
+			return nil, fmt.Errorf("invalid source: %s", err)
+		}
+	}
+	for _, ref := range spec.Targets {
+		if err := validatePolicyRef(ref, "Deployment", "StatefulSet", "DaemonSet"); err != nil {
+			return nil, fmt.Errorf("invalid target: %s", err)
+		}
+	}
+	// restarting the pod template is the only strategy so far
+	if spec.Strategy != "" && spec.Strategy != "restart" {
+		return nil, fmt.Errorf("unknown strategy %q, expected restart", spec.Strategy)
+	}
+	policy := &reloadPolicy{namespace: u.GetNamespace(), name: u.GetName(), sources: spec.Sources, targets: spec.Targets, notifiers: spec.Notifiers}
+	if spec.Cooldown != "" {
+		cooldown, err := time.ParseDuration(spec.Cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cooldown: %s", err)
+		}
+		policy.cooldown = cooldown
+	}
+	for _, w := range spec.Windows {
+		window, err := parseRolloutWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		policy.windows = append(policy.windows, window)
+	}
+	for _, name := range spec.Notifiers {
+		if _, ok := notifierBackends[name]; !ok {
+			return nil, fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+	return policy, nil
+}
+
+func validatePolicyRef(ref PolicyRef, kinds ...string) error {
+	if (ref.Name == "") == (ref.Selector == nil) {
+		return fmt.Errorf("exactly one of name and selector has to be set")
+	}
+	if ref.Selector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(ref.Selector); err != nil {
+			return err
+		}
+	}
+	if ref.Kind == "" {
+		return nil
+	}
+	for _, kind := range kinds {
+		if ref.Kind == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported kind %q, expected one of %s", ref.Kind, strings.Join(kinds, ", "))
+}
+
+// parseRolloutWindow parses a HH:MM-HH:MM UTC window
+func parseRolloutWindow(s string) (rolloutWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return rolloutWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return rolloutWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return rolloutWindow{start: bounds[0], end: bounds[1]}, nil
+}
+
+// windowWait returns how long to wait from now until any of the windows opens, 0 within one of them or without windows
+func windowWait(windows []rolloutWindow, now time.Time) time.Duration {
+	if len(windows) == 0 {
+		return 0
+	}
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	sinceMidnight := now.Sub(midnight)
+	wait := 24 * time.Hour
+	for _, w := range windows {
+		inside := sinceMidnight >= w.start && sinceMidnight < w.end
+		if w.end <= w.start {
+			inside = sinceMidnight >= w.start || sinceMidnight < w.end
+		}
+		if inside {
+			return 0
+		}
+		until := w.start - sinceMidnight
+		if until < 0 {
+			until += 24 * time.Hour
+		}
+		if until < wait {
+			wait = until
+		}
+	}
+	return wait
+}
+
+// policyFor returns the first ReloadPolicy, by name, of the namespace of obj selecting it as a source
+func policyFor(kind string, obj metav1.Object) *reloadPolicy {
+	if !viper.GetBool("reload-policies") {
+		return nil
+	}
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+	var matching []*reloadPolicy
+	for _, p := range policies {
+		if p.namespace != obj.GetNamespace() {
+			continue
+		}
+		for _, ref := range p.sources {
+			if refMatches(ref, kind, obj.GetName(), obj.GetLabels()) {
+				matching = append(matching, p)
+				break
+			}
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].name < matching[j].name })
+	if len(matching) > 1 {
+		logrus.Warnf("%s %s/%s is selected by %d ReloadPolicies, applying %s", kind, obj.GetNamespace(), obj.GetName(), len(matching), matching[0])
+	}
+	return matching[0]
+}
+
+func refMatches(ref PolicyRef, kind, name string, objLabels map[string]string) bool {
+	if ref.Kind != "" && ref.Kind != kind {
+		return false
+	}
+	if ref.Name != "" {
+		return ref.Name == name
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ref.Selector)
+	return err == nil && selector.Matches(labels.Set(objLabels))
+}
+
+// policyTargets returns the workloads the policy of src targets, replacing the label and annotation based matching
+func policyTargets(src Source) []Workload {
+	p := src.Policy
+	clientset := clientset()
+	seen := map[Workload]bool{}
+	var targets []Workload
+	add := func(w Workload) {
+		if !seen[w] {
+			seen[w] = true
+			targets = append(targets, w)
+		}
+	}
+	for _, ref := range p.targets {
+		kinds := []string{"Deployment", "StatefulSet", "DaemonSet"}
+		if ref.Kind != "" {
+			kinds = []string{ref.Kind}
+		}
+		if ref.Name != "" {
+			for _, kind := range kinds {
+				w := Workload{Kind: kind, Namespace: p.namespace, Name: ref.Name}
+				if _, _, err := getWorkload(w); err == nil {
+					add(w)
+				}
+			}
+			continue
+		}
+		selector, _ := metav1.LabelSelectorAsSelector(ref.Selector)
+		opts := metav1.ListOptions{LabelSelector: selector.String()}
+		for _, kind := range kinds {
+			var names []string
+			var err error
+			switch kind {
+			case "Deployment":
+				d, listErr := clientset.AppsV1().Deployments(p.namespace).List(context.Background(), opts)
+				if err = listErr; err == nil {
+					for _, item := range d.Items {
+						names = append(names, item.Name)
+					}
+				}
+			case "StatefulSet":
+				s, listErr := clientset.AppsV1().StatefulSets(p.namespace).List(context.Background(), opts)
+				if err = listErr; err == nil {
+					for _, item := range s.Items {
+						names = append(names, item.Name)
+					}
+				}
+			case "DaemonSet":
+				d, listErr := clientset.AppsV1().DaemonSets(p.namespace).List(context.Background(), opts)
+				if err = listErr; err == nil {
+					for _, item := range d.Items {
+						names = append(names, item.Name)
+					}
+				}
+			}
+			if err != nil {
+				logrus.Errorf("%s failed to list %ss of %s", err, kind, p)
+				patchPolicyStatus(p.namespace, p.name, map[string]interface{}{"lastError": fmt.Sprintf("failed to list %ss: %s", kind, err)})
+				continue
+			}
+			for _, name := range names {
+				add(Workload{Kind: kind, Namespace: p.namespace, Name: name})
+			}
+		}
+	}
+	if len(targets) == 0 {
+		logrus.Infof("%s targets no existing workloads", p)
+	}
+	return targets
+}
+
+// notifierAllowed tells if the policy of src, if any, lets the named notifier receive its events
+func notifierAllowed(src Source, name string) bool {
+	if src.Policy == nil || len(src.Policy.notifiers) == 0 {
+		return true
+	}
+	return notifierSelected(src.Policy.notifiers, name)
+}
+
+// recordPolicyRollout reports a finished rollout of src in the status of its policy
+func recordPolicyRollout(src Source, targets []Workload) {
+	if src.Policy == nil {
+		return
+	}
+	status := map[string]interface{}{
+		"lastTriggered": time.Now().UTC().Format(time.RFC3339),
+		"lastSource":    src.String(),
+		"lastTargets":   len(targets),
+	}
+	if len(targets) == 0 {
+		status["lastError"] = fmt.Sprintf("no workload was restarted for %s", src)
+	} else {
+		status["lastError"] = nil
+	}
+	patchPolicyStatus(src.Policy.namespace, src.Policy.name, status)
+}
+
+// patchPolicyStatus merges status into the status subresource, failures are logged and never affect rollouts
+func patchPolicyStatus(ns, name string, status map[string]interface{}) {
+	data, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		logrus.Errorf("%s failed to marshal status of ReloadPolicy %s/%s", err, ns, name)
+		return
+	}
+	_, err = dynamicClient().Resource(reloadPoliciesGVR).Namespace(ns).Patch(context.Background(), name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+	if err != nil {
+		logrus.Errorf("%s failed to update status of ReloadPolicy %s/%s", err, ns, name)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Workload annotations selecting and tuning the reload profile
+const (
+	profileAnnotation         = "cre.cnvrg.io/profile"
+	reloadStrategyAnnotation  = "cre.cnvrg.io/reload-strategy"
+	reloadSignalAnnotation    = "cre.cnvrg.io/reload-signal"
+	reloadPortAnnotation      = "cre.cnvrg.io/reload-port"
+	reloadPathAnnotation      = "cre.cnvrg.io/reload-path"
+	reloadContainerAnnotation = "cre.cnvrg.io/reload-container"
+)
+
+// appProfile tells how an application reloads its configuration in place:
+// signal sends Signal to pid 1 of the container, http POSTs to Path on Port of the pod, restart bumps the pod template
+type appProfile struct {
+	Name     string   `mapstructure:"name"`
+	Images   []string `mapstructure:"images"`
+	Strategy string   `mapstructure:"strategy"`
+	Signal   string   `mapstructure:"signal"`
+	Port     int      `mapstructure:"port"`
+	Path     string   `mapstructure:"path"`
+	// container the profile applies to, resolved per workload
+	container string
+}
+
+func (p appProfile) String() string {
+	switch p.Strategy {
+	case "signal":
+		return fmt.Sprintf("%s (SIG%s)", p.Name, p.Signal)
+	case "http":
+		return fmt.Sprintf("%s (POST :%d%s)", p.Name, p.Port, p.Path)
+	}
+	return p.Name
+}
+
+// builtinProfiles are the applications known to reload their configuration on their own,
+// profiles of the config file with the same name replace them
+var builtinProfiles = []appProfile{
+	{Name: "nginx", Images: []string{"nginx", "nginx-unprivileged", "openresty"}, Strategy: "signal", Signal: "HUP"},
+	{Name: "haproxy", Images: []string{"haproxy"}, Strategy: "signal", Signal: "HUP"},
+	{Name: "fluent-bit", Images: []string{"fluent-bit"}, Strategy: "signal", Signal: "HUP"},
+	{Name: "prometheus", Images: []string{"prometheus"}, Strategy: "http", Port: 9090, Path: "/-/reload"},
+}
+
+// appProfiles returns the profiles of the config file followed by the builtin ones they don't replace
+func appProfiles() []appProfile {
+	var profiles []appProfile
+	if err := viper.UnmarshalKey("profiles", &profiles); err != nil {
+		logrus.Errorf("%s failed to read profiles from the config file", err)
+	}
+	custom := map[string]bool{}
+	for _, p := range profiles {
+		custom[p.Name] = true
+	}
+	for _, p := range builtinProfiles {
+		if !custom[p.Name] {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// imageMatches matches the repository of image, without registry, tag and digest,
+// patterns without a / match its last path segment, e.g. nginx matches docker.io/library/nginx:1.25
+func imageMatches(pattern, image string) bool {
+	repo := image
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo = repo[:i]
+	}
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, repo)
+		return ok || strings.HasSuffix(repo, "/"+pattern)
+	}
+	ok, _ := path.Match(pattern, path.Base(repo))
+	return ok
+}
+
+// reloadProfile returns the profile reloading w in place for the change of src. The profile annotation selects it,
+// with app-profiles the container images do, the reload-* annotations override its parameters.
+// A restart is still needed when src reaches the container any other way than a mounted volume,
+// env vars and subPath mounts never see updates.
+func reloadProfile(src Source, w Workload) (appProfile, bool) {
+	obj, template, err := getWorkload(w)
+	if err != nil {
+		return appProfile{}, false
+	}
+	annotations := obj.GetAnnotations()
+	name, annotated := annotations[profileAnnotation]
+	if name == "restart" || (!annotated && !viper.GetBool("app-profiles") && annotations[reloadStrategyAnnotation] == "") {
+		return appProfile{}, false
+	}
+	var profile appProfile
+	found := false
+	containers := template.Spec.Containers
+	for _, p := range appProfiles() {
+		if annotated && p.Name != name {
+			continue
+		}
+		for _, c := range containers {
+			for _, pattern := range p.Images {
+				if imageMatches(pattern, c.Image) {
+					profile, found = p, true
+					profile.container = c.Name
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if annotated && !found && len(containers) > 0 {
+			// the annotation applies the profile whatever the image
+			profile, found = p, true
+			profile.container = containers[0].Name
+		}
+		if found {
+			break
+		}
+	}
+	if annotated && !found {
+		logrus.Warnf("%s asks for the unknown profile %q, restarting it", w, name)
+		return appProfile{}, false
+	}
+	if !found {
+		profile = appProfile{Name: "custom"}
+		if len(containers) > 0 {
+			profile.container = containers[0].Name
+		}
+	}
+	if v := annotations[reloadStrategyAnnotation]; v != "" {
+		profile.Strategy = v
+	}
+	if v := annotations[reloadSignalAnnotation]; v != "" {
+		profile.Signal = strings.TrimPrefix(strings.ToUpper(v), "SIG")
+	}
+	if v := annotations[reloadPathAnnotation]; v != "" {
+		profile.Path = v
+	}
+	if v := annotations[reloadContainerAnnotation]; v != "" {
+		profile.container = v
+	}
+	if v := annotations[reloadPortAnnotation]; v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			logrus.Warnf("%s has an invalid %s annotation %q, restarting it", w, reloadPortAnnotation, v)
+			return appProfile{}, false
+		}
+		profile.Port = port
+	}
+	switch profile.Strategy {
+	case "signal":
+		if _, ok := signals[profile.Signal]; !ok {
+			logrus.Warnf("%s profile %s has the unsupported signal %q, restarting it", w, profile.Name, profile.Signal)
+			return appProfile{}, false
+		}
+	case "http":
+		if profile.Port <= 0 || profile.Path == "" {
+			logrus.Warnf("%s profile %s needs a port and a path, restarting it", w, profile.Name)
+			return appProfile{}, false
+		}
+	default:
+		return appProfile{}, false
+	}
+	if !mountedOnly(template.Spec, profile.container, src) {
+		src.log().Infof("%s consumes %s through env vars or subPath mounts, restarting it instead of a %s reload", w, src, profile.Name)
+		return appProfile{}, false
+	}
+	return profile, true
+}
+
+// mountedOnly tells if container consumes src only through volumes the kubelet updates in place
+func mountedOnly(spec corev1.PodSpec, container string, src Source) bool {
+	volumes := map[string]bool{}
+	for _, v := range spec.Volumes {
+		var inner corev1.PodSpec
+		inner.Volumes = []corev1.Volume{v}
+		if referencesSource(inner, src) {
+			volumes[v.Name] = true
+		}
+	}
+	for _, c := range spec.Containers {
+		if c.Name != container {
+			continue
+		}
+		single := corev1.PodSpec{Containers: []corev1.Container{{EnvFrom: c.EnvFrom, Env: c.Env}}}
+		if referencesSource(single, src) {
+			return false
+		}
+		for _, m := range c.VolumeMounts {
+			if volumes[m.Name] && m.SubPath != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// triggerInPlaceReload reloads the pods of w with profile once in-place-reload-delay passed, leaving the kubelet
+// time to update the mounted files. Pods failing to reload lead to a regular restart of the workload.
+func triggerInPlaceReload(src Source, w Workload, profile appProfile) bool {
+	delay := viper.GetDuration("in-place-reload-delay")
+	src.log().Infof("reloading %s in place with profile %s in %s, for %s", w, profile, delay, src)
+	go func() {
+		time.Sleep(delay)
+		pods, err := workloadPods(w)
+		if err == nil && len(pods) == 0 {
+			err = fmt.Errorf("no running pods")
+		}
+		for _, pod := range pods {
+			if err = reloadPod(pod, profile); err != nil {
+				err = fmt.Errorf("pod %s: %s", pod.Name, err)
+				break
+			}
+		}
+		ref := &corev1.ObjectReference{APIVersion: "apps/v1", Kind: w.Kind, Namespace: w.Namespace, Name: w.Name}
+		if err != nil {
+			src.log().Warnf("%s failed to reload %s in place with profile %s, restarting it", err, w, profile)
+			recordCorrelatedEvent(ref, src, corev1.EventTypeWarning, "InPlaceReloadFailed",
+				fmt.Sprintf("Reload with profile %s failed, restarting: %s", profile, err))
+			triggerRestart(src, w)
+			return
+		}
+		src.log().Infof("reloaded %d pods of %s in place with profile %s", len(pods), w, profile)
+		recordCorrelatedEvent(ref, src, corev1.EventTypeNormal, "ConfigReloaded",
+			fmt.Sprintf("Reloaded %d pods in place with profile %s for %s, correlation id %s", len(pods), profile, src, src.CorrelationID))
+	}()
+	return true
+}
+
+// workloadPods returns the running pods selected by w
+func workloadPods(w Workload) ([]corev1.Pod, error) {
+	client, err := workloadClient(w)
+	if err != nil {
+		return nil, err
+	}
+	apps := client.AppsV1()
+	var selector *metav1.LabelSelector
+	switch w.Kind {
+	case "Deployment":
+		d, err := apps.Deployments(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = d.Spec.Selector
+	case "StatefulSet":
+		s, err := apps.StatefulSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = s.Spec.Selector
+	case "DaemonSet":
+		d, err := apps.DaemonSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		selector = d.Spec.Selector
+	default:
+		return nil, fmt.Errorf("unsupported workload kind %s", w.Kind)
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.CoreV1().Pods(w.Namespace).List(context.Background(), metav1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, pod := range list.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func reloadPod(pod corev1.Pod, profile appProfile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if profile.Strategy == "http" {
+		url := fmt.Sprintf("http://%s:%d%s", pod.Status.PodIP, profile.Port, profile.Path)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s responded with %s", url, resp.Status)
+		}
+		return nil
+	}
+	config, err := namespaceRESTConfig(pod.Namespace)
+	if err != nil {
+		return err
+	}
+	client, err := namespaceClient(pod.Namespace)
+	if err != nil {
+		return err
+	}
+	req := client.CoreV1().RESTClient().Post().Resource("pods").Namespace(pod.Namespace).Name(pod.Name).SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: profile.container,
+			Command:   []string{"kill", "-s", profile.Signal, "1"},
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- executor.Stream(remotecommand.StreamOptions{Stdout: &bytes.Buffer{}, Stderr: &stderr})
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"sync"
+	"time"
+)
+
+// targetNamespaceAnnotation on a ConfigMap or Secret redirects its rollout to another namespace
+const targetNamespaceAnnotation = "cre.cnvrg.io/target-namespace"
+
+// workloadResources are the apps/v1 and batch/v1 resources cre rolls out
+var workloadResources = []string{"deployments", "statefulsets", "daemonsets", "cronjobs"}
+
+// workloadGroup returns the API group of a workload resource
+func workloadGroup(resource string) string {
+	if resource == "cronjobs" {
+		return "batch"
+	}
+	return "apps"
+}
+
+// rolloutAccessTTL is how long the review of a namespace and workload resource is reused, so changes don't review it again
+const rolloutAccessTTL = time.Minute
+
+type rolloutAccess struct {
+	err      error
+	reviewed time.Time
+}
+
+var (
+	rolloutAccessMu sync.Mutex
+	// rolloutAccesses caches the reviews of canRollout by namespace and resource
+	rolloutAccesses = map[string]rolloutAccess{}
+)
+
+// canRollout checks with SelfSubjectAccessReviews that cre may list and patch the workload resource in ns,
+// other resources of ns are reviewed on their own. A failed review isn't cached.
+func canRollout(ns, resource string) error {
+	key := ns + "/" + resource
+	rolloutAccessMu.Lock()
+	cached, ok := rolloutAccesses[key]
+	rolloutAccessMu.Unlock()
+	if ok && time.Since(cached.reviewed) < rolloutAccessTTL {
+		return cached.err
+	}
+	var denied error
+	for _, verb := range []string{"list", "patch"} {
+		allowed, err := canI(ns, workloadGroup(resource), resource, verb)
+		if err != nil {
+			return fmt.Errorf("failed to review access to %s in namespace %s: %s", resource, ns, err)
+		}
+		if !allowed {
+			denied = fmt.Errorf("not allowed to %s %s in namespace %s", verb, resource, ns)
+			break
+		}
+	}
+	rolloutAccessMu.Lock()
+	rolloutAccesses[key] = rolloutAccess{err: denied, reviewed: time.Now()}
+	rolloutAccessMu.Unlock()
+	return denied
+}
+
+// canI reviews the verb on the resource, a resource/subresource like pods/exec reviews the subresource
+func canI(ns, group, resource, verb string) (bool, error) {
+	var subresource string
+	if i := strings.Index(resource, "/"); i >= 0 {
+		resource, subresource = resource[:i], resource[i+1:]
+	}
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   ns,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+				Verb:        verb,
+			},
+		},
+	}
+	review, err := clientset().AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), review, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
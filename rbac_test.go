@@ -0,0 +1,60 @@
+package main
+
+import (
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+// reviewer answers the SelfSubjectAccessReviews of cre, allowing the namespaces of allowed, and counts them
+func reviewer(t *testing.T, client *fake.Clientset, allowed ...string) *int {
+	t.Helper()
+	reviews := 0
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		for _, ns := range allowed {
+			if review.Spec.ResourceAttributes.Namespace == ns {
+				review.Status.Allowed = true
+			}
+		}
+		return true, review, nil
+	})
+	t.Cleanup(func() {
+		rolloutAccessMu.Lock()
+		rolloutAccesses = map[string]rolloutAccess{}
+		rolloutAccessMu.Unlock()
+	})
+	return &reviews
+}
+
+func TestCanRolloutIsCachedByResource(t *testing.T) {
+	reviews := reviewer(t, fakeClientset(t), "prod-apps")
+	if err := canRollout("prod-apps", "deployments"); err != nil {
+		t.Fatal(err)
+	}
+	if *reviews != 2 {
+		t.Fatalf("expected list and patch reviewed, got %d reviews", *reviews)
+	}
+	if err := canRollout("prod-apps", "deployments"); err != nil || *reviews != 2 {
+		t.Fatalf("expected the cached review, got %v after %d reviews", err, *reviews)
+	}
+	if err := canRollout("prod-apps", "statefulsets"); err != nil || *reviews != 4 {
+		t.Fatalf("expected StatefulSets reviewed on their own, got %v after %d reviews", err, *reviews)
+	}
+}
+
+func TestCanRolloutDenied(t *testing.T) {
+	reviews := reviewer(t, fakeClientset(t))
+	if err := canRollout("prod-apps", "deployments"); err == nil {
+		t.Fatal("expected the rollout denied")
+	}
+	if *reviews != 1 {
+		t.Fatalf("expected the review to stop at the denied list, got %d reviews", *reviews)
+	}
+	if err := canRollout("prod-apps", "deployments"); err == nil || *reviews != 1 {
+		t.Fatalf("expected the cached denial, got %v after %d reviews", err, *reviews)
+	}
+}
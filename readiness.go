@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sourceKinds are the informers /readyz waits for
+var sourceKinds = []string{"ConfigMap", "Secret"}
+
+var sourceSync = struct {
+	sync.Mutex
+	// expected is set by the controller, the other commands serving the probes have no informers to wait for
+	expected bool
+	// standby is set while a replica waits for the leadership, with nothing to sync
+	standby bool
+	// synced holds the HasSynced of the informers of each source kind, one per watched namespace
+	synced map[string][]cache.InformerSynced
+}{synced: map[string][]cache.InformerSynced{}}
+
+// expectSourceSync makes /readyz wait for the source informers, or for the leadership with standby
+func expectSourceSync(standby bool) {
+	sourceSync.Lock()
+	defer sourceSync.Unlock()
+	sourceSync.expected = true
+	sourceSync.standby = standby
+}
+
+// trackSourceSync registers the informers of kind, once they're all created so a partial set isn't ready
+func trackSourceSync(kind string, synced []cache.InformerSynced) {
+	sourceSync.Lock()
+	defer sourceSync.Unlock()
+	sourceSync.standby = false
+	sourceSync.synced[kind] = synced
+}
+
+// unsyncedSources returns the source kinds whose informers haven't synced yet
+func unsyncedSources() []string {
+	sourceSync.Lock()
+	defer sourceSync.Unlock()
+	if !sourceSync.expected || sourceSync.standby {
+		return nil
+	}
+	var unsynced []string
+	for _, kind := range sourceKinds {
+		synced, ok := sourceSync.synced[kind]
+		ready := ok
+		for _, hasSynced := range synced {
+			ready = ready && hasSynced()
+		}
+		if !ready {
+			unsynced = append(unsynced, kind)
+		}
+	}
+	return unsynced
+}
+
+// readyzHandler responds 200 once the ConfigMap and Secret caches are warm, 503 until then
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if unsynced := unsyncedSources(); len(unsynced) > 0 {
+		http.Error(w, fmt.Sprintf("waiting for the %s informers to sync", strings.Join(unsynced, " and ")), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
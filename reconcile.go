@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	observedMu sync.Mutex
+	// observedSources holds the hash of every data key of the watched sources as last seen
+	observedSources = map[string]map[string]string{}
+)
+
+// hashData hashes every value, so sources can be compared without keeping their content around
+func hashData(data map[string][]byte) map[string]string {
+	hashes := make(map[string]string, len(data))
+	for k, v := range data {
+		sum := sha256.Sum256(v)
+		hashes[k] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+func configMapData(data map[string]string) map[string][]byte {
+	m := make(map[string][]byte, len(data))
+	for k, v := range data {
+		m[k] = []byte(v)
+	}
+	return m
+}
+
+func sourceKey(kind, ns, name string) string {
+	return kind + " " + ns + "/" + name
+}
+
+// observeSource records the data hashes of a source and returns the ones seen before,
+// nil when the source wasn't seen yet
+func observeSource(key string, hashes map[string]string) map[string]string {
+	observedMu.Lock()
+	defer observedMu.Unlock()
+	last := observedSources[key]
+	observedSources[key] = hashes
+	return last
+}
+
+// forgetSource drops the data hashes of a deleted source, so a recreated one is observed anew
+// and the deleted one no longer pairs with its same-name counterpart
+func forgetSource(kind string, obj metav1.Object) {
+	observedMu.Lock()
+	defer observedMu.Unlock()
+	delete(observedSources, sourceKey(kind, obj.GetNamespace(), obj.GetName()))
+}
+
+// alreadyReconciled tells if the reconcile loop rolled out this change before the informer delivered it
+func alreadyReconciled(kind string, obj metav1.Object, data map[string][]byte) bool {
+	hashes := hashData(data)
+	last := observeSource(sourceKey(kind, obj.GetNamespace(), obj.GetName()), hashes)
+	if last != nil && reflect.DeepEqual(last, hashes) {
+		logrus.Infof("%s %s/%s change was already rolled out by the reconcile loop", kind, obj.GetNamespace(), obj.GetName())
+		return true
+	}
+	return false
+}
+
+// reconcile periodically lists the watched sources to catch changes the informers missed, e.g. during a watch gap.
+// Missed changes are rolled out through the rollout queue like any other change.
+func reconcile() {
+	interval := viper.GetDuration("reconcile-interval")
+	if interval <= 0 {
+		return
+	}
+	logrus.Infof("reconciling sources every %s", interval)
+	for range time.Tick(interval) {
+		reconcileSources()
+	}
+}
+
+func reconcileSources() {
+	opts := metav1.ListOptions{LabelSelector: matchSelector()}
+	for _, ns := range watchedNamespaces() {
+		cms, err := clientset().CoreV1().ConfigMaps(ns).List(context.Background(), opts)
+		if err != nil {
+			logrus.Errorf("%s failed to list ConfigMaps to reconcile", err)
+		} else {
+			for i := range cms.Items {
+				reconcileSource("ConfigMap", &cms.Items[i], configMapData(cms.Items[i].Data))
+			}
+		}
+		secrets, err := clientset().CoreV1().Secrets(ns).List(context.Background(), opts)
+		if err != nil {
+			logrus.Errorf("%s failed to list Secrets to reconcile", err)
+		} else {
+			for i := range secrets.Items {
+				reconcileSource("Secret", &secrets.Items[i], secrets.Items[i].Data)
+			}
+		}
+	}
+}
+
+func reconcileSource(kind string, obj metav1.Object, data map[string][]byte) {
+	hashes := hashData(data)
+	last := observeSource(sourceKey(kind, obj.GetNamespace(), obj.GetName()), hashes)
+	value, matched := matchValue(obj)
+	if last == nil || !matched || reflect.DeepEqual(last, hashes) || !ownedByWatchedParent(obj) {
+		return
+	}
+	logrus.Warnf("%s %s/%s changed without the informer noticing, rolling it out", kind, obj.GetNamespace(), obj.GetName())
+	src := Source{
+		Kind:            kind,
+		Namespace:       obj.GetNamespace(),
+		Name:            obj.GetName(),
+		UID:             obj.GetUID(),
+		TargetNamespace: obj.GetAnnotations()[targetNamespaceAnnotation],
+		ChangedKeys:     changedKeys(last, hashes),
+		CorrelationID:   string(uuid.NewUUID()),
+		MatchLabelValue: value,
+		GitSHA:          obj.GetAnnotations()[gitSHAAnnotation],
+		GitRepo:         obj.GetAnnotations()[gitRepoAnnotation],
+		Clusters:        sourceClusters(obj.GetAnnotations()),
+	}
+	rollout(src, src.MatchLabelValue)
+}
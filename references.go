@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podReferences returns the ConfigMaps and Secrets a pod spec consumes, through volumes,
+// projected volumes, envFrom and env valueFrom, of both containers and init containers
+func podReferences(spec corev1.PodSpec) (configMaps, secrets map[string]bool) {
+	configMaps, secrets = map[string]bool{}, map[string]bool{}
+	for _, v := range spec.Volumes {
+		if v.ConfigMap != nil {
+			configMaps[v.ConfigMap.Name] = true
+		}
+		if v.Secret != nil {
+			secrets[v.Secret.SecretName] = true
+		}
+		if v.Projected != nil {
+			for _, s := range v.Projected.Sources {
+				if s.ConfigMap != nil {
+					configMaps[s.ConfigMap.Name] = true
+				}
+				if s.Secret != nil {
+					secrets[s.Secret.Name] = true
+				}
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, c := range containers {
+		for _, from := range c.EnvFrom {
+			if from.ConfigMapRef != nil {
+				configMaps[from.ConfigMapRef.Name] = true
+			}
+			if from.SecretRef != nil {
+				secrets[from.SecretRef.Name] = true
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				configMaps[env.ValueFrom.ConfigMapKeyRef.Name] = true
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				secrets[env.ValueFrom.SecretKeyRef.Name] = true
+			}
+		}
+	}
+	return configMaps, secrets
+}
+
+// referencesSource tells if the pod spec consumes src
+func referencesSource(spec corev1.PodSpec, src Source) bool {
+	configMaps, secrets := podReferences(spec)
+	switch src.Kind {
+	case "ConfigMap":
+		return configMaps[src.Name]
+	case "Secret":
+		return secrets[src.Name]
+	}
+	return false
+}
+
+// unreferenced tells with require-reference if the labeled workload w doesn't consume src, so a label shared by
+// unrelated services doesn't restart all of them. Workloads of another namespace can't reference src, they're kept.
+func unreferenced(src Source, w Workload, spec corev1.PodSpec) bool {
+	if !viper.GetBool("require-reference") || (src.Kind != "ConfigMap" && src.Kind != "Secret") || w.Namespace != src.Namespace {
+		return false
+	}
+	if referencesSource(spec, src) {
+		return false
+	}
+	src.log().Warnf("%s is labeled like %s but doesn't reference it, not restarting it", w, src)
+	traceDecision(src, stageTargets, "unreferenced", &w, "labeled like %s, but its pod template doesn't reference it", src)
+	return true
+}
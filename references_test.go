@@ -0,0 +1,99 @@
+package main
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+var (
+	appConfig = Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}
+	appSecret = Source{Kind: "Secret", Namespace: "apps", Name: "app-secret"}
+)
+
+func TestPodReferences(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		spec corev1.PodSpec
+		refs []Source
+	}{
+		{"configmap volume", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}},
+		}}}}, []Source{appConfig}},
+		{"secret volume", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "app-secret"},
+		}}}}, []Source{appSecret}},
+		{"projected volume", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{
+			{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+			{Secret: &corev1.SecretProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "app-secret"}}},
+		}}}}}}, []Source{appConfig, appSecret}},
+		{"envFrom", corev1.PodSpec{Containers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-secret"}}},
+		}}}}, []Source{appConfig, appSecret}},
+		{"single key refs", corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{
+			{Name: "LEVEL", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}, Key: "level"}}},
+			{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app-secret"}, Key: "password"}}},
+			{Name: "PLAIN", Value: "app-config"},
+		}}}}, []Source{appConfig, appSecret}},
+		{"init container", corev1.PodSpec{InitContainers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+		}}}}, []Source{appConfig}},
+		{"another name", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "other-config"}},
+		}}}}, nil},
+		// a Secret of the name of the ConfigMap isn't a reference to the ConfigMap
+		{"another kind", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "app-config"},
+		}}}}, nil},
+	} {
+		referenced := map[string]bool{}
+		for _, src := range c.refs {
+			referenced[src.Kind] = true
+		}
+		for _, src := range []Source{appConfig, appSecret} {
+			if got := referencesSource(c.spec, src); got != referenced[src.Kind] {
+				t.Fatalf("%s: expected a reference to %s %v, got %v", c.name, src, referenced[src.Kind], got)
+			}
+		}
+	}
+}
+
+func referencingDeployment(name string, spec corev1.PodSpec) *appsv1.Deployment {
+	d := labeledDeployment("apps", name, "app")
+	d.Spec.Template.Spec = spec
+	return d
+}
+
+func TestOnlyReferencingWorkloadsRollOut(t *testing.T) {
+	fakeClientset(t,
+		referencingDeployment("mounted", corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}},
+		}}}}),
+		referencingDeployment("env", corev1.PodSpec{Containers: []corev1.Container{{EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+		}}}}),
+		referencingDeployment("key", corev1.PodSpec{Containers: []corev1.Container{{Env: []corev1.EnvVar{
+			{Name: "LEVEL", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}, Key: "level"}}},
+		}}}}),
+		referencingDeployment("unrelated", corev1.PodSpec{Containers: []corev1.Container{{Name: "web"}}}),
+	)
+	for _, c := range []struct {
+		require bool
+		want    int
+	}{{true, 3}, {false, 4}} {
+		setFlags(t, map[string]interface{}{"require-reference": c.require})
+		targets, err := matchingDeployments(appConfig, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(targets) != c.want {
+			t.Fatalf("require-reference %v: expected %d labeled Deployments restarted, got %v", c.require, c.want, targets)
+		}
+		for _, w := range targets {
+			if c.require && w.Name == "unrelated" {
+				t.Fatal("expected the labeled Deployment not referencing the ConfigMap skipped")
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+	"time"
+)
+
+var reloadEventsGVR = schema.GroupVersionResource{Group: "cre.cnvrg.io", Version: "v1alpha1", Resource: "reloadevents"}
+
+const reloadEventsPruneInterval = 10 * time.Minute
+
+// recordReloadEvent keeps a finished rollout of src as a ReloadEvent in the source namespace with record-reload-events,
+// a queryable history surviving log rotation. It's created in the background, failures are only logged.
+func recordReloadEvent(src Source, detectedAt time.Time, triggered, skipped []Workload, also []string) {
+	if !viper.GetBool("record-reload-events") {
+		return
+	}
+	targets := []interface{}{}
+	for _, group := range []struct {
+		outcome   string
+		workloads []Workload
+	}{{"triggered", triggered}, {"skipped", skipped}} {
+		for _, w := range group.workloads {
+			targets = append(targets, map[string]interface{}{"kind": w.Kind, "namespace": w.Namespace, "name": w.Name, "outcome": group.outcome})
+		}
+	}
+	spec := map[string]interface{}{
+		"source":        map[string]interface{}{"kind": src.Kind, "namespace": src.Namespace, "name": src.Name},
+		"changedKeys":   stringsToInterfaces(src.ChangedKeys),
+		"targets":       targets,
+		"triggered":     int64(len(triggered)),
+		"skipped":       int64(len(skipped)),
+		"correlationID": src.CorrelationID,
+		"detectedAt":    detectedAt.UTC().Format(time.RFC3339),
+		"finishedAt":    time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(also) > 0 {
+		spec["alsoCausedBy"] = stringsToInterfaces(also)
+	}
+	if steps := traceSteps(src.CorrelationID); len(steps) > 0 {
+		decisions := []interface{}{}
+		for _, step := range steps {
+			decision := map[string]interface{}{
+				"time":     step.Time.UTC().Format(time.RFC3339),
+				"stage":    step.Stage,
+				"decision": step.Decision,
+				"detail":   step.Detail,
+			}
+			if w := step.Workload; w != nil {
+				decision["workload"] = map[string]interface{}{"kind": w.Kind, "namespace": w.Namespace, "name": w.Name, "cluster": w.Cluster}
+			}
+			decisions = append(decisions, decision)
+		}
+		spec["decisions"] = decisions
+	}
+	event := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": reloadEventsGVR.GroupVersion().String(),
+		"kind":       "ReloadEvent",
+		"metadata": map[string]interface{}{
+			"generateName": strings.ToLower(src.Kind) + "-" + src.Name + "-",
+			"namespace":    src.Namespace,
+			"labels": map[string]interface{}{
+				"cre.cnvrg.io/source-kind": src.Kind,
+				"cre.cnvrg.io/source-name": src.Name,
+			},
+		},
+		"spec": spec,
+	}}
+	go func() {
+		if !resourceServed(reloadEventsGVR) {
+			logrus.Debugf("%s isn't served by the cluster, not recording the rollout of %s", reloadEventsGVR, src)
+			return
+		}
+		_, err := dynamicClient().Resource(reloadEventsGVR).Namespace(src.Namespace).Create(context.Background(), event, metav1.CreateOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to record ReloadEvent for %s", err, src)
+		}
+	}()
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	result := []interface{}{}
+	for _, v := range values {
+		result = append(result, v)
+	}
+	return result
+}
+
+// pruneReloadEvents deletes ReloadEvents older than reload-events-max-age, and the oldest
+// beyond reload-events-max-count per namespace, every reloadEventsPruneInterval
+func pruneReloadEvents() {
+	if !viper.GetBool("record-reload-events") {
+		return
+	}
+	for {
+		if resourceServed(reloadEventsGVR) {
+			pruneReloadEventsOnce(viper.GetDuration("reload-events-max-age"), viper.GetInt("reload-events-max-count"))
+		}
+		time.Sleep(reloadEventsPruneInterval)
+	}
+}
+
+func pruneReloadEventsOnce(maxAge time.Duration, maxCount int) {
+	client := dynamicClient().Resource(reloadEventsGVR)
+	byNamespace := map[string][]unstructured.Unstructured{}
+	// listed in each watched namespace, --namespaces only grants namespaced RBAC
+	for _, watchedNs := range watchedNamespaces() {
+		list, err := client.Namespace(watchedNs).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list ReloadEvents for pruning", err)
+			continue
+		}
+		for _, item := range list.Items {
+			byNamespace[item.GetNamespace()] = append(byNamespace[item.GetNamespace()], item)
+		}
+	}
+	for ns, events := range byNamespace {
+		// newest first
+		sort.Slice(events, func(i, j int) bool {
+			return events[i].GetCreationTimestamp().Time.After(events[j].GetCreationTimestamp().Time)
+		})
+		for i, event := range events {
+			expired := maxAge > 0 && time.Since(event.GetCreationTimestamp().Time) > maxAge
+			if !expired && (maxCount <= 0 || i < maxCount) {
+				continue
+			}
+			if err := client.Namespace(ns).Delete(context.Background(), event.GetName(), metav1.DeleteOptions{}); err != nil {
+				logrus.Errorf("%s failed to prune ReloadEvent %s/%s", err, ns, event.GetName())
+				continue
+			}
+			logrus.Debugf("pruned ReloadEvent %s/%s", ns, event.GetName())
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rolloutQueue holds the workloads to restart. Event and reconcile driven rollouts both go through it,
+// so they share the same concurrency, stagger and cooldown limits, and a workload queued
+// by several changes is restarted once for all of them.
+var rolloutQueue = workqueue.NewNamedDelayingQueue("rollouts")
+
+// kindQueues are the dedicated queues of source kinds given their own workers with configmap-workers
+// and secret-workers, so a flood of changes of one kind doesn't starve the other.
+// A workload queued from both is restarted by whichever gets to it first, for all pending changes.
+var kindQueues = map[string]workqueue.DelayingInterface{}
+
+var (
+	rolloutsMu sync.Mutex
+	// pendingBatches holds the batches waiting on each queued workload, the causes of its restart
+	pendingBatches = map[Workload][]*rolloutBatch{}
+	lastRestart    = map[Workload]time.Time{}
+	nextStart      time.Time
+	// workloadPolicies holds the ReloadPolicy which last queued each workload, for its cooldown and windows
+	workloadPolicies = map[Workload]*reloadPolicy{}
+)
+
+// rolloutWorkers tracks the running workers, the shutdown waits for their in-flight rollouts
+var rolloutWorkers sync.WaitGroup
+
+// rolloutBatch collects the targets restarted for a single source change,
+// reported in one triggered event once all of them were processed
+type rolloutBatch struct {
+	src       Source
+	mu        sync.Mutex
+	remaining int
+	targets   []Workload
+	skipped   []Workload
+	queued    time.Time
+	// alsoCausedBy holds the other sources restarting the same workloads
+	alsoCausedBy map[string]bool
+}
+
+func enqueueRollouts(src Source, workloads []Workload) {
+	if len(workloads) == 0 {
+		return
+	}
+	queueBatch(newRolloutBatch(src, len(workloads)), workloads)
+}
+
+// newRolloutBatch returns the batch of the n targets of the change of src
+func newRolloutBatch(src Source, n int) *rolloutBatch {
+	return &rolloutBatch{src: src, remaining: n, queued: time.Now()}
+}
+
+// queueBatch queues workloads for the rollout of batch. They may be only part of its targets,
+// enqueueInKindOrder queues the targets of a change kind by kind in a single batch so it's reported once.
+func queueBatch(batch *rolloutBatch, workloads []Workload) {
+	src := batch.src
+	if !leading() {
+		src.log().Warnf("not the leader, dropping the rollout of %d workloads for %s", len(workloads), src)
+		return
+	}
+	rolloutsMu.Lock()
+	for _, w := range workloads {
+		if len(pendingBatches[w]) > 0 {
+			src.log().Infof("%s is already queued for a rollout, merging the change of %s into it", w, src)
+		}
+		pendingBatches[w] = append(pendingBatches[w], batch)
+		if src.Policy != nil {
+			workloadPolicies[w] = src.Policy
+		} else {
+			delete(workloadPolicies, w)
+		}
+	}
+	rolloutsMu.Unlock()
+	reportPendingRollouts()
+	delay := pairDelay(src)
+	// A workload already waiting keeps its earlier deadline, later changes of other sources merge into its restart
+	if window := viper.GetDuration("coalesce-window"); window > delay {
+		delay = window
+	}
+	queue := queueFor(src.Kind)
+	for _, w := range workloads {
+		queue.AddAfter(w, delay)
+	}
+}
+
+// pairDelay holds back the rollout of a ConfigMap or Secret by pair-window when a source of the other kind
+// has the same name, a deploy usually changes both and their workloads should restart once for the two changes
+func pairDelay(src Source) time.Duration {
+	var other string
+	switch src.Kind {
+	case "ConfigMap":
+		other = "Secret"
+	case "Secret":
+		other = "ConfigMap"
+	default:
+		return 0
+	}
+	observedMu.Lock()
+	_, paired := observedSources[sourceKey(other, src.Namespace, src.Name)]
+	observedMu.Unlock()
+	if !paired {
+		return 0
+	}
+	return viper.GetDuration("pair-window")
+}
+
+func (b *rolloutBatch) done(w Workload, triggered bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining--
+	recordSpokeRollout(w, triggered)
+	if triggered {
+		b.targets = append(b.targets, w)
+		lifetime.rollout(time.Since(b.queued))
+		rolloutDuration.WithLabelValues(w.Kind).Observe(time.Since(b.queued).Seconds())
+	} else {
+		b.skipped = append(b.skipped, w)
+	}
+	if b.remaining > 0 {
+		return
+	}
+	var also []string
+	for cause := range b.alsoCausedBy {
+		also = append(also, cause)
+	}
+	also = mergeKeys(also, nil)
+	recordReloadEvent(b.src, b.queued, b.targets, b.skipped, also)
+	auditRollout(b.src, b.targets, b.skipped)
+	if len(b.targets) == 0 {
+		recordPolicyRollout(b.src, nil)
+		return
+	}
+	notify(RolloutEvent{Type: EventRolloutTriggered, Source: b.src, Targets: b.targets, Outcome: "triggered"})
+	recordRolloutEvent(b.src, b.targets, also)
+	recordPolicyRollout(b.src, b.targets)
+	if b.src.Certificate != nil {
+		certificateRollouts.WithLabelValues(b.src.Namespace, b.src.Certificate.Name).Inc()
+	}
+}
+
+// startRolloutWorkers starts max-concurrent-rollouts workers restarting queued workloads,
+// plus the dedicated workers of source kinds set with configmap-workers and secret-workers.
+// Once ctx is done the queues are shut down, the workers finish the rollouts ready to start and exit,
+// the ones still waiting on a delay are dropped.
+func startRolloutWorkers(ctx context.Context) {
+	workers := viper.GetInt("max-concurrent-rollouts")
+	if workers <= 0 {
+		workers = 1
+	}
+	startWorkers(rolloutQueue, workers)
+	for pool, param := range map[string]string{"ConfigMap": "configmap-workers", "Secret": "secret-workers"} {
+		if n := viper.GetInt(param); n > 0 {
+			logrus.Infof("rollouts caused by %s changes get %d dedicated workers", pool, n)
+			kindQueues[pool] = workqueue.NewNamedDelayingQueue(strings.ToLower(pool) + "-rollouts")
+			startWorkers(kindQueues[pool], n)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		rolloutQueue.ShutDown()
+		for _, queue := range kindQueues {
+			queue.ShutDown()
+		}
+	}()
+}
+
+func startWorkers(queue workqueue.DelayingInterface, workers int) {
+	for i := 0; i < workers; i++ {
+		rolloutWorkers.Add(1)
+		go func() {
+			defer rolloutWorkers.Done()
+			for processNextRollout(queue) {
+			}
+		}()
+	}
+}
+
+// drainRolloutWorkers waits for the workers to exit after the shutdown, false if they didn't within timeout
+func drainRolloutWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		rolloutWorkers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// queueFor returns the queue of rollouts caused by a source of kind, the kinds backed by Secrets,
+// e.g. SecretProviderClass, share the Secret workers
+func queueFor(kind string) workqueue.DelayingInterface {
+	pool := "Secret"
+	if kind == "ConfigMap" {
+		pool = "ConfigMap"
+	}
+	if queue, ok := kindQueues[pool]; ok {
+		return queue
+	}
+	return rolloutQueue
+}
+
+// requeueParked queues w again for its pending changes, e.g. once its namespace was resumed
+func requeueParked(w Workload) {
+	if !leading() {
+		return
+	}
+	rolloutsMu.Lock()
+	batches := pendingBatches[w]
+	rolloutsMu.Unlock()
+	if len(batches) == 0 {
+		return
+	}
+	queueFor(batches[0].src.Kind).Add(w)
+}
+
+func processNextRollout(queue workqueue.DelayingInterface) bool {
+	item, shutdown := queue.Get()
+	if shutdown {
+		return false
+	}
+	defer queue.Done(item)
+	w := item.(Workload)
+	if wait := cooldownLeft(w); wait > 0 {
+		rolloutLog(w).Infof("%s was restarted less than %s ago, delaying its rollout by %s", w, tunableDuration("rollout-cooldown"), wait.Round(time.Second))
+		traceWorkload(w, stageQueue, "delayed", "within its rollout cooldown, delayed by %s", wait.Round(time.Second))
+		queue.AddAfter(w, wait)
+		return true
+	}
+	if wait := windowWait(policyWindows(w), time.Now()); wait > 0 {
+		rolloutLog(w).Infof("%s is outside the rollout windows of its ReloadPolicy, delaying its rollout by %s", w, wait.Round(time.Second))
+		traceWorkload(w, stageQueue, "delayed", "outside the rollout windows of its ReloadPolicy, delayed by %s", wait.Round(time.Second))
+		queue.AddAfter(w, wait)
+		return true
+	}
+	if paused(w.Namespace) {
+		rolloutLog(w).Infof("rollouts of namespace %s are paused, %s stays queued until resumed", w.Namespace, w)
+		traceWorkload(w, stageQueue, "parked", "rollouts of namespace %s are paused, queued until resumed", w.Namespace)
+		park(w)
+		return true
+	}
+	if breakerHolds() {
+		rolloutLog(w).Infof("the circuit breaker is open, %s stays queued until resumed", w)
+		traceWorkload(w, stageQueue, "parked", "the mass-change circuit breaker is open, queued until resumed")
+		park(w)
+		return true
+	}
+	if rolloutsDisabled() {
+		rolloutLog(w).Infof("rollouts are disabled by the control ConfigMap, %s stays queued until enabled", w)
+		traceWorkload(w, stageQueue, "parked", "rollouts are disabled by the control ConfigMap, queued until enabled")
+		park(w)
+		return true
+	}
+	// the approval requeues the workload, a rejection drops its pending changes
+	if awaitingApproval(w) {
+		return true
+	}
+	rolloutsMu.Lock()
+	batches := pendingBatches[w]
+	rolloutsMu.Unlock()
+	if len(batches) > 0 {
+		if wait := capacityWait(batches[0].src, w); wait > 0 {
+			queue.AddAfter(w, wait)
+			return true
+		}
+	}
+	rolloutsMu.Lock()
+	batches = pendingBatches[w]
+	delete(pendingBatches, w)
+	rolloutsMu.Unlock()
+	defer reportPendingRollouts()
+	if len(batches) == 0 {
+		return true
+	}
+	src := batches[0].src
+	if len(batches) > 1 {
+		var causes []string
+		for _, b := range batches {
+			causes = append(causes, b.src.String())
+		}
+		src.log().Infof("restarting %s once for %s", w, strings.Join(causes, ", "))
+		for _, cause := range mergeKeys(causes, nil) {
+			if cause != src.String() {
+				src.CoalescedWith = append(src.CoalescedWith, cause)
+			}
+		}
+		for _, b := range batches {
+			b.mu.Lock()
+			if b.alsoCausedBy == nil {
+				b.alsoCausedBy = map[string]bool{}
+			}
+			for _, other := range batches {
+				if other != b && other.src.String() != b.src.String() {
+					b.alsoCausedBy[other.src.String()] = true
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+	waitForStagger()
+	// A workload restarted for several changes is patched once, attributed to the first of them
+	triggered := stillTarget(src, w) && triggerRollout(src, w)
+	if triggered {
+		rolloutsMu.Lock()
+		lastRestart[w] = time.Now()
+		rolloutsMu.Unlock()
+	}
+	for _, b := range batches {
+		b.done(w, triggered)
+	}
+	return true
+}
+
+// rolloutLog returns the logger of the first change queued for w, tagging its lines with its correlation id
+func rolloutLog(w Workload) *logrus.Entry {
+	rolloutsMu.Lock()
+	defer rolloutsMu.Unlock()
+	if batches := pendingBatches[w]; len(batches) > 0 {
+		return batches[0].src.log()
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// stillTarget re-reads the workload right before patching it with verify-targets, as it was matched
+// when the change was queued and may have been deleted or relabeled meanwhile, e.g. while waiting on a cooldown
+func stillTarget(src Source, w Workload) bool {
+	if !viper.GetBool("verify-targets") {
+		return true
+	}
+	obj, template, err := getWorkload(w)
+	reason := ""
+	switch {
+	case apierrors.IsNotFound(err):
+		reason = "it was deleted"
+	case err != nil:
+		// Let the patch itself report the error
+		return true
+	case obj.GetDeletionTimestamp() != nil:
+		reason = "it is being deleted"
+	case !matchesSource(src, w, obj, template):
+		reason = "it no longer matches"
+	default:
+		return true
+	}
+	src.log().Infof("skipping rollout of %s since it was matched for %s, %s", w, src, reason)
+	notify(RolloutEvent{Type: EventRolloutSkipped, Source: src, Targets: []Workload{w}, Outcome: "skipped", Error: reason})
+	return false
+}
+
+// matchesSource tells if the current state of the workload still selects it for src,
+// by the ReloadPolicy of src, the match label or annotation, its references with auto discovery or stakater annotations. Spoke workloads are only matched by the label.
+// A workload opted out meanwhile no longer matches, unless a ReloadPolicy names it, nor does one relabeled with another value.
+func matchesSource(src Source, w Workload, obj metav1.Object, template *corev1.PodTemplateSpec) bool {
+	if src.Policy != nil && w.Cluster == "" {
+		for _, ref := range src.Policy.targets {
+			if refMatches(ref, w.Kind, w.Name, obj.GetLabels()) {
+				return true
+			}
+		}
+		return false
+	}
+	if optedOut(src, w, obj.GetAnnotations()) {
+		return false
+	}
+	if value, ok := matchValue(obj); ok && !src.Unlabeled && (src.MatchLabelValue == "" || value == src.MatchLabelValue) {
+		return true
+	}
+	if _, ok := sourceReference(template.Spec, src); ok {
+		return true
+	}
+	return viper.GetBool("stakater-compat") && stakaterTriggers(obj.GetAnnotations(), template.Spec, src)
+}
+
+// cooldownLeft returns how long the workload has to wait until rollout-cooldown, or the cooldown
+// of its ReloadPolicy, passed since its last restart
+func cooldownLeft(w Workload) time.Duration {
+	rolloutsMu.Lock()
+	defer rolloutsMu.Unlock()
+	cooldown := tunableDuration("rollout-cooldown")
+	if p := workloadPolicies[w]; p != nil && p.cooldown > 0 {
+		cooldown = p.cooldown
+	}
+	if cooldown <= 0 {
+		return 0
+	}
+	last, ok := lastRestart[w]
+	if !ok {
+		return 0
+	}
+	return cooldown - time.Since(last)
+}
+
+func policyWindows(w Workload) []rolloutWindow {
+	rolloutsMu.Lock()
+	defer rolloutsMu.Unlock()
+	if p := workloadPolicies[w]; p != nil {
+		return p.windows
+	}
+	return nil
+}
+
+// waitForStagger spaces out the start of successive rollouts by rollout-stagger, across all workers,
+// or by breaker-drain-interval if longer while the rollouts held by the circuit breaker drain
+func waitForStagger() {
+	stagger := tunableDuration("rollout-stagger")
+	if drain := drainInterval(); drain > stagger {
+		stagger = drain
+	}
+	if stagger <= 0 {
+		return
+	}
+	rolloutsMu.Lock()
+	now := time.Now()
+	start := nextStart
+	if start.Before(now) {
+		start = now
+	}
+	nextStart = start.Add(stagger)
+	rolloutsMu.Unlock()
+	time.Sleep(time.Until(start))
+}
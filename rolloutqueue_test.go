@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// patchRecorder records the Deployment patches sent through client
+type patchRecorder struct {
+	mu      sync.Mutex
+	patches [][]byte
+}
+
+func recordPatches(client *fake.Clientset) *patchRecorder {
+	recorder := &patchRecorder{}
+	client.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		recorder.patches = append(recorder.patches, action.(k8stesting.PatchAction).GetPatch())
+		return false, nil, nil
+	})
+	return recorder
+}
+
+func (r *patchRecorder) recorded() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]byte(nil), r.patches...)
+}
+
+// templateAnnotations returns the pod template annotations set by a restart patch
+func templateAnnotations(t *testing.T, patch []byte) map[string]string {
+	t.Helper()
+	var restart struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(patch, &restart); err != nil {
+		t.Fatalf("%s failed to parse the restart patch %s", err, patch)
+	}
+	return restart.Spec.Template.Metadata.Annotations
+}
+
+// waitQueued waits for n rollouts to be ready in the queue of cre
+func waitQueued(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for rolloutQueue.Len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d rollouts ready, got %d", n, rolloutQueue.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPairedSourcesRestartOnce(t *testing.T) {
+	client := fakeClientset(t, labeledDeployment("apps", "paired", "app"))
+	patches := recordPatches(client)
+	events := fakeRecorder(t)
+	setFlags(t, map[string]interface{}{"pair-window": 50 * time.Millisecond, "preflight-dry-run": false})
+	for _, kind := range []string{"ConfigMap", "Secret"} {
+		key := sourceKey(kind, "apps", "app")
+		observeSource(key, hashData(nil))
+		t.Cleanup(func() {
+			observedMu.Lock()
+			delete(observedSources, key)
+			observedMu.Unlock()
+		})
+	}
+	paired := Workload{Kind: "Deployment", Namespace: "apps", Name: "paired"}
+	cm := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app", CorrelationID: "cm"}
+	secret := Source{Kind: "Secret", Namespace: "apps", Name: "app", CorrelationID: "secret"}
+	if pairDelay(cm) == 0 || pairDelay(secret) == 0 {
+		t.Fatal("expected the same-name ConfigMap and Secret held back by pair-window")
+	}
+	enqueueRollouts(cm, []Workload{paired})
+	enqueueRollouts(secret, []Workload{paired})
+	waitQueued(t, 1)
+	processQueuedRollouts(t)
+	recorded := patches.recorded()
+	if len(recorded) != 1 {
+		t.Fatalf("expected a single restart for both changes, got %d patches", len(recorded))
+	}
+	if causes := templateAnnotations(t, recorded[0])[triggeredByAnnotation]; causes != "ConfigMap apps/app, Secret apps/app" {
+		t.Fatalf("expected the restart triggered by both sources, got %q", causes)
+	}
+	var together []string
+	for _, event := range recordedEvents(events) {
+		if strings.Contains(event, "together with") {
+			together = append(together, event)
+		}
+	}
+	if len(together) != 2 || !strings.Contains(together[0], "together with Secret apps/app") || !strings.Contains(together[1], "together with ConfigMap apps/app") {
+		t.Fatalf("expected the events of both sources to name the other one, got %v", together)
+	}
+}
+
+func TestNearSimultaneousTriggersRestartOnce(t *testing.T) {
+	sources := []Source{
+		{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", CorrelationID: "cm"},
+		{Kind: "Secret", Namespace: "apps", Name: "app-credentials", CorrelationID: "secret"},
+		{Kind: "ConfigMap", Namespace: "apps", Name: "feature-flags", CorrelationID: "flags"},
+	}
+	for _, triggers := range []int{2, 3} {
+		t.Run(fmt.Sprintf("%d triggers", triggers), func(t *testing.T) {
+			name := fmt.Sprintf("coalesced-%d", triggers)
+			client := fakeClientset(t, labeledDeployment("apps", name, "app"))
+			patches := recordPatches(client)
+			events := fakeRecorder(t)
+			setFlags(t, map[string]interface{}{"coalesce-window": 50 * time.Millisecond, "pair-window": time.Duration(0), "preflight-dry-run": false})
+			coalesced := Workload{Kind: "Deployment", Namespace: "apps", Name: name}
+			var causes []string
+			for _, src := range sources[:triggers] {
+				enqueueRollouts(src, []Workload{coalesced})
+				causes = append(causes, src.String())
+			}
+			waitQueued(t, 1)
+			processQueuedRollouts(t)
+			recorded := patches.recorded()
+			if len(recorded) != 1 {
+				t.Fatalf("expected a single restart for %d triggers, got %d patches", triggers, len(recorded))
+			}
+			if got, want := templateAnnotations(t, recorded[0])[triggeredByAnnotation], strings.Join(mergeKeys(causes, nil), ", "); got != want {
+				t.Fatalf("expected the restart triggered by %q, got %q", want, got)
+			}
+			var together int
+			for _, event := range recordedEvents(events) {
+				if strings.Contains(event, "together with") {
+					together++
+				}
+			}
+			if together != triggers {
+				t.Fatalf("expected the event of each of the %d sources to name the others, got %v", triggers, recordedEvents(events))
+			}
+		})
+	}
+}
+
+func TestStaleTargetsAreSkipped(t *testing.T) {
+	relabeled := labeledDeployment("apps", "relabeled", "other")
+	deleting := labeledDeployment("apps", "deleting", "app")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	optedOut := labeledDeployment("apps", "opted-out", "app")
+	optedOut.Annotations = map[string]string{"cre.cnvrg.io/skip-rollout": "true"}
+	fakeClientset(t, relabeled, deleting, optedOut, labeledDeployment("apps", "web", "app"))
+	setFlags(t, map[string]interface{}{"verify-targets": true})
+	notifier := &fakeNotifier{name: "fake"}
+	fakeNotifiers(t, notifier)
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", MatchLabelValue: "app"}
+	reasons := map[string]string{
+		"gone":      "it was deleted",
+		"deleting":  "it is being deleted",
+		"opted-out": "it no longer matches",
+		"relabeled": "it no longer matches",
+	}
+	for name, reason := range reasons {
+		if stillTarget(src, Workload{Kind: "Deployment", Namespace: "apps", Name: name}) {
+			t.Fatalf("expected the stale Deployment %s skipped as %s", name, reason)
+		}
+	}
+	if !stillTarget(src, Workload{Kind: "Deployment", Namespace: "apps", Name: "web"}) {
+		t.Fatal("expected the Deployment still labeled a target")
+	}
+	drainNotifiers(time.Second)
+	skipped := map[string]string{}
+	for _, event := range notifier.delivered() {
+		skipped[event.Targets[0].Name] = event.Error
+	}
+	for name, reason := range reasons {
+		if skipped[name] != reason {
+			t.Fatalf("expected %s notified as skipped since %s, got %q", name, reason, skipped[name])
+		}
+	}
+}
+
+func TestDeletedTargetIsNotPatched(t *testing.T) {
+	// the Deployment was matched, then deleted while its rollout was queued
+	client := fakeClientset(t)
+	patches := patchCounter(client, false)
+	setFlags(t, map[string]interface{}{"verify-targets": true, "pair-window": time.Duration(0), "preflight-dry-run": false})
+	enqueueRollouts(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, []Workload{{Kind: "Deployment", Namespace: "apps", Name: "gone"}})
+	processQueuedRollouts(t)
+	if *patches != 0 {
+		t.Fatalf("expected the deleted Deployment skipped, got %d patches", *patches)
+	}
+}
+
+func TestTargetsAreNotVerifiedWhenDisabled(t *testing.T) {
+	fakeClientset(t)
+	setFlags(t, map[string]interface{}{"verify-targets": false})
+	if !stillTarget(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, Workload{Kind: "Deployment", Namespace: "apps", Name: "gone"}) {
+		t.Fatal("expected the workload not verified without verify-targets")
+	}
+}
+
+// secretWorkers gives the rollouts caused by Secrets a dedicated worker for the test, as secret-workers does
+func secretWorkers(t *testing.T) {
+	t.Helper()
+	queue := workqueue.NewNamedDelayingQueue("secret-rollouts-test")
+	kindQueues["Secret"] = queue
+	startWorkers(queue, 1)
+	t.Cleanup(func() {
+		queue.ShutDown()
+		delete(kindQueues, "Secret")
+	})
+}
+
+func TestKindsAreQueuedApart(t *testing.T) {
+	secretWorkers(t)
+	if queueFor("Secret") == rolloutQueue || queueFor("SecretProviderClass") != queueFor("Secret") {
+		t.Fatal("expected the Secret backed kinds queued for the Secret workers")
+	}
+	if queueFor("ConfigMap") != rolloutQueue {
+		t.Fatal("expected the ConfigMaps queued for the shared workers without configmap-workers")
+	}
+}
+
+func TestSecretRolloutsProceedUnderConfigMapLoad(t *testing.T) {
+	var objects []runtime.Object
+	var flood []Workload
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("flooded-%d", i)
+		objects = append(objects, labeledDeployment("apps", name, "app"))
+		flood = append(flood, Workload{Kind: "Deployment", Namespace: "apps", Name: name})
+	}
+	client := fakeClientset(t, append(objects, labeledDeployment("apps", "certs", "app"))...)
+	patches := recordPatches(client)
+	setFlags(t, map[string]interface{}{"pair-window": time.Duration(0), "preflight-dry-run": false})
+	secretWorkers(t)
+	// nothing works the ConfigMap queue, as if its workers were busy
+	enqueueRollouts(Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config"}, flood)
+	enqueueRollouts(Source{Kind: "Secret", Namespace: "apps", Name: "tls"}, []Workload{{Kind: "Deployment", Namespace: "apps", Name: "certs"}})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(patches.recorded()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the Secret rollout waited on the ConfigMap ones")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queued := rolloutQueue.Len(); queued != len(flood) {
+		t.Fatalf("expected the ConfigMap rollouts still queued, got %d", queued)
+	}
+	processQueuedRollouts(t)
+	if restarted := len(patches.recorded()); restarted != len(flood)+1 {
+		t.Fatalf("expected every workload restarted once, got %d patches", restarted)
+	}
+}
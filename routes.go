@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"path"
+	"strings"
+)
+
+// dropRoute is the notifier of routes sending nothing
+const dropRoute = "drop"
+
+// notificationRoute is a routing rule of the config file, selecting the notifiers of the events it matches.
+// Empty matchers match everything, matchers with several values match any of them.
+type notificationRoute struct {
+	Name        string   `mapstructure:"name"`
+	Namespaces  []string `mapstructure:"namespaces"`
+	Events      []string `mapstructure:"events"`
+	Outcomes    []string `mapstructure:"outcomes"`
+	LabelValues []string `mapstructure:"labelValues"`
+	Notifiers   []string `mapstructure:"notifiers"`
+}
+
+// defaultRoute applies when no rule matches, it sends to all notifiers like without routing
+var defaultRoute = notificationRoute{Name: "default"}
+
+var routes []notificationRoute
+
+var routesCmd = &cobra.Command{
+	Use:   "routes",
+	Short: "inspect the notification routing rules",
+}
+
+// routesTestCmd prints the rule and notifiers an event would hit, without sending anything
+var routesTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "print which routing rule and notifiers a hypothetical event would hit",
+	Run: func(cmd *cobra.Command, args []string) {
+		loaded, err := loadRoutes()
+		if err != nil {
+			logrus.Fatalf("%s, invalid routes in the config file", err)
+		}
+		routes = loaded
+		ns, _ := cmd.Flags().GetString("namespace")
+		eventName, _ := cmd.Flags().GetString("event")
+		outcome, _ := cmd.Flags().GetString("outcome")
+		labelValue, _ := cmd.Flags().GetString("label-value")
+		eventType := EventType(eventName)
+		if outcome == "" {
+			outcome = strings.TrimPrefix(string(eventType), "rollout-")
+		}
+		event := RolloutEvent{
+			Type:    eventType,
+			Source:  Source{Namespace: ns, MatchLabelValue: labelValue},
+			Outcome: outcome,
+		}
+		i, route := routeFor(event)
+		if i < 0 {
+			fmt.Fprintf(os.Stdout, "rule: %s (no rule matches)\n", route.Name)
+		} else {
+			fmt.Fprintf(os.Stdout, "rule: #%d %s\n", i+1, route.Name)
+		}
+		switch {
+		case route.drops():
+			fmt.Fprintln(os.Stdout, "notifiers: none, dropped")
+		case len(route.Notifiers) == 0:
+			fmt.Fprintln(os.Stdout, "notifiers: all configured ones")
+		default:
+			fmt.Fprintf(os.Stdout, "notifiers: %s\n", strings.Join(route.Notifiers, ", "))
+		}
+		fmt.Fprintln(os.Stdout, "the namespaces, events and severity filters of each notifier still apply")
+	},
+}
+
+// setupRoutesTestFlags adds the flags describing the event of routes test. They're local to the command
+// and not bound to viper, where the names would be shared with the params of the other commands.
+func setupRoutesTestFlags() {
+	flags := routesTestCmd.Flags()
+	flags.String("namespace", "default", "namespace of the hypothetical event")
+	flags.String("event", string(EventRolloutFailed), "type of the hypothetical event, e.g. rollout-failed")
+	flags.String("outcome", "", "outcome of the hypothetical event, defaults to the one of its type")
+	flags.String("label-value", "", "match label value of the source of the hypothetical event")
+}
+
+// loadRoutes reads and validates the routes of the config file
+func loadRoutes() ([]notificationRoute, error) {
+	var loaded []notificationRoute
+	if err := viper.UnmarshalKey("routes", &loaded); err != nil {
+		return nil, err
+	}
+	for i := range loaded {
+		r := &loaded[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("routes[%d]", i)
+		}
+		if len(r.Notifiers) == 0 {
+			return nil, fmt.Errorf("route %s selects no notifiers, use [%s] to send nothing", r.Name, dropRoute)
+		}
+		for _, n := range r.Notifiers {
+			if n == dropRoute && len(r.Notifiers) > 1 {
+				return nil, fmt.Errorf("route %s mixes %s with notifiers", r.Name, dropRoute)
+			}
+			if _, ok := notifierBackends[strings.SplitN(n, "-", 2)[0]]; !ok && n != dropRoute {
+				return nil, fmt.Errorf("route %s selects the unknown notifier %q", r.Name, n)
+			}
+		}
+		for _, e := range r.Events {
+			switch EventType(e) {
+			case EventRolloutMatched, EventRolloutTriggered, EventRolloutCompleted, EventRolloutFailed, EventRolloutStuck, EventRolloutSkipped, EventBreakerTripped, EventRolloutPendingApproval:
+			default:
+				return nil, fmt.Errorf("route %s matches the unknown event %q", r.Name, e)
+			}
+		}
+		for _, pattern := range r.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %s has the invalid namespace pattern %q", r.Name, pattern)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+func setupRoutes() {
+	loaded, err := loadRoutes()
+	if err != nil {
+		logrus.Fatalf("%s, invalid routes in the config file", err)
+	}
+	routes = loaded
+	if len(routes) > 0 {
+		logrus.Infof("routing notifications with %d rules", len(routes))
+	}
+}
+
+// routeFor returns the first route matching event and its index, the default route and -1 when none does
+func routeFor(event RolloutEvent) (int, notificationRoute) {
+	for i, r := range routes {
+		if r.matches(event) {
+			return i, r
+		}
+	}
+	return -1, defaultRoute
+}
+
+func (r notificationRoute) matches(event RolloutEvent) bool {
+	return matchesValue(r.Events, string(event.Type), false) &&
+		matchesValue(r.Outcomes, event.Outcome, false) &&
+		matchesValue(r.LabelValues, event.Source.MatchLabelValue, false) &&
+		matchesValue(r.Namespaces, event.Source.Namespace, true)
+}
+
+// matchesValue tells if value is any of values, or matches any of them as glob patterns, true when values is empty
+func matchesValue(values []string, value string, glob bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+		if ok, _ := path.Match(v, value); glob && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r notificationRoute) drops() bool {
+	return len(r.Notifiers) == 1 && r.Notifiers[0] == dropRoute
+}
+
+// selects tells if the route sends to the notifier called name
+func (r notificationRoute) selects(name string) bool {
+	if len(r.Notifiers) == 0 {
+		return true
+	}
+	return notifierSelected(r.Notifiers, name)
+}
+
+// notifierSelected tells if the notifier called name is any of selected, by its own name or its backend,
+// e.g. webhook selects all webhook-<host> notifiers
+func notifierSelected(selected []string, name string) bool {
+	for _, n := range selected {
+		if n == name || strings.HasPrefix(name, n+"-") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
+)
+
+var sealedSecretsGVR = schema.GroupVersionResource{Group: "bitnami.com", Version: "v1alpha1", Resource: "sealedsecrets"}
+
+var (
+	sealedSecretsMu    sync.Mutex
+	sealedSecretsStore customResourceInformers
+	// unsealPending holds the generation of SealedSecrets changed since their Secret was last rewritten
+	unsealPending = map[string]int64{}
+	// sealedRollouts holds the SealedSecret generation and time of the last rollout per Secret
+	sealedRollouts = map[string]sealedRollout{}
+)
+
+type sealedRollout struct {
+	generation int64
+	at         time.Time
+}
+
+// sealedSecretInformer watches SealedSecrets producing labeled Secrets, to report ones which fail to unseal.
+// Secrets don't change when unsealing fails, so without it nobody would notice.
+func sealedSecretInformer() {
+	if !viper.GetBool("watch-sealed-secrets") {
+		return
+	}
+	informer := watchCustomResource(sealedSecretsGVR, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldO := oldObj.(*unstructured.Unstructured)
+			newO := newObj.(*unstructured.Unstructured)
+			if !sealsWatchedSecret(newO) {
+				return
+			}
+			if newO.GetGeneration() != oldO.GetGeneration() {
+				expectUnseal(newO)
+			}
+			if msg, failed := unsealError(newO); failed {
+				if oldMsg, oldFailed := unsealError(oldO); !oldFailed || oldMsg != msg {
+					sealedSecretWarning(newO, "UnsealFailed", msg)
+				}
+			}
+		},
+	})
+	if informer == nil {
+		return
+	}
+	sealedSecretsMu.Lock()
+	sealedSecretsStore = informer
+	sealedSecretsMu.Unlock()
+	stopper := make(chan struct{})
+	defer close(stopper)
+	informer.Run(stopper)
+}
+
+// sealsWatchedSecret tells if the Secret templated by the SealedSecret carries the match label
+func sealsWatchedSecret(ss *unstructured.Unstructured) bool {
+	labels, _, _ := unstructured.NestedStringMap(ss.Object, "spec", "template", "metadata", "labels")
+	_, ok := labels[viper.GetString("match-label")]
+	return ok
+}
+
+// unsealError returns the message of a failed Synced condition
+func unsealError(ss *unstructured.Unstructured) (string, bool) {
+	status, _, msg, _ := statusCondition(ss, "Synced")
+	return msg, status == "False"
+}
+
+// expectUnseal waits for the Secret of a changed SealedSecret to be rewritten within sealed-secrets-unseal-timeout
+func expectUnseal(ss *unstructured.Unstructured) {
+	key := ss.GetNamespace() + "/" + ss.GetName()
+	generation := ss.GetGeneration()
+	sealedSecretsMu.Lock()
+	unsealPending[key] = generation
+	sealedSecretsMu.Unlock()
+	timeout := viper.GetDuration("sealed-secrets-unseal-timeout")
+	time.AfterFunc(timeout, func() {
+		sealedSecretsMu.Lock()
+		pending, ok := unsealPending[key]
+		if ok && pending == generation {
+			delete(unsealPending, key)
+		}
+		sealedSecretsMu.Unlock()
+		if ok && pending == generation {
+			sealedSecretWarning(ss, "UnsealTimeout", fmt.Sprintf("Secret wasn't rewritten within %s after the SealedSecret changed", timeout))
+		}
+	})
+}
+
+func sealedSecretWarning(ss *unstructured.Unstructured, reason, msg string) {
+	logrus.Warnf("SealedSecret %s/%s: %s", ss.GetNamespace(), ss.GetName(), msg)
+	sealedSecretWarnings.WithLabelValues(ss.GetNamespace(), reason).Inc()
+	recordEvent(&corev1.ObjectReference{
+		APIVersion: "bitnami.com/v1alpha1",
+		Kind:       "SealedSecret",
+		Namespace:  ss.GetNamespace(),
+		Name:       ss.GetName(),
+		UID:        ss.GetUID(),
+	}, corev1.EventTypeWarning, reason, msg)
+}
+
+// duplicateSealedChange marks the SealedSecret of s as unsealed and tells if s was already rolled out
+// for the same SealedSecret generation within sealed-secrets-dedup-window,
+// e.g. when the controller rewrites the Secret more than once for a single change
+func duplicateSealedChange(s *corev1.Secret) bool {
+	owner := metav1.GetControllerOf(s)
+	if owner == nil || owner.Kind != "SealedSecret" {
+		return false
+	}
+	sealedSecretsMu.Lock()
+	defer sealedSecretsMu.Unlock()
+	if sealedSecretsStore == nil {
+		return false
+	}
+	key := s.Namespace + "/" + owner.Name
+	delete(unsealPending, key)
+	obj, exists, _ := sealedSecretsStore.GetByKey(key)
+	if !exists {
+		return false
+	}
+	generation := obj.(*unstructured.Unstructured).GetGeneration()
+	last, ok := sealedRollouts[key]
+	if ok && last.generation == generation && time.Since(last.at) < viper.GetDuration("sealed-secrets-dedup-window") {
+		logrus.Infof("Secret %s/%s was already rolled out for generation %d of its SealedSecret, skipping", s.Namespace, s.Name, generation)
+		return true
+	}
+	sealedRollouts[key] = sealedRollout{generation: generation, at: time.Now()}
+	return false
+}
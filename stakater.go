@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+// Workload annotations of stakater/Reloader honored with --stakater-compat
+const (
+	stakaterAutoAnnotation            = "reloader.stakater.com/auto"
+	stakaterConfigMapAutoAnnotation   = "configmap.reloader.stakater.com/auto"
+	stakaterSecretAutoAnnotation      = "secret.reloader.stakater.com/auto"
+	stakaterConfigMapReloadAnnotation = "configmap.reloader.stakater.com/reload"
+	stakaterSecretReloadAnnotation    = "secret.reloader.stakater.com/reload"
+)
+
+// stakaterWorkloads returns the workloads in the namespace of src which stakater annotations ask for a restart on its change.
+// Workloads carrying the match label are left to cre's own matching, so its settings take precedence.
+func stakaterWorkloads(src Source) []Workload {
+	if !viper.GetBool("stakater-compat") || src.Kind == triggerKind {
+		return nil
+	}
+	ns := src.Namespace
+	clientset := clientset()
+	matchLabel := viper.GetString("match-label")
+	var targets []Workload
+	add := func(kind string, meta metav1.ObjectMeta, spec corev1.PodSpec) {
+		if _, ok := meta.Labels[matchLabel]; ok {
+			return
+		}
+		if stakaterTriggers(meta.Annotations, spec, src) && !optedOut(src, Workload{Kind: kind, Namespace: ns, Name: meta.Name}, meta.Annotations) {
+			logrus.Debugf("%s %s/%s asks for a restart on changes of %s with stakater annotations", kind, ns, meta.Name, src)
+			targets = append(targets, Workload{Kind: kind, Namespace: ns, Name: meta.Name})
+		}
+	}
+	// kinds RBAC denies listing are left out, logged once by checkCapabilities
+	if canList("Deployment") {
+		deployments, err := clientset.AppsV1().Deployments(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list Deployments in namespace %s for stakater annotations", err, ns)
+		} else {
+			for _, d := range deployments.Items {
+				add("Deployment", d.ObjectMeta, d.Spec.Template.Spec)
+			}
+		}
+	}
+	if canList("StatefulSet") {
+		statefulSets, err := clientset.AppsV1().StatefulSets(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list StatefulSets in namespace %s for stakater annotations", err, ns)
+		} else {
+			for _, s := range statefulSets.Items {
+				add("StatefulSet", s.ObjectMeta, s.Spec.Template.Spec)
+			}
+		}
+	}
+	if canList("DaemonSet") {
+		daemonSets, err := clientset.AppsV1().DaemonSets(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list DaemonSets in namespace %s for stakater annotations", err, ns)
+		} else {
+			for _, d := range daemonSets.Items {
+				add("DaemonSet", d.ObjectMeta, d.Spec.Template.Spec)
+			}
+		}
+	}
+	if canList("CronJob") {
+		cronJobs, err := clientset.BatchV1().CronJobs(ns).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			logrus.Errorf("%s failed to list CronJobs in namespace %s for stakater annotations", err, ns)
+		} else {
+			for _, c := range cronJobs.Items {
+				add("CronJob", c.ObjectMeta, c.Spec.JobTemplate.Spec.Template.Spec)
+			}
+		}
+	}
+	return targets
+}
+
+// stakaterTriggers applies the stakater semantics: the auto annotations restart on any referenced source
+// of their kind, the reload annotations name the sources explicitly, comma separated
+func stakaterTriggers(annotations map[string]string, spec corev1.PodSpec, src Source) bool {
+	autoAnnotation, reloadAnnotation := stakaterConfigMapAutoAnnotation, stakaterConfigMapReloadAnnotation
+	if src.Kind == "Secret" {
+		autoAnnotation, reloadAnnotation = stakaterSecretAutoAnnotation, stakaterSecretReloadAnnotation
+	}
+	for _, name := range strings.Split(annotations[reloadAnnotation], ",") {
+		if strings.TrimSpace(name) == src.Name {
+			return true
+		}
+	}
+	if annotations[stakaterAutoAnnotation] == "true" || annotations[autoAnnotation] == "true" {
+		return referencesSource(spec, src)
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"testing"
+)
+
+// mounting returns a pod spec mounting the ConfigMap named cm
+func mounting(cm string) corev1.PodSpec {
+	return corev1.PodSpec{Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{
+		ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: cm}},
+	}}}}
+}
+
+func TestStakaterTriggers(t *testing.T) {
+	cm := Source{Kind: "ConfigMap", Namespace: "apps", Name: "my-cm"}
+	secret := Source{Kind: "Secret", Namespace: "apps", Name: "my-cm"}
+	for _, c := range []struct {
+		name        string
+		annotations map[string]string
+		spec        corev1.PodSpec
+		src         Source
+		want        bool
+	}{
+		{"reload names it", map[string]string{stakaterConfigMapReloadAnnotation: "other, my-cm"}, corev1.PodSpec{}, cm, true},
+		{"reload names another", map[string]string{stakaterConfigMapReloadAnnotation: "other"}, mounting("my-cm"), cm, false},
+		{"reload of the other kind", map[string]string{stakaterSecretReloadAnnotation: "my-cm"}, corev1.PodSpec{}, cm, false},
+		{"secret reload", map[string]string{stakaterSecretReloadAnnotation: "my-cm"}, corev1.PodSpec{}, secret, true},
+		{"auto mounting it", map[string]string{stakaterAutoAnnotation: "true"}, mounting("my-cm"), cm, true},
+		{"auto not mounting it", map[string]string{stakaterAutoAnnotation: "true"}, mounting("other"), cm, false},
+		{"auto disabled", map[string]string{stakaterAutoAnnotation: "false"}, mounting("my-cm"), cm, false},
+		{"configmap auto", map[string]string{stakaterConfigMapAutoAnnotation: "true"}, mounting("my-cm"), cm, true},
+		// a Secret of the name of the mounted ConfigMap isn't consumed by the workload
+		{"secret auto on a configmap mount", map[string]string{stakaterSecretAutoAnnotation: "true"}, mounting("my-cm"), secret, false},
+		{"no annotation", nil, mounting("my-cm"), cm, false},
+	} {
+		if got := stakaterTriggers(c.annotations, c.spec, c.src); got != c.want {
+			t.Fatalf("%s: expected a restart on %s %v, got %v", c.name, c.src, c.want, got)
+		}
+	}
+}
+
+func TestStakaterWorkloads(t *testing.T) {
+	auto := map[string]string{stakaterAutoAnnotation: "true"}
+	reload := map[string]string{stakaterConfigMapReloadAnnotation: "my-cm"}
+	fakeClientset(t,
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "reloaded", Annotations: reload}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto", Annotations: auto},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: mounting("my-cm")}}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "auto-elsewhere", Annotations: auto},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: mounting("other")}}},
+		// labeled workloads are matched by cre's own label scheme
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "labeled", Annotations: reload, Labels: map[string]string{"mlops.cnvrg.io": "app"}}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "reloaded", Annotations: reload}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "db", Annotations: auto},
+			Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: mounting("my-cm")}}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "agent", Annotations: reload}},
+		&batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "report", Annotations: auto},
+			Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: mounting("my-cm")}}}}},
+	)
+	src := Source{Kind: "ConfigMap", Namespace: "apps", Name: "my-cm"}
+	setFlags(t, map[string]interface{}{"stakater-compat": false})
+	if targets := stakaterWorkloads(src); len(targets) != 0 {
+		t.Fatalf("expected the stakater annotations ignored without stakater-compat, got %v", targets)
+	}
+	setFlags(t, map[string]interface{}{"stakater-compat": true})
+	var targets []string
+	for _, w := range stakaterWorkloads(src) {
+		targets = append(targets, w.Kind+" "+w.Name)
+	}
+	sort.Strings(targets)
+	want := []string{"CronJob report", "DaemonSet agent", "Deployment auto", "Deployment reloaded", "StatefulSet db"}
+	if len(targets) != len(want) {
+		t.Fatalf("expected the workloads annotated for my-cm %v, got %v", want, targets)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Fatalf("expected the workloads annotated for my-cm %v, got %v", want, targets)
+		}
+	}
+}
+
+func TestStakaterAlongsideTheLabels(t *testing.T) {
+	fakeClientset(t,
+		labeledDeployment("apps", "labeled", "app"),
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "annotated", Annotations: map[string]string{stakaterConfigMapReloadAnnotation: "my-cm"}}},
+	)
+	setFlags(t, map[string]interface{}{"stakater-compat": true})
+	targets := matchingWorkloads(Source{Kind: "ConfigMap", Namespace: "apps", Name: "my-cm"}, "app")
+	if len(targets) != 2 || !containsWorkload(targets, Workload{Kind: "Deployment", Namespace: "apps", Name: "labeled"}) ||
+		!containsWorkload(targets, Workload{Kind: "Deployment", Namespace: "apps", Name: "annotated"}) {
+		t.Fatalf("expected both the labeled and the stakater annotated Deployments, got %v", targets)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"time"
+)
+
+const stuckRolloutPollInterval = 30 * time.Second
+
+// rolloutPollInterval is how often the progress of a rollout is checked
+var rolloutPollInterval = 5 * time.Second
+
+var (
+	trackersMu sync.Mutex
+	// trackers holds the generation of the latest tracker per workload,
+	// older trackers of a workload stop once it was rolled out again
+	trackers   = map[Workload]int{}
+	trackerGen int
+)
+
+// trackRollout waits for the workload to finish its rollout and reports it as completed,
+// or as stuck when rollout-timeout expires. Stuck rollouts are followed further,
+// so their completion is still reported when the workload eventually recovers.
+func trackRollout(src Source, w Workload) {
+	if !viper.GetBool("track-rollouts") || (len(notifiers) == 0 && !statusesTracked()) {
+		return
+	}
+	trackersMu.Lock()
+	trackerGen++
+	gen := trackerGen
+	trackers[w] = gen
+	trackersMu.Unlock()
+	current := func() bool {
+		trackersMu.Lock()
+		defer trackersMu.Unlock()
+		return trackers[w] == gen
+	}
+	done := func() {
+		trackersMu.Lock()
+		defer trackersMu.Unlock()
+		if trackers[w] == gen {
+			delete(trackers, w)
+		}
+	}
+	go func() {
+		defer done()
+		timeout := viper.GetDuration("rollout-timeout")
+		deadline := time.Now().Add(timeout)
+		interval := rolloutPollInterval
+		stuck := false
+		for {
+			time.Sleep(interval)
+			if !current() {
+				return
+			}
+			ready, err := rolloutDone(w)
+			if apierrors.IsNotFound(err) {
+				src.log().Infof("%s was deleted, no longer tracking its rollout", w)
+				return
+			}
+			if err != nil {
+				src.log().Errorf("%s failed to check rollout status of %s", err, w)
+			}
+			if ready {
+				src.log().Infof("rollout of %s completed", w)
+				notify(RolloutEvent{Type: EventRolloutCompleted, Source: src, Targets: []Workload{w}, Outcome: "completed"})
+				return
+			}
+			if !stuck && time.Now().After(deadline) {
+				src.log().Warnf("rollout of %s did not complete within %s", w, timeout)
+				notify(RolloutEvent{
+					Type:    EventRolloutStuck,
+					Source:  src,
+					Targets: []Workload{w},
+					Outcome: "stuck",
+					Error:   fmt.Sprintf("rollout did not complete within %s", timeout),
+				})
+				stuck = true
+				interval = stuckRolloutPollInterval
+			}
+		}
+	}()
+}
+
+// rolloutDone mirrors the checks of kubectl rollout status
+func rolloutDone(w Workload) (bool, error) {
+	clientset, err := workloadClient(w)
+	if err != nil {
+		return false, err
+	}
+	switch w.Kind {
+	case "Deployment":
+		d, err := clientset.AppsV1().Deployments(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deploymentDone(d), nil
+	case "StatefulSet":
+		s, err := clientset.AppsV1().StatefulSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return statefulSetDone(s), nil
+	case "DaemonSet":
+		d, err := clientset.AppsV1().DaemonSets(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return daemonSetDone(d), nil
+	case "CronJob":
+		// nothing restarts until the next scheduled Job, which is created from the patched template
+		_, err := clientset.BatchV1().CronJobs(w.Namespace).Get(context.Background(), w.Name, metav1.GetOptions{})
+		return err == nil, err
+	}
+	return false, fmt.Errorf("unsupported workload kind %s", w.Kind)
+}
+
+func deploymentDone(d *appsv1.Deployment) bool {
+	if d.Generation > d.Status.ObservedGeneration {
+		return false
+	}
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return d.Status.UpdatedReplicas >= replicas &&
+		d.Status.Replicas <= d.Status.UpdatedReplicas &&
+		d.Status.AvailableReplicas >= d.Status.UpdatedReplicas
+}
+
+func statefulSetDone(s *appsv1.StatefulSet) bool {
+	if s.Status.ObservedGeneration == 0 || s.Generation > s.Status.ObservedGeneration {
+		return false
+	}
+	if s.Spec.Replicas != nil && s.Status.ReadyReplicas < *s.Spec.Replicas {
+		return false
+	}
+	if s.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType &&
+		s.Spec.UpdateStrategy.RollingUpdate != nil &&
+		s.Spec.UpdateStrategy.RollingUpdate.Partition != nil &&
+		s.Spec.Replicas != nil {
+		return s.Status.UpdatedReplicas >= *s.Spec.Replicas-*s.Spec.UpdateStrategy.RollingUpdate.Partition
+	}
+	return s.Status.UpdateRevision == s.Status.CurrentRevision
+}
+
+func daemonSetDone(d *appsv1.DaemonSet) bool {
+	if d.Generation > d.Status.ObservedGeneration {
+		return false
+	}
+	return d.Status.UpdatedNumberScheduled >= d.Status.DesiredNumberScheduled &&
+		d.Status.NumberAvailable >= d.Status.DesiredNumberScheduled
+}
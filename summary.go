@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the rollout latency histogram, 100ms doubling up to about 55 minutes
+var latencyBuckets = func() []time.Duration {
+	var buckets []time.Duration
+	for b := 100 * time.Millisecond; b < time.Hour; b *= 2 {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}()
+
+// lifetimeStats are summarized in the log on shutdown with summary-on-exit
+type lifetimeStats struct {
+	mu            sync.Mutex
+	started       time.Time
+	sourceChanges int
+	rollouts      int
+	errors        int
+	// counts per latencyBuckets, the last one for the latencies beyond them
+	latencies  []int
+	maxLatency time.Duration
+}
+
+var lifetime = &lifetimeStats{started: time.Now(), latencies: make([]int, len(latencyBuckets)+1)}
+
+func (s *lifetimeStats) sourceChange() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sourceChanges++
+}
+
+func (s *lifetimeStats) error() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+}
+
+// rollout records a restart, latency is the time from the change being queued until the restart was triggered
+func (s *lifetimeStats) rollout(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rollouts++
+	if latency > s.maxLatency {
+		s.maxLatency = latency
+	}
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+	s.latencies[i]++
+}
+
+// percentile estimates the p-th latency percentile, interpolating linearly inside the bucket it falls in
+func (s *lifetimeStats) percentile(p float64) time.Duration {
+	total := 0
+	for _, n := range s.latencies {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(total)
+	cumulative := 0
+	for i, n := range s.latencies {
+		if n == 0 || float64(cumulative+n) < rank {
+			cumulative += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return s.maxLatency
+		}
+		lower := time.Duration(0)
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		upper := latencyBuckets[i]
+		if s.maxLatency < upper {
+			upper = s.maxLatency
+		}
+		return lower + time.Duration(float64(upper-lower)*(rank-float64(cumulative))/float64(n))
+	}
+	return s.maxLatency
+}
+
+func (s *lifetimeStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "uptime %s, %d source changes, %d rollouts, %d errors", time.Since(s.started).Round(time.Second), s.sourceChanges, s.rollouts, s.errors)
+	if s.rollouts > 0 {
+		fmt.Fprintf(&b, ", rollout latency p50 %s p95 %s p99 %s",
+			s.percentile(50).Round(time.Millisecond), s.percentile(95).Round(time.Millisecond), s.percentile(99).Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// logSummary logs the lifetime statistics, unless summary-on-exit is disabled
+func logSummary() {
+	if !viper.GetBool("summary-on-exit") {
+		return
+	}
+	logrus.Infof("cre summary: %s", lifetime)
+}
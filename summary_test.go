@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rolloutSequence records 3 source changes, 1 error and 100 rollouts: 90 within 50ms, 9 within 1s and 1 of 10s
+func rolloutSequence() *lifetimeStats {
+	stats := &lifetimeStats{started: time.Now(), latencies: make([]int, len(latencyBuckets)+1)}
+	for i := 0; i < 3; i++ {
+		stats.sourceChange()
+	}
+	stats.error()
+	for i := 0; i < 90; i++ {
+		stats.rollout(50 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		stats.rollout(time.Second)
+	}
+	stats.rollout(10 * time.Second)
+	return stats
+}
+
+func TestSummaryCounts(t *testing.T) {
+	summary := rolloutSequence().String()
+	for _, count := range []string{"3 source changes", "100 rollouts", "1 errors", "p50", "p95", "p99"} {
+		if !strings.Contains(summary, count) {
+			t.Fatalf("expected %q in the summary, got %q", count, summary)
+		}
+	}
+}
+
+func TestSummaryPercentiles(t *testing.T) {
+	stats := rolloutSequence()
+	if p50 := stats.percentile(50); p50 > 100*time.Millisecond {
+		t.Fatalf("expected p50 within the first bucket, got %s", p50)
+	}
+	if p95 := stats.percentile(95); p95 <= 800*time.Millisecond || p95 > 1600*time.Millisecond {
+		t.Fatalf("expected p95 in the bucket of the 1s rollouts, got %s", p95)
+	}
+	if p100 := stats.percentile(100); p100 != 10*time.Second {
+		t.Fatalf("expected the slowest rollout as p100, got %s", p100)
+	}
+}
+
+func TestSummaryWithoutRollouts(t *testing.T) {
+	stats := &lifetimeStats{started: time.Now(), latencies: make([]int, len(latencyBuckets)+1)}
+	if summary := stats.String(); strings.Contains(summary, "latency") || !strings.Contains(summary, "0 rollouts") {
+		t.Fatalf("expected no latencies without rollouts, got %q", summary)
+	}
+}
+
+func TestSummaryOnExit(t *testing.T) {
+	previous := lifetime
+	lifetime = rolloutSequence()
+	var out bytes.Buffer
+	logrus.SetOutput(&out)
+	t.Cleanup(func() {
+		lifetime = previous
+		logrus.SetOutput(ioutil.Discard)
+	})
+	setFlags(t, map[string]interface{}{"summary-on-exit": false})
+	logSummary()
+	if out.Len() != 0 {
+		t.Fatalf("expected no summary with summary-on-exit disabled, got %q", out.String())
+	}
+	viper.Set("summary-on-exit", true)
+	logSummary()
+	if !strings.Contains(out.String(), "cre summary: ") || !strings.Contains(out.String(), "100 rollouts") {
+		t.Fatalf("expected the summary logged on exit, got %q", out.String())
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notificationTemplate renders the JSON body of a notifier request from a Go template,
+// set per notifier with templates.<notifier> in the config file
+type notificationTemplate struct {
+	name string
+	file string
+	tmpl *template.Template
+}
+
+// templateData is what templates render: the RolloutEvent fields (.Type, .Time, .Source, .Targets,
+// .Outcome, .Error, .CorrelationID and .Severity) and the .Cluster name
+type templateData struct {
+	RolloutEvent
+	Cluster string
+}
+
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// json quotes a value, for strings to embed safely in the JSON body
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// loadTemplate parses the template of notifier and test-renders it, so mistakes fail the startup
+// rather than the first notification. It returns nil when no template is set.
+func loadTemplate(notifier string) (*notificationTemplate, error) {
+	file := viper.GetString("templates." + notifier)
+	if file == "" {
+		return nil, nil
+	}
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(notifier).Funcs(templateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template %s: %s", notifier, file, err)
+	}
+	t := &notificationTemplate{name: notifier, file: file, tmpl: tmpl}
+	if _, err := t.render(sampleEvent()); err != nil {
+		return nil, fmt.Errorf("%s template %s failed to render a sample event: %s", notifier, file, err)
+	}
+	logrus.Infof("%s notifications are rendered with the template %s", notifier, file)
+	return t, nil
+}
+
+func (t *notificationTemplate) render(event RolloutEvent) ([]byte, error) {
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, templateData{RolloutEvent: event, Cluster: viper.GetString("cluster-name")}); err != nil {
+		return nil, err
+	}
+	if !json.Valid(b.Bytes()) {
+		return nil, fmt.Errorf("rendered invalid JSON")
+	}
+	return b.Bytes(), nil
+}
+
+// body renders event with the template, falling back to the default format with a warning when there's none,
+// or it fails to render
+func (t *notificationTemplate) body(event RolloutEvent, defaultBody func() ([]byte, error)) ([]byte, error) {
+	if t == nil {
+		return defaultBody()
+	}
+	payload, err := t.render(event)
+	if err != nil {
+		event.Source.log().Warnf("%s failed to render the %s template %s, sending the default format", err, t.name, t.file)
+		return defaultBody()
+	}
+	return payload, nil
+}
+
+// sampleEvent has every field set, for templates to be test-rendered
+func sampleEvent() RolloutEvent {
+	return RolloutEvent{
+		Type:          EventRolloutFailed,
+		Time:          time.Now(),
+		CorrelationID: "00000000-0000-0000-0000-000000000000",
+		Source: Source{
+			Kind:        "ConfigMap",
+			Namespace:   "default",
+			Name:        "sample",
+			ChangedKeys: []string{"config.yaml"},
+		},
+		Targets: []Workload{{Kind: "Deployment", Namespace: "default", Name: "sample"}},
+		Outcome: "failed",
+		Error:   "sample error",
+	}
+}
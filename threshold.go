@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"strconv"
+	"strings"
+)
+
+// changeThreshold is the parsed min-changed-keys, either a number of keys or a percentage of all keys.
+// The zero value lets every change through.
+type changeThreshold struct {
+	keys    int
+	percent float64
+}
+
+var minChanged changeThreshold
+
+func parseChangeThreshold(value string) (changeThreshold, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return changeThreshold{}, nil
+	}
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return changeThreshold{}, fmt.Errorf("expected a percentage between 0%% and 100%%, got %s", value)
+		}
+		return changeThreshold{percent: percent}, nil
+	}
+	keys, err := strconv.Atoi(value)
+	if err != nil || keys < 0 {
+		return changeThreshold{}, fmt.Errorf("expected a number of keys or a percentage, got %s", value)
+	}
+	return changeThreshold{keys: keys}, nil
+}
+
+func setupChangeThreshold() {
+	threshold, err := parseChangeThreshold(viper.GetString("min-changed-keys"))
+	if err != nil {
+		logrus.Fatalf("%s, invalid --min-changed-keys", err)
+	}
+	minChanged = threshold
+	if threshold != (changeThreshold{}) {
+		logrus.Infof("ignoring changes below %s changed keys, always rolling out on %v", viper.GetString("min-changed-keys"), viper.GetStringSlice("require-key"))
+	}
+}
+
+// belowChangeThreshold tells if the change of src, out of total keys, is too small to rollout.
+// Changes to a require-key always rollout.
+func belowChangeThreshold(src Source, total int) bool {
+	if minChanged == (changeThreshold{}) {
+		return false
+	}
+	for _, required := range viper.GetStringSlice("require-key") {
+		for _, k := range src.ChangedKeys {
+			if k == required {
+				return false
+			}
+		}
+	}
+	changed := len(src.ChangedKeys)
+	below := changed < minChanged.keys
+	if minChanged.percent > 0 && total > 0 {
+		below = float64(changed)*100/float64(total) < minChanged.percent
+	}
+	if below {
+		traceDecision(src, stageChange, "skipped", nil, "only %d of %d keys changed, below --min-changed-keys %s", changed, total, viper.GetString("min-changed-keys"))
+		src.log().Infof("only %d of %d keys of %s changed, below --min-changed-keys %s, nothing to rollout",
+			changed, total, src, viper.GetString("min-changed-keys"))
+		noopUpdates.WithLabelValues(src.Namespace, "below-threshold").Inc()
+	}
+	return below
+}
+
+// keyCount returns the number of distinct keys in old and new
+func keyCount(old, new map[string]string) int {
+	n := len(new)
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func secretKeyCount(old, new map[string][]byte) int {
+	n := len(new)
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
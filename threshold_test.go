@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+// changeThresholdOf sets min-changed-keys and require-key for the test
+func changeThresholdOf(t *testing.T, value string, required ...string) {
+	t.Helper()
+	setFlags(t, map[string]interface{}{"min-changed-keys": value, "require-key": required})
+	previous := minChanged
+	setupChangeThreshold()
+	t.Cleanup(func() { minChanged = previous })
+}
+
+func changeOf(keys ...string) Source {
+	return Source{Kind: "ConfigMap", Namespace: "apps", Name: "app-config", ChangedKeys: keys}
+}
+
+func TestChangeThresholdKeys(t *testing.T) {
+	changeThresholdOf(t, "2")
+	if !belowChangeThreshold(changeOf("a"), 10) {
+		t.Fatal("expected a single changed key below a threshold of 2")
+	}
+	if belowChangeThreshold(changeOf("a", "b"), 10) {
+		t.Fatal("expected 2 changed keys to reach a threshold of 2")
+	}
+}
+
+func TestChangeThresholdPercent(t *testing.T) {
+	changeThresholdOf(t, "50%")
+	if !belowChangeThreshold(changeOf("a"), 3) {
+		t.Fatal("expected 1 of 3 keys below 50%")
+	}
+	if belowChangeThreshold(changeOf("a", "b"), 3) {
+		t.Fatal("expected 2 of 3 keys above 50%")
+	}
+}
+
+func TestRequiredKeyIgnoresTheThreshold(t *testing.T) {
+	changeThresholdOf(t, "3", "tls.crt")
+	if belowChangeThreshold(changeOf("tls.crt"), 10) {
+		t.Fatal("expected a change of a require-key to always rollout")
+	}
+	if !belowChangeThreshold(changeOf("other"), 10) {
+		t.Fatal("expected other keys held to the threshold")
+	}
+}
+
+func TestNoThreshold(t *testing.T) {
+	changeThresholdOf(t, "")
+	if belowChangeThreshold(changeOf("a"), 100) {
+		t.Fatal("expected every change to rollout without min-changed-keys")
+	}
+}
+
+func TestParseChangeThreshold(t *testing.T) {
+	for value, want := range map[string]changeThreshold{"": {}, "3": {keys: 3}, " 25% ": {percent: 25}} {
+		got, err := parseChangeThreshold(value)
+		if err != nil || got != want {
+			t.Fatalf("%q: expected %+v, got %+v, %v", value, want, got, err)
+		}
+	}
+	for _, invalid := range []string{"-1", "150%", "few"} {
+		if _, err := parseChangeThreshold(invalid); err == nil {
+			t.Fatalf("expected %q rejected", invalid)
+		}
+	}
+}
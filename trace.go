@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxDecisionTraces   = 2000
+	maxTraceSteps       = 200
+	decisionTraceMaxAge = 24 * time.Hour
+)
+
+// Stages of a decision trace, in the order a change goes through them
+const (
+	stageChange  = "change"
+	stageGuard   = "guard"
+	stageTargets = "targets"
+	stageQueue   = "queue"
+	stageRollout = "rollout"
+)
+
+// traceStep is a decision taken on a change, for one workload or the whole change.
+// Steps only ever hold key names and reasons, never the values of the source.
+type traceStep struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Decision string    `json:"decision"`
+	Workload *Workload `json:"workload,omitempty"`
+	Detail   string    `json:"detail"`
+}
+
+func (s traceStep) String() string {
+	subject := ""
+	if s.Workload != nil {
+		subject = " " + s.Workload.String() + ":"
+	}
+	return fmt.Sprintf("%s %s/%s:%s %s", s.Time.UTC().Format(time.RFC3339), s.Stage, s.Decision, subject, s.Detail)
+}
+
+// decisionTrace is the decision path of a change, answering why a workload was or wasn't reloaded
+type decisionTrace struct {
+	CorrelationID string      `json:"correlationId"`
+	Source        Source      `json:"source"`
+	Started       time.Time   `json:"started"`
+	Steps         []traceStep `json:"steps"`
+	// Persisted tells the trace was read back from a ReloadEvent
+	Persisted bool `json:"persisted,omitempty"`
+}
+
+var (
+	tracesMu sync.Mutex
+	// decisionTraces holds the traces of the recent changes by correlation id
+	decisionTraces = map[string]*decisionTrace{}
+)
+
+// traceDecision adds a step to the trace of the change of src, w is nil for decisions on the whole change
+func traceDecision(src Source, stage, decision string, w *Workload, format string, args ...interface{}) {
+	if src.CorrelationID == "" {
+		return
+	}
+	step := traceStep{Time: time.Now(), Stage: stage, Decision: decision, Detail: fmt.Sprintf(format, args...)}
+	if w != nil {
+		workload := *w
+		step.Workload = &workload
+	}
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	t := decisionTraces[src.CorrelationID]
+	if t == nil {
+		pruneDecisionTraces()
+		t = &decisionTrace{CorrelationID: src.CorrelationID, Source: src, Started: step.Time}
+		decisionTraces[src.CorrelationID] = t
+	}
+	// keeps the first steps, the ones telling why a change went where it went
+	if len(t.Steps) < maxTraceSteps {
+		t.Steps = append(t.Steps, step)
+	}
+}
+
+// traceWorkload adds a step to the traces of every change queued for w
+func traceWorkload(w Workload, stage, decision, format string, args ...interface{}) {
+	rolloutsMu.Lock()
+	var sources []Source
+	for _, b := range pendingBatches[w] {
+		sources = append(sources, b.src)
+	}
+	rolloutsMu.Unlock()
+	for _, src := range sources {
+		traceDecision(src, stage, decision, &w, format, args...)
+	}
+}
+
+// traceEvent adds the lifecycle events not traced where they're decided, e.g. the batch cap, skips and failures
+func traceEvent(event RolloutEvent) {
+	decision := strings.TrimPrefix(string(event.Type), "rollout-")
+	detail := event.Error
+	if detail == "" {
+		detail = event.Outcome
+	}
+	if len(event.Targets) == 0 {
+		traceDecision(event.Source, stageRollout, decision, nil, "%s", detail)
+		return
+	}
+	for i := range event.Targets {
+		traceDecision(event.Source, stageRollout, decision, &event.Targets[i], "%s", detail)
+	}
+}
+
+// traceTargets records how the targets of src were resolved
+func traceTargets(src Source, matchLabelValue string, targets []Workload) {
+	how := fmt.Sprintf("labeled %s=%s in namespace %s", viper.GetString("match-label"), matchLabelValue, src.RolloutNamespace())
+	switch {
+	case len(src.Clusters) > 0:
+		how += " of clusters " + strings.Join(src.Clusters, ", ")
+	case src.Policy != nil:
+		how = "selected by the ReloadPolicy " + src.Policy.name
+	case src.Unlabeled && autoDiscovering():
+		how = "consuming it or asking for it with stakater annotations"
+	case src.Unlabeled:
+		how = "asking for it with stakater annotations"
+	}
+	if len(targets) == 0 {
+		traceDecision(src, stageTargets, "none", nil, "no workloads %s", how)
+		return
+	}
+	for i := range targets {
+		traceDecision(src, stageTargets, "matched", &targets[i], "%s", how)
+	}
+}
+
+func pruneDecisionTraces() {
+	var traces []*decisionTrace
+	for id, t := range decisionTraces {
+		if time.Since(t.Started) > decisionTraceMaxAge {
+			delete(decisionTraces, id)
+			continue
+		}
+		traces = append(traces, t)
+	}
+	if len(traces) < maxDecisionTraces {
+		return
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Started.Before(traces[j].Started) })
+	for _, t := range traces[:len(traces)-maxDecisionTraces+1] {
+		delete(decisionTraces, t.CorrelationID)
+	}
+}
+
+// traceSteps returns a copy of the steps of a change, for its ReloadEvent
+func traceSteps(id string) []traceStep {
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	if t := decisionTraces[id]; t != nil {
+		return append([]traceStep(nil), t.Steps...)
+	}
+	return nil
+}
+
+// workloadTraces returns the traces of the recent changes which targeted w or of sources it consumes, newest first.
+// Changes of consumed sources which never targeted w get a final step telling why, from the current state of w.
+func workloadTraces(w Workload, limit int) []decisionTrace {
+	obj, template, err := getWorkload(w)
+	var configMaps, secrets map[string]bool
+	var labels map[string]string
+	if err == nil {
+		configMaps, secrets = podReferences(template.Spec)
+		labels = obj.GetLabels()
+	}
+	tracesMu.Lock()
+	var traces []decisionTrace
+	for _, t := range decisionTraces {
+		targeted := false
+		for _, s := range t.Steps {
+			targeted = targeted || (s.Workload != nil && *s.Workload == w)
+		}
+		src := t.Source
+		consumed := src.Namespace == w.Namespace && ((src.Kind == "ConfigMap" && configMaps[src.Name]) || (src.Kind == "Secret" && secrets[src.Name]))
+		if !targeted && !consumed {
+			continue
+		}
+		trace := *t
+		trace.Steps = append([]traceStep(nil), t.Steps...)
+		if !targeted {
+			trace.Steps = append(trace.Steps, traceStep{
+				Time: time.Now(), Stage: stageTargets, Decision: "not-targeted", Workload: &w,
+				Detail: notTargetedReason(t.Source, labels),
+			})
+		}
+		traces = append(traces, trace)
+	}
+	tracesMu.Unlock()
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Started.After(traces[j].Started) })
+	if limit > 0 && len(traces) > limit {
+		traces = traces[:limit]
+	}
+	return traces
+}
+
+// notTargetedReason tells why a workload consuming src wasn't among the targets of its change
+func notTargetedReason(src Source, labels map[string]string) string {
+	matchLabel := viper.GetString("match-label")
+	value, labeled := labels[matchLabel]
+	switch {
+	case src.Policy != nil:
+		return fmt.Sprintf("it consumes %s, but the ReloadPolicy %s selecting it doesn't target it", src, src.Policy.name)
+	case src.Unlabeled:
+		return fmt.Sprintf("it consumes %s, which isn't labeled %s, and has no stakater annotation asking for it", src, matchLabel)
+	case !labeled:
+		return fmt.Sprintf("it consumes %s labeled %s=%s but isn't labeled %s", src, matchLabel, src.MatchLabelValue, matchLabel)
+	case value != src.MatchLabelValue:
+		return fmt.Sprintf("it's labeled %s=%s, the change of %s rolled out %s=%s", matchLabel, value, src, matchLabel, src.MatchLabelValue)
+	case src.RolloutNamespace() != src.Namespace:
+		return fmt.Sprintf("the change of %s was redirected to namespace %s", src, src.RolloutNamespace())
+	}
+	return "it matches now, it may have been labeled after the change was processed"
+}
+
+// explainHandler serves the traces of a workload, ?kind=Deployment&namespace=prod&name=web, to cre explain
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	workload := Workload{Kind: r.FormValue("kind"), Namespace: r.FormValue("namespace"), Name: r.FormValue("name")}
+	if workloadKindResources[workload.Kind] == "" || workload.Namespace == "" || workload.Name == "" {
+		http.Error(w, "kind (Deployment, StatefulSet, DaemonSet or CronJob), namespace and name are required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(workloadTraces(workload, 10)); err != nil {
+		logrus.Errorf("%s failed to write the traces of %s", err, workload)
+	}
+}
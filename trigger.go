@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/flowcontrol"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	triggerPath = "/api/v1/trigger"
+	// triggerKind is the Kind of sources triggered by match label value rather than by a ConfigMap or Secret
+	triggerKind         = "Trigger"
+	maxTriggerBody      = 4 << 10
+	maxTrackedStatuses  = 10000
+	trackedStatusMaxAge = 24 * time.Hour
+)
+
+var triggerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cre_trigger_api_requests_total",
+	Help: "Trigger API requests by result (accepted, unauthorized, rate-limited, invalid, not-found, error)",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(triggerRequests)
+}
+
+// triggerRequest names a ConfigMap or Secret to handle as changed, or a match label value to roll out
+type triggerRequest struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+// changeStatus is the outcome of a change so far, built from its lifecycle events
+type changeStatus struct {
+	CorrelationID string             `json:"correlationId"`
+	Source        Source             `json:"source"`
+	State         string             `json:"state"`
+	Created       time.Time          `json:"created"`
+	Updated       time.Time          `json:"updated"`
+	Workloads     map[string]string  `json:"workloads"`
+	Errors        []string           `json:"errors,omitempty"`
+	Events        []changeStatusStep `json:"events"`
+}
+
+type changeStatusStep struct {
+	Type    EventType  `json:"type"`
+	Time    time.Time  `json:"time"`
+	Targets []Workload `json:"targets,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+var (
+	statusesMu sync.Mutex
+	// changeStatuses holds the status of the recent changes by correlation id, for the trigger and gRPC APIs
+	changeStatuses = map[string]*changeStatus{}
+)
+
+// statusesTracked tells if the lifecycle of changes is kept for an API to query it
+func statusesTracked() bool {
+	return viper.GetString("trigger-api-addr") != "" || viper.GetString("grpc-addr") != ""
+}
+
+// recordChangeStatus updates the status of the change of the event
+func recordChangeStatus(event RolloutEvent) {
+	if !statusesTracked() {
+		return
+	}
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	s := changeStatuses[event.CorrelationID]
+	if s == nil {
+		pruneChangeStatuses()
+		s = &changeStatus{CorrelationID: event.CorrelationID, Source: event.Source, Created: event.Time, Workloads: map[string]string{}}
+		changeStatuses[event.CorrelationID] = s
+	}
+	s.Updated = event.Time
+	s.State = strings.TrimPrefix(string(event.Type), "rollout-")
+	for _, w := range event.Targets {
+		if event.Type != EventRolloutTriggered || s.Workloads[w.String()] == "" {
+			s.Workloads[w.String()] = event.Outcome
+		}
+	}
+	if event.Error != "" {
+		s.Errors = append(s.Errors, event.Error)
+	}
+	s.Events = append(s.Events, changeStatusStep{Type: event.Type, Time: event.Time, Targets: event.Targets, Error: event.Error})
+}
+
+// pruneChangeStatuses drops statuses older than trackedStatusMaxAge, and the oldest beyond maxTrackedStatuses
+func pruneChangeStatuses() {
+	var statuses []*changeStatus
+	for id, s := range changeStatuses {
+		if time.Since(s.Updated) > trackedStatusMaxAge {
+			delete(changeStatuses, id)
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	if len(statuses) < maxTrackedStatuses {
+		return
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Updated.Before(statuses[j].Updated) })
+	for _, s := range statuses[:len(statuses)-maxTrackedStatuses+1] {
+		delete(changeStatuses, s.CorrelationID)
+	}
+}
+
+// getChangeStatus returns a copy of the status of a change
+func getChangeStatus(id string) (changeStatus, bool) {
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	s, ok := changeStatuses[id]
+	if !ok {
+		return changeStatus{}, false
+	}
+	status := *s
+	status.Workloads = make(map[string]string, len(s.Workloads))
+	for w, outcome := range s.Workloads {
+		status.Workloads[w] = outcome
+	}
+	status.Errors = append([]string(nil), s.Errors...)
+	status.Events = append([]changeStatusStep(nil), s.Events...)
+	return status, true
+}
+
+// markUntargeted reports a matched change which queued nothing, as no workload matched it
+func markUntargeted(id string) {
+	rolloutsMu.Lock()
+	queued := false
+	for _, batches := range pendingBatches {
+		for _, b := range batches {
+			queued = queued || b.src.CorrelationID == id
+		}
+	}
+	rolloutsMu.Unlock()
+	statusesMu.Lock()
+	defer statusesMu.Unlock()
+	if s := changeStatuses[id]; s != nil && !queued && s.State == "matched" {
+		s.State = "no-targets"
+	}
+}
+
+// triggerCaller is who called the trigger API, to rate limit and log by
+type triggerCaller string
+
+// triggerAPI handles changes requested by external systems, e.g. CI, through the same pipeline as the observed ones.
+// The HTTP and gRPC APIs share it, so they share their callers and rate limits.
+type triggerAPI struct {
+	// tokens by caller name
+	tokens map[string]string
+	mtls   bool
+	// tokenReview authenticates the other bearer tokens with TokenReviews, restricted to users when set
+	tokenReview bool
+	users       map[string]bool
+	limiters    map[triggerCaller]flowcontrol.RateLimiter
+	mu          sync.Mutex
+}
+
+var (
+	triggerAPIOnce   sync.Once
+	sharedTriggerAPI *triggerAPI
+	triggerTLSConfig *tls.Config
+	triggerAPIErr    error
+)
+
+// apiAuth returns the callers, rate limits and TLS configuration of the APIs
+func apiAuth() (*triggerAPI, *tls.Config, error) {
+	triggerAPIOnce.Do(func() {
+		sharedTriggerAPI, triggerTLSConfig, triggerAPIErr = newTriggerAPI()
+	})
+	return sharedTriggerAPI, triggerTLSConfig, triggerAPIErr
+}
+
+// serveTriggerAPI serves the trigger API on trigger-api-addr, nothing is started without it
+func serveTriggerAPI() {
+	addr := viper.GetString("trigger-api-addr")
+	if addr == "" {
+		return
+	}
+	api, tlsConfig, err := apiAuth()
+	if err != nil {
+		logrus.Fatalf("%s, invalid trigger api configuration", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(triggerPath, api.authenticate(api.serveTrigger))
+	mux.HandleFunc(triggerPath+"/", api.authenticate(api.serveStatus))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	if tlsConfig == nil {
+		logrus.Warnf("serving the trigger api on %s without TLS, bearer tokens are sent in the clear", addr)
+		err = server.ListenAndServe()
+	} else {
+		logrus.Infof("serving the trigger api on %s%s", addr, triggerPath)
+		err = server.ListenAndServeTLS("", "")
+	}
+	logrus.Fatalf("%s trigger api server stopped", err)
+}
+
+func newTriggerAPI() (*triggerAPI, *tls.Config, error) {
+	api := &triggerAPI{limiters: map[triggerCaller]flowcontrol.RateLimiter{}}
+	tokens, err := triggerTokens()
+	if err != nil {
+		return nil, nil, err
+	}
+	api.tokens = tokens
+	if viper.GetString("http-auth") == httpAuthTokenReview {
+		api.tokenReview, api.users = true, map[string]bool{}
+		for _, user := range viper.GetStringSlice("http-auth-users") {
+			api.users[user] = true
+		}
+	}
+	var tlsConfig *tls.Config
+	if certFile, keyFile := viper.GetString("trigger-api-tls-cert"), viper.GetString("trigger-api-tls-key"); certFile != "" || keyFile != "" {
+		certs := &certificateReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	if caFile := viper.GetString("trigger-api-client-ca"); caFile != "" {
+		if tlsConfig == nil {
+			return nil, nil, fmt.Errorf("--trigger-api-client-ca needs --trigger-api-tls-cert and --trigger-api-tls-key")
+		}
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		// Token callers don't need a certificate, verified ones are authenticated by it
+		tlsConfig.ClientCAs, tlsConfig.ClientAuth = pool, tls.VerifyClientCertIfGiven
+		api.mtls = true
+	}
+	if len(api.tokens) == 0 && !api.mtls && !api.tokenReview {
+		return nil, nil, fmt.Errorf("the trigger api needs bearer tokens (TRIGGER_API_TOKEN, --trigger-api-token-file), --trigger-api-client-ca or --http-auth=tokenreview")
+	}
+	return api, tlsConfig, nil
+}
+
+// triggerTokens reads the TRIGGER_API_TOKEN env, or the token file holding one token per line,
+// optionally named as name=token to tell the callers apart in logs and rate limits
+func triggerTokens() (map[string]string, error) {
+	tokens := map[string]string{}
+	if token := viper.GetString("trigger-api-token"); token != "" {
+		tokens["token"] = token
+		return tokens, nil
+	}
+	file := viper.GetString("trigger-api-token-file")
+	if file == "" {
+		return tokens, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		name, token := fmt.Sprintf("token-%d", line), entry
+		if parts := strings.SplitN(entry, "=", 2); len(parts) == 2 {
+			name, token = parts[0], parts[1]
+		}
+		if len(token) < 16 {
+			return nil, fmt.Errorf("token %s of %s is shorter than 16 characters", name, file)
+		}
+		tokens[name] = token
+	}
+	return tokens, scanner.Err()
+}
+
+type triggerHandler func(w http.ResponseWriter, r *http.Request, caller triggerCaller)
+
+// authenticate lets callers with a verified client certificate or a known bearer token through, rate limited per caller
+func (api *triggerAPI) authenticate(next triggerHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := api.caller(r)
+		if !ok {
+			triggerRequests.WithLabelValues("unauthorized").Inc()
+			logrus.Warnf("rejected unauthenticated trigger api request from %s", remoteHost(r))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cre"`)
+			writeTriggerError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if !api.limiter(caller).TryAccept() {
+			triggerRequests.WithLabelValues("rate-limited").Inc()
+			logrus.Warnf("rate limited trigger api requests of %s", caller)
+			w.Header().Set("Retry-After", "10")
+			writeTriggerError(w, http.StatusTooManyRequests, "rate limited, retry later")
+			return
+		}
+		next(w, r, caller)
+	}
+}
+
+func (api *triggerAPI) caller(r *http.Request) (triggerCaller, bool) {
+	return api.callerOf(r.TLS, r.Header.Get("Authorization"))
+}
+
+// callerOf authenticates by the verified client certificate of the connection, or by the authorization header
+func (api *triggerAPI) callerOf(state *tls.ConnectionState, auth string) (triggerCaller, bool) {
+	if api.mtls && state != nil && len(state.VerifiedChains) > 0 {
+		return triggerCaller("cert:" + state.PeerCertificates[0].Subject.CommonName), true
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	got := []byte(strings.TrimPrefix(auth, "Bearer "))
+	// compares with every token, so the time taken doesn't tell which token almost matched
+	var caller triggerCaller
+	for name, token := range api.tokens {
+		if subtle.ConstantTimeCompare(got, []byte(token)) == 1 {
+			caller = triggerCaller(name)
+		}
+	}
+	if caller == "" && api.tokenReview {
+		if user, ok := reviewToken(string(got)); ok && (len(api.users) == 0 || api.users[user]) {
+			caller = triggerCaller("user:" + user)
+		}
+	}
+	return caller, caller != ""
+}
+
+func (api *triggerAPI) limiter(caller triggerCaller) flowcontrol.RateLimiter {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	limiter, ok := api.limiters[caller]
+	if !ok {
+		perMinute := viper.GetInt("trigger-api-rate-limit")
+		if perMinute <= 0 {
+			perMinute = 1
+		}
+		limiter = flowcontrol.NewTokenBucketRateLimiter(float32(perMinute)/60, viper.GetInt("trigger-api-burst"))
+		api.limiters[caller] = limiter
+	}
+	return limiter
+}
+
+func (api *triggerAPI) serveTrigger(w http.ResponseWriter, r *http.Request, caller triggerCaller) {
+	if r.Method != http.MethodPost {
+		writeTriggerError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		triggerRequests.WithLabelValues("invalid").Inc()
+		writeTriggerError(w, http.StatusUnsupportedMediaType, "expected application/json")
+		return
+	}
+	var req triggerRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTriggerBody))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = fmt.Errorf("unexpected data after the request")
+	}
+	if err == nil {
+		err = req.validate()
+	}
+	if err != nil {
+		triggerRequests.WithLabelValues("invalid").Inc()
+		writeTriggerError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	id, status, err := trigger(req, string(caller))
+	if err != nil {
+		result := "error"
+		if status == http.StatusNotFound || status == http.StatusUnprocessableEntity {
+			result = "not-found"
+		}
+		triggerRequests.WithLabelValues(result).Inc()
+		writeTriggerError(w, status, err.Error())
+		return
+	}
+	triggerRequests.WithLabelValues("accepted").Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", triggerPath+"/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"correlationId": id, "status": triggerPath + "/" + id})
+}
+
+func (api *triggerAPI) serveStatus(w http.ResponseWriter, r *http.Request, caller triggerCaller) {
+	if r.Method != http.MethodGet {
+		writeTriggerError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	status, ok := getChangeStatus(strings.TrimPrefix(r.URL.Path, triggerPath+"/"))
+	if !ok {
+		writeTriggerError(w, http.StatusNotFound, "unknown correlation id, or it expired")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logrus.Errorf("%s failed to write the change status", err)
+	}
+}
+
+func (req triggerRequest) validate() error {
+	if errs := validation.IsDNS1123Label(req.Namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", req.Namespace, strings.Join(errs, ", "))
+	}
+	switch {
+	case req.Value != "" && (req.Kind != "" || req.Name != ""):
+		return fmt.Errorf("expected either kind and name, or value")
+	case req.Value != "":
+		if errs := validation.IsValidLabelValue(req.Value); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q: %s", req.Value, strings.Join(errs, ", "))
+		}
+	case req.Kind != "ConfigMap" && req.Kind != "Secret":
+		return fmt.Errorf("kind must be ConfigMap or Secret, or set value instead")
+	default:
+		if errs := validation.IsDNS1123Subdomain(req.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid name %q: %s", req.Name, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// trigger rolls out the workloads of the request like for an observed change, through target resolution,
+// deploy tool gates, batch limits and the rollout queue guards, returning the correlation id of the change
+func trigger(req triggerRequest, caller string) (string, int, error) {
+	if !leading() {
+		return "", http.StatusServiceUnavailable, fmt.Errorf("this replica isn't the leader, retry against the leader")
+	}
+	src := Source{Kind: triggerKind, Namespace: req.Namespace, Name: req.Value, MatchLabelValue: req.Value, CorrelationID: string(uuid.NewUUID())}
+	var obj metav1.Object
+	if req.Value == "" {
+		var err error
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if req.Kind == "ConfigMap" {
+			obj, err = clientset().CoreV1().ConfigMaps(req.Namespace).Get(ctx, req.Name, metav1.GetOptions{})
+		} else {
+			obj, err = clientset().CoreV1().Secrets(req.Namespace).Get(ctx, req.Name, metav1.GetOptions{})
+		}
+		if apierrors.IsNotFound(err) {
+			return "", http.StatusNotFound, fmt.Errorf("%s %s/%s not found", req.Kind, req.Namespace, req.Name)
+		}
+		if err != nil {
+			logrus.Errorf("%s failed to get %s %s/%s for a trigger api request", err, req.Kind, req.Namespace, req.Name)
+			return "", http.StatusBadGateway, fmt.Errorf("failed to get %s %s/%s", req.Kind, req.Namespace, req.Name)
+		}
+		matchLabelValue, labeled := matchValue(obj)
+		policy := policyFor(req.Kind, obj)
+		if (!labeled && policy == nil && !viper.GetBool("stakater-compat")) || !ownedByWatchedParent(obj) {
+			return "", http.StatusUnprocessableEntity, fmt.Errorf("%s %s/%s isn't watched by cre", req.Kind, req.Namespace, req.Name)
+		}
+		src = Source{
+			Kind:            req.Kind,
+			Namespace:       req.Namespace,
+			Name:            req.Name,
+			UID:             obj.GetUID(),
+			TargetNamespace: obj.GetAnnotations()[targetNamespaceAnnotation],
+			CorrelationID:   src.CorrelationID,
+			Unlabeled:       !labeled,
+			Policy:          policy,
+			MatchLabelValue: matchLabelValue,
+			GitSHA:          obj.GetAnnotations()[gitSHAAnnotation],
+			GitRepo:         obj.GetAnnotations()[gitRepoAnnotation],
+			Clusters:        sourceClusters(obj.GetAnnotations()),
+		}
+	}
+	src.log().Infof("%s requested a rollout of %s through the trigger api", caller, src)
+	statusesMu.Lock()
+	pruneChangeStatuses()
+	changeStatuses[src.CorrelationID] = &changeStatus{
+		CorrelationID: src.CorrelationID,
+		Source:        src,
+		State:         "accepted",
+		Created:       time.Now(),
+		Updated:       time.Now(),
+		Workloads:     map[string]string{},
+	}
+	statusesMu.Unlock()
+	go func() {
+		if obj != nil && heldByDeployTool(obj, src, src.MatchLabelValue) {
+			return
+		}
+		rollout(src, src.MatchLabelValue)
+		markUntargeted(src.CorrelationID)
+	}()
+	return src.CorrelationID, http.StatusAccepted, nil
+}
+
+func writeTriggerError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// triggerCall posts body to the trigger api as the platform caller
+func triggerCall(t *testing.T, body string) (int, map[string]string) {
+	t.Helper()
+	setFlags(t, map[string]interface{}{"trigger-api-rate-limit": 600, "trigger-api-burst": 100})
+	api := &triggerAPI{tokens: map[string]string{"platform": "secret"}, limiters: map[triggerCaller]flowcontrol.RateLimiter{}}
+	req := httptest.NewRequest(http.MethodPost, triggerPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	api.authenticate(api.serveTrigger)(resp, req)
+	var reply map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Code, reply
+}
+
+func TestTriggerSourceMatchedByAnnotation(t *testing.T) {
+	annotated := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "annotated", Annotations: map[string]string{"cre.cnvrg.io/match": "app"}}}
+	client := fakeClientset(t, annotated, labeledDeployment("apps", "web", "app"), labeledDeployment("apps", "other", "other"))
+	patches := recordPatches(client)
+	setFlags(t, map[string]interface{}{"match-annotation": "cre.cnvrg.io/match", "pair-window": time.Duration(0), "preflight-dry-run": false})
+	code, reply := triggerCall(t, `{"namespace": "apps", "kind": "ConfigMap", "name": "annotated"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected the ConfigMap matched by annotation watched, got %d %v", code, reply)
+	}
+	waitQueued(t, 1)
+	processQueuedRollouts(t)
+	recorded := patches.recorded()
+	if len(recorded) != 1 {
+		t.Fatalf("expected only the Deployment labeled with the annotation value restarted, got %d patches", len(recorded))
+	}
+	if id := templateAnnotations(t, recorded[0])[correlationIDAnnotation]; id != reply["correlationId"] {
+		t.Fatalf("expected the restart of the triggered change %s, got %s", reply["correlationId"], id)
+	}
+}
+
+func TestTriggerUnmatchedSource(t *testing.T) {
+	fakeClientset(t, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "plain"}})
+	setFlags(t, map[string]interface{}{"match-annotation": "cre.cnvrg.io/match"})
+	if code, reply := triggerCall(t, `{"namespace": "apps", "kind": "ConfigMap", "name": "plain"}`); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a ConfigMap without the label or annotation not watched, got %d %v", code, reply)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const validatePath = "/validate"
+
+// Checks of the validating webhook, --webhook-enforce turns them from warnings into denials
+const (
+	// checkMissingLabel: the workload references a labeled source but lacks the match label and stakater annotations
+	checkMissingLabel = "missing-label"
+	// checkLabelMismatch: the workload and a referenced source carry different match label values
+	checkLabelMismatch = "label-mismatch"
+	// checkUnlabeledSources: the workload carries the match label but none of its referenced sources do
+	checkUnlabeledSources = "unlabeled-sources"
+)
+
+var validationChecks = []string{checkMissingLabel, checkLabelMismatch, checkUnlabeledSources}
+
+// referencedSource is a ConfigMap or Secret consumed by a workload under review
+type referencedSource struct {
+	kind, name string
+	labels     map[string]string
+}
+
+func (s referencedSource) String() string {
+	return s.kind + " " + s.name
+}
+
+// webhookEnforced returns the checks denying workloads, failing on unknown ones
+func webhookEnforced() (map[string]bool, error) {
+	enforced := map[string]bool{}
+	for _, check := range viper.GetStringSlice("webhook-enforce") {
+		known := false
+		for _, c := range validationChecks {
+			known = known || c == check
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown check %s, expected one of %s", check, strings.Join(validationChecks, ", "))
+		}
+		enforced[check] = true
+	}
+	return enforced, nil
+}
+
+func serveValidate(w http.ResponseWriter, r *http.Request) {
+	serveReview(w, r, validate)
+}
+
+type reviewedWorkload struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Template corev1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// validate warns about workloads whose labels won't restart them on changes of the sources they consume.
+// It only denies for the --webhook-enforce checks, a failed source lookup never denies.
+func validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+	var workload reviewedWorkload
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		logrus.Errorf("%s failed to decode %s %s/%s", err, req.Kind.Kind, req.Namespace, req.Name)
+		return allowed
+	}
+	configMaps, secrets := podReferences(workload.Spec.Template.Spec)
+	// Updates keeping the labels, annotations and references, e.g. the restarts of cre itself, were reviewed already
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		var old reviewedWorkload
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err == nil {
+			oldConfigMaps, oldSecrets := podReferences(old.Spec.Template.Spec)
+			if reflect.DeepEqual(old.Labels, workload.Labels) && reflect.DeepEqual(old.Annotations, workload.Annotations) &&
+				reflect.DeepEqual(oldConfigMaps, configMaps) && reflect.DeepEqual(oldSecrets, secrets) {
+				return allowed
+			}
+		}
+	}
+	if len(configMaps) == 0 && len(secrets) == 0 {
+		return allowed
+	}
+	name := workload.Name
+	if name == "" {
+		name = workload.GenerateName
+	}
+	subject := fmt.Sprintf("%s %s/%s", req.Kind.Kind, req.Namespace, name)
+	findings := validateWorkload(subject, workload.ObjectMeta, workload.Spec.Template.Spec, lookupSources(req.Namespace, configMaps, secrets))
+	enforced, _ := webhookEnforced()
+	var denials []string
+	for _, f := range findings {
+		allowed.Warnings = append(allowed.Warnings, f.message)
+		if enforced[f.check] {
+			denials = append(denials, f.message)
+		}
+	}
+	if len(findings) > 0 {
+		logrus.Infof("%s: %s", subject, strings.Join(allowed.Warnings, "; "))
+	}
+	if len(denials) > 0 {
+		return &admissionv1.AdmissionResponse{
+			Allowed:  false,
+			Warnings: allowed.Warnings,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+				Message: "denied by cre: " + strings.Join(denials, "; "),
+			},
+		}
+	}
+	return allowed
+}
+
+type validationFinding struct {
+	check, message string
+}
+
+func validateWorkload(subject string, meta metav1.ObjectMeta, spec corev1.PodSpec, sources []referencedSource) []validationFinding {
+	matchLabel := viper.GetString("match-label")
+	value, labeled := meta.Labels[matchLabel]
+	var findings []validationFinding
+	sourceLabeled := false
+	for _, s := range sources {
+		v, ok := s.labels[matchLabel]
+		if !ok {
+			continue
+		}
+		sourceLabeled = true
+		switch {
+		case !labeled && !stakaterTriggers(meta.Annotations, spec, Source{Kind: s.kind, Name: s.name}):
+			findings = append(findings, validationFinding{checkMissingLabel, fmt.Sprintf(
+				"%s references %s labeled %s=%s but lacks the %s label, it won't be restarted on its changes", subject, s, matchLabel, v, matchLabel)})
+		case labeled && v != value:
+			findings = append(findings, validationFinding{checkLabelMismatch, fmt.Sprintf(
+				"%s is labeled %s=%s but references %s labeled %s=%s, it won't be restarted on its changes", subject, matchLabel, value, s, matchLabel, v)})
+		}
+	}
+	if labeled && !sourceLabeled && len(sources) > 0 {
+		var names []string
+		for _, s := range sources {
+			names = append(names, s.String())
+		}
+		findings = append(findings, validationFinding{checkUnlabeledSources, fmt.Sprintf(
+			"%s is labeled %s=%s but none of the sources it references carry the label (%s), their changes won't restart it",
+			subject, matchLabel, value, strings.Join(names, ", "))})
+	}
+	return findings
+}
+
+// lookupSources gets the referenced ConfigMaps and Secrets, by kind and name, skipping the ones not found,
+// e.g. created after the workload
+func lookupSources(ns string, configMaps, secrets map[string]bool) []referencedSource {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookLookupTimeout)
+	defer cancel()
+	clientset := clientset()
+	var sources []referencedSource
+	for _, name := range sortedKeys(configMaps) {
+		cm, err := clientset.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			logrus.Debugf("%s failed to get ConfigMap %s/%s", err, ns, name)
+			continue
+		}
+		sources = append(sources, referencedSource{kind: "ConfigMap", name: name, labels: cm.Labels})
+	}
+	for _, name := range sortedKeys(secrets) {
+		s, err := clientset.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			logrus.Debugf("%s failed to get Secret %s/%s", err, ns, name)
+			continue
+		}
+		sources = append(sources, referencedSource{kind: "Secret", name: name, labels: s.Labels})
+	}
+	return sources
+}
+
+// validatingWebhookManifest renders the ValidatingWebhookConfiguration, without an object selector
+// as both labeled and unlabeled workloads are checked
+func validatingWebhookManifest(caBundle []byte) admissionregistrationv1.ValidatingWebhookConfiguration {
+	path := validatePath
+	port := int32(viper.GetInt("webhook-port"))
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	timeout := int32(5)
+	return admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: "cre-workload-validator"},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name: "workload-validator.cre.cnvrg.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: viper.GetString("webhook-namespace"),
+					Name:      viper.GetString("webhook-service"),
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{"apps"},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+				},
+			}},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"runtime"
+)
+
+// version is set at build time, -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+// versionCmd prints the version of cre and the cluster name it would run with, so mismatches are easy to spot
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "print the version of cre and the cluster name it runs with",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("cre %s (%s)\n", version, runtime.Version())
+		name, err := clusterName()
+		switch {
+		case err != nil:
+			fmt.Printf("cluster: unknown, %s\n", err)
+		case name == "":
+			fmt.Println("cluster: not set, see --cluster-name and --cluster-name-detect")
+		default:
+			fmt.Printf("cluster: %s\n", name)
+		}
+	},
+}
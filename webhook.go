@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"os"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookPath = "/mutate"
+	// webhookLookupTimeout bounds the source lookups of a review, well below the webhook timeoutSeconds
+	webhookLookupTimeout = 2 * time.Second
+	// labelInjectedAnnotation records which source the match label was injected for
+	labelInjectedAnnotation = "cre.cnvrg.io/label-injected-from"
+)
+
+var webhookParams = []Param{
+	{Name: "webhook-addr", Shorthand: "", Value: ":8443", Usage: "address the webhook server listens on"},
+	{Name: "tls-cert", Shorthand: "", Value: "", Usage: "TLS certificate file of the webhook server, reloaded when it changes"},
+	{Name: "tls-key", Shorthand: "", Value: "", Usage: "TLS key file of the webhook server"},
+	{Name: "webhook-enforce", Shorthand: "", Value: []string{}, Usage: "validating webhook checks denying workloads instead of warning, missing-label|label-mismatch|unlabeled-sources"},
+}
+
+var webhookManifestParams = []Param{
+	{Name: "webhook-service", Shorthand: "", Value: "cre-webhook", Usage: "Service in front of the webhook server"},
+	{Name: "webhook-namespace", Shorthand: "", Value: "default", Usage: "namespace of the webhook Service"},
+	{Name: "webhook-port", Shorthand: "", Value: 443, Usage: "port of the webhook Service"},
+	{Name: "ca-bundle-file", Shorthand: "", Value: "", Usage: "PEM CA bundle the API server verifies the webhook certificate with"},
+	{Name: "validating", Shorthand: "", Value: false, Usage: "also print the ValidatingWebhookConfiguration warning about inconsistent reload labels"},
+}
+
+// webhookCmd runs cre as a mutating admission webhook labeling workloads which reference labeled ConfigMaps and Secrets,
+// so the controller targets them without anyone keeping the labels in sync by hand, and as a validating webhook
+// warning about the workloads whose labels are still inconsistent with their sources
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "serve a mutating admission webhook injecting the match label onto workloads referencing labeled sources",
+	Run: func(cmd *cobra.Command, args []string) {
+		certFile, keyFile := viper.GetString("tls-cert"), viper.GetString("tls-key")
+		if certFile == "" || keyFile == "" {
+			logrus.Fatal("--tls-cert and --tls-key are required, the API server only calls webhooks over TLS")
+		}
+		if _, err := webhookEnforced(); err != nil {
+			logrus.Fatalf("%s, invalid --webhook-enforce", err)
+		}
+		certs := &certificateReloader{certFile: certFile, keyFile: keyFile}
+		if _, err := certs.GetCertificate(nil); err != nil {
+			logrus.Fatalf("%s failed to load the webhook certificate", err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(webhookPath, serveMutate)
+		mux.HandleFunc(validatePath, serveValidate)
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+		server := &http.Server{
+			Addr:      viper.GetString("webhook-addr"),
+			Handler:   mux,
+			TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12},
+		}
+		go serveMetrics(context.Background())
+		logrus.Infof("serving admission webhook on %s%s, match-label: %s", server.Addr, webhookPath, viper.GetString("match-label"))
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			logrus.Fatalf("%s webhook server stopped", err)
+		}
+	},
+}
+
+var webhookManifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "print the MutatingWebhookConfiguration of the webhook, and with --validating its ValidatingWebhookConfiguration",
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest, err := webhookManifest()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Print(string(manifest))
+	},
+}
+
+// certificateReloader serves the key pair from disk, reloading it when the files change, e.g. renewed by cert-manager
+type certificateReloader struct {
+	certFile, keyFile string
+	mu                sync.Mutex
+	cert              *tls.Certificate
+	modTime           time.Time
+}
+
+func (c *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	modTime := time.Time{}
+	for _, f := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if c.cert != nil && !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			logrus.Errorf("%s failed to reload the webhook certificate, serving the previous one", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	if c.cert != nil {
+		logrus.Info("reloaded the webhook certificate")
+	}
+	c.cert, c.modTime = &cert, modTime
+	return c.cert, nil
+}
+
+func serveMutate(w http.ResponseWriter, r *http.Request) {
+	serveReview(w, r, mutate)
+}
+
+// serveReview decodes the AdmissionReview, reviews its request and responds with the same review
+func serveReview(w http.ResponseWriter, r *http.Request, review func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 3<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &admissionReview); err != nil || admissionReview.Request == nil {
+		http.Error(w, "expected an AdmissionReview request", http.StatusBadRequest)
+		return
+	}
+	admissionReview.Response = review(admissionReview.Request)
+	admissionReview.Response.UID = admissionReview.Request.UID
+	admissionReview.Request = nil
+	resp, err := json.Marshal(admissionReview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// mutate always allows the request, the webhook only ever adds the match label.
+// Anything it can't decide on, e.g. a failed source lookup, leaves the workload untouched.
+func mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+	var workload struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Spec              struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		logrus.Errorf("%s failed to decode %s %s/%s", err, req.Kind.Kind, req.Namespace, req.Name)
+		return allowed
+	}
+	matchLabel := viper.GetString("match-label")
+	// Fast path, the workload is labeled already
+	if _, ok := workload.Labels[matchLabel]; ok {
+		return allowed
+	}
+	configMaps, secrets := podReferences(workload.Spec.Template.Spec)
+	if len(configMaps) == 0 && len(secrets) == 0 {
+		return allowed
+	}
+	ns := req.Namespace
+	value, from, ok := referencedMatchLabel(ns, configMaps, secrets)
+	if !ok {
+		return allowed
+	}
+	name := workload.Name
+	if name == "" {
+		name = workload.GenerateName
+	}
+	logrus.Infof("labeling %s %s/%s %s=%s, it references %s", req.Kind.Kind, ns, name, matchLabel, value, from)
+	var patch []map[string]interface{}
+	if workload.Labels == nil {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/labels", "value": map[string]string{}})
+	}
+	patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/labels/" + jsonPointerEscape(matchLabel), "value": value})
+	if workload.Annotations == nil {
+		patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/annotations", "value": map[string]string{}})
+	}
+	patch = append(patch, map[string]interface{}{"op": "add", "path": "/metadata/annotations/" + jsonPointerEscape(labelInjectedAnnotation), "value": from})
+	data, err := json.Marshal(patch)
+	if err != nil {
+		logrus.Errorf("%s failed to marshal the label patch", err)
+		return allowed
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	allowed.Patch, allowed.PatchType = data, &patchType
+	return allowed
+}
+
+// referencedMatchLabel returns the match label value of the first referenced labeled source, by kind and name.
+// A workload carries a single value, when its sources disagree the first one wins and the others are logged.
+func referencedMatchLabel(ns string, configMaps, secrets map[string]bool) (string, string, bool) {
+	matchLabel := viper.GetString("match-label")
+	var value, from string
+	found := false
+	for _, s := range lookupSources(ns, configMaps, secrets) {
+		v, ok := s.labels[matchLabel]
+		if !ok {
+			continue
+		}
+		if !found {
+			value, from, found = v, s.kind+"/"+s.name, true
+		} else if v != value {
+			logrus.Warnf("%s/%s is labeled %s=%s, but %s already set %s, ignoring it", s.kind, s.name, matchLabel, v, from, value)
+		}
+	}
+	return value, from, found
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonPointerEscape escapes a map key for a JSON patch path, as label keys usually hold a /
+func jsonPointerEscape(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+// webhookManifest renders the MutatingWebhookConfiguration. The failure policy is Ignore:
+// the webhook is a convenience, an unavailable webhook must not block deploys.
+func webhookManifest() ([]byte, error) {
+	var caBundle []byte
+	if file := viper.GetString("ca-bundle-file"); file != "" {
+		var err error
+		if caBundle, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+	} else {
+		logrus.Warn("no --ca-bundle-file, the caBundle has to be injected, e.g. by the cert-manager CA injector")
+	}
+	path := webhookPath
+	port := int32(viper.GetInt("webhook-port"))
+	failurePolicy := admissionregistrationv1.Ignore
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	reinvocation := admissionregistrationv1.IfNeededReinvocationPolicy
+	timeout := int32(5)
+	config := admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: "cre-workload-labeler"},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "workload-labeler.cre.cnvrg.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: viper.GetString("webhook-namespace"),
+					Name:      viper.GetString("webhook-service"),
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{"apps"},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+				},
+			}},
+			// Workloads labeled already skip the webhook altogether
+			ObjectSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: viper.GetString("match-label"), Operator: metav1.LabelSelectorOpDoesNotExist}},
+			},
+			FailurePolicy:           &failurePolicy,
+			SideEffects:             &sideEffects,
+			ReinvocationPolicy:      &reinvocation,
+			TimeoutSeconds:          &timeout,
+			AdmissionReviewVersions: []string{"v1"},
+		}},
+	}
+	manifest, err := yaml.Marshal(config)
+	if err != nil || !viper.GetBool("validating") {
+		return manifest, err
+	}
+	validating, err := yaml.Marshal(validatingWebhookManifest(caBundle))
+	if err != nil {
+		return nil, err
+	}
+	return append(append(manifest, []byte("---\n")...), validating...), nil
+}